@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit events are written for everything that changes or removes log data.
+// Unlike the activity log this is meant for machines, one JSON object per line.
+type auditEvent struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Path       string    `json:"path"`
+	Target     string    `json:"target,omitempty"`
+	RotationID string    `json:"rotation_id,omitempty"`
+}
+
+var auditFile *os.File
+var auditLock sync.Mutex
+
+func openAuditFile(path string) error {
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	auditFile = file
+	return nil
+}
+
+func audit(rotationID string, action string, path string, target string) {
+
+	if auditFile == nil {
+		return
+	}
+
+	line, err := json.Marshal(auditEvent{
+		Time:       time.Now(),
+		Action:     action,
+		Path:       path,
+		Target:     target,
+		RotationID: rotationID,
+	})
+	if err != nil {
+		logActivity("Failed to encode audit event. Error: %s", err)
+		return
+	}
+
+	// Lines must never interleave, several threads delete and rename files
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	if _, err := auditFile.Write(append(line, '\n')); err != nil {
+		logActivity("Failed to write audit event. Error: %s", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func makeBenchmarkInput(lines int) []byte {
+	var input bytes.Buffer
+	for i := 0; i < lines; i++ {
+		input.WriteString(strconv.Itoa(i) + ": Text and stuff, a typical log line with a bit of payload\n")
+	}
+	return input.Bytes()
+}
+
+// Everything between stdin and the output file, without starting a process
+func benchmarkWritePath(b *testing.B, echo bool) {
+
+	input := makeBenchmarkInput(100000)
+	outputFile := filepath.Join(b.TempDir(), testLogFileName)
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		config := rotateConfig{state: newPipelineState()}
+		if echo {
+			config.echo = newEchoWriter("Stdout", io.Discard, 1000, echoDropNever, echoErrorIgnore)
+		}
+
+		var wg sync.WaitGroup
+		inputData := make(chan *lineChunk, lineChunkQueueSize)
+		wg.Add(1)
+		go write(&wg, inputData, outputFile, true, config)
+		readLines(bytes.NewReader(input), inputData, readOptions{})
+		close(inputData)
+		wg.Wait()
+	}
+
+	b.StopTimer()
+	if stat, err := os.Stat(outputFile); err != nil || stat.Size() != int64(len(input)) {
+		b.Fatal("Logfile output missmatch")
+	}
+}
+
+func BenchmarkWritePath(b *testing.B) {
+	benchmarkWritePath(b, false)
+}
+
+func BenchmarkWritePathEcho(b *testing.B) {
+	benchmarkWritePath(b, true)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// How writes reach the output file
+const (
+	bufferingLine   string = "line"
+	bufferingBlock  string = "block"
+	bufferingNone   string = "none"
+	bufferingDirect string = "direct"
+)
+
+func parseBufferingMode(mode string) (string, error) {
+	switch mode {
+	case bufferingLine, bufferingBlock, bufferingNone, bufferingDirect:
+		return mode, nil
+	}
+	return "", errors.New("Unknown buffering mode " + mode + ", use line, block, none or direct")
+}
+
+// Block and direct buffering hold writes back until a block is full
+func (config *rotateConfig) holdsWrites() bool {
+	return config.buffering == bufferingBlock || config.buffering == bufferingDirect
+}
+
+// Flags to open the output file with, without buffering or with --sync-open every write waits for the disk
+func outputOpenFlags(config rotateConfig, truncate bool) int {
+	flags := os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	if truncate {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	}
+
+	// Direct writes go to offsets the writer keeps track of, Go refuses that on files opened for appending
+	if config.buffering == bufferingDirect {
+		flags &^= os.O_APPEND
+	}
+	if config.buffering == bufferingNone {
+		flags |= os.O_SYNC
+	} else if config.syncOpen {
+		flags |= openDataSync
+	}
+	return flags
+}
+
+// Open the output file for the writer, with --preallocate its blocks are reserved right away
+func openOutputFile(outputFile string, truncate bool, config rotateConfig) (*os.File, error) {
+	output, err := os.OpenFile(outputFile, outputOpenFlags(config, truncate), 0644)
+	if err != nil {
+		return nil, err
+	}
+	if config.buffering == bufferingDirect {
+		if err := config.state.openDirectFile(outputFile, output, config.blockBytes); err != nil {
+			output.Close()
+			return nil, err
+		}
+	}
+	preallocateOutputFile(output, outputFile, config)
+	return output, nil
+}
+
+// A disk that can not hold the reserved size is reported now, not once the writes fail
+func preallocateOutputFile(output *os.File, outputFile string, config rotateConfig) {
+	if config.preallocateBytes <= 0 {
+		return
+	}
+	err := preallocate(output, config.preallocateBytes)
+	if errors.Is(err, syscall.ENOSPC) {
+		logActivity("Warning: can not reserve %d bytes for %s, the disk is full", config.preallocateBytes, outputFile)
+		reportFailure(config, "write", outputFile, "", err)
+	} else if err != nil {
+		logActivity("Can not preallocate %s, writing without. Error: %s", outputFile, err)
+	}
+}
+
+// Hold data back until a block is full, the caller holds outputFileLock
+func (state *pipelineState) bufferWrite(output *os.File, data []byte, blockBytes int) error {
+	state.pendingFile = output
+	state.pendingWrites = append(state.pendingWrites, data...)
+	if len(state.pendingWrites) < blockBytes {
+		return nil
+	}
+	return state.flushPendingWrites()
+}
+
+// Write whatever --buffering block held back, before anyone else looks at
+// the output file. The caller holds outputFileLock.
+func (state *pipelineState) flushPendingWrites() error {
+	if state.directFile != nil {
+		return state.flushDirectWrites()
+	}
+	if len(state.pendingWrites) == 0 {
+		return nil
+	}
+	_, err := state.pendingFile.Write(state.pendingWrites)
+	state.pendingWrites = state.pendingWrites[:0]
+	return err
+}
+
+// When input counts as taken
+const (
+	ackModeNone    string = "none"
+	ackModeDurable string = "durable"
+)
+
+func parseAckMode(mode string) (string, error) {
+	switch mode {
+	case ackModeNone, ackModeDurable:
+		return mode, nil
+	}
+	return "", errors.New("Unknown ack mode " + mode + ", use none or durable")
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func makeBundlePath(archiveBase string, period string) string {
+	return archiveBase + "." + period + ".tar.zst"
+}
+
+// Bundle all archives older than the configured number of days into one
+// tarball per month, so long retention does not mean thousands of files.
+func bundleArchives(archives []archiveFile, manifest *archiveManifest, config rotateConfig) []archiveFile {
+
+	now := time.Now()
+	periods := make(map[string][]int)
+	for i, archive := range archives {
+		created, err := archiveCreated(archive, manifest)
+		if err != nil {
+			continue
+		}
+		if int(math.Floor(now.Sub(created).Hours()/24)) < config.bundleAfterDays {
+			continue
+		}
+
+		// Bundles are never uploaded, so wait until the archive itself is
+		if record := manifest.get(archive); record != nil && record.uploadPending() {
+			logRotation(config.rotationID, "Not bundling %s, it was not uploaded yet", archive.getPath())
+			continue
+		}
+
+		// Months start at midnight where the user lives, not in UTC
+		period := created.In(config.location).Format("2006-01")
+		periods[period] = append(periods[period], i)
+	}
+
+	bundled := make([]int, 0)
+	for period, indexes := range periods {
+		bundlePath := makeBundlePath(manifest.outputFile, period)
+		logRotation(config.rotationID, "Bundling %d archives into %s", len(indexes), bundlePath)
+
+		members := make([]archiveFile, 0, len(indexes))
+		for _, i := range indexes {
+			members = append(members, archives[i])
+		}
+		if err := writeBundle(bundlePath, members, manifest); err != nil {
+			logRotation(config.rotationID, "Failed to write bundle %s. Error: %s", bundlePath, err)
+			reportFailure(config, "bundle", manifest.outputFile, bundlePath, err)
+			continue
+		}
+		for _, archive := range members {
+			audit(config.rotationID, "bundle", archive.getPath(), bundlePath)
+		}
+		bundled = append(bundled, indexes...)
+	}
+
+	// Remove from the back so the positions of the remaining archives stay valid
+	sort.Sort(sort.Reverse(sort.IntSlice(bundled)))
+	for _, i := range bundled {
+		path := archives[i].getPath()
+		var err error
+		if archives, err = removeArchive(archives, i, manifest, config.rotationID); err != nil {
+			logRotation(config.rotationID, "Failed to delete bundled archive %s. Error: %s", path, err)
+		}
+	}
+
+	return archives
+}
+
+func writeBundle(bundlePath string, archives []archiveFile, manifest *archiveManifest) error {
+
+	output, err := os.Create(bundlePath + partialArchiveSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(bundlePath + partialArchiveSuffix)
+	defer output.Close()
+
+	compressWriter, err := zstd.NewWriter(output)
+	if err != nil {
+		return err
+	}
+	tarWriter := tar.NewWriter(compressWriter)
+
+	// A bundle for this month might exist from an earlier run, carry its content over
+	newest := time.Time{}
+	if existing, err := os.Open(bundlePath); err == nil {
+		defer existing.Close()
+		if stat, err := existing.Stat(); err == nil {
+			newest = stat.ModTime()
+		}
+		if err := copyBundle(tarWriter, existing); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	for _, archive := range archives {
+		if err := addToBundle(tarWriter, archive); err != nil {
+			return err
+		}
+		if created, err := archiveCreated(archive, manifest); err == nil && created.After(newest) {
+			newest = created
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	if err := compressWriter.Close(); err != nil {
+		return err
+	}
+	if err := output.Sync(); err != nil {
+		return err
+	}
+	if err := output.Close(); err != nil {
+		return err
+	}
+
+	// The bundle is as old as its newest archive, this way the max age rule works on bundles too
+	if err := os.Chtimes(bundlePath+partialArchiveSuffix, newest, newest); err != nil {
+		return err
+	}
+	return renameFile(bundlePath+partialArchiveSuffix, bundlePath)
+}
+
+func copyBundle(tarWriter *tar.Writer, bundle io.Reader) error {
+
+	decoder, err := zstd.NewReader(bundle)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	tarReader := tar.NewReader(decoder)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tarWriter, tarReader); err != nil {
+			return err
+		}
+	}
+}
+
+func addToBundle(tarWriter *tar.Writer, archive archiveFile) error {
+
+	input, err := os.Open(archive.getPath())
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	stat, err := input.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Index based names are meaningless once the archive left the rotation chain
+	header, err := tar.FileInfoHeader(stat, "")
+	if err != nil {
+		return err
+	}
+	header.Name = makeRemoteArchiveName(archive, stat.ModTime())
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tarWriter, input)
+	return err
+}
+
+// Bundles are kept until they are older than the max age
+func pruneBundles(archiveBase string, config rotateConfig) []string {
+
+	pruned := make([]string, 0)
+	if config.maxAgeDays < 0 {
+		return pruned
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(archiveBase))
+	if err != nil {
+		return pruned
+	}
+	bundlePattern := regexp.MustCompile("^" + regexp.QuoteMeta(filepath.Base(archiveBase)) + `\.[0-9]{4}-[0-9]{2}\.tar\.zst$`)
+	for _, entry := range entries {
+		if !bundlePattern.MatchString(entry.Name()) {
+			continue
+		}
+		bundle := filepath.Join(filepath.Dir(archiveBase), entry.Name())
+		stat, err := statFile(bundle)
+		if err != nil {
+			continue
+		}
+		if int(math.Floor(time.Since(stat.ModTime()).Hours()/24)) >= config.maxAgeDays {
+			logRotation(config.rotationID, "Removing bundle %s because of age", bundle)
+			if err := removeArchiveFile(archiveBase, bundle); err != nil {
+				logRotation(config.rotationID, "Failed to delete %s", bundle)
+				reportFailure(config, "prune", archiveBase, bundle, err)
+				continue
+			}
+			audit(config.rotationID, "delete", bundle, "")
+			pruned = append(pruned, bundle)
+		}
+	}
+	return pruned
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+// How often the position of a file input is saved while lines keep coming
+const checkpointInterval time.Duration = time.Second
+
+// Where reading a file input stopped, so the next run starts right after the
+// last line that made it into the output file. The file is recognized by device
+// and inode, a replaced or truncated input is read from the start.
+type inputCheckpoint struct {
+	path     string
+	lastSave time.Time
+
+	Input  string `json:"input"`
+	Device uint64 `json:"device"`
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+func newInputCheckpoint(path string) *inputCheckpoint {
+	return &inputCheckpoint{path: path}
+}
+
+// Seek to where the last run stopped, called by the reader before it hands over any line
+func (checkpoint *inputCheckpoint) resume(input *os.File) error {
+
+	stat, err := input.Stat()
+	if err != nil {
+		return err
+	}
+	device, inode := fileIdentity(stat)
+
+	saved := inputCheckpoint{}
+	if content, err := os.ReadFile(checkpoint.path); err == nil {
+		if err := json.Unmarshal(content, &saved); err != nil {
+			logActivity("Ignoring broken position file %s. Error: %s", checkpoint.path, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	checkpoint.Input, checkpoint.Device, checkpoint.Inode, checkpoint.Offset = input.Name(), device, inode, 0
+	switch {
+	case saved.Input == "":
+		logActivity("No position saved for %s yet, reading it from the start", input.Name())
+	case saved.Device != device || saved.Inode != inode || saved.Offset > stat.Size():
+		logActivity("%s was replaced or truncated since the last run, reading it from the start", input.Name())
+	default:
+		if _, err := input.Seek(saved.Offset, 0); err != nil {
+			return err
+		}
+		checkpoint.Offset = saved.Offset
+		logActivity("Resuming %s at byte %d", input.Name(), saved.Offset)
+	}
+	return nil
+}
+
+// The writer wrote this many more bytes of the input, saved every now and then or when forced
+func (checkpoint *inputCheckpoint) advance(written int, force bool) {
+	checkpoint.Offset += int64(written)
+	if !force && time.Since(checkpoint.lastSave) < checkpointInterval {
+		return
+	}
+	if err := checkpoint.save(); err != nil {
+		logActivity("Failed to save position to %s. Error: %s", checkpoint.path, err)
+	}
+}
+
+// Write the position under a temporary name first, a crash must not leave half a file
+func (checkpoint *inputCheckpoint) save() error {
+
+	checkpoint.lastSave = time.Now()
+	content, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(checkpoint.path+partialArchiveSuffix, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(checkpoint.path+partialArchiveSuffix, checkpoint.path)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+// Lines travel from the reader to the writer in chunks of complete lines.
+// A busy pipe this way costs one write per chunk instead of one per line,
+// and the chunks are reused so reading does not allocate at all.
+type lineChunk struct {
+	data []byte
+}
+
+// Whatever arrived in one go up to this size goes into one chunk
+const lineChunkSize int = 64 * 1024
+
+// How many chunks may wait for the writer
+const lineChunkQueueSize int = 50
+
+var lineChunkPool = sync.Pool{
+	New: func() any {
+		return &lineChunk{data: make([]byte, 0, lineChunkSize)}
+	},
+}
+
+func newLineChunk() *lineChunk {
+	chunk := lineChunkPool.Get().(*lineChunk)
+	chunk.data = chunk.data[:0]
+	return chunk
+}
+
+func (chunk *lineChunk) release() {
+
+	// A single huge line made this one grow, do not keep that much memory around
+	if cap(chunk.data) > 4*lineChunkSize {
+		return
+	}
+	lineChunkPool.Put(chunk)
+}
+
+// How the reader splits the input into lines
+type readOptions struct {
+
+	// Lines of any length up to this end up in one chunk, longer ones are
+	// handed over in pieces of that size so memory stays bounded. 0 means no limit.
+	maxLineBytes int
+
+	// A lone carriage return ends a line as well
+	crIsLineEnd bool
+
+	// Convert the input from this to UTF-8 before splitting it, nil if it is UTF-8 already
+	encoding encoding.Encoding
+
+	// Unpack the input if it is gzip compressed
+	decompress bool
+
+	// Resume a file input where the last run stopped, nil without --position-file
+	checkpoint *inputCheckpoint
+
+	// With --ack-mode durable the writer answers every chunk once it is on disk,
+	// the reader waits for that before it takes more from the input. nil otherwise.
+	acks chan struct{}
+
+	// Closed by the Drain call of the control service, nil without --grpc-listen
+	drain chan struct{}
+
+	// Length prefixed binary records instead of lines, empty for lines.
+	// Records are never split, longer ones than this end the input.
+	recordFraming  string
+	maxRecordBytes int
+}
+
+// Input that starts like a gzip stream is unpacked on the fly, anything else is read as it is
+func decompressInput(input io.Reader) io.Reader {
+
+	reader := bufio.NewReader(input)
+	if magic, _ := reader.Peek(2); !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return reader
+	}
+	unpacked, err := gzip.NewReader(reader)
+	if err != nil {
+		logActivity("Input looks like gzip but can not be unpacked, reading the rest as it is. Error: %s", err)
+		return reader
+	}
+	logActivity("Input is gzip compressed, unpacking it")
+	return unpacked
+}
+
+// Like ReadSlice('\n'), but with crIsLineEnd a carriage return ends the line too
+func readLineSlice(reader *bufio.Reader, crIsLineEnd bool) ([]byte, error) {
+
+	if !crIsLineEnd {
+		return reader.ReadSlice('\n')
+	}
+	for {
+		buffered, _ := reader.Peek(reader.Buffered())
+		if i := bytes.IndexAny(buffered, "\r\n"); i >= 0 {
+			reader.Discard(i + 1)
+			return buffered[:i+1], nil
+		}
+		if len(buffered) == reader.Size() {
+			reader.Discard(len(buffered))
+			return buffered, bufio.ErrBufferFull
+		}
+
+		// Nothing that ends a line yet, wait for more input
+		if _, err := reader.Peek(len(buffered) + 1); err != nil {
+			rest, _ := reader.Peek(reader.Buffered())
+			reader.Discard(len(rest))
+			return rest, err
+		}
+	}
+}
+
+func readLines(input io.Reader, inputData chan *lineChunk, options readOptions) {
+
+	// Every input gets its own decoder, a new writer of a named pipe starts with a new BOM
+	if options.decompress {
+		input = decompressInput(input)
+	}
+	if options.encoding != nil {
+		input = transform.NewReader(input, options.encoding.NewDecoder())
+	}
+	if options.drain != nil {
+		input = newDrainableReader(input, options.drain)
+	}
+
+	// Hand over a chunk, and with acks wait until the writer has it on disk
+	send := func(chunk *lineChunk) {
+		inputData <- chunk
+		if options.acks != nil {
+			<-options.acks
+		}
+	}
+
+	reader := bufio.NewReaderSize(input, lineChunkSize)
+	if options.recordFraming != "" {
+		readRecords(reader, send, options)
+		return
+	}
+	chunk := newLineChunk()
+	lineStart := 0
+	splitting := false
+	for {
+
+		// We get the reader's own buffer, we copy it into the chunk right away
+		line, err := readLineSlice(reader, options.crIsLineEnd)
+		chunk.data = append(chunk.data, line...)
+
+		// Lines longer than the read buffer come in pieces, never split them across chunks
+		// unless they grow beyond the limit. A rotation can then end up within the line.
+		if errors.Is(err, bufio.ErrBufferFull) {
+			if options.maxLineBytes > 0 && len(chunk.data)-lineStart >= options.maxLineBytes {
+				if !splitting {
+					logActivity("Line is longer than %d bytes, writing it in pieces", options.maxLineBytes)
+					splitting = true
+				}
+				send(chunk)
+				chunk = newLineChunk()
+				lineStart = 0
+			}
+			continue
+		}
+		splitting = false
+
+		// Exit if we read EOF or the input broke.
+		// A last line without delimiter is left out, it might be incomplete.
+		if err != nil {
+			chunk.data = chunk.data[:lineStart]
+			if len(chunk.data) > 0 {
+				send(chunk)
+			} else {
+				chunk.release()
+			}
+			return
+		}
+
+		// Hand over once the chunk is full or nothing else is waiting,
+		// lines should not sit here while the input is quiet
+		if len(chunk.data) >= lineChunkSize || reader.Buffered() == 0 {
+			send(chunk)
+			chunk = newLineChunk()
+		}
+		lineStart = len(chunk.data)
+	}
+}
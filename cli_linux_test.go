@@ -0,0 +1,647 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestExtendedAttributes(t *testing.T) {
+
+	const testOutputDirectory string = "output_extended_attributes"
+	const subprocessTimeWait int = 50
+
+	// Let nobody read the log through an ACL entry
+	acl := binary.LittleEndian.AppendUint32(nil, 2)
+	for _, entry := range []struct {
+		tag  uint16
+		perm uint16
+		id   uint32
+	}{{0x01, 6, 0xffffffff}, {0x02, 4, 65534}, {0x04, 4, 0xffffffff}, {0x10, 4, 0xffffffff}, {0x20, 4, 0xffffffff}} {
+		acl = binary.LittleEndian.AppendUint16(acl, entry.tag)
+		acl = binary.LittleEndian.AppendUint16(acl, entry.perm)
+		acl = binary.LittleEndian.AppendUint32(acl, entry.id)
+	}
+	attributes := map[string]string{
+		"security.selinux":        "system_u:object_r:var_log_t:s0\x00",
+		"system.posix_acl_access": string(acl),
+		"user.origin":             "frontend",
+	}
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without SELinux only root may set security attributes
+	outputFile := filepath.Join(testOutputDirectory, testLogFileName)
+	if err := os.WriteFile(outputFile, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range attributes {
+		if err := unix.Setxattr(outputFile, name, []byte(value), 0); err != nil {
+			t.Log("Not checking extended attribute ", name, ", can not set it: ", err)
+			delete(attributes, name)
+		}
+	}
+	if len(attributes) == 0 {
+		t.Skip("Can not set any extended attribute")
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", outputFile,
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-c",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate should have worked")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both the recreated output file and the archive carry the attributes of the original
+	for _, path := range []string{outputFile, outputFile + ".1.gz"} {
+		for name, expected := range attributes {
+			value := make([]byte, 256)
+			if size, err := unix.Getxattr(path, name, value); err != nil || string(value[:size]) != expected {
+				t.Fatalf("Extended attribute %s missmatch for %s", name, path)
+			}
+		}
+	}
+}
+
+func TestPassthrough(t *testing.T) {
+
+	const testOutputDirectory string = "output_passthrough"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--no-stdout",
+	)
+	var stdout bytes.Buffer
+	process.Stdout = &stdout
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for logrotate
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate should have worked")
+	}
+
+	if _, err := io.WriteString(stdin, "More text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if archive_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".1")); err != nil ||
+		string(archive_content) != "Text and stuff\n" {
+		t.Fatal("Archive output missmatch")
+	}
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil ||
+		string(log_content) != "More text and stuff\n" {
+		t.Fatal("Logfile output missmatch")
+	}
+	if stdout.String() != "" {
+		t.Fatal("Stdout should be empty")
+	}
+	if debug_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testDebugFileName)); err != nil ||
+		!bytes.Contains(debug_content, []byte("without copying")) {
+		t.Fatal("Input should have been spliced")
+	}
+
+	// A file as stdin takes copy_file_range instead
+	input, err := os.Open(filepath.Join(testOutputDirectory, testLogFileName+".1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Close()
+	process = exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName), "--no-stdout")
+	process.Stdin = input
+	if err := process.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil ||
+		string(log_content) != "More text and stuff\nText and stuff\n" {
+		t.Fatal("Logfile output missmatch")
+	}
+}
+
+func TestStallFallback(t *testing.T) {
+
+	const testOutputDirectory string = "output_stall_fallback"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes to a pipe nobody reads from hang once the pipe buffer is full, like on a hung NFS mount
+	fifo := filepath.Join(testOutputDirectory, testLogFileName)
+	if err := unix.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := os.OpenFile(fifo, os.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	fallback := filepath.Join(testOutputDirectory, "fallback.log")
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName), "-o", fifo,
+		"--stall-timeout", "500ms", "--stall-fallback", fallback)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.WriteString(stdin, string(bytes.Repeat([]byte("Text and stuff\n"), 10000))); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := io.WriteString(stdin, "After the stall\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if content, err := os.ReadFile(fallback); err != nil || !bytes.HasSuffix(content, []byte("Text and stuff\nAfter the stall\n")) {
+		t.Fatal("Fallback output missmatch")
+	}
+	if debug_log, err := os.ReadFile(filepath.Join(testOutputDirectory, testDebugFileName)); err != nil ||
+		!bytes.Contains(debug_log, []byte("Critical: writer made no progress on "+fifo)) {
+		t.Fatal("Activity log is missing the stall")
+	}
+}
+
+func TestSpoolFile(t *testing.T) {
+
+	const testOutputDirectory string = "output_spool_file"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody reads from the pipe for now, so the writer can not keep up
+	fifo := filepath.Join(testOutputDirectory, testLogFileName)
+	if err := unix.Mkfifo(fifo, 0644); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := os.OpenFile(fifo, os.O_RDONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	spool := filepath.Join(testOutputDirectory, "spool")
+	process := exec.Command("./rotee", "-o", fifo, "--spool-file", spool)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Far more than the pipe and the queue to the writer hold, it still goes in without waiting
+	var test_input bytes.Buffer
+	for i := 0; i < 500000; i++ {
+		test_input.WriteString("Text and stuff " + time.Duration(i).String() + "\n")
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := stdin.Write(test_input.Bytes())
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Input was held up")
+	}
+	if stat, err := os.Stat(spool); err != nil || stat.Size() == 0 {
+		t.Fatal("Input was not spilled")
+	}
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything comes out in order once the pipe is read
+	read := make(chan []byte, 1)
+	go func() {
+		content, _ := io.ReadAll(reader)
+		read <- content
+	}()
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if content := <-read; !bytes.Equal(content, test_input.Bytes()) {
+		t.Fatal("Logfile output missmatch")
+	}
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Fatal("Spool file was not removed")
+	}
+}
+
+func TestPreallocate(t *testing.T) {
+
+	const testOutputDirectory string = "output_preallocate"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	const test_input string = "Test\n"
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName), "--preallocate", "1mb")
+	process.Stdin = strings.NewReader(test_input)
+	if err := process.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The space is reserved, but readers only see what was written
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != test_input {
+		t.Fatal("Logfile output missmatch")
+	}
+	var stat unix.Stat_t
+	if err := unix.Stat(filepath.Join(testOutputDirectory, testLogFileName), &stat); err != nil {
+		t.Fatal(err)
+	}
+	if stat.Blocks*512 < 1000000 {
+		t.Fatalf("Expected 1mb to be reserved, got %d bytes", stat.Blocks*512)
+	}
+}
+
+func TestSyncOpen(t *testing.T) {
+
+	const testOutputDirectory string = "output_sync_open"
+	const subprocessTimeWait int = 100
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	outputFile, err := filepath.Abs(filepath.Join(testOutputDirectory, testLogFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	process := exec.Command("./rotee", "-o", outputFile, "--sync-open")
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(stdin, "Test\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	// The kernel tells the flags of every open file
+	fdDirectory := filepath.Join("/proc", strconv.Itoa(process.Process.Pid), "fd")
+	entries, err := os.ReadDir(fdDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags := int64(-1)
+	for _, entry := range entries {
+		if target, err := os.Readlink(filepath.Join(fdDirectory, entry.Name())); err == nil && target == outputFile {
+			info, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(process.Process.Pid), "fdinfo", entry.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, line := range strings.Split(string(info), "\n") {
+				if value, found := strings.CutPrefix(line, "flags:"); found {
+					flags, _ = strconv.ParseInt(strings.TrimSpace(value), 8, 64)
+				}
+			}
+		}
+	}
+	if flags < 0 || flags&unix.O_DSYNC == 0 {
+		t.Fatalf("Output file should be open with O_DSYNC, flags are %o", flags)
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if log_content, err := os.ReadFile(outputFile); err != nil || string(log_content) != "Test\n" {
+		t.Fatal("Logfile output missmatch")
+	}
+}
+
+func TestDirectIO(t *testing.T) {
+
+	const testOutputDirectory string = "output_direct_io"
+	const subprocessTimeWait int = 200
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Whatever is already there stays, even though it does not end on a block boundary
+	const existing string = "Existing line\n"
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testLogFileName), []byte(existing), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName), "-f", "0.01",
+		"--buffering", "direct", "--block-size", "8kb", "--flush-interval", "0.05")
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var beforeRotation bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		beforeRotation.WriteString("Before rotation " + time.Duration(i).String() + "\n")
+	}
+	if _, err := stdin.Write(beforeRotation.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	// Readers see the last partial block before the next one is full
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil ||
+		string(log_content) != existing+beforeRotation.String() {
+		t.Fatal("Logfile output missmatch")
+	}
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	var afterRotation bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		afterRotation.WriteString("After rotation " + time.Duration(i).String() + "\n")
+	}
+	if _, err := stdin.Write(afterRotation.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if archive_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".1")); err != nil ||
+		string(archive_content) != existing+beforeRotation.String() {
+		t.Fatal("Archive output missmatch")
+	}
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil ||
+		string(log_content) != afterRotation.String() {
+		t.Fatal("Logfile output missmatch")
+	}
+}
+
+func TestCompressPriority(t *testing.T) {
+
+	const testOutputDirectory string = "output_compress_priority"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	const test_input string = "Test\n"
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName), "-c", "--rotate-on-exit",
+		"--compress-nice", "10", "--compress-ionice", "idle", "-v", filepath.Join(testOutputDirectory, testDebugFileName))
+	process.Stdin = strings.NewReader(test_input)
+	if err := process.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if archive_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+".1.gz")); err != nil ||
+		archive_content != test_input {
+		t.Fatal("Archive output missmatch")
+	}
+
+	// Lowering the priority needs no privileges
+	if debug_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testDebugFileName)); err != nil ||
+		strings.Contains(string(debug_content), "Failed to lower the priority") {
+		t.Fatal("Priority of compression should have been lowered")
+	}
+
+	if err := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--compress-ionice", "realtime").Run(); err == nil {
+		t.Fatal("Expected an error for a realtime I/O priority")
+	}
+}
+
+func TestExternalRotation(t *testing.T) {
+
+	const testOutputDirectory string = "output_external_rotation"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Polling takes an hour, only the SIGHUP of the postrotate script reopens the file
+	logFile := filepath.Join(testOutputDirectory, testLogFileName)
+	process := exec.Command("./rotee", "-o", logFile, "--external-rotation", "-f", "3600")
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(stdin, "Before rotation\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// What logrotate does with create and a postrotate script sending SIGHUP
+	time.Sleep(100 * time.Millisecond)
+	if err := os.Rename(logFile, logFile+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(logFile, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Process.Signal(unix.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := io.WriteString(stdin, "After rotation\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(logFile + ".1"); err != nil || string(content) != "Before rotation\n" {
+		t.Fatal("Archive content missmatch")
+	}
+	if content, err := os.ReadFile(logFile); err != nil || string(content) != "After rotation\n" {
+		t.Fatal("Output file content missmatch")
+	}
+
+	// Without a postrotate script the file being moved away is enough
+	process = exec.Command("./rotee", "-o", logFile, "--external-rotation", "-f", "0.01")
+	if stdin, err = process.StdinPipe(); err != nil {
+		t.Fatal(err)
+	}
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := os.Rename(logFile, logFile+".2"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := io.WriteString(stdin, "After second rotation\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(logFile); err != nil || string(content) != "After second rotation\n" {
+		t.Fatal("Output file content missmatch")
+	}
+
+	// rotee must not rotate on its own
+	process = exec.Command("./rotee", "-o", logFile, "--external-rotation", "-a", "60")
+	if err := process.Run(); err == nil || process.ProcessState.ExitCode() != 3 {
+		t.Fatal("Exit code missmatch")
+	}
+}
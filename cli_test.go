@@ -1,15 +1,53 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/pkg/sftp"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"github.com/vmihailenco/msgpack/v5"
+	collogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 const testLogFileName string = "test.log"
@@ -115,10 +153,11 @@ func TestTeeOnly(t *testing.T) {
 	}
 }
 
-func TestTruncateOnStart(t *testing.T) {
+func TestSlowStdout(t *testing.T) {
 
-	const testOutputDirectory string = "output_truncate_no_start"
-	const subprocessTimeWait int = 50
+	const testOutputDirectory string = "output_slow_stdout"
+	const testLines int = 20000
+	const subprocessTimeWait int = 200
 
 	defer func() {
 		if err := os.RemoveAll(testOutputDirectory); err != nil {
@@ -130,35 +169,73 @@ func TestTruncateOnStart(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := os.WriteFile(filepath.Join(testOutputDirectory, testLogFileName), []byte{'a'}, 0644); err != nil {
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--echo-buffer", "10", "--echo-drop", "newest")
+	stdin, err := process.StdinPipe()
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
-		"-o", filepath.Join(testOutputDirectory, testLogFileName), "-x")
-	stdin, err := process.StdinPipe()
+	// Nobody reads stdout for now, like a paused terminal
+	stdout, err := process.StdoutPipe()
 	if err != nil {
 		t.Fatal(err)
 	}
+
 	if err = process.Start(); err != nil {
 		t.Fatal(err)
 	}
+
+	var sb strings.Builder
+
+	for i := 0; i < testLines; i++ {
+		sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+	}
+
+	// Far more than fits into the pipe to stdout
+	test_input := sb.String()
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
 	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != test_input {
+		t.Fatal("Logfile output missmatch")
+	}
+
 	if err := stdin.Close(); err != nil {
 		t.Fatal(err)
 	}
 
-	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
-		t.Fatal("Logfile should be empty")
+	output, err := io.ReadAll(stdout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stdout got what fit, the rest was dropped line by line
+	if len(output) == 0 || len(output) >= len(test_input) {
+		t.Fatal("Stdout output missmatch")
+	}
+	previous := -1
+	for _, line := range strings.Split(strings.TrimSuffix(string(output), "\n"), "\n") {
+		number, err := strconv.Atoi(strings.TrimSuffix(line, ": Text and stuff"))
+		if err != nil || number <= previous {
+			t.Fatalf("Stdout line missmatch %s", line)
+		}
+		previous = number
 	}
 }
 
-func TestRotate(t *testing.T) {
+func TestLongLines(t *testing.T) {
 
-	const testOutputDirectory string = "output_rotate"
-	const iterations int = 7
-	const linesPerIteration int = 1000
-	const subprocessTimeWait int = 50
+	const testOutputDirectory string = "output_long_lines"
 
 	defer func() {
 		if err := os.RemoveAll(testOutputDirectory); err != nil {
@@ -170,76 +247,89 @@ func TestRotate(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
-		"-o", filepath.Join(testOutputDirectory, testLogFileName),
-		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
-		"-f", "0.001", "-c",
-	)
-	stdin, err := process.StdinPipe()
-	if err != nil {
-		t.Fatal(err)
-	}
+	// One line far longer than any read buffer and one longer than the limit
+	test_input := "Short line\n" + strings.Repeat("a", 150000) + "\n" + strings.Repeat("b", 400000) + "\nShort line\n"
+	for _, maxLineSize := range []string{"0", "200kb"} {
 
-	if err = process.Start(); err != nil {
-		t.Fatal(err)
+		process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+			"-o", filepath.Join(testOutputDirectory, testLogFileName), "-x",
+			"--max-line-size", maxLineSize)
+		process.Stdin = strings.NewReader(test_input)
+		output, err := process.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(output) != test_input {
+			t.Fatal("Stdout output missmatch")
+		}
+		if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != test_input {
+			t.Fatal("Logfile output missmatch")
+		}
 	}
 
-	var sb strings.Builder
-	var expected []string
+	// Only the limited run had to write a line in pieces
+	if debug_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testDebugFileName)); err != nil ||
+		strings.Count(string(debug_content), "writing it in pieces") != 1 {
+		t.Fatal("Long line should have been split once")
+	}
+}
 
-	for n := 0; n < iterations; n++ {
+func TestFsyncAfterIdle(t *testing.T) {
 
-		for i := n * linesPerIteration; i < (n+1)*linesPerIteration; i++ {
-			sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
-		}
+	const testOutputDirectory string = "output_fsync_after_idle"
+	const idleWait int = 300
 
-		test_input := sb.String()
-		expected = append(expected, test_input)
-		_, err := io.WriteString(stdin, test_input)
-		if err != nil {
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
 			t.Fatal(err)
 		}
+	}()
 
-		// Wait for log lines to be processed
-		// Being slower than this might indicate a problem...
-		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
 
-		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
-			t.Fatal(err)
-		}
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName), "--fsync-after-idle", "0.1")
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		// Wait for logrotate
-		// Being slower than this might indicate a problem...
-		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
 
-		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+	// Two quiet periods after input, each synced once
+	for i := 0; i < 2; i++ {
+		if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
 			t.Fatal(err)
 		}
-
-		sb.Reset()
+		time.Sleep(time.Millisecond * time.Duration(idleWait))
 	}
 
 	if err := stdin.Close(); err != nil {
 		t.Fatal(err)
 	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
 
-	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil ||
+		string(log_content) != "Text and stuff\nText and stuff\n" {
 		t.Fatal("Logfile output missmatch")
 	}
-
-	for i, expected_content := range expected {
-		if log_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations-i)+".gz")); err != nil || string(log_content) != expected_content {
-			t.Fatalf("Archive Logfile %d output missmatch", iterations-i)
-		}
+	if debug_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testDebugFileName)); err != nil ||
+		strings.Count(string(debug_content), "Input is idle, synced") != 2 {
+		t.Fatal("Output file should have been synced once per quiet period")
 	}
 }
 
-func TestRotateNoCompression(t *testing.T) {
+func TestHeartbeat(t *testing.T) {
 
-	const testOutputDirectory string = "output_rotate_no_compression"
-	const iterations int = 7
-	const linesPerIteration int = 1000
-	const subprocessTimeWait int = 50
+	const testOutputDirectory string = "output_heartbeat"
+	const idleWait int = 625
 
 	defer func() {
 		if err := os.RemoveAll(testOutputDirectory); err != nil {
@@ -251,77 +341,48 @@ func TestRotateNoCompression(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
-		"-o", filepath.Join(testOutputDirectory, testLogFileName),
-		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
-		"-f", "0.001",
-	)
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--heartbeat", "250ms", "--heartbeat-text", "-- MARK --")
 	stdin, err := process.StdinPipe()
 	if err != nil {
 		t.Fatal(err)
 	}
+	var stdout bytes.Buffer
+	process.Stdout = &stdout
 
 	if err = process.Start(); err != nil {
 		t.Fatal(err)
 	}
 
-	var sb strings.Builder
-	var expected []string
-
-	for n := 0; n < iterations; n++ {
-
-		for i := n * linesPerIteration; i < (n+1)*linesPerIteration; i++ {
-			sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
-		}
-
-		test_input := sb.String()
-		expected = append(expected, test_input)
-		_, err := io.WriteString(stdin, test_input)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		// Wait for log lines to be processed
-		// Being slower than this might indicate a problem...
-		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
-
-		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
-			t.Fatal(err)
-		}
-
-		// Wait for logrotate
-		// Being slower than this might indicate a problem...
-		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
-
-		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
-			t.Fatal(err)
-		}
-
-		sb.Reset()
+	// Every input starts the interval over, two marks fit into the quiet period
+	if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(idleWait))
+	if _, err := io.WriteString(stdin, "More text\n"); err != nil {
+		t.Fatal(err)
 	}
 
 	if err := stdin.Close(); err != nil {
 		t.Fatal(err)
 	}
-
-	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
-		t.Fatal("Logfile output missmatch")
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
 	}
 
-	for i, expected_content := range expected {
-		if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations-i))); err != nil || string(log_content) != expected_content {
-			t.Fatalf("Archive Logfile %d output missmatch", iterations-i)
-		}
+	if stdout.String() != "Text and stuff\nMore text\n" {
+		t.Fatal("Stdout output missmatch")
+	}
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil ||
+		string(log_content) != "Text and stuff\n-- MARK --\n-- MARK --\nMore text\n" {
+		t.Fatal("Logfile output missmatch")
 	}
 }
 
-func TestRotateMaxFiles(t *testing.T) {
+func TestExitAfterIdle(t *testing.T) {
 
-	const testOutputDirectory string = "output_rotate_max_files"
-	const iterations int = 7
-	const linesPerIteration int = 1000
-	const subprocessTimeWait int = 50
-	const intMaxFiles = 3
+	const testOutputDirectory string = "output_exit_after_idle"
+	const exitWait int = 2000
 
 	defer func() {
 		if err := os.RemoveAll(testOutputDirectory); err != nil {
@@ -333,84 +394,84 @@ func TestRotateMaxFiles(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
-		"-o", filepath.Join(testOutputDirectory, testLogFileName),
-		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
-		"-f", "0.001",
-		"-n", strconv.Itoa(intMaxFiles), "-c",
-	)
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--exit-after-idle", "300ms", "--rotate-on-exit")
 	stdin, err := process.StdinPipe()
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer stdin.Close()
 
 	if err = process.Start(); err != nil {
 		t.Fatal(err)
 	}
 
-	var sb strings.Builder
-	var expected []string
-
-	for n := 0; n < iterations; n++ {
-
-		for i := n * linesPerIteration; i < (n+1)*linesPerIteration; i++ {
-			sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
-		}
+	// The input stays open, rotee has to notice the silence on its own
+	if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
 
-		test_input := sb.String()
-		expected = append(expected, test_input)
-		_, err := io.WriteString(stdin, test_input)
+	exited := make(chan error, 1)
+	go func() { exited <- process.Wait() }()
+	select {
+	case err := <-exited:
 		if err != nil {
 			t.Fatal(err)
 		}
+	case <-time.After(time.Millisecond * time.Duration(exitWait)):
+		process.Process.Kill()
+		t.Fatal("rotee did not exit after the input went quiet")
+	}
 
-		// Wait for log lines to be processed
-		// Being slower than this might indicate a problem...
-		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".1")); err != nil || string(log_content) != "Text and stuff\n" {
+		t.Fatal("Archive Logfile output missmatch")
+	}
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
+		t.Fatal("Logfile output missmatch")
+	}
+}
 
-		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
-			t.Fatal(err)
-		}
+func TestNormalizeNewlines(t *testing.T) {
 
-		// Wait for logrotate
-		// Being slower than this might indicate a problem...
-		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	const testOutputDirectory string = "output_normalize_newlines"
 
-		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
 			t.Fatal(err)
 		}
+	}()
 
-		sb.Reset()
-	}
-
-	if err := stdin.Close(); err != nil {
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
 		t.Fatal(err)
 	}
 
-	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
-		t.Fatal("Logfile output missmatch")
-	}
+	const test_input string = "Windows line\r\nOld mac line\rUnix line\n\r\n"
+	const expected string = "Windows line\nOld mac line\nUnix line\n\n"
+	for _, convertStdout := range []bool{false, true} {
 
-	for i, expected_content := range expected {
-		if i <= intMaxFiles {
-			if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations-i)+".gz")); err == nil {
-				t.Fatalf("Archive %d should be deleted", iterations-i)
-			}
-		} else {
+		args := []string{"-o", filepath.Join(testOutputDirectory, testLogFileName), "-x", "--normalize-newlines"}
+		if convertStdout {
+			args = append(args, "--convert-stdout")
+		}
+		process := exec.Command("./rotee", args...)
+		process.Stdin = strings.NewReader(test_input)
+		output, err := process.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
 
-			if log_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations-i)+".gz")); err != nil || string(log_content) != expected_content {
-				t.Fatalf("Archive Logfile %d output missmatch", iterations-i)
-			}
+		if (convertStdout && string(output) != expected) || (!convertStdout && string(output) != test_input) {
+			t.Fatal("Stdout output missmatch")
+		}
+		if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != expected {
+			t.Fatal("Logfile output missmatch")
 		}
 	}
 }
 
-func TestRotateMaxAge(t *testing.T) {
+func TestUtf8Policy(t *testing.T) {
 
-	const testOutputDirectory string = "output_rotate_max_age"
-	const iterations int = 7
-	const linesPerIteration int = 1000
-	const subprocessTimeWait int = 50
+	const testOutputDirectory string = "output_utf8_policy"
 
 	defer func() {
 		if err := os.RemoveAll(testOutputDirectory); err != nil {
@@ -422,74 +483,149 @@ func TestRotateMaxAge(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
-		"-o", filepath.Join(testOutputDirectory, testLogFileName),
-		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
-		"-f", "0.001",
-		"-d", "0", "-c",
-	)
-	stdin, err := process.StdinPipe()
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	if err = process.Start(); err != nil {
-		t.Fatal(err)
+	const test_input string = "Valid \u20ac\nBinary \xff\xfe garbage\nCut off \xe2\x82\n"
+	for policy, expected := range map[string]string{
+		"pass":    test_input,
+		"replace": "Valid \u20ac\nBinary \ufffd\ufffd garbage\nCut off \ufffd\ufffd\n",
+		"escape":  "Valid \u20ac\nBinary \\xff\\xfe garbage\nCut off \\xe2\\x82\n",
+	} {
+		process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName), "-x",
+			"--utf8-policy", policy)
+		process.Stdin = strings.NewReader(test_input)
+		output, err := process.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(output) != test_input {
+			t.Fatal("Stdout output missmatch")
+		}
+		if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != expected {
+			t.Fatalf("Logfile output missmatch for %s", policy)
+		}
 	}
+}
 
-	var sb strings.Builder
+func TestInputEncoding(t *testing.T) {
 
-	for n := 0; n < iterations; n++ {
+	const testOutputDirectory string = "output_input_encoding"
 
-		for i := n * linesPerIteration; i < (n+1)*linesPerIteration; i++ {
-			sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
 		}
+	}()
 
-		test_input := sb.String()
-		_, err := io.WriteString(stdin, test_input)
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	const expected string = "Caf\u00e9 1\nCaf\u00e9 2\n"
+	for encoding, test_input := range map[string]string{
+		"latin1":  "Caf\xe9 1\nCaf\xe9 2\n",
+		"utf16":   "\xff\xfeC\x00a\x00f\x00\xe9\x00 \x001\x00\n\x00C\x00a\x00f\x00\xe9\x00 \x002\x00\n\x00",
+		"utf16be": "\x00C\x00a\x00f\x00\xe9\x00 \x001\x00\n\x00C\x00a\x00f\x00\xe9\x00 \x002\x00\n",
+	} {
+		process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName), "-x",
+			"--input-encoding", encoding)
+		process.Stdin = strings.NewReader(test_input)
+		output, err := process.Output()
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		// Wait for log lines to be processed
-		// Being slower than this might indicate a problem...
-		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+		if string(output) != expected {
+			t.Fatalf("Stdout output missmatch for %s", encoding)
+		}
+		if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != expected {
+			t.Fatalf("Logfile output missmatch for %s", encoding)
+		}
+	}
+}
 
-		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+func TestDecompressInput(t *testing.T) {
+
+	const testOutputDirectory string = "output_decompress_input"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
 			t.Fatal(err)
 		}
+	}()
 
-		// Wait for logrotate
-		// Being slower than this might indicate a problem...
-		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
 
-		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+	const test_input string = "Hello\nWorld\n"
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(test_input))
+	writer.Close()
+
+	// Plain input must pass unchanged
+	for _, input := range []string{compressed.String(), test_input} {
+		process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName), "-x",
+			"--decompress-input")
+		process.Stdin = strings.NewReader(input)
+		output, err := process.Output()
+		if err != nil {
 			t.Fatal(err)
 		}
 
-		sb.Reset()
+		if string(output) != test_input {
+			t.Fatal("Stdout output missmatch")
+		}
+		if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != test_input {
+			t.Fatal("Logfile output missmatch")
+		}
 	}
+}
 
-	if err := stdin.Close(); err != nil {
+func TestTruncateOnStart(t *testing.T) {
+
+	const testOutputDirectory string = "output_truncate_no_start"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
 		t.Fatal(err)
 	}
 
-	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
-		t.Fatal("Logfile output missmatch")
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testLogFileName), []byte{'a'}, 0644); err != nil {
+		t.Fatal(err)
 	}
 
-	for i := range iterations {
-		if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations-i)+".gz")); err == nil {
-			t.Fatalf("Archive %d should be deleted", iterations-i)
-		}
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName), "-x")
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
+		t.Fatal("Logfile should be empty")
 	}
 }
 
-func TestRotateNothingLost(t *testing.T) {
-	const testOutputDirectory string = "output_rotate_nothing_lost"
+func TestRotate(t *testing.T) {
+
+	const testOutputDirectory string = "output_rotate"
 	const iterations int = 7
-	const linesPerIteration int = 10000
-	const subprocessTimeWait int = 100
+	const linesPerIteration int = 1000
+	const subprocessTimeWait int = 50
 
 	defer func() {
 		if err := os.RemoveAll(testOutputDirectory); err != nil {
@@ -516,7 +652,7 @@ func TestRotateNothingLost(t *testing.T) {
 	}
 
 	var sb strings.Builder
-	var expected string
+	var expected []string
 
 	for n := 0; n < iterations; n++ {
 
@@ -525,17 +661,24 @@ func TestRotateNothingLost(t *testing.T) {
 		}
 
 		test_input := sb.String()
-		expected += test_input
+		expected = append(expected, test_input)
 		_, err := io.WriteString(stdin, test_input)
 		if err != nil {
 			t.Fatal(err)
 		}
 
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
 		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
 			t.Fatal(err)
 		}
 
+		// Wait for logrotate
+		// Being slower than this might indicate a problem...
 		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
 		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
 			t.Fatal(err)
 		}
@@ -547,36 +690,22 @@ func TestRotateNothingLost(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Wait for writes to complete
-	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
-
-	var all_output string
-	for i := range iterations {
-		if log_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations-i)+".gz")); err != nil {
-			continue
-		} else {
-			all_output += log_content
-		}
-	}
-
-	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil {
-		t.Fatal("Logfile could not be read")
-	} else {
-		all_output += string(log_content)
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
+		t.Fatal("Logfile output missmatch")
 	}
 
-	if all_output != expected {
-		t.Fatal("Output missmatch")
+	for i, expected_content := range expected {
+		if log_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations-i)+".gz")); err != nil || string(log_content) != expected_content {
+			t.Fatalf("Archive Logfile %d output missmatch", iterations-i)
+		}
 	}
 }
 
-func TestPreAndPostScript(t *testing.T) {
+func TestRotateSmallCompressBuffer(t *testing.T) {
 
-	const testOutputDirectory string = "output_pre_and_post_script"
+	const testOutputDirectory string = "output_small_compress_buffer"
 	const linesToWrite int = 1000
 	const subprocessTimeWait int = 50
-	const preScriptOutputFile = "pre_script_output"
-	const postScriptOutputFile = "post_script_output"
 
 	defer func() {
 		if err := os.RemoveAll(testOutputDirectory); err != nil {
@@ -588,26 +717,11 @@ func TestPreAndPostScript(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	expectedPreScriptOutput, err := filepath.Abs(filepath.Join(testOutputDirectory, testLogFileName))
-	if err != nil {
-		t.Fatal("Could not form pre script output")
-	} else {
-		expectedPreScriptOutput += "\n"
-	}
-
-	expectedPostScriptOutput, err := filepath.Abs(filepath.Join(testOutputDirectory, testLogFileName+".1.gz"))
-	if err != nil {
-		t.Fatal("Could not form post script output")
-	} else {
-		expectedPostScriptOutput += "\n"
-	}
-
+	// A buffer much smaller than the file makes sure we stream in many chunks
 	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
 		"-o", filepath.Join(testOutputDirectory, testLogFileName),
 		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
-		"-f", "0.001", "-c",
-		"-s", "echo $0 | tee "+filepath.Join(testOutputDirectory, preScriptOutputFile),
-		"-p", "echo $0 | tee "+filepath.Join(testOutputDirectory, postScriptOutputFile),
+		"-f", "0.001", "-c", "--compress-buffer-bytes", "7",
 	)
 	stdin, err := process.StdinPipe()
 	if err != nil {
@@ -619,8 +733,7 @@ func TestPreAndPostScript(t *testing.T) {
 	}
 
 	var sb strings.Builder
-
-	for i := linesToWrite; i < linesToWrite; i++ {
+	for i := 0; i < linesToWrite; i++ {
 		sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
 	}
 
@@ -629,36 +742,34 @@ func TestPreAndPostScript(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
 	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
 		t.Fatal(err)
 	}
 
 	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
 	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
-		t.Fatal(err)
+		t.Fatal("Rotate should have worked")
 	}
 
 	if err := stdin.Close(); err != nil {
 		t.Fatal(err)
 	}
 
-	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, preScriptOutputFile)); err != nil ||
-		string(log_content) != expectedPreScriptOutput {
-		t.Fatal("Pre script output wrong")
-	}
-
-	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, postScriptOutputFile)); err != nil ||
-		string(log_content) != expectedPostScriptOutput {
-		t.Fatal("Post script output wrong")
+	if archive_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+".1.gz")); err != nil ||
+		archive_content != test_input {
+		t.Fatal("Archive output missmatch")
 	}
 }
 
-func TestRotateMixedCompression(t *testing.T) {
+func TestRotateZstdDictionary(t *testing.T) {
 
-	const testOutputDirectory string = "output_rotate_mixed_compression"
-	const iterations int = 3
-	const linesPerIteration int = 100
-	const subprocessTimeWait int = 50
+	const testOutputDirectory string = "output_zstd_dictionary"
+	const linesToWrite int = 1000
+	const subprocessTimeWait int = 200
 
 	defer func() {
 		if err := os.RemoveAll(testOutputDirectory); err != nil {
@@ -673,7 +784,8 @@ func TestRotateMixedCompression(t *testing.T) {
 	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
 		"-o", filepath.Join(testOutputDirectory, testLogFileName),
 		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
-		"-f", "0.001",
+		"-f", "0.001", "--compression", "zstd", "--compression-level", "9", "--zstd-long", "20",
+		"--zstd-train-dictionary",
 	)
 	stdin, err := process.StdinPipe()
 	if err != nil {
@@ -684,19 +796,16 @@ func TestRotateMixedCompression(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	var sb strings.Builder
-	var expected []string
-
-	for n := 0; n < iterations; n++ {
-
-		for i := n * linesPerIteration; i < (n+1)*linesPerIteration; i++ {
-			sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+	// The first rotation trains the dictionary, the second one uses it
+	inputs := make([]string, 0)
+	for round := 0; round < 2; round++ {
+		var sb strings.Builder
+		for i := 0; i < linesToWrite; i++ {
+			sb.WriteString(strconv.Itoa(round) + " " + strconv.Itoa(i) + ": GET /api/v1/items status=200 Text and stuff\n")
 		}
+		inputs = append(inputs, sb.String())
 
-		test_input := sb.String()
-		expected = append(expected, test_input)
-		_, err := io.WriteString(stdin, test_input)
-		if err != nil {
+		if _, err := io.WriteString(stdin, sb.String()); err != nil {
 			t.Fatal(err)
 		}
 
@@ -708,95 +817,56 @@ func TestRotateMixedCompression(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		// Wait for logrotate
-		// Being slower than this might indicate a problem...
 		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
-
 		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
-			t.Fatal(err)
+			t.Fatal("Rotate should have worked")
 		}
-
-		sb.Reset()
 	}
 
 	if err := stdin.Close(); err != nil {
 		t.Fatal(err)
 	}
 
-	// Okay now we run with compression, the non compressed files have to still be non compressed!
-	process = exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
-		"-o", filepath.Join(testOutputDirectory, testLogFileName),
-		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
-		"-f", "0.001", "-c",
-	)
-	stdin, err = process.StdinPipe()
+	dictionary, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".zdict"))
 	if err != nil {
-		t.Fatal(err)
+		t.Fatal("Dictionary was not trained")
 	}
 
-	if err = process.Start(); err != nil {
+	// Without the dictionary the newer archive can not be read
+	plainDecoder, err := zstd.NewReader(nil)
+	if err != nil {
 		t.Fatal(err)
 	}
-
-	for n := 0; n < iterations; n++ {
-
-		for i := n * linesPerIteration; i < (n+1)*linesPerIteration; i++ {
-			sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
-		}
-
-		test_input := sb.String()
-		expected = append(expected, test_input)
-		_, err := io.WriteString(stdin, test_input)
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		// Wait for log lines to be processed
-		// Being slower than this might indicate a problem...
-		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
-
-		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
-			t.Fatal(err)
-		}
-
-		// Wait for logrotate
-		// Being slower than this might indicate a problem...
-		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
-
-		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
-			t.Fatal(err)
-		}
-
-		sb.Reset()
+	defer plainDecoder.Close()
+	dictionaryDecoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dictionary))
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer dictionaryDecoder.Close()
 
-	if err := stdin.Close(); err != nil {
+	older, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".2.zst"))
+	if err != nil {
 		t.Fatal(err)
 	}
-
-	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
-		t.Fatal("Logfile output missmatch")
+	if content, err := plainDecoder.DecodeAll(older, nil); err != nil || string(content) != inputs[0] {
+		t.Fatal("Archive output missmatch")
 	}
 
-	for i, expected_content := range expected {
-		if i < iterations {
-			if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations*2-i))); err != nil || string(log_content) != expected_content {
-				t.Fatalf("Archive Logfile %d output missmatch", iterations-i)
-			}
-		} else {
-			if log_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations*2-i)+".gz")); err != nil || string(log_content) != expected_content {
-				t.Fatalf("Archive Logfile %d output missmatch", iterations-i)
-			}
-		}
+	newer, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".1.zst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plainDecoder.DecodeAll(newer, nil); err == nil {
+		t.Fatal("Archive should need the dictionary")
+	}
+	if content, err := dictionaryDecoder.DecodeAll(newer, nil); err != nil || string(content) != inputs[1] {
+		t.Fatal("Archive output missmatch")
 	}
 }
 
-func TestRotateTempFileBroken(t *testing.T) {
+func TestRotateBzip2(t *testing.T) {
 
-	const testOutputDirectory string = "output_rotate_temp_file_broken"
-	const tempFileName string = testLogFileName + ".tmp"
-	const iterations int = 7
-	const linesPerIteration int = 1000
+	const testOutputDirectory string = "output_bzip2"
 	const subprocessTimeWait int = 50
 
 	defer func() {
@@ -809,16 +879,15 @@ func TestRotateTempFileBroken(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	// Place a temp file in the way of rotate
-	// This file must not be destroyed by rotate!
-	if err := os.WriteFile(filepath.Join(testOutputDirectory, tempFileName), []byte{'a'}, 0644); err != nil {
+	// An archive made by some other bzip2 tooling, it has to be found and pruned
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testLogFileName+".1.bz2"), []byte("old archive"), 0644); err != nil {
 		t.Fatal(err)
 	}
 
 	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
 		"-o", filepath.Join(testOutputDirectory, testLogFileName),
 		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
-		"-f", "0.001", "-c",
+		"-f", "0.001", "--compression", "bzip2", "-n", "1",
 	)
 	stdin, err := process.StdinPipe()
 	if err != nil {
@@ -829,66 +898,107 @@ func TestRotateTempFileBroken(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	var sb strings.Builder
-	var expected []string
+	test_input := "Text and stuff\n"
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
 
-	for n := 0; n < iterations; n++ {
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
 
-		for i := n * linesPerIteration; i < (n+1)*linesPerIteration; i++ {
-			sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
-		}
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
 
-		test_input := sb.String()
-		expected = append(expected, test_input)
-		_, err := io.WriteString(stdin, test_input)
-		if err != nil {
-			t.Fatal(err)
-		}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate should have worked")
+	}
 
-		// Wait for log lines to be processed
-		// Being slower than this might indicate a problem...
-		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
 
-		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
-			t.Fatal(err)
-		}
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".2.bz2")); err == nil {
+		t.Fatal("Old bzip2 archive should have been pruned")
+	}
 
-		// Wait for logrotate
-		// Being slower than this might indicate a problem...
-		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	archive, err := os.Open(filepath.Join(testOutputDirectory, testLogFileName+".1.bz2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	if archive_content, err := io.ReadAll(bzip2.NewReader(archive)); err != nil || string(archive_content) != test_input {
+		t.Fatal("Archive output missmatch")
+	}
+}
 
-		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+func TestRotateLz4(t *testing.T) {
+
+	const testOutputDirectory string = "output_lz4"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
 			t.Fatal(err)
 		}
+	}()
 
-		sb.Reset()
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
 	}
 
-	if err := stdin.Close(); err != nil {
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--compression", "lz4",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
-		t.Fatal("Logfile output missmatch")
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
 	}
 
-	for i, expected_content := range expected {
-		if log_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations-i)+".gz")); err != nil || string(log_content) != expected_content {
-			t.Fatalf("Archive Logfile %d output missmatch", iterations-i)
-		}
+	test_input := "Text and stuff\n"
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
 	}
 
-	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, tempFileName)); err != nil || string(log_content) != "a" {
-		t.Fatal("Tempfile was destroyed")
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate should have worked")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := os.Open(filepath.Join(testOutputDirectory, testLogFileName+".1.lz4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	if archive_content, err := io.ReadAll(lz4.NewReader(archive)); err != nil || string(archive_content) != test_input {
+		t.Fatal("Archive output missmatch")
 	}
 }
 
-func TestTimedRotate(t *testing.T) {
+func TestRotateBrotli(t *testing.T) {
 
-	const testOutputDirectory string = "output_timed_rotate"
-	const lines int = 1000
+	const testOutputDirectory string = "output_brotli"
 	const subprocessTimeWait int = 50
-	const rotateTimeWait float64 = 0.5
 
 	defer func() {
 		if err := os.RemoveAll(testOutputDirectory); err != nil {
@@ -902,7 +1012,8 @@ func TestTimedRotate(t *testing.T) {
 
 	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
 		"-o", filepath.Join(testOutputDirectory, testLogFileName),
-		"-a", strconv.FormatFloat(rotateTimeWait, 'f', 2, 32), "-c",
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--compression", "brotli", "--compression-level", "11",
 	)
 	stdin, err := process.StdinPipe()
 	if err != nil {
@@ -913,44 +1024,132 @@ func TestTimedRotate(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	var sb strings.Builder
+	test_input := "Text and stuff\n"
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
 
-	for i := 0; i < lines; i++ {
-		sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
 	}
 
-	test_input := sb.String()
-	_, err = io.WriteString(stdin, test_input)
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate should have worked")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := os.Open(filepath.Join(testOutputDirectory, testLogFileName+".1.br"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	if archive_content, err := io.ReadAll(brotli.NewReader(archive)); err != nil || string(archive_content) != test_input {
+		t.Fatal("Archive output missmatch")
+	}
+}
+
+func TestInvalidCompressionLevel(t *testing.T) {
+
+	const testOutputDirectory string = "output_invalid_compression_level"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Levels each format refuses, rotee must not start with them
+	for format, level := range map[string]string{"gzip": "20", "lz4": "10", "brotli": "12", "snappy": "1", "zip": "10"} {
+		process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+			"--compression", format, "--compression-level", level)
+		if err := process.Run(); err == nil || process.ProcessState.ExitCode() != 3 {
+			t.Fatalf("Expected level %s of %s to be refused", level, format)
+		}
+	}
+}
+
+func TestRotateSnappy(t *testing.T) {
+
+	const testOutputDirectory string = "output_snappy"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--compression", "snappy",
+	)
+	stdin, err := process.StdinPipe()
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	test_input := "Text and stuff\n"
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+
 	// Wait for log lines to be processed
 	// Being slower than this might indicate a problem...
 	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
-	time.Sleep(time.Millisecond * time.Duration(rotateTimeWait*1000))
 
-	// Wait for logrotate
-	// Being slower than this might indicate a problem...
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
 	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate should have worked")
+	}
 
 	if err := stdin.Close(); err != nil {
 		t.Fatal(err)
 	}
 
-	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
-		t.Fatal("Logfile output missmatch")
+	// Plain snappy readers only accept the snappy stream identifier
+	if archive_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".1.sz")); err != nil ||
+		!bytes.HasPrefix(archive_content, []byte("\xff\x06\x00\x00sNaPpY")) {
+		t.Fatal("Archive is not snappy framed")
 	}
 
-	if log_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(1)+".gz")); err != nil || string(log_content) != test_input {
-		t.Fatalf("Archive Logfile %d output missmatch", 1)
+	archive, err := os.Open(filepath.Join(testOutputDirectory, testLogFileName+".1.sz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	if archive_content, err := io.ReadAll(s2.NewReader(archive)); err != nil || string(archive_content) != test_input {
+		t.Fatal("Archive output missmatch")
 	}
 }
 
-func TestMaxFileSizeRotate(t *testing.T) {
+func TestRotateZip(t *testing.T) {
 
-	const testOutputDirectory string = "output_max_file_size_rotate"
-	const lines int = 1000
+	const testOutputDirectory string = "output_zip"
 	const subprocessTimeWait int = 50
 
 	defer func() {
@@ -965,7 +1164,8 @@ func TestMaxFileSizeRotate(t *testing.T) {
 
 	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
 		"-o", filepath.Join(testOutputDirectory, testLogFileName),
-		"-m", "2kb", "-c", "-f", "0.001",
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--compression", "zip", "-n", "1",
 	)
 	stdin, err := process.StdinPipe()
 	if err != nil {
@@ -976,31 +1176,6885 @@ func TestMaxFileSizeRotate(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	var sb strings.Builder
+	for i := range 2 {
+		if _, err := io.WriteString(stdin, strconv.Itoa(i)+": Text and stuff\n"); err != nil {
+			t.Fatal(err)
+		}
 
-	for i := 0; i < lines; i++ {
-		sb.WriteString("a\n")
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatal("Rotate should have worked")
+		}
 	}
 
-	test_input := sb.String()
-	_, err = io.WriteString(stdin, test_input)
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The older zip archive was found and pruned
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".2.zip")); err == nil {
+		t.Fatal("Old zip archive should have been deleted")
+	}
+
+	archive, err := zip.OpenReader(filepath.Join(testOutputDirectory, testLogFileName+".1.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	if len(archive.File) != 1 || archive.File[0].Name != testLogFileName {
+		t.Fatal("Zip entry missmatch")
+	}
+	entry, err := archive.File[0].Open()
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer entry.Close()
+	if archive_content, err := io.ReadAll(entry); err != nil || string(archive_content) != "1: Text and stuff\n" {
+		t.Fatal("Archive output missmatch")
+	}
+}
 
-	// Wait for log lines to be processed
-	// Being slower than this might indicate a problem...
-	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+func TestRotateDateNaming(t *testing.T) {
 
-	if err := stdin.Close(); err != nil {
+	const testOutputDirectory string = "output_date_naming"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
 		t.Fatal(err)
 	}
 
-	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
-		t.Fatal("Logfile output missmatch")
+	// Left over from before switching to dated names, this is the oldest archive
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testLogFileName+".1"), []byte("Old stuff\n"), 0644); err != nil {
+		t.Fatal(err)
 	}
 
-	if log_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(1)+".gz")); err != nil || string(log_content) != test_input {
-		t.Fatalf("Archive Logfile %d output missmatch", 1)
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-c", "-n", "3", "--archive-naming", "date",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	today := time.Now().Format("2006-01-02")
+	for i := 1; i <= 3; i++ {
+		if _, err := io.WriteString(stdin, strconv.Itoa(i)+": Text and stuff\n"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatal("Rotate should have worked")
+		}
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Archives keep their names, the counter goes up within the day
+	for i := 1; i <= 3; i++ {
+		archive, err := os.Open(filepath.Join(testOutputDirectory, testLogFileName+"."+today+"."+strconv.Itoa(i)+".gz"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer archive.Close()
+		reader, err := gzip.NewReader(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if archive_content, err := io.ReadAll(reader); err != nil || string(archive_content) != strconv.Itoa(i)+": Text and stuff\n" {
+			t.Fatal("Archive output missmatch")
+		}
+	}
+
+	// The numbered archive was the oldest and did not fit anymore
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".1")); err == nil {
+		t.Fatal("Old numbered archive should have been deleted")
+	}
+}
+
+func TestLatestLink(t *testing.T) {
+
+	const testOutputDirectory string = "output_latest_link"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--archive-naming", "date", "--latest-link", "symlink",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	today := time.Now().Format("2006-01-02")
+	for i := 1; i <= 2; i++ {
+		if _, err := io.WriteString(stdin, strconv.Itoa(i)+": Text and stuff\n"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatal("Rotate should have worked")
+		}
+
+		// The link always follows the newest archive
+		linkPath := filepath.Join(testOutputDirectory, testLogFileName+".latest")
+		if target, err := os.Readlink(linkPath); err != nil || target != testLogFileName+"."+today+"."+strconv.Itoa(i) {
+			t.Fatal("Latest link target missmatch")
+		}
+		if archive_content, err := os.ReadFile(linkPath); err != nil || string(archive_content) != strconv.Itoa(i)+": Text and stuff\n" {
+			t.Fatal("Latest archive output missmatch")
+		}
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCurrentSymlink(t *testing.T) {
+
+	const testOutputDirectory string = "output_current_symlink"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--current-symlink", filepath.Join(testOutputDirectory, "current.log"),
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	test_input := "Text and stuff\n"
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedTarget, err := filepath.Abs(filepath.Join(testOutputDirectory, testLogFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(filepath.Join(testOutputDirectory, "current.log")); err != nil || target != expectedTarget {
+		t.Fatal("Current symlink target missmatch")
+	}
+	if content, err := os.ReadFile(filepath.Join(testOutputDirectory, "current.log")); err != nil || string(content) != test_input {
+		t.Fatal("Current symlink output missmatch")
+	}
+}
+
+func TestNoCreate(t *testing.T) {
+
+	const testOutputDirectory string = "output_no_create"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--no-create",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.WriteString(stdin, "1: Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	// Rotating twice, the second time there is nothing to rotate
+	for _, status := range []string{"0", "4"} {
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != status {
+			t.Fatal("Trigger status missmatch")
+		}
+
+		if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName)); err == nil {
+			t.Fatal("Output file should not have been created")
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".2")); err == nil {
+		t.Fatal("Nothing should have been rotated the second time")
+	}
+
+	// The next write creates the file
+	if _, err := io.WriteString(stdin, "2: Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if output_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil ||
+		string(output_content) != "2: Text and stuff\n" {
+		t.Fatal("Log output missmatch")
+	}
+	if archive_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".1")); err != nil ||
+		string(archive_content) != "1: Text and stuff\n" {
+		t.Fatal("Archive output missmatch")
+	}
+}
+
+func TestUmask(t *testing.T) {
+
+	const testOutputDirectory string = "output_umask"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-c", "--umask", "077",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate should have worked")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything rotee created is only accessible by the owner
+	for _, name := range []string{testDebugFileName, testLogFileName, testLogFileName + ".1.gz"} {
+		if stat, err := os.Stat(filepath.Join(testOutputDirectory, name)); err != nil || stat.Mode().Perm() != 0600 {
+			t.Fatalf("Permission missmatch for %s", name)
+		}
+	}
+}
+
+func TestArchiveKeepsLastWriteTime(t *testing.T) {
+
+	const testOutputDirectory string = "output_archive_last_write_time"
+	const subprocessTimeWait int = 50
+	const idleTime int = 1100
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-c",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is written for a while before the rotation
+	time.Sleep(time.Millisecond * time.Duration(idleTime))
+	rotationStart := time.Now()
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate should have worked")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".1.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stat.ModTime().Before(rotationStart) {
+		t.Fatal("Archive modification time should be the time of the last write")
+	}
+
+	records := make([]archiveRecord, 0)
+	if content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".manifest")); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(content, &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].FirstWrite == nil || records[0].LastWrite == nil ||
+		records[0].FirstWrite.After(*records[0].LastWrite) || !records[0].LastWrite.Equal(stat.ModTime()) {
+		t.Fatalf("Manifest time range missmatch %v", records)
+	}
+}
+
+func TestArchiveReadonly(t *testing.T) {
+
+	const testOutputDirectory string = "output_archive_readonly"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-c", "-n", "1", "--archive-readonly",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read-only archives can still be moved up and deleted
+	for i := range 3 {
+		if _, err := io.WriteString(stdin, strconv.Itoa(i)+": Text and stuff\n"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatal("Rotate should have worked")
+		}
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if stat, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".1.gz")); err != nil || stat.Mode().Perm()&0222 != 0 {
+		t.Fatal("Archive should be read-only")
+	}
+	if archive_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+".1.gz")); err != nil ||
+		archive_content != "2: Text and stuff\n" {
+		t.Fatal("Archive output missmatch")
+	}
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".2.gz")); err == nil {
+		t.Fatal("Old archive should have been deleted")
+	}
+}
+
+func TestMultiPipelines(t *testing.T) {
+
+	const testOutputDirectory string = "output_multi_pipelines"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// One pipeline reads stdin, the other one a file
+	inputFile := filepath.Join(testOutputDirectory, "input.txt")
+	if err := os.WriteFile(inputFile, []byte("b: Text and stuff\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := json.Marshal(map[string]any{"pipelines": []map[string]any{
+		{"stdout": true, "args": []string{
+			"-o", filepath.Join(testOutputDirectory, "a.log"),
+			"-t", filepath.Join(testOutputDirectory, "a.trigger"), "-f", "0.001", "-c"}},
+		{"input": inputFile, "args": []string{
+			"-o", filepath.Join(testOutputDirectory, "b.log"),
+			"-t", filepath.Join(testOutputDirectory, "b.trigger"), "-f", "0.001"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, "pipelines.json"), config, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "multi", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-c", filepath.Join(testOutputDirectory, "pipelines.json"),
+	)
+	var stdout bytes.Buffer
+	process.Stdout = &stdout
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.WriteString(stdin, "a: Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	// Pipelines rotate independently
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, name+".trigger"), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	for _, name := range []string{"a", "b"} {
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, name+".trigger")); err != nil || string(result) != "0" {
+			t.Fatalf("Rotate of %s should have worked", name)
+		}
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if archive_content, err := readGzipFile(filepath.Join(testOutputDirectory, "a.log.1.gz")); err != nil ||
+		archive_content != "a: Text and stuff\n" {
+		t.Fatal("Archive a output missmatch")
+	}
+	if archive_content, err := os.ReadFile(filepath.Join(testOutputDirectory, "b.log.1")); err != nil ||
+		string(archive_content) != "b: Text and stuff\n" {
+		t.Fatal("Archive b output missmatch")
+	}
+
+	// Only the pipeline that asked for it echoes to stdout
+	if stdout.String() != "a: Text and stuff\n" {
+		t.Fatalf("Stdout missmatch %q", stdout.String())
+	}
+}
+
+func TestRotateNoCompression(t *testing.T) {
+
+	const testOutputDirectory string = "output_rotate_no_compression"
+	const iterations int = 7
+	const linesPerIteration int = 1000
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	var expected []string
+
+	for n := 0; n < iterations; n++ {
+
+		for i := n * linesPerIteration; i < (n+1)*linesPerIteration; i++ {
+			sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+		}
+
+		test_input := sb.String()
+		expected = append(expected, test_input)
+		_, err := io.WriteString(stdin, test_input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for logrotate
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatal(err)
+		}
+
+		sb.Reset()
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
+		t.Fatal("Logfile output missmatch")
+	}
+
+	for i, expected_content := range expected {
+		if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations-i))); err != nil || string(log_content) != expected_content {
+			t.Fatalf("Archive Logfile %d output missmatch", iterations-i)
+		}
+	}
+}
+
+func TestRotateMaxFiles(t *testing.T) {
+
+	const testOutputDirectory string = "output_rotate_max_files"
+	const iterations int = 7
+	const linesPerIteration int = 1000
+	const subprocessTimeWait int = 50
+	const intMaxFiles = 3
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001",
+		"-n", strconv.Itoa(intMaxFiles), "-c",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	var expected []string
+
+	for n := 0; n < iterations; n++ {
+
+		for i := n * linesPerIteration; i < (n+1)*linesPerIteration; i++ {
+			sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+		}
+
+		test_input := sb.String()
+		expected = append(expected, test_input)
+		_, err := io.WriteString(stdin, test_input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for logrotate
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatal(err)
+		}
+
+		sb.Reset()
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
+		t.Fatal("Logfile output missmatch")
+	}
+
+	for i, expected_content := range expected {
+		if i <= intMaxFiles {
+			if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations-i)+".gz")); err == nil {
+				t.Fatalf("Archive %d should be deleted", iterations-i)
+			}
+		} else {
+
+			if log_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations-i)+".gz")); err != nil || string(log_content) != expected_content {
+				t.Fatalf("Archive Logfile %d output missmatch", iterations-i)
+			}
+		}
+	}
+}
+
+func TestArchiveWrittenAtomically(t *testing.T) {
+
+	const testOutputDirectory string = "output_archive_written_atomically"
+	const iterations int = 3
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-n", "2", "-c",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	// Left behind by a compression that never finished, after startup cleaned up
+	stalePath := filepath.Join(testOutputDirectory, testLogFileName+".3.gz.part")
+	if err := os.WriteFile(stalePath, []byte("truncated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 0; n < iterations; n++ {
+		if _, err := io.WriteString(stdin, strconv.Itoa(n)+": Text and stuff\n"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatal("Trigger status missmatch")
+		}
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stale file is neither moved along with the archives nor counted by -n
+	for i := 1; i <= 2; i++ {
+		if log_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(i)+".gz")); err != nil ||
+			string(log_content) != strconv.Itoa(iterations-i)+": Text and stuff\n" {
+			t.Fatalf("Archive Logfile %d output missmatch", i)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".3.gz")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Archive 3 should be deleted")
+	}
+	if content, err := os.ReadFile(stalePath); err != nil || string(content) != "truncated" {
+		t.Fatal("Stale partial archive missmatch")
+	}
+
+	// Finished archives never leave a partial file behind
+	entries, err := os.ReadDir(testOutputDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".part") && entry.Name() != filepath.Base(stalePath) {
+			t.Fatalf("Partial archive %s was left behind", entry.Name())
+		}
+	}
+}
+
+func TestPruneOnlyArchives(t *testing.T) {
+
+	const testOutputDirectory string = "output_prune_only_archives"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Named like an archive but not one rotee would ever create
+	if err := os.Mkdir(filepath.Join(testOutputDirectory, testLogFileName+".1"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001",
+		"-n", "1", "-c", "--prune-orphans",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	// Left behind by a failed rotation, after startup recovery already ran
+	for _, name := range []string{testLogFileName + ".tmp.7", testLogFileName + ".tmp.7.keep"} {
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, name), []byte("Old stuff\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for logrotate
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate should have worked")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if archive_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+".1.gz")); err != nil ||
+		archive_content != "Text and stuff\n" {
+		t.Fatal("Archive output missmatch")
+	}
+
+	// The directory was moved up like an archive, but max files must not delete it
+	if stat, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".2")); err != nil || !stat.IsDir() {
+		t.Fatal("Directory should not be pruned")
+	}
+
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".tmp.7")); err == nil {
+		t.Fatal("Orphaned temporary file should be deleted")
+	}
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".tmp.7.keep")); err != nil {
+		t.Fatal("Unrelated file should not be deleted")
+	}
+}
+
+func TestRotateMaxAge(t *testing.T) {
+
+	const testOutputDirectory string = "output_rotate_max_age"
+	const iterations int = 7
+	const linesPerIteration int = 1000
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001",
+		"-d", "0", "-c",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+
+	for n := 0; n < iterations; n++ {
+
+		for i := n * linesPerIteration; i < (n+1)*linesPerIteration; i++ {
+			sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+		}
+
+		test_input := sb.String()
+		_, err := io.WriteString(stdin, test_input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for logrotate
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatal(err)
+		}
+
+		sb.Reset()
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
+		t.Fatal("Logfile output missmatch")
+	}
+
+	for i := range iterations {
+		if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations-i)+".gz")); err == nil {
+			t.Fatalf("Archive %d should be deleted", iterations-i)
+		}
+	}
+}
+
+func TestRotateNothingLost(t *testing.T) {
+	const testOutputDirectory string = "output_rotate_nothing_lost"
+	const iterations int = 7
+	const linesPerIteration int = 10000
+	const subprocessTimeWait int = 100
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-c",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	var expected string
+
+	for n := 0; n < iterations; n++ {
+
+		for i := n * linesPerIteration; i < (n+1)*linesPerIteration; i++ {
+			sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+		}
+
+		test_input := sb.String()
+		expected += test_input
+		_, err := io.WriteString(stdin, test_input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatal(err)
+		}
+
+		sb.Reset()
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for writes to complete
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	var all_output string
+	for i := range iterations {
+		if log_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations-i)+".gz")); err != nil {
+			continue
+		} else {
+			all_output += log_content
+		}
+	}
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil {
+		t.Fatal("Logfile could not be read")
+	} else {
+		all_output += string(log_content)
+	}
+
+	if all_output != expected {
+		t.Fatal("Output missmatch")
+	}
+}
+
+func TestPreAndPostScript(t *testing.T) {
+
+	const testOutputDirectory string = "output_pre_and_post_script"
+	const linesToWrite int = 1000
+	const subprocessTimeWait int = 50
+	const preScriptOutputFile = "pre_script_output"
+	const postScriptOutputFile = "post_script_output"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedPreScriptOutput, err := filepath.Abs(filepath.Join(testOutputDirectory, testLogFileName))
+	if err != nil {
+		t.Fatal("Could not form pre script output")
+	} else {
+		expectedPreScriptOutput += "\n"
+	}
+
+	expectedPostScriptOutput, err := filepath.Abs(filepath.Join(testOutputDirectory, testLogFileName+".1.gz"))
+	if err != nil {
+		t.Fatal("Could not form post script output")
+	} else {
+		expectedPostScriptOutput += "\n"
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-c",
+		"-s", "echo $0 | tee "+filepath.Join(testOutputDirectory, preScriptOutputFile),
+		"-p", "echo $0 | tee "+filepath.Join(testOutputDirectory, postScriptOutputFile),
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+
+	for i := linesToWrite; i < linesToWrite; i++ {
+		sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+	}
+
+	test_input := sb.String()
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal(err)
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, preScriptOutputFile)); err != nil ||
+		string(log_content) != expectedPreScriptOutput {
+		t.Fatal("Pre script output wrong")
+	}
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, postScriptOutputFile)); err != nil ||
+		string(log_content) != expectedPostScriptOutput {
+		t.Fatal("Post script output wrong")
+	}
+}
+
+func TestScriptUser(t *testing.T) {
+
+	const testOutputDirectory string = "output_script_user"
+	const subprocessTimeWait int = 100
+	const postScriptOutputFile = "post_script_output"
+
+	if os.Geteuid() != 0 {
+		t.Skip("Dropping privileges needs root")
+	}
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// The checkout is usually not reachable for nobody, so the script writes to a temp dir
+	scriptOutputDirectory, err := os.MkdirTemp("", testOutputDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(scriptOutputDirectory)
+	if err := os.Chmod(scriptOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--script-user", "nobody",
+		"-p", "id -u > "+filepath.Join(scriptOutputDirectory, postScriptOutputFile),
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate should have worked")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if script_output, err := os.ReadFile(filepath.Join(scriptOutputDirectory, postScriptOutputFile)); err != nil ||
+		strings.TrimSpace(string(script_output)) == "0" {
+		t.Fatal("Post script should not run as root")
+	}
+}
+
+func TestRotationID(t *testing.T) {
+
+	const testOutputDirectory string = "output_rotation_id"
+	const subprocessTimeWait int = 50
+	const postScriptOutputFile = "post_script_output"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001",
+		"-p", "printf $ROTEE_ROTATION_ID > "+filepath.Join(testOutputDirectory, postScriptOutputFile),
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate should have worked")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotationID, err := os.ReadFile(filepath.Join(testOutputDirectory, postScriptOutputFile))
+	if err != nil || len(rotationID) != 26 {
+		t.Fatalf("Post script got no rotation id: %q", rotationID)
+	}
+
+	records := make([]map[string]any, 0)
+	if content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".manifest")); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(content, &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0]["rotation_id"] != string(rotationID) {
+		t.Fatalf("Manifest rotation id missmatch %v", records)
+	}
+
+	if debug_log, err := os.ReadFile(filepath.Join(testOutputDirectory, testDebugFileName)); err != nil ||
+		!strings.Contains(string(debug_log), "["+string(rotationID)+"] Starting logrotate...") {
+		t.Fatal("Activity log is missing the rotation id")
+	}
+}
+
+func TestSummaryFooter(t *testing.T) {
+
+	const testOutputDirectory string = "output_summary_footer"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--summary", "footer",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	const test_input string = "Text and stuff\nMore text\n"
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate should have worked")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := make([]map[string]any, 0)
+	if content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".manifest")); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(content, &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0]["lines"] != 2.0 || records[0]["bytes"] != float64(len(test_input)) {
+		t.Fatalf("Manifest summary missmatch %v", records)
+	}
+
+	// The footer comes after the log and names the rotation
+	log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".1"))
+	if err != nil || !strings.HasPrefix(string(log_content), test_input) {
+		t.Fatal("Archive Logfile output missmatch")
+	}
+	footer := strings.TrimPrefix(string(log_content), test_input)
+	if !strings.HasPrefix(footer, "-- rotee: 2 lines, 25 bytes, from ") ||
+		!strings.HasSuffix(footer, ", rotation "+records[0]["rotation_id"].(string)+" --\n") {
+		t.Fatalf("Summary footer missmatch %q", footer)
+	}
+}
+
+func TestAuditFile(t *testing.T) {
+
+	const testOutputDirectory string = "output_audit_file"
+	const subprocessTimeWait int = 50
+	const auditFileName = "audit.jsonl"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-x", "-n", "1",
+		"--audit-file", filepath.Join(testOutputDirectory, auditFileName),
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate twice so the first archive is moved up and then deleted
+	for i := 0; i < 2; i++ {
+		if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatal("Rotate should have worked")
+		}
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	auditFile, err := os.Open(filepath.Join(testOutputDirectory, auditFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditFile.Close()
+
+	actions := make([]string, 0)
+	scanner := bufio.NewScanner(auditFile)
+	for scanner.Scan() {
+		event := make(map[string]string)
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		actions = append(actions, event["action"]+" "+filepath.Base(event["path"])+" "+filepath.Base(event["target"]))
+	}
+
+	expected := []string{
+		"truncate test.log .",
+		"rename test.log test.log.tmp.1",
+		"delete test.log.tmp.1 .",
+		"rename test.log test.log.tmp.1",
+		"rename test.log.1 test.log.2",
+		"delete test.log.tmp.1 .",
+		"delete test.log.2 .",
+	}
+	if strings.Join(actions, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Audit events missmatch %v", actions)
+	}
+}
+
+func TestRotateMixedCompression(t *testing.T) {
+
+	const testOutputDirectory string = "output_rotate_mixed_compression"
+	const iterations int = 3
+	const linesPerIteration int = 100
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	var expected []string
+
+	for n := 0; n < iterations; n++ {
+
+		for i := n * linesPerIteration; i < (n+1)*linesPerIteration; i++ {
+			sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+		}
+
+		test_input := sb.String()
+		expected = append(expected, test_input)
+		_, err := io.WriteString(stdin, test_input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for logrotate
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatal(err)
+		}
+
+		sb.Reset()
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Okay now we run with compression, the non compressed files have to still be non compressed!
+	process = exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-c",
+	)
+	stdin, err = process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 0; n < iterations; n++ {
+
+		for i := n * linesPerIteration; i < (n+1)*linesPerIteration; i++ {
+			sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+		}
+
+		test_input := sb.String()
+		expected = append(expected, test_input)
+		_, err := io.WriteString(stdin, test_input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for logrotate
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatal(err)
+		}
+
+		sb.Reset()
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
+		t.Fatal("Logfile output missmatch")
+	}
+
+	for i, expected_content := range expected {
+		if i < iterations {
+			if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations*2-i))); err != nil || string(log_content) != expected_content {
+				t.Fatalf("Archive Logfile %d output missmatch", iterations-i)
+			}
+		} else {
+			if log_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations*2-i)+".gz")); err != nil || string(log_content) != expected_content {
+				t.Fatalf("Archive Logfile %d output missmatch", iterations-i)
+			}
+		}
+	}
+}
+
+func TestRotateTempFileBroken(t *testing.T) {
+
+	const testOutputDirectory string = "output_rotate_temp_file_broken"
+	const tempFileName string = testLogFileName + ".tmp"
+	const iterations int = 7
+	const linesPerIteration int = 1000
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Place a temp file in the way of rotate
+	// This file must not be destroyed by rotate!
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, tempFileName), []byte{'a'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-c",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	var expected []string
+
+	for n := 0; n < iterations; n++ {
+
+		for i := n * linesPerIteration; i < (n+1)*linesPerIteration; i++ {
+			sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+		}
+
+		test_input := sb.String()
+		expected = append(expected, test_input)
+		_, err := io.WriteString(stdin, test_input)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for logrotate
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatal(err)
+		}
+
+		sb.Reset()
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
+		t.Fatal("Logfile output missmatch")
+	}
+
+	for i, expected_content := range expected {
+		if log_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations-i)+".gz")); err != nil || string(log_content) != expected_content {
+			t.Fatalf("Archive Logfile %d output missmatch", iterations-i)
+		}
+	}
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, tempFileName)); err != nil || string(log_content) != "a" {
+		t.Fatal("Tempfile was destroyed")
+	}
+}
+
+func TestMaxRotationsPerHour(t *testing.T) {
+
+	const testOutputDirectory string = "output_max_rotations_per_hour"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--max-rotations-per-hour", "2",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The third rotation within the hour must be refused
+	for i, expected := range []string{"0", "0", "3"} {
+		if _, err := io.WriteString(stdin, strconv.Itoa(i)+": Text and stuff\n"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != expected {
+			t.Fatalf("Trigger result missmatch, expected %s got %s", expected, result)
+		}
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The refused rotation must not touch the log file
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil ||
+		string(log_content) != "2: Text and stuff\n" {
+		t.Fatal("Log file output missmatch")
+	}
+
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".3")); err == nil {
+		t.Fatal("There should only be 2 archives")
+	}
+}
+
+func TestArchiveDirOtherFilesystem(t *testing.T) {
+
+	const testOutputDirectory string = "output_archive_dir"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// /dev/shm is a tmpfs on most linux systems, so rename to it fails with EXDEV
+	if _, err := os.Stat("/dev/shm"); err != nil {
+		t.Skip("Need /dev/shm for a second filesystem")
+	}
+	archiveDirectory, err := os.MkdirTemp("/dev/shm", testOutputDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(archiveDirectory)
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--archive-dir", archiveDirectory,
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := io.WriteString(stdin, strconv.Itoa(i)+": Text and stuff\n"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatal("Rotate should have worked")
+		}
+	}
+
+	if _, err := io.WriteString(stdin, "2: Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The output file was truncated instead of moved, the writer must keep writing to it
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil ||
+		string(log_content) != "2: Text and stuff\n" {
+		t.Fatal("Log file output missmatch")
+	}
+
+	for index, expected := range []string{"1: Text and stuff\n", "0: Text and stuff\n"} {
+		if archive_content, err := os.ReadFile(filepath.Join(archiveDirectory, testLogFileName+"."+strconv.Itoa(index+1))); err != nil ||
+			string(archive_content) != expected {
+			t.Fatal("Archive output missmatch")
+		}
+	}
+}
+
+func TestRecoverInterruptedRotation(t *testing.T) {
+
+	const testOutputDirectory string = "output_recover_interrupted_rotation"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave things like a crash during compression would: the archives were already
+	// moved up, the rotated data is still in the temporary file and the new archive is half written.
+	crashState := map[string]string{
+		testLogFileName + ".tmp.1":     "1: Text and stuff\n",
+		testLogFileName + ".2":         "0: Text and stuff\n",
+		testLogFileName + ".1.gz.part": "garbage",
+
+		// Belong to a route and a position file next to the output file, not to us
+		testLogFileName + ".err.1.gz.part": "route",
+		testLogFileName + ".pos.part":      "position",
+	}
+	for name, content := range crashState {
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{testLogFileName + ".tmp.1", testLogFileName + ".1.gz.part"} {
+		if _, err := os.Stat(filepath.Join(testOutputDirectory, name)); err == nil {
+			t.Fatalf("%s should have been cleaned up", name)
+		}
+	}
+
+	for _, name := range []string{testLogFileName + ".err.1.gz.part", testLogFileName + ".pos.part"} {
+		if _, err := os.Stat(filepath.Join(testOutputDirectory, name)); err != nil {
+			t.Fatalf("%s should have been left alone", name)
+		}
+	}
+
+	for index, expected := range []string{"1: Text and stuff\n", "0: Text and stuff\n"} {
+		if archive_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(index+1))); err != nil ||
+			string(archive_content) != expected {
+			t.Fatal("Archive output missmatch")
+		}
+	}
+}
+
+func TestCollectOrphans(t *testing.T) {
+
+	const testOutputDirectory string = "output_collect_orphans"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-c", "--orphan-max-age", "0.2", "--orphan-policy", "archive",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Left behind by a rotation that failed while rotee kept running
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testLogFileName+".tmp.3"), []byte("Lost stuff\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Old enough after 200ms, found within the next 200ms
+	time.Sleep(time.Millisecond * time.Duration(400+subprocessTimeWait))
+
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".tmp.3")); err == nil {
+		t.Fatal("Orphaned temporary file should be collected")
+	}
+	if archive_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+".1.gz")); err != nil ||
+		archive_content != "Lost stuff\n" {
+		t.Fatal("Archive output missmatch")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil ||
+		string(log_content) != "Text and stuff\n" {
+		t.Fatal("Logfile output missmatch")
+	}
+}
+
+func TestBundleOldArchives(t *testing.T) {
+
+	const testOutputDirectory string = "output_bundle_old_archives"
+	const subprocessTimeWait int = 100
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two old archives from june and one from may
+	oldArchives := []struct {
+		content string
+		rotated time.Time
+	}{
+		{"3: Text and stuff\n", time.Date(2024, 6, 20, 12, 0, 0, 0, time.UTC)},
+		{"2: Text and stuff\n", time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)},
+		{"1: Text and stuff\n", time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)},
+	}
+	for i, archive := range oldArchives {
+		path := filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(i+1))
+		if err := os.WriteFile(path, []byte(archive.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, archive.rotated, archive.rotated); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--bundle-after-days", "30",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.WriteString(stdin, "4: Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate should have worked")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the fresh archive is left
+	if archive_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".1")); err != nil ||
+		string(archive_content) != "4: Text and stuff\n" {
+		t.Fatal("Archive output missmatch")
+	}
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".2")); err == nil {
+		t.Fatal("Old archives should have been bundled")
+	}
+
+	expectedBundles := map[string][]string{
+		"2024-06": {"3: Text and stuff\n", "2: Text and stuff\n"},
+		"2024-05": {"1: Text and stuff\n"},
+	}
+	for period, expected := range expectedBundles {
+		bundle, err := os.Open(filepath.Join(testOutputDirectory, testLogFileName+"."+period+".tar.zst"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bundle.Close()
+
+		decoder, err := zstd.NewReader(bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer decoder.Close()
+
+		contents := make([]string, 0)
+		reader := tar.NewReader(decoder)
+		for {
+			header, err := reader.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(header.Name, testLogFileName+"."+strings.ReplaceAll(period, "-", "")) {
+				t.Fatalf("Unexpected bundle entry %s", header.Name)
+			}
+			content, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contents = append(contents, string(content))
+		}
+
+		if strings.Join(contents, "") != strings.Join(expected, "") {
+			t.Fatalf("Bundle %s content missmatch %v", period, contents)
+		}
+	}
+}
+
+func TestTimedRotate(t *testing.T) {
+
+	const testOutputDirectory string = "output_timed_rotate"
+	const lines int = 1000
+	const subprocessTimeWait int = 50
+	const rotateTimeWait float64 = 0.5
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-a", strconv.FormatFloat(rotateTimeWait, 'f', 2, 32), "-c",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+
+	for i := 0; i < lines; i++ {
+		sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+	}
+
+	test_input := sb.String()
+	_, err = io.WriteString(stdin, test_input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	time.Sleep(time.Millisecond * time.Duration(rotateTimeWait*1000))
+
+	// Wait for logrotate
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
+		t.Fatal("Logfile output missmatch")
+	}
+
+	if log_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(1)+".gz")); err != nil || string(log_content) != test_input {
+		t.Fatalf("Archive Logfile %d output missmatch", 1)
+	}
+}
+
+func TestMaxFileSizeRotate(t *testing.T) {
+
+	const testOutputDirectory string = "output_max_file_size_rotate"
+	const lines int = 1000
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-m", "2kb", "-c", "-f", "0.001",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+
+	for i := 0; i < lines; i++ {
+		sb.WriteString("a\n")
+	}
+
+	test_input := sb.String()
+	_, err = io.WriteString(stdin, test_input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "" {
+		t.Fatal("Logfile output missmatch")
+	}
+
+	if log_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(1)+".gz")); err != nil || string(log_content) != test_input {
+		t.Fatalf("Archive Logfile %d output missmatch", 1)
+	}
+}
+
+func TestTriggerPolicyAll(t *testing.T) {
+
+	const testOutputDirectory string = "output_trigger_policy_all"
+	const subprocessTimeWait int = 50
+	const minAgeWait int = 500
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-m", "1kb", "-a", "0.4", "--trigger-policy", "all", "-f", "0.001",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Large enough right away, but the file is not old enough yet
+	test_input := strings.Repeat("Text and stuff\n", 100)
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".1")); err == nil {
+		t.Fatal("Rotated before the file was old enough")
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(minAgeWait))
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".1")); err != nil || string(log_content) != test_input {
+		t.Fatal("Archive Logfile output missmatch")
+	}
+
+	// Old enough again, but too small this time
+	if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(minAgeWait))
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".2")); err == nil {
+		t.Fatal("Rotated before the file was large enough")
+	}
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "Text and stuff\n" {
+		t.Fatal("Logfile output missmatch")
+	}
+}
+
+func TestRotateWhen(t *testing.T) {
+
+	const testOutputDirectory string = "output_rotate_when"
+	const subprocessTimeWait int = 100
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Broken conditions are refused right away
+	if err := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--rotate-when", "size > 1h").Run(); err == nil {
+		t.Fatal("Expected rotee to refuse a size compared to a duration")
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--rotate-when", "lines >= 100 || (size > 1mb && age > 1h)", "-f", "0.001",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	for i := 0; i < 100; i++ {
+		sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+	}
+	test_input := sb.String()
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".1")); err != nil || string(log_content) != test_input {
+		t.Fatal("Archive Logfile output missmatch")
+	}
+
+	// The line count starts over after the rotation
+	if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".2")); err == nil {
+		t.Fatal("Rotated before enough lines were written")
+	}
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(log_content) != "Text and stuff\n" {
+		t.Fatal("Logfile output missmatch")
+	}
+}
+
+func TestRotateIfIdle(t *testing.T) {
+
+	const testOutputDirectory string = "output_rotate_if_idle"
+	const subprocessTimeWait int = 50
+	const idleWait int = 500
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--rotate-if-idle", "300ms", "-f", "0.001",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	test_input := strings.Repeat("Text and stuff\n", 100)
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".1")); err == nil {
+		t.Fatal("Rotated while input was still arriving")
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(idleWait))
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".1")); err != nil || string(log_content) != test_input {
+		t.Fatal("Archive Logfile output missmatch")
+	}
+
+	// Still idle, but there is nothing to rotate
+	time.Sleep(time.Millisecond * time.Duration(idleWait))
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".2")); err == nil {
+		t.Fatal("Rotated an empty file")
+	}
+}
+
+func TestFollowSymlink(t *testing.T) {
+
+	const testOutputDirectory string = "output_follow_symlink"
+	const lines int = 100
+	const subprocessTimeWait int = 50
+	const firstTarget string = "first.log"
+	const secondTarget string = "second.log"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(firstTarget, filepath.Join(testOutputDirectory, testLogFileName)); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-f", "0.001", "--follow-symlink",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	var expected []string
+
+	for n := 0; n < 2; n++ {
+
+		for i := n * lines; i < (n+1)*lines; i++ {
+			sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+		}
+
+		test_input := sb.String()
+		expected = append(expected, test_input)
+		if _, err := io.WriteString(stdin, test_input); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		// Swap the link atomically, the way the kubelet does it
+		if n == 0 {
+			if err := os.Symlink(secondTarget, filepath.Join(testOutputDirectory, testLogFileName+".new")); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Rename(filepath.Join(testOutputDirectory, testLogFileName+".new"),
+				filepath.Join(testOutputDirectory, testLogFileName)); err != nil {
+				t.Fatal(err)
+			}
+
+			// Wait for the writer to pick up the new target
+			time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+		}
+
+		sb.Reset()
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, firstTarget)); err != nil || string(log_content) != expected[0] {
+		t.Fatal("First symlink target output missmatch")
+	}
+
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, secondTarget)); err != nil || string(log_content) != expected[1] {
+		t.Fatal("Second symlink target output missmatch")
+	}
+}
+
+func TestUploadS3CompatibleEndpoint(t *testing.T) {
+
+	const testOutputDirectory string = "output_upload_s3"
+	const lines int = 100
+	const subprocessTimeWait int = 100
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend to be a MinIO server, remember everything that was put
+	var uploadsLock sync.Mutex
+	uploads := make(map[string][]byte)
+	authorization := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil || r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		uploadsLock.Lock()
+		defer uploadsLock.Unlock()
+		uploads[r.URL.Path] = body
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-c",
+		"--upload", "s3://bucket/logs", "--upload-delete",
+		"--s3-endpoint", server.URL, "--s3-path-style",
+		"--s3-access-key", "rotee", "--s3-secret-key", "secret",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+
+	for i := 0; i < lines; i++ {
+		sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+	}
+
+	test_input := sb.String()
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for logrotate and upload
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate with upload failed")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".1.gz")); err == nil {
+		t.Fatal("Uploaded archive should be deleted")
+	}
+
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+
+	if len(uploads) != 1 {
+		t.Fatalf("Expected exactly one upload, got %d", len(uploads))
+	}
+
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=rotee/") {
+		t.Fatal("Upload was not signed with the static credentials")
+	}
+
+	for path, body := range uploads {
+		if !strings.HasPrefix(path, "/bucket/logs/"+testLogFileName+".") || !strings.HasSuffix(path, ".gz") {
+			t.Fatalf("Unexpected upload path %s", path)
+		}
+
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content, err := io.ReadAll(reader); err != nil || string(content) != test_input {
+			t.Fatal("Uploaded archive content missmatch")
+		}
+	}
+}
+
+func TestUploadGCSEmulator(t *testing.T) {
+
+	const testOutputDirectory string = "output_upload_gcs"
+	const lines int = 100
+	const subprocessTimeWait int = 100
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend to be the GCS emulator, remember everything that was uploaded
+	var uploadsLock sync.Mutex
+	uploads := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil || r.Method != http.MethodPost || r.URL.Path != "/upload/storage/v1/b/bucket/o" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		uploadsLock.Lock()
+		defer uploadsLock.Unlock()
+		uploads[r.URL.Query().Get("name")] = body
+	}))
+	defer server.Close()
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--upload", "gs://bucket/logs",
+	)
+	process.Env = append(os.Environ(), "STORAGE_EMULATOR_HOST="+server.URL)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+
+	for i := 0; i < lines; i++ {
+		sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+	}
+
+	test_input := sb.String()
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for logrotate and upload
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate with upload failed")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without --upload-delete the local archive stays
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".1")); err != nil || string(log_content) != test_input {
+		t.Fatal("Archive Logfile 1 output missmatch")
+	}
+
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+
+	if len(uploads) != 1 {
+		t.Fatalf("Expected exactly one upload, got %d", len(uploads))
+	}
+
+	for name, body := range uploads {
+		if !strings.HasPrefix(name, "logs/"+testLogFileName+".") {
+			t.Fatalf("Unexpected upload name %s", name)
+		}
+		if string(body) != test_input {
+			t.Fatal("Uploaded archive content missmatch")
+		}
+	}
+}
+
+func TestUploadAzureConnectionString(t *testing.T) {
+
+	const testOutputDirectory string = "output_upload_azure"
+	const lines int = 100
+	const subprocessTimeWait int = 100
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend to be Azurite, remember everything that was uploaded
+	var uploadsLock sync.Mutex
+	uploads := make(map[string][]byte)
+	authorization := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil || r.Method != http.MethodPut || r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		uploadsLock.Lock()
+		defer uploadsLock.Unlock()
+		uploads[r.URL.Path] = body
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--upload", "azblob://container/logs",
+		"--azure-connection-string", "AccountName=devstoreaccount1;AccountKey=cm90ZWU=;BlobEndpoint="+server.URL+"/devstoreaccount1",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+
+	for i := 0; i < lines; i++ {
+		sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+	}
+
+	test_input := sb.String()
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for logrotate and upload
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate with upload failed")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+
+	if len(uploads) != 1 {
+		t.Fatalf("Expected exactly one upload, got %d", len(uploads))
+	}
+
+	if !strings.HasPrefix(authorization, "SharedKey devstoreaccount1:") {
+		t.Fatal("Upload was not signed with the account key")
+	}
+
+	for path, body := range uploads {
+		if !strings.HasPrefix(path, "/devstoreaccount1/container/logs/"+testLogFileName+".") {
+			t.Fatalf("Unexpected upload path %s", path)
+		}
+		if string(body) != test_input {
+			t.Fatal("Uploaded archive content missmatch")
+		}
+	}
+}
+
+// Start a minimal SFTP server accepting the returned client key,
+// the returned known hosts line identifies the server.
+func startSFTPServer(t *testing.T) (string, []byte, string) {
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientPublicKey, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPEM, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizedKey, err := ssh.NewPublicKey(clientPublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorizedKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, channels, requests, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(requests)
+				for newChannel := range channels {
+					channel, channelRequests, err := newChannel.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						for request := range channelRequests {
+							request.Reply(request.Type == "subsystem" && string(request.Payload[4:]) == "sftp", nil)
+						}
+					}()
+					if server, err := sftp.NewServer(channel); err == nil {
+						server.Serve()
+					}
+					channel.Close()
+				}
+			}()
+		}
+	}()
+
+	knownHost := "[127.0.0.1]:" + strconv.Itoa(listener.Addr().(*net.TCPAddr).Port) + " " +
+		string(ssh.MarshalAuthorizedKey(hostSigner.PublicKey()))
+	return listener.Addr().String(), pem.EncodeToMemory(clientPEM), knownHost
+}
+
+func TestUploadSFTP(t *testing.T) {
+
+	const testOutputDirectory string = "output_upload_sftp"
+	const remoteDirectory string = "remote"
+	const lines int = 100
+	const subprocessTimeWait int = 200
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	address, clientKey, knownHost := startSFTPServer(t)
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, "id_ed25519"), clientKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, "known_hosts"), []byte(knownHost), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	remotePath, err := filepath.Abs(filepath.Join(testOutputDirectory, remoteDirectory))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-c", "--upload", "sftp://rotee@"+address+remotePath,
+		"--sftp-key", filepath.Join(testOutputDirectory, "id_ed25519"),
+		"--sftp-known-hosts", filepath.Join(testOutputDirectory, "known_hosts"),
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+
+	for i := 0; i < lines; i++ {
+		sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+	}
+
+	test_input := sb.String()
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for logrotate and upload
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate with upload failed")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	uploads, err := filepath.Glob(filepath.Join(remotePath, testLogFileName+".*.gz"))
+	if err != nil || len(uploads) != 1 {
+		t.Fatalf("Expected exactly one upload, got %d", len(uploads))
+	}
+
+	if log_content, err := readGzipFile(uploads[0]); err != nil || log_content != test_input {
+		t.Fatal("Uploaded archive content missmatch")
+	}
+}
+
+func TestSyncArchives(t *testing.T) {
+
+	const testOutputDirectory string = "output_sync_archives"
+	const mirrorDirectory string = "mirror"
+	const manualMirrorDirectory string = "manual_mirror"
+	const iterations int = 3
+	const linesPerIteration int = 100
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep a single local archive, the mirror has to keep all of them
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-c", "-n", "1",
+		"--sync-to", filepath.Join(testOutputDirectory, mirrorDirectory),
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	var expected []string
+
+	for n := 0; n < iterations; n++ {
+
+		for i := n * linesPerIteration; i < (n+1)*linesPerIteration; i++ {
+			sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+		}
+
+		test_input := sb.String()
+		expected = append(expected, test_input)
+		if _, err := io.WriteString(stdin, test_input); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for logrotate
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatal(err)
+		}
+
+		sb.Reset()
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Time based names sort in rotation order
+	mirrored, err := filepath.Glob(filepath.Join(testOutputDirectory, mirrorDirectory, testLogFileName+".*.gz"))
+	if err != nil || len(mirrored) != iterations {
+		t.Fatalf("Expected %d mirrored archives, got %d", iterations, len(mirrored))
+	}
+
+	for i, expected_content := range expected {
+		if log_content, err := readGzipFile(mirrored[i]); err != nil || log_content != expected_content {
+			t.Fatalf("Mirrored archive %s output missmatch", mirrored[i])
+		}
+	}
+
+	// Manual sync only sees the single local archive
+	output, err := exec.Command("./rotee", "sync",
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-d", filepath.Join(testOutputDirectory, manualMirrorDirectory)).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Count(string(output), "\n") != 1 {
+		t.Fatalf("Expected a single synced archive, got %s", string(output))
+	}
+
+	if log_content, err := readGzipFile(strings.TrimSpace(string(output))); err != nil || log_content != expected[iterations-1] {
+		t.Fatal("Manually synced archive output missmatch")
+	}
+
+	// Touching the archive must not copy it again under another name
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(testOutputDirectory, testLogFileName+".1.gz"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	output, err = exec.Command("./rotee", "sync",
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-d", filepath.Join(testOutputDirectory, manualMirrorDirectory)).Output()
+	if err != nil || len(output) != 0 {
+		t.Fatalf("Expected nothing to sync after touching the archive, got %s", string(output))
+	}
+}
+
+func TestSyncSFTP(t *testing.T) {
+
+	const testOutputDirectory string = "output_sync_sftp"
+	const remoteDirectory string = "remote"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.MkdirAll(filepath.Join(testOutputDirectory, ".ssh"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotee sync takes the key and known hosts from the home directory
+	home, err := filepath.Abs(testOutputDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, clientKey, knownHost := startSFTPServer(t)
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "id_ed25519"), clientKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), []byte(knownHost), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		path := filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(i))
+		if err := os.WriteFile(path, []byte("Archive "+strconv.Itoa(i)+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second run finds everything on the remote already
+	for run, expected := range []int{2, 0} {
+		command := exec.Command("./rotee", "sync",
+			"-o", filepath.Join(testOutputDirectory, testLogFileName),
+			"-d", "sftp://rotee@"+address+filepath.Join(home, remoteDirectory))
+		command.Env = append(os.Environ(), "HOME="+home)
+		output, err := command.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Count(string(output), "\n") != expected {
+			t.Fatalf("Expected %d synced archives in run %d, got %s", expected, run+1, string(output))
+		}
+	}
+
+	mirrored, err := filepath.Glob(filepath.Join(home, remoteDirectory, testLogFileName+".*"))
+	if err != nil || len(mirrored) != 2 {
+		t.Fatalf("Expected 2 mirrored archives, got %d", len(mirrored))
+	}
+}
+
+func TestSyncFailureKeepsRotation(t *testing.T) {
+
+	const testOutputDirectory string = "output_sync_failure"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file where the mirror directory should be, like an unmounted share
+	blocker := filepath.Join(testOutputDirectory, "blocker")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee",
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--sync-to", filepath.Join(blocker, "mirror"),
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 0; n < 2; n++ {
+		if _, err := io.WriteString(stdin, "Line "+strconv.Itoa(n)+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatalf("Expected rotation to succeed without the mirror, got %s", string(result))
+		}
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range []string{"Line 1\n", "Line 0\n"} {
+		if content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(i+1))); err != nil || string(content) != expected {
+			t.Fatal("Archive output missmatch")
+		}
+	}
+}
+
+func TestCompactArchives(t *testing.T) {
+
+	const testOutputDirectory string = "output_compact_archives"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two runs of small archives with a large one in between that stays as it is
+	large := strings.Repeat("Large archive\n", 100)
+	for i := 1; i <= 6; i++ {
+		path := filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(i))
+		if i == 4 {
+			if err := os.WriteFile(path, []byte(large), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		writer.Write([]byte("Archive " + strconv.Itoa(i) + "\n"))
+		writer.Close()
+		if err := os.WriteFile(path+".gz", compressed.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	output, err := exec.Command("./rotee", "compact",
+		"-o", filepath.Join(testOutputDirectory, testLogFileName), "--min-size", "1kb").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(output), "\n") != 2 {
+		t.Fatalf("Expected two merged archives, got %s", string(output))
+	}
+
+	// Oldest lines first within each archive, archives numbered without holes
+	if log_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+".1.gz")); err != nil ||
+		log_content != "Archive 3\nArchive 2\nArchive 1\n" {
+		t.Fatal("First merged archive output missmatch")
+	}
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".2")); err != nil ||
+		string(log_content) != large {
+		t.Fatal("Large archive output missmatch")
+	}
+	if log_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+".3.gz")); err != nil ||
+		log_content != "Archive 6\nArchive 5\n" {
+		t.Fatal("Second merged archive output missmatch")
+	}
+
+	if strings.Fields(string(output))[1] != filepath.Join(testOutputDirectory, testLogFileName+".3.gz") {
+		t.Fatalf("Expected the merged archives under their final names, got %s", string(output))
+	}
+
+	archives, err := filepath.Glob(filepath.Join(testOutputDirectory, testLogFileName+".[0-9]*"))
+	if err != nil || len(archives) != 3 {
+		t.Fatalf("Expected 3 archives, got %v", archives)
+	}
+}
+
+func TestLocalRetentionAfterUpload(t *testing.T) {
+
+	const testOutputDirectory string = "output_local_retention_after_upload"
+	const iterations int = 4
+	const firstFailingIteration int = 1
+	const linesPerIteration int = 100
+	const subprocessTimeWait int = 100
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend to be a MinIO server that goes down after the first rotation
+	var failUploads sync.Mutex
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failUploads.Lock()
+		defer failUploads.Unlock()
+		if _, err := io.ReadAll(r.Body); err != nil || failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001",
+		"--upload", "s3://bucket/logs", "--upload-retries", "0", "--local-max-files", "1",
+		"--s3-endpoint", server.URL, "--s3-path-style",
+		"--s3-access-key", "rotee", "--s3-secret-key", "secret",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+	var expected []string
+
+	for n := 0; n < iterations; n++ {
+
+		for i := n * linesPerIteration; i < (n+1)*linesPerIteration; i++ {
+			sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+		}
+
+		test_input := sb.String()
+		expected = append(expected, test_input)
+		if _, err := io.WriteString(stdin, test_input); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		failUploads.Lock()
+		failing = n >= firstFailingIteration
+		failUploads.Unlock()
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for logrotate and upload
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		// Failed uploads are queued, the rotation itself is fine
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatal(err)
+		}
+
+		sb.Reset()
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Archives that failed to upload are kept, the uploaded one is gone
+	for n := firstFailingIteration; n < iterations; n++ {
+		if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations-n))); err != nil || string(log_content) != expected[n] {
+			t.Fatalf("Archive Logfile %d that failed to upload should be kept", iterations-n)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations))); err == nil {
+		t.Fatalf("Uploaded archive %d should be deleted", iterations)
+	}
+}
+
+func TestRetentionKeepsPendingUploads(t *testing.T) {
+
+	const testOutputDirectory string = "output_retention_pending_uploads"
+	const iterations int = 4
+	const firstFailingIteration int = 1
+	const subprocessTimeWait int = 100
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend to be a MinIO server that goes down after the first rotation
+	var failUploads sync.Mutex
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failUploads.Lock()
+		defer failUploads.Unlock()
+		if _, err := io.ReadAll(r.Body); err != nil || failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-n", "1",
+		"--upload", "s3://bucket/logs", "--upload-retries", "0",
+		"--s3-endpoint", server.URL, "--s3-path-style",
+		"--s3-access-key", "rotee", "--s3-secret-key", "secret",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 0; n < iterations; n++ {
+
+		if _, err := io.WriteString(stdin, "Rotation "+strconv.Itoa(n)+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		failUploads.Lock()
+		failing = n >= firstFailingIteration
+		failUploads.Unlock()
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatal(err)
+		}
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// -n 1 deletes only the archive that made it to the remote
+	for n := firstFailingIteration; n < iterations; n++ {
+		if content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations-n))); err != nil || string(content) != "Rotation "+strconv.Itoa(n)+"\n" {
+			t.Fatalf("Archive %d that failed to upload should be kept", iterations-n)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations))); err == nil {
+		t.Fatalf("Uploaded archive %d should be deleted", iterations)
+	}
+}
+
+func TestUploadDoesNotBlockRotation(t *testing.T) {
+
+	const testOutputDirectory string = "output_upload_does_not_block_rotation"
+	const iterations int = 3
+	const subprocessTimeWait int = 100
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// A remote that accepts the connection and then hangs
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--upload", "s3://bucket/logs", "--upload-retries", "0",
+		"--s3-endpoint", server.URL, "--s3-path-style",
+		"--s3-access-key", "rotee", "--s3-secret-key", "secret",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer process.Process.Kill()
+
+	for n := 0; n < iterations; n++ {
+
+		if _, err := io.WriteString(stdin, "Rotation "+strconv.Itoa(n)+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		// The upload of the first archive still hangs, rotations go on regardless
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+			t.Fatalf("Rotation %d waited for the upload", n)
+		}
+	}
+
+	for n := 0; n < iterations; n++ {
+		if content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(iterations-n))); err != nil || string(content) != "Rotation "+strconv.Itoa(n)+"\n" {
+			t.Fatalf("Archive %d output missmatch", iterations-n)
+		}
+	}
+}
+
+func TestUploadQueueSurvivesRestart(t *testing.T) {
+
+	const testOutputDirectory string = "output_upload_queue"
+	const lines int = 100
+	const subprocessTimeWait int = 100
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend to be a MinIO server that is down at first
+	var uploadsLock sync.Mutex
+	uploads := make(map[string][]byte)
+	failing := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		uploadsLock.Lock()
+		defer uploadsLock.Unlock()
+		if err != nil || failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		uploads[r.URL.Path] = body
+	}))
+	defer server.Close()
+
+	startRotee := func() (*exec.Cmd, io.WriteCloser) {
+		process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+			"-o", filepath.Join(testOutputDirectory, testLogFileName),
+			"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+			"-f", "0.001", "--upload", "s3://bucket/logs", "--upload-retries", "0",
+			"--s3-endpoint", server.URL, "--s3-path-style",
+			"--s3-access-key", "rotee", "--s3-secret-key", "secret",
+		)
+		stdin, err := process.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = process.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return process, stdin
+	}
+
+	process, stdin := startRotee()
+
+	var sb strings.Builder
+
+	for i := 0; i < lines; i++ {
+		sb.WriteString(strconv.Itoa(i) + ": Text and stuff\n")
+	}
+
+	test_input := sb.String()
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for logrotate and the failing upload
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	uploadsLock.Lock()
+	if len(uploads) != 0 {
+		t.Fatal("Nothing should be uploaded while the server is down")
+	}
+	failing = false
+	uploadsLock.Unlock()
+
+	// The queued upload has to happen after a restart
+	process, stdin = startRotee()
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+
+	if len(uploads) != 1 {
+		t.Fatalf("Expected exactly one upload, got %d", len(uploads))
+	}
+
+	for _, body := range uploads {
+		if string(body) != test_input {
+			t.Fatal("Uploaded archive content missmatch")
+		}
+	}
+}
+
+func TestOnErrorScriptAndWebhook(t *testing.T) {
+
+	const testOutputDirectory string = "output_on_error"
+	const subprocessTimeWait int = 100
+	const errorScriptOutputFile = "error_script_output"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	var eventsLock sync.Mutex
+	events := make([]map[string]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := make(map[string]string)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Error(err)
+		}
+		eventsLock.Lock()
+		defer eventsLock.Unlock()
+		events = append(events, event)
+	}))
+	defer server.Close()
+
+	// The failing pre script makes the rotation fail
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-s", "exit 1",
+		"--on-error-script", "echo $ROTEE_STAGE > "+filepath.Join(testOutputDirectory, errorScriptOutputFile),
+		"--on-error-webhook", server.URL,
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for log lines to be processed
+	// Being slower than this might indicate a problem...
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for logrotate and notifications
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "2" {
+		t.Fatal("Rotate should have failed")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if script_output, err := os.ReadFile(filepath.Join(testOutputDirectory, errorScriptOutputFile)); err != nil || string(script_output) != "rotate\n" {
+		t.Fatal("Error script output wrong")
+	}
+
+	eventsLock.Lock()
+	defer eventsLock.Unlock()
+
+	if len(events) != 1 || events[0]["stage"] != "rotate" || events[0]["error"] == "" ||
+		events[0]["output_file"] != filepath.Join(testOutputDirectory, testLogFileName) {
+		t.Fatalf("Unexpected webhook events %v", events)
+	}
+}
+
+func TestNotifySlack(t *testing.T) {
+
+	const testOutputDirectory string = "output_notify_slack"
+	const subprocessTimeWait int = 100
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	var messagesLock sync.Mutex
+	messages := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		message := make(map[string]string)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if err := json.Unmarshal(body, &message); err != nil {
+			t.Error(err)
+		}
+		messagesLock.Lock()
+		defer messagesLock.Unlock()
+		messages = append(messages, message["text"])
+	}))
+	defer server.Close()
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-n", "1",
+		"--notify-slack", server.URL,
+		"--notify-events", "rotation,prune",
+		"--notify-template", "{{.Event}} {{.Archive}} {{.Size}} {{len .Pruned}}",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate twice, the second rotation prunes the first archive
+	for i := 0; i < 2; i++ {
+		if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for logrotate and notifications
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	messagesLock.Lock()
+	defer messagesLock.Unlock()
+
+	archive := filepath.Join(testOutputDirectory, testLogFileName) + ".1"
+	expected := []string{"rotation " + archive + " 15 0", "rotation " + archive + " 15 0", "prune  0 1"}
+	if len(messages) != len(expected) {
+		t.Fatalf("Unexpected chat messages %v", messages)
+	}
+	for i := range expected {
+		if messages[i] != expected[i] {
+			t.Fatalf("Unexpected chat messages %v", messages)
+		}
+	}
+}
+
+// Start a minimal SMTP server, every received mail is sent to the returned channel
+func startSMTPServer(t *testing.T) (string, chan string) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	mails := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				io.WriteString(conn, "220 localhost ESMTP\r\n")
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch command := strings.ToUpper(strings.TrimSpace(line)); {
+					case command == "DATA":
+						io.WriteString(conn, "354 Go ahead\r\n")
+						var mail strings.Builder
+						for {
+							line, err := reader.ReadString('\n')
+							if err != nil || line == ".\r\n" {
+								break
+							}
+							mail.WriteString(line)
+						}
+						mails <- mail.String()
+						io.WriteString(conn, "250 OK\r\n")
+					case command == "QUIT":
+						io.WriteString(conn, "221 Bye\r\n")
+						return
+					default:
+						io.WriteString(conn, "250 OK\r\n")
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), mails
+}
+
+func TestAlertEmailAfterRepeatedFailures(t *testing.T) {
+
+	const testOutputDirectory string = "output_alert_email"
+	const alertAfter int = 2
+	const subprocessTimeWait int = 100
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	address, mails := startSMTPServer(t)
+
+	// The failing pre script makes every rotation fail
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-s", "exit 1",
+		"--alert-email", "ops@example.com", "--alert-after", strconv.Itoa(alertAfter),
+		"--smtp-server", address, "--smtp-from", "rotee@example.com",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 0; n < alertAfter+1; n++ {
+
+		if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for log lines to be processed
+		// Being slower than this might indicate a problem...
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		// Wait for logrotate and notifications
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+		if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "2" {
+			t.Fatal("Rotate should have failed")
+		}
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Exactly one mail once the threshold was reached
+	if len(mails) != 1 {
+		t.Fatalf("Expected exactly one alert mail, got %d", len(mails))
+	}
+
+	mail := <-mails
+	if !strings.Contains(mail, "To: ops@example.com") || !strings.Contains(mail, "Failed rotations in a row: "+strconv.Itoa(alertAfter)) {
+		t.Fatalf("Unexpected alert mail %s", mail)
+	}
+}
+
+func TestHTTPListen(t *testing.T) {
+
+	const testOutputDirectory string = "output_http_listen"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Find a free port for rotee to listen on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-c", "--http-listen", address,
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	const test_input string = "Text and stuff\nMore text\n"
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	const test_input_current string = "Current text\n"
+	if _, err := io.WriteString(stdin, test_input_current); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	get := func(path string, header http.Header) (*http.Response, string) {
+		request, err := http.NewRequest("GET", "http://"+address+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key := range header {
+			request.Header.Set(key, header.Get(key))
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response, string(body)
+	}
+
+	if response, body := get("/current", nil); response.StatusCode != http.StatusOK || body != test_input_current {
+		t.Fatal("Current file missmatch")
+	}
+	if response, body := get("/current", http.Header{"Range": {"bytes=0-6"}}); response.StatusCode != http.StatusPartialContent ||
+		body != "Current" {
+		t.Fatal("Current file range missmatch")
+	}
+
+	archives := make([]map[string]any, 0)
+	if response, body := get("/archives", nil); response.StatusCode != http.StatusOK {
+		t.Fatal("Archive list missmatch")
+	} else if err := json.Unmarshal([]byte(body), &archives); err != nil {
+		t.Fatal(err)
+	}
+	if len(archives) != 1 || archives[0]["name"] != testLogFileName+".1.gz" {
+		t.Fatal("Archive list missmatch")
+	}
+
+	if response, body := get("/archives/"+testLogFileName+".1.gz", http.Header{"Range": {"bytes=0-1"}}); response.StatusCode != http.StatusPartialContent ||
+		body != "\x1f\x8b" {
+		t.Fatal("Archive range missmatch")
+	}
+	if response, body := get("/archives/"+testLogFileName+".1.gz?decompress=true", nil); response.StatusCode != http.StatusOK ||
+		body != test_input {
+		t.Fatal("Decompressed archive missmatch")
+	}
+
+	// Nothing but the archives can be downloaded
+	if response, _ := get("/archives/"+testDebugFileName, nil); response.StatusCode != http.StatusNotFound {
+		t.Fatal("Unknown archive should not be found")
+	}
+	if response, _ := get("/archives/..%2F"+testLogFileName, nil); response.StatusCode != http.StatusNotFound {
+		t.Fatal("Unknown archive should not be found")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGRPCControl(t *testing.T) {
+
+	const testOutputDirectory string = "output_grpc_control"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Find a free port for rotee to listen on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-f", "0.001", "-d", "1", "--grpc-listen", address,
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	const test_input string = "Text and stuff\nMore text\n"
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	connection, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	state := &structpb.Struct{}
+	if err := connection.Invoke(ctx, "/rotee.Control/Status", &emptypb.Empty{}, state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Fields["size"].GetNumberValue() != float64(len(test_input)) || state.Fields["archives"].GetNumberValue() != 0 {
+		t.Fatal("Status missmatch")
+	}
+
+	// Follow the output file across a rotation
+	stream, err := connection.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, "/rotee.Control/Tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.SendMsg(&emptypb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	const test_input_tail string = "Tailed text\n"
+	if _, err := io.WriteString(stdin, test_input_tail); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := connection.Invoke(ctx, "/rotee.Control/Flush", &emptypb.Empty{}, &emptypb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	rotationID := &wrapperspb.StringValue{}
+	if err := connection.Invoke(ctx, "/rotee.Control/Rotate", &emptypb.Empty{}, rotationID); err != nil {
+		t.Fatal(err)
+	}
+	if rotationID.Value == "" {
+		t.Fatal("Rotation id missmatch")
+	}
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".1")); err != nil ||
+		string(result) != test_input+test_input_tail {
+		t.Fatal("Archive content missmatch")
+	}
+
+	const test_input_rotated string = "Text after rotation\n"
+	if _, err := io.WriteString(stdin, test_input_rotated); err != nil {
+		t.Fatal(err)
+	}
+
+	tailed := ""
+	for tailed != test_input_tail+test_input_rotated {
+		chunk := &wrapperspb.BytesValue{}
+		if err := stream.RecvMsg(chunk); err != nil {
+			t.Fatal(err)
+		}
+		tailed += string(chunk.Value)
+		if len(tailed) > len(test_input_tail+test_input_rotated) {
+			t.Fatal("Tail missmatch")
+		}
+	}
+
+	// Only the archive that is too old goes
+	old := time.Now().Add(-72 * time.Hour)
+	if err := os.Chtimes(filepath.Join(testOutputDirectory, testLogFileName+".1"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	pruned := &structpb.ListValue{}
+	if err := connection.Invoke(ctx, "/rotee.Control/Prune", &emptypb.Empty{}, pruned); err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned.Values) != 1 || pruned.Values[0].GetStringValue() != filepath.Join(testOutputDirectory, testLogFileName+".1") {
+		t.Fatal("Pruned archives missmatch")
+	}
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".1")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Old archive should have been deleted")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCoalesceRotations(t *testing.T) {
+
+	const testOutputDirectory string = "output_coalesce_rotations"
+	const preScriptOutputFile string = "pre_script.txt"
+	const subprocessTimeWait int = 100
+	const queuedRequests int = 5
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Find a free port for rotee to listen on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	// The pre script keeps the first rotation busy while the other requests come in
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName), "-f", "0.001", "--grpc-listen", address,
+		"-s", "echo $0 >> "+filepath.Join(testOutputDirectory, preScriptOutputFile)+"; sleep 1",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	const test_input string = "Text and stuff\nMore text\n"
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	connection, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	rotate := func(wg *sync.WaitGroup, errs chan error) {
+		defer wg.Done()
+		errs <- connection.Invoke(ctx, "/rotee.Control/Rotate", &emptypb.Empty{}, &wrapperspb.StringValue{})
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, queuedRequests+1)
+	wg.Add(1)
+	go rotate(&wg, errs)
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait*3))
+	for range queuedRequests {
+		wg.Add(1)
+		go rotate(&wg, errs)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first request rotates on its own, all others share the next rotation
+	if output, err := os.ReadFile(filepath.Join(testOutputDirectory, preScriptOutputFile)); err != nil ||
+		strings.Count(string(output), "\n") != 2 {
+		t.Fatal("Number of rotations missmatch")
+	}
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".3")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Coalesced requests should not rotate again")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	debug_log, err := os.ReadFile(filepath.Join(testOutputDirectory, testDebugFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(debug_log), "Coalesced into rotation") != queuedRequests-1 ||
+		!strings.Contains(string(debug_log), fmt.Sprintf("Rotating for %d requests, 0 waiting", queuedRequests)) {
+		t.Fatal("Activity log missmatch")
+	}
+}
+
+func TestMQTTEvents(t *testing.T) {
+
+	const testOutputDirectory string = "output_mqtt_events"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Just enough of a broker to accept a client and its messages
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	published := make(chan *packets.PublishPacket, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					packet, err := packets.ReadPacket(conn)
+					if err != nil {
+						return
+					}
+					switch packet := packet.(type) {
+					case *packets.ConnectPacket:
+						packets.NewControlPacket(packets.Connack).Write(conn)
+					case *packets.PingreqPacket:
+						packets.NewControlPacket(packets.Pingresp).Write(conn)
+					case *packets.PublishPacket:
+						published <- packet
+						acknowledge := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+						acknowledge.MessageID = packet.MessageID
+						acknowledge.Write(conn)
+					case *packets.DisconnectPacket:
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "--mqtt", "tcp://"+listener.Addr().String()+"/fleet/rotee",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	const test_input string = "Text and stuff\nMore text\n"
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case packet := <-published:
+		event := make(map[string]any)
+		if err := json.Unmarshal(packet.Payload, &event); err != nil {
+			t.Fatal(err)
+		}
+		if packet.TopicName != "fleet/rotee" || event["event"] != "rotation" ||
+			event["archive"] != filepath.Join(testOutputDirectory, testLogFileName+".1") ||
+			event["size"] != float64(len(test_input)) {
+			t.Fatal("MQTT message missmatch")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No MQTT message for the rotation")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKafkaSink(t *testing.T) {
+
+	const testOutputDirectory string = "output_kafka_sink"
+	const testTopic string = "lines"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Just enough of a single node cluster with one partition to take produced records
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	port, _ := strconv.Atoi(strings.Split(listener.Addr().String(), ":")[1])
+
+	var receivedLock sync.Mutex
+	received := make([]string, 0)
+	respond := func(request kmsg.Request) kmsg.Response {
+		switch request := request.(type) {
+		case *kmsg.ApiVersionsRequest:
+			response := request.ResponseKind().(*kmsg.ApiVersionsResponse)
+			response.ApiKeys = []kmsg.ApiVersionsResponseApiKey{
+				{ApiKey: 0, MinVersion: 3, MaxVersion: 8},
+				{ApiKey: 3, MinVersion: 0, MaxVersion: 8},
+				{ApiKey: 18, MinVersion: 0, MaxVersion: 3},
+			}
+			return response
+		case *kmsg.MetadataRequest:
+			response := request.ResponseKind().(*kmsg.MetadataResponse)
+			response.Brokers = []kmsg.MetadataResponseBroker{{NodeID: 0, Host: "127.0.0.1", Port: int32(port)}}
+			topic := kmsg.NewMetadataResponseTopic()
+			topic.Topic = kmsg.StringPtr(testTopic)
+			topic.Partitions = []kmsg.MetadataResponseTopicPartition{{Partition: 0, Leader: 0, Replicas: []int32{0}, ISR: []int32{0}}}
+			response.Topics = []kmsg.MetadataResponseTopic{topic}
+			return response
+		case *kmsg.ProduceRequest:
+			response := request.ResponseKind().(*kmsg.ProduceResponse)
+			for _, topic := range request.Topics {
+				responseTopic := kmsg.ProduceResponseTopic{Topic: topic.Topic}
+				for _, partition := range topic.Partitions {
+					var batch kmsg.RecordBatch
+					if err := batch.ReadFrom(partition.Records); err != nil {
+						t.Error(err)
+					}
+					records := batch.Records
+					if batch.Attributes&0x07 == 2 {
+						if records, err = s2.Decode(nil, records); err != nil {
+							t.Error(err)
+						}
+					}
+					for i := int32(0); i < batch.NumRecords; i++ {
+						length, n := binary.Varint(records)
+						var record kmsg.Record
+						if err := record.ReadFrom(records[:n+int(length)]); err != nil {
+							t.Error(err)
+						}
+						records = records[n+int(length):]
+						receivedLock.Lock()
+						received = append(received, string(record.Value))
+						receivedLock.Unlock()
+					}
+					responseTopic.Partitions = append(responseTopic.Partitions, kmsg.ProduceResponseTopicPartition{Partition: partition.Partition})
+				}
+				response.Topics = append(response.Topics, responseTopic)
+			}
+			return response
+		}
+		return nil
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					var size int32
+					if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+						return
+					}
+					message := make([]byte, size)
+					if _, err := io.ReadFull(conn, message); err != nil {
+						return
+					}
+
+					// Header: key, version, correlation id, client id and tags if flexible
+					request := kmsg.RequestForKey(int16(binary.BigEndian.Uint16(message)))
+					request.SetVersion(int16(binary.BigEndian.Uint16(message[2:])))
+					correlationID := message[4:8]
+					body := message[10+int(int16(binary.BigEndian.Uint16(message[8:]))):]
+					if request.IsFlexible() {
+						body = body[1:]
+					}
+					if err := request.ReadFrom(body); err != nil {
+						t.Error(err)
+						return
+					}
+
+					response := respond(request)
+					if response == nil {
+						t.Errorf("Unexpected Kafka request %d", request.Key())
+						return
+					}
+					reply := append([]byte(nil), correlationID...)
+					if request.IsFlexible() && request.Key() != 18 {
+						reply = append(reply, 0)
+					}
+					reply = response.AppendTo(reply)
+					if err := binary.Write(conn, binary.BigEndian, int32(len(reply))); err != nil {
+						return
+					}
+					if _, err := conn.Write(reply); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--kafka-brokers", listener.Addr().String(), "--kafka-topic", testTopic,
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	const test_input string = "Text and stuff\nMore text\n\nLast line\n"
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything is sent before rotee exits
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(result) != test_input {
+		t.Fatal("Output file content missmatch")
+	}
+	receivedLock.Lock()
+	defer receivedLock.Unlock()
+	if strings.Join(received, "|") != "Text and stuff|More text||Last line" {
+		t.Fatal("Kafka message missmatch")
+	}
+}
+
+func TestFluentForward(t *testing.T) {
+
+	const testOutputDirectory string = "output_fluent_forward"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Collect every forward mode message sent to us
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	messages := make(chan []any, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		decoder := msgpack.NewDecoder(conn)
+		for {
+			var message []any
+			if err := decoder.Decode(&message); err != nil {
+				close(messages)
+				return
+			}
+			messages <- message
+		}
+	}()
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--fluent-forward", listener.Addr().String(), "--fluent-tag", "app.logs",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	const test_input string = "Text and stuff\nMore text\n"
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make([]string, 0)
+	for message := range messages {
+		if len(message) != 2 || message[0] != "app.logs" {
+			t.Fatal("Fluent message missmatch")
+		}
+		for _, entry := range message[1].([]any) {
+			entry := entry.([]any)
+			eventTime, ok := entry[0].(*fluentEventTime)
+			if !ok || time.Time(*eventTime).Before(start.Truncate(time.Second)) {
+				t.Fatal("Fluent event time missmatch")
+			}
+			received = append(received, entry[1].(map[string]any)["message"].(string))
+		}
+	}
+	if strings.Join(received, "|") != "Text and stuff|More text" {
+		t.Fatal("Fluent record missmatch")
+	}
+}
+
+func TestLokiPush(t *testing.T) {
+
+	const testOutputDirectory string = "output_loki_push"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Loki is unwell on the first push, rotee has to try again
+	var pushesLock sync.Mutex
+	pushes := make([]lokiPushRequest, 0)
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushesLock.Lock()
+		defer pushesLock.Unlock()
+		if r.URL.Path != "/loki/api/v1/push" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if attempts++; attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var push lokiPushRequest
+		if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		pushes = append(pushes, push)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--loki-url", server.URL, "--loki-labels", "job=app, env=test",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	const test_input string = "Text and stuff\nMore text\n"
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	pushesLock.Lock()
+	defer pushesLock.Unlock()
+	if attempts != 2 || len(pushes) != 1 || len(pushes[0].Streams) != 1 {
+		t.Fatal("Loki push missmatch")
+	}
+	stream := pushes[0].Streams[0]
+	if len(stream.Stream) != 2 || stream.Stream["job"] != "app" || stream.Stream["env"] != "test" {
+		t.Fatal("Loki labels missmatch")
+	}
+	if len(stream.Values) != 2 || stream.Values[0][1] != "Text and stuff" || stream.Values[1][1] != "More text" ||
+		stream.Values[0][0] >= stream.Values[1][0] {
+		t.Fatal("Loki values missmatch")
+	}
+}
+
+func TestElasticsearchBulk(t *testing.T) {
+
+	const testOutputDirectory string = "output_elasticsearch_bulk"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Accept everything but documents with a bad line, like a mapping conflict would
+	var indexedLock sync.Mutex
+	indexed := make([]string, 0)
+	indices := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		indexedLock.Lock()
+		defer indexedLock.Unlock()
+		if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		items := make([]any, 0)
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil || !scanner.Scan() {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var document map[string]string
+			if err := json.Unmarshal(scanner.Bytes(), &document); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			indices[action["index"]["_index"]] = true
+			if document["message"] == "Bad line" {
+				items = append(items, map[string]any{"index": map[string]any{"status": 400,
+					"error": map[string]string{"type": "mapper_parsing_exception", "reason": "failed to parse"}}})
+				continue
+			}
+			indexed = append(indexed, document["message"])
+			items = append(items, map[string]any{"index": map[string]any{"status": 201}})
+		}
+		json.NewEncoder(w).Encode(map[string]any{"errors": len(items) != len(indexed), "items": items})
+	}))
+	defer server.Close()
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--elasticsearch-url", server.URL, "--elasticsearch-index", "app-%Y",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	const test_input string = "Text and stuff\nBad line\nMore text\n"
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	indexedLock.Lock()
+	defer indexedLock.Unlock()
+	if strings.Join(indexed, "|") != "Text and stuff|More text" {
+		t.Fatal("Indexed documents missmatch")
+	}
+	if len(indices) != 1 || !indices["app-"+time.Now().UTC().Format("2006")] {
+		t.Fatal("Index name missmatch")
+	}
+	if debug, err := os.ReadFile(filepath.Join(testOutputDirectory, testDebugFileName)); err != nil ||
+		!strings.Contains(string(debug), "Failed to send the last 1 lines to Elasticsearch") {
+		t.Fatal("Rejected document should be logged")
+	}
+}
+
+// Remembers every export request, like a collector would take them
+type testLogsCollector struct {
+	collogs.UnimplementedLogsServiceServer
+	lock     sync.Mutex
+	requests []*collogs.ExportLogsServiceRequest
+}
+
+func (collector *testLogsCollector) Export(ctx context.Context, request *collogs.ExportLogsServiceRequest) (*collogs.ExportLogsServiceResponse, error) {
+	collector.lock.Lock()
+	defer collector.lock.Unlock()
+	collector.requests = append(collector.requests, request)
+	return &collogs.ExportLogsServiceResponse{}, nil
+}
+
+func TestOTLPExport(t *testing.T) {
+
+	const testOutputDirectory string = "output_otlp_export"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	collector := &testLogsCollector{}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	collogs.RegisterLogsServiceServer(server, collector)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	httpCollector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request := &collogs.ExportLogsServiceRequest{}
+		if r.URL.Path != "/v1/logs" || r.Header.Get("Content-Type") != "application/x-protobuf" || proto.Unmarshal(body, request) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		collector.Export(r.Context(), request)
+		response, _ := proto.Marshal(&collogs.ExportLogsServiceResponse{})
+		w.Write(response)
+	}))
+	defer httpCollector.Close()
+
+	for protocol, endpoint := range map[string]string{
+		"grpc":          "http://" + listener.Addr().String(),
+		"http/protobuf": httpCollector.URL,
+	} {
+		collector.requests = nil
+		if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+			t.Fatal(err)
+		}
+
+		process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+			"-o", filepath.Join(testOutputDirectory, testLogFileName),
+			"--otlp-endpoint", endpoint, "--otlp-protocol", protocol,
+			"--otlp-resource", "service.name=app,host.name=test-host",
+		)
+		stdin, err := process.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = process.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		const test_input string = "Text and stuff\nMore text\n"
+		if _, err := io.WriteString(stdin, test_input); err != nil {
+			t.Fatal(err)
+		}
+		if err := stdin.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := process.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		collector.lock.Lock()
+		lines := make([]string, 0)
+		for _, request := range collector.requests {
+			for _, resourceLogs := range request.ResourceLogs {
+				attributes := make(map[string]string)
+				for _, attribute := range resourceLogs.Resource.Attributes {
+					attributes[attribute.Key] = attribute.Value.GetStringValue()
+				}
+				if len(attributes) != 2 || attributes["service.name"] != "app" || attributes["host.name"] != "test-host" {
+					t.Fatal("Resource attributes missmatch for " + protocol)
+				}
+				for _, scopeLogs := range resourceLogs.ScopeLogs {
+					for _, record := range scopeLogs.LogRecords {
+						if record.TimeUnixNano == 0 {
+							t.Fatal("Log record time missmatch for " + protocol)
+						}
+						lines = append(lines, record.Body.GetStringValue())
+					}
+				}
+			}
+		}
+		collector.lock.Unlock()
+		if strings.Join(lines, "|") != "Text and stuff|More text" {
+			t.Fatal("Log records missmatch for " + protocol)
+		}
+
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSyslogFormat(t *testing.T) {
+
+	const testOutputDirectory string = "output_syslog_format"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName), "-x",
+		"--format", "rfc5424", "--syslog-facility", "local0", "--syslog-severity", "info", "--syslog-app-name", "test app")
+	process.Stdin = strings.NewReader("First line\nSecond line\n")
+	output, err := process.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "First line\nSecond line\n" {
+		t.Fatal("Stdout output missmatch")
+	}
+
+	hostname, _ := os.Hostname()
+	header := regexp.MustCompile(`^<134>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}(Z|[+-]\d\d:\d\d) ` +
+		regexp.QuoteMeta(hostname) + ` testapp \d+ - - (.*)$`)
+	content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Logfile output missmatch")
+	}
+	for i, expected := range []string{"First line", "Second line"} {
+		if match := header.FindStringSubmatch(lines[i]); match == nil || match[2] != expected {
+			t.Fatal("Logfile output missmatch")
+		}
+	}
+
+	// Unknown names are refused
+	if err := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--format", "rfc5424", "--syslog-facility", "local9").Run(); err == nil {
+		t.Fatal("Expected an error for an unknown facility")
+	}
+}
+
+func TestGELF(t *testing.T) {
+
+	const testOutputDirectory string = "output_gelf"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// The long line does not fit into one datagram and has to be chunked
+	longLine := strings.Repeat("Long text ", 50)
+	test_input := "Text and stuff\n" + longLine + "\n"
+
+	for _, network := range []string{"udp", "tcp"} {
+
+		// Collect the JSON of every message sent to us, chunks are put back together
+		messages := make(chan []byte, 10)
+		var address string
+		if network == "udp" {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			address = conn.LocalAddr().String()
+			go func() {
+				chunks := make(map[byte][]byte)
+				buffer := make([]byte, 65536)
+				for {
+					n, _, err := conn.ReadFrom(buffer)
+					if err != nil {
+						return
+					}
+					datagram := buffer[:n]
+					if datagram[0] != 0x1e || datagram[1] != 0x0f {
+						messages <- append([]byte(nil), datagram...)
+						continue
+					}
+					if n > 100 {
+						messages <- []byte("chunk too big")
+					}
+					chunks[datagram[10]] = append([]byte(nil), datagram[12:]...)
+					if len(chunks) == int(datagram[11]) {
+						message := make([]byte, 0)
+						for i := 0; i < len(chunks); i++ {
+							message = append(message, chunks[byte(i)]...)
+						}
+						messages <- message
+						chunks = make(map[byte][]byte)
+					}
+				}
+			}()
+		} else {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			address = listener.Addr().String()
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					message, err := reader.ReadBytes(0)
+					if err != nil {
+						return
+					}
+					messages <- message[:len(message)-1]
+				}
+			}()
+		}
+
+		process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+			"--gelf", network+"://"+address, "--gelf-chunk-size", "100")
+		process.Stdin = strings.NewReader(test_input)
+		if err := process.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		hostname, _ := os.Hostname()
+		for _, expected := range []string{"Text and stuff", longLine} {
+			var message map[string]any
+			select {
+			case data := <-messages:
+				if err := json.Unmarshal(data, &message); err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("No GELF message received")
+			}
+			if message["version"] != "1.1" || message["short_message"] != expected || message["host"] != hostname ||
+				message["_log_file"] != filepath.Join(testOutputDirectory, testLogFileName) {
+				t.Fatal("GELF message missmatch")
+			}
+		}
+	}
+}
+
+func TestBufferingMode(t *testing.T) {
+
+	const testOutputDirectory string = "output_buffering_mode"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	const test_input string = "Text and stuff\nMore text\n"
+	for _, mode := range []string{"line", "block", "none"} {
+
+		logFile := filepath.Join(testOutputDirectory, mode+".log")
+		process := exec.Command("./rotee", "-o", logFile, "--buffering", mode, "--flush-interval", "1")
+		stdin, err := process.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = process.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(stdin, test_input); err != nil {
+			t.Fatal(err)
+		}
+
+		// Block buffering holds the lines back until the flush interval passed
+		time.Sleep(300 * time.Millisecond)
+		content, _ := os.ReadFile(logFile)
+		if (mode == "block" && len(content) != 0) || (mode != "block" && string(content) != test_input) {
+			t.Fatal("Logfile output missmatch before flush")
+		}
+		time.Sleep(time.Second)
+		if content, err := os.ReadFile(logFile); err != nil || string(content) != test_input {
+			t.Fatal("Logfile output missmatch after flush")
+		}
+
+		if err := stdin.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := process.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Everything held back is written at the end
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName), "-x",
+		"--buffering", "block", "--flush-interval", "60")
+	process.Stdin = strings.NewReader(test_input)
+	if err := process.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil || string(content) != test_input {
+		t.Fatal("Logfile output missmatch at exit")
+	}
+}
+
+func TestCompressionSavings(t *testing.T) {
+
+	const testOutputDirectory string = "output_compression_savings"
+	const subprocessTimeWait int = 50
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-c",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	test_input := strings.Repeat("Text and stuff\n", 1000)
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate should have worked")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".1.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := make([]map[string]any, 0)
+	if content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".manifest")); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(content, &records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0]["original_size"] != float64(len(test_input)) ||
+		records[0]["compressed_size"] != float64(stat.Size()) {
+		t.Fatalf("Manifest compression sizes missmatch %v", records)
+	}
+
+	expected := fmt.Sprintf("Compressed %d bytes to %d bytes, ratio %.2f, saved %.1f%%", len(test_input), stat.Size(),
+		float64(len(test_input))/float64(stat.Size()), 100-float64(stat.Size())*100/float64(len(test_input)))
+	if debug_log, err := os.ReadFile(filepath.Join(testOutputDirectory, testDebugFileName)); err != nil ||
+		!strings.Contains(string(debug_log), expected) {
+		t.Fatal("Activity log is missing the compression savings")
+	}
+}
+
+func TestRotationWarnThreshold(t *testing.T) {
+
+	const testOutputDirectory string = "output_rotation_warn_threshold"
+	const subprocessTimeWait int = 500
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pre script makes the rotation slow
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.001", "-s", "sleep 0.2", "--rotation-warn-threshold", "100ms",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testTriggerFileName)); err != nil || string(result) != "0" {
+		t.Fatal("Rotate should have worked")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	debug_log, err := os.ReadFile(filepath.Join(testOutputDirectory, testDebugFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	warning := regexp.MustCompile(`Warning: rotation took \S+, more than the threshold of 100ms. ` +
+		`Breakdown: rename \S+, hooks (\S+), shift \S+, compress \S+, notify \S+, upload \S+, prune \S+\n`)
+	match := warning.FindStringSubmatch(string(debug_log))
+	if match == nil {
+		t.Fatal("Activity log is missing the slow rotation warning")
+	}
+	if hooks, err := time.ParseDuration(match[1]); err != nil || hooks < 200*time.Millisecond {
+		t.Fatalf("Slow rotation breakdown missmatch %s", match[0])
+	}
+}
+
+func TestPositionFile(t *testing.T) {
+
+	const testOutputDirectory string = "output_position_file"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	inputFile := filepath.Join(testOutputDirectory, "input.txt")
+	positionFile := filepath.Join(testOutputDirectory, "input.pos")
+	config, err := json.Marshal(map[string]any{"pipelines": []map[string]any{
+		{"input": inputFile, "args": []string{
+			"-o", filepath.Join(testOutputDirectory, testLogFileName), "--position-file", positionFile}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, "pipelines.json"), config, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(input string, replace bool, expected string) {
+		if replace {
+			os.Remove(inputFile)
+		}
+		file, err := os.OpenFile(inputFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.WriteString(input); err != nil {
+			t.Fatal(err)
+		}
+		file.Close()
+
+		if err := exec.Command("./rotee", "multi", "-c", filepath.Join(testOutputDirectory, "pipelines.json")).Run(); err != nil {
+			t.Fatal(err)
+		}
+		if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil ||
+			string(log_content) != expected {
+			t.Fatalf("Logfile output missmatch %q", log_content)
+		}
+	}
+
+	// The half line is left for the next run, nothing is read twice
+	run("Text and stuff\nMore text\n", false, "Text and stuff\nMore text\n")
+	run("Even more\nHalf a li", false, "Text and stuff\nMore text\nEven more\n")
+	run("ne\n", false, "Text and stuff\nMore text\nEven more\nHalf a line\n")
+
+	position := make(map[string]any)
+	if content, err := os.ReadFile(positionFile); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(content, &position); err != nil {
+		t.Fatal(err)
+	}
+	if position["input"] != inputFile || position["offset"] != float64(len("Text and stuff\nMore text\nEven more\nHalf a line\n")) {
+		t.Fatalf("Position file missmatch %v", position)
+	}
+
+	// A new file with the same name starts over
+	run("New file\n", true, "Text and stuff\nMore text\nEven more\nHalf a line\nNew file\n")
+}
+
+func TestAckMode(t *testing.T) {
+
+	const testOutputDirectory string = "output_ack_mode"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Large enough to need many chunks, each of them waits for the disk
+	var test_input strings.Builder
+	for i := 0; i < 20000; i++ {
+		test_input.WriteString("Text and stuff " + strconv.Itoa(i) + "\n")
+	}
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName), "--ack-mode", "durable")
+	process.Stdin = strings.NewReader(test_input.String())
+	output, err := process.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != test_input.String() {
+		t.Fatal("Stdout output missmatch")
+	}
+	if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil ||
+		string(log_content) != test_input.String() {
+		t.Fatal("Logfile output missmatch")
+	}
+
+	// Spilling to disk would take input before it is written
+	if err := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName), "--ack-mode", "durable",
+		"--spool-file", filepath.Join(testOutputDirectory, "spool")).Run(); err == nil {
+		t.Fatal("Expected an error for --ack-mode durable with --spool-file")
+	}
+}
+
+func TestMultiInheritedFDs(t *testing.T) {
+
+	const testOutputDirectory string = "output_multi_inherited_fds"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stdin and two more pipes from the parent, each into its own output file
+	config, err := json.Marshal(map[string]any{"pipelines": []map[string]any{
+		{"args": []string{"-o", filepath.Join(testOutputDirectory, "stdin.log")}},
+		{"input": "fd:3", "args": []string{"-o", filepath.Join(testOutputDirectory, "errors.log")}},
+		{"input": "fd:4", "args": []string{"-o", filepath.Join(testOutputDirectory, "access.log")}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, "pipelines.json"), config, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "multi", "-c", filepath.Join(testOutputDirectory, "pipelines.json"))
+	process.Stdin = strings.NewReader("Main text\n")
+	writers := make([]*os.File, 2)
+	for i := range writers {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reader.Close()
+		process.ExtraFiles = append(process.ExtraFiles, reader)
+		writers[i] = writer
+	}
+	if err := process.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i, text := range []string{"Error text\n", "Access text\n"} {
+		if _, err := io.WriteString(writers[i], text); err != nil {
+			t.Fatal(err)
+		}
+		writers[i].Close()
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]string{"stdin.log": "Main text\n", "errors.log": "Error text\n", "access.log": "Access text\n"} {
+		if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, name)); err != nil || string(log_content) != expected {
+			t.Fatalf("Logfile %s output missmatch", name)
+		}
+	}
+
+	// Our own descriptors are not inputs
+	config, err = json.Marshal(map[string]any{"pipelines": []map[string]any{
+		{"input": "fd:1", "args": []string{"-o", filepath.Join(testOutputDirectory, "stdout.log")}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, "pipelines.json"), config, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("./rotee", "multi", "-c", filepath.Join(testOutputDirectory, "pipelines.json")).Run(); err == nil {
+		t.Fatal("Expected an error for fd:1")
+	}
+}
+
+func TestRoutes(t *testing.T) {
+
+	const testOutputDirectory string = "output_routes"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	const test_input string = "Starting\nERROR: broken\nGET /index.html\nWARN: slow GET\nDone\n"
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--route", "ERROR|WARN=>"+filepath.Join(testOutputDirectory, "errors.log"),
+		"--route", "^GET =>"+filepath.Join(testOutputDirectory, "access.log"),
+	)
+	process.Stdin = strings.NewReader(test_input)
+	output, err := process.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stdout still gets everything, the first matching route takes the line
+	if string(output) != test_input {
+		t.Fatal("Stdout output missmatch")
+	}
+	for name, expected := range map[string]string{
+		testLogFileName: "Starting\nDone\n",
+		"errors.log":    "ERROR: broken\nWARN: slow GET\n",
+		"access.log":    "GET /index.html\n",
+	} {
+		if log_content, err := os.ReadFile(filepath.Join(testOutputDirectory, name)); err != nil || string(log_content) != expected {
+			t.Fatalf("Logfile %s output missmatch", name)
+		}
+	}
+
+	if err := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--route", "ERROR").Run(); err == nil {
+		t.Fatal("Expected an error for a route without output file")
+	}
+}
+
+func TestRoutesFile(t *testing.T) {
+
+	const testOutputDirectory string = "output_routes_file"
+	const subprocessTimeWait int = 200
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	routes := `{"routes": [{"pattern": "ERROR", "output": "` + filepath.Join(testOutputDirectory, "errors.log") +
+		`", "compression": "none", "max_files": 1}]}`
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, "routes.json"), []byte(routes), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName), "-c", "-m", "10", "-f", "0.001",
+		"--routes-file", filepath.Join(testOutputDirectory, "routes.json"))
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := io.WriteString(stdin, fmt.Sprintf("ERROR: broken %d\nINFO: running %d\n", i, i)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	}
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The main output file keeps its settings, the route its own
+	if archive_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+".1.gz")); err != nil ||
+		archive_content != "INFO: running 2\n" {
+		t.Fatal("Archive output missmatch")
+	}
+	if archive_content, err := os.ReadFile(filepath.Join(testOutputDirectory, "errors.log.1")); err != nil ||
+		string(archive_content) != "ERROR: broken 2\n" {
+		t.Fatal("Routed archive output missmatch")
+	}
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".3.gz")); err != nil {
+		t.Fatal("Archive should have been kept")
+	}
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, "errors.log.2")); !os.IsNotExist(err) {
+		t.Fatal("Routed archive should have been removed")
+	}
+
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, "routes.json"),
+		[]byte(`{"routes": [{"pattern": "ERROR", "output": "errors.log", "compression": "rar"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--routes-file", filepath.Join(testOutputDirectory, "routes.json")).Run(); err == nil {
+		t.Fatal("Expected an error for an unknown compression format")
+	}
+}
+
+func TestOutputFileTemplate(t *testing.T) {
+
+	const testOutputDirectory string = "output_file_template"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new file every second, the ones left behind are compressed and only two are kept
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, "app-%H%M%S.log"), "-c", "-n", "2")
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := io.WriteString(stdin, fmt.Sprintf("Line %d\n", i)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(1100 * time.Millisecond)
+	}
+	if _, err := io.WriteString(stdin, "Last line\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	archives, err := filepath.Glob(filepath.Join(testOutputDirectory, "app-*.log.gz"))
+	if err != nil || len(archives) != 2 {
+		t.Fatalf("Expected 2 compressed files, found %v", archives)
+	}
+	sort.Strings(archives)
+	for i, archive := range archives {
+		if archive_content, err := readGzipFile(archive); err != nil || archive_content != fmt.Sprintf("Line %d\n", i+2) {
+			t.Fatal("Archive output missmatch")
+		}
+	}
+	current, err := filepath.Glob(filepath.Join(testOutputDirectory, "app-*.log"))
+	if err != nil || len(current) != 1 {
+		t.Fatalf("Expected 1 current file, found %v", current)
+	}
+	if log_content, err := os.ReadFile(current[0]); err != nil || string(log_content) != "Last line\n" {
+		t.Fatal("Logfile output missmatch")
+	}
+
+	if err := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, "app-%Q.log")).Run(); err == nil {
+		t.Fatal("Expected an error for an unknown date pattern")
+	}
+}
+
+func TestTimezone(t *testing.T) {
+
+	const testOutputDirectory string = "output_timezone"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Far away from the zone of any test host, so the day differs for most of it
+	location, err := time.LoadLocation("Pacific/Kiritimati")
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().In(location).Format("2006-01-02-15")
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, "app-%Y-%m-%d-%H.log"),
+		"--timezone", "Pacific/Kiritimati")
+	process.Stdin = strings.NewReader("Test\n")
+	if err := process.Run(); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now().In(location).Format("2006-01-02-15")
+
+	_, errBefore := os.Stat(filepath.Join(testOutputDirectory, "app-"+before+".log"))
+	_, errAfter := os.Stat(filepath.Join(testOutputDirectory, "app-"+after+".log"))
+	if errBefore != nil && errAfter != nil {
+		t.Fatal("Output file should be named after the time in the given timezone")
+	}
+
+	if err := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--timezone", "Mars/Olympus").Run(); err == nil {
+		t.Fatal("Expected an error for an unknown timezone")
+	}
+}
+
+func TestCompressMaxCPUs(t *testing.T) {
+
+	const testOutputDirectory string = "output_compress_max_cpus"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Large enough for zstd to split it into several blocks
+	var sb strings.Builder
+	for i := 0; i < 100000; i++ {
+		sb.WriteString("Line number " + strconv.Itoa(i) + "\n")
+	}
+	test_input := sb.String()
+
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName), "--rotate-on-exit",
+		"--compression", "zstd", "--compress-max-cpus", "1")
+	process.Stdin = strings.NewReader(test_input)
+	if err := process.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoder.Close()
+	archive, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".1.zst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := decoder.DecodeAll(archive, nil); err != nil || string(content) != test_input {
+		t.Fatal("Archive output missmatch")
+	}
+
+	if err := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--compress-max-cpus", "-1").Run(); err == nil {
+		t.Fatal("Expected an error for a negative CPU limit")
+	}
+}
+
+func TestCompressMaxJobs(t *testing.T) {
+
+	const testOutputDirectory string = "output_compress_max_jobs"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both pipelines rotate at the end of their input, the slow pre script keeps the only slot busy
+	pipelines := make([]map[string]any, 0)
+	for _, name := range []string{"a", "b"} {
+		inputFile := filepath.Join(testOutputDirectory, name+".txt")
+		if err := os.WriteFile(inputFile, []byte(name+": Text and stuff\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		pipelines = append(pipelines, map[string]any{"input": inputFile, "args": []string{
+			"-o", filepath.Join(testOutputDirectory, name+".log"), "-c", "--rotate-on-exit", "-s", "sleep 0.5"}})
+	}
+	config, err := json.Marshal(map[string]any{"pipelines": pipelines})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, "pipelines.json"), config, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exec.Command("./rotee", "multi", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-c", filepath.Join(testOutputDirectory, "pipelines.json"), "--compress-max-jobs", "1").Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"a", "b"} {
+		if archive_content, err := readGzipFile(filepath.Join(testOutputDirectory, name+".log.1.gz")); err != nil ||
+			archive_content != name+": Text and stuff\n" {
+			t.Fatalf("Archive %s output missmatch", name)
+		}
+	}
+	if debug_content, err := os.ReadFile(filepath.Join(testOutputDirectory, testDebugFileName)); err != nil ||
+		!strings.Contains(string(debug_content), "All 1 compression slots are busy, waiting") {
+		t.Fatal("One rotation should have waited for the other")
+	}
+
+	if err := exec.Command("./rotee", "multi", "-c", filepath.Join(testOutputDirectory, "pipelines.json"),
+		"--compress-max-jobs", "-1").Run(); err == nil {
+		t.Fatal("Expected an error for a negative job limit")
+	}
+}
+
+func TestNetworkFS(t *testing.T) {
+
+	const testOutputDirectory string = "output_network_fs"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server's clock says the archive is three days old, the manifest knows it was rotated just now
+	archive := filepath.Join(testOutputDirectory, testLogFileName+".1")
+	if err := os.WriteFile(archive, []byte("Old text\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-72 * time.Hour)
+	if err := os.Chtimes(archive, old, old); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := json.Marshal([]map[string]any{{"index": 1, "extension": "", "rotated": time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testLogFileName+".manifest"), manifest, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-d", "1", "--rotate-on-exit", "--network-fs")
+	process.Stdin = strings.NewReader("Text and stuff\n")
+	if err := process.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".2")); err != nil ||
+		string(content) != "Old text\n" {
+		t.Fatal("Archive output missmatch")
+	}
+
+	// Without it the modification time decides
+	process = exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-d", "1", "--rotate-on-exit")
+	process.Stdin = strings.NewReader("More text\n")
+	if err := process.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".3")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Old archive should have been deleted")
+	}
+	if content, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".2")); err != nil ||
+		string(content) != "Text and stuff\n" {
+		t.Fatal("Archive output missmatch")
+	}
+}
+
+func TestRotationHold(t *testing.T) {
+
+	const testOutputDirectory string = "output_rotation_hold"
+	const subprocessTimeWait int = 100
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	holdFile := filepath.Join(testOutputDirectory, "backup.running")
+	if err := os.WriteFile(holdFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-f", "0.001", "-m", "10", "--hold-file", holdFile, "--grpc-listen", address,
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Large enough to rotate, but the hold file is there
+	const test_input string = "Text and stuff\nMore text\n"
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".1")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Should not rotate during a hold")
+	}
+
+	connection, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The control service holds on after the hold file is gone
+	if err := connection.Invoke(ctx, "/rotee.Control/Hold", &emptypb.Empty{}, &emptypb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(holdFile); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".1")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Should not rotate during a hold")
+	}
+	state := &structpb.Struct{}
+	if err := connection.Invoke(ctx, "/rotee.Control/Status", &emptypb.Empty{}, state); err != nil {
+		t.Fatal(err)
+	}
+	if !state.Fields["rotations_held"].GetBoolValue() {
+		t.Fatal("Status missmatch")
+	}
+	if err := connection.Invoke(ctx, "/rotee.Control/Rotate", &emptypb.Empty{}, &wrapperspb.StringValue{}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatal("Expected rotate to fail during a hold")
+	}
+
+	// Whatever became due rotates after resume
+	if err := connection.Invoke(ctx, "/rotee.Control/Resume", &emptypb.Empty{}, &emptypb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".1")); err != nil ||
+		string(result) != test_input {
+		t.Fatal("Archive content missmatch")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPauseWriter(t *testing.T) {
+
+	const testOutputDirectory string = "output_pause_writer"
+	const subprocessTimeWait int = 100
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	process := exec.Command("./rotee", "-v", filepath.Join(testOutputDirectory, testDebugFileName),
+		"-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--spool-file", filepath.Join(testOutputDirectory, "output.spool"), "--grpc-listen", address,
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	const test_input string = "Text and stuff\n"
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	connection, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := connection.Invoke(ctx, "/rotee.Control/PauseWriter", &emptypb.Empty{}, &emptypb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	state := &structpb.Struct{}
+	if err := connection.Invoke(ctx, "/rotee.Control/Status", &emptypb.Empty{}, state); err != nil {
+		t.Fatal(err)
+	}
+	if !state.Fields["writer_paused"].GetBoolValue() {
+		t.Fatal("Status missmatch")
+	}
+
+	// The output file is closed, moving it away is fine and new input waits
+	if err := os.Rename(filepath.Join(testOutputDirectory, testLogFileName),
+		filepath.Join(testOutputDirectory, "moved.log")); err != nil {
+		t.Fatal(err)
+	}
+	const test_input_paused string = "Text during the pause\n"
+	if _, err := io.WriteString(stdin, test_input_paused); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, "moved.log")); err != nil || string(result) != test_input {
+		t.Fatal("Output file content missmatch")
+	}
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Should not write during a pause")
+	}
+
+	if err := connection.Invoke(ctx, "/rotee.Control/ResumeWriter", &emptypb.Empty{}, &emptypb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName)); err != nil ||
+		string(result) != test_input_paused {
+		t.Fatal("Output file content missmatch")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+
+	const testOutputDirectory string = "output_drain"
+	const subprocessTimeWait int = 100
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-c", "--no-stdout", "--grpc-listen", address)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	const test_input string = "Text and stuff\nMore text\n"
+	if _, err := io.WriteString(stdin, test_input); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+
+	connection, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The input stays open, rotee exits anyway and rotates on the way out
+	if err := connection.Invoke(ctx, "/rotee.Control/Drain", wrapperspb.Bool(true), &emptypb.Empty{}); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- process.Wait() }()
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		process.Process.Kill()
+		t.Fatal("rotee did not exit after drain")
+	}
+
+	if archive_content, err := readGzipFile(filepath.Join(testOutputDirectory, testLogFileName+".1.gz")); err != nil ||
+		archive_content != test_input {
+		t.Fatal("Archive output missmatch")
+	}
+}
+
+func TestOnEchoError(t *testing.T) {
+
+	const testOutputDirectory string = "output_on_echo_error"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	const test_input string = "Text and stuff\nMore text\n"
+
+	// Nobody reads stdout, every write to it fails
+	run := func(policy string) error {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader.Close()
+		defer writer.Close()
+
+		process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, policy+".log"), "--on-echo-error", policy)
+		process.Stdin = strings.NewReader(test_input)
+		process.Stdout = writer
+		return process.Run()
+	}
+
+	for _, policy := range []string{"ignore", "disable"} {
+		if err := run(policy); err != nil {
+			t.Fatal(err)
+		}
+		if content, err := os.ReadFile(filepath.Join(testOutputDirectory, policy+".log")); err != nil ||
+			string(content) != test_input {
+			t.Fatalf("Output file %s missmatch", policy)
+		}
+	}
+	if err := run("exit"); err == nil {
+		t.Fatal("Expected rotee to exit because of the failed echo")
+	}
+
+	if err := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--on-echo-error", "retry").Run(); err == nil {
+		t.Fatal("Expected an error for an unknown policy")
+	}
+}
+
+func TestErrorMode(t *testing.T) {
+
+	const testOutputDirectory string = "output_error_mode"
+	const subprocessTimeWait int = 500
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	exitCode := func(err error) int {
+		var exitError *exec.ExitError
+		if errors.As(err, &exitError) {
+			return exitError.ExitCode()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return 0
+	}
+
+	// The pre script fails every timed rotation
+	run := func(mode string) int {
+		process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+			"-a", "0.1", "-s", "exit 1", "--error-mode", mode)
+		stdin, err := process.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = process.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond * time.Duration(subprocessTimeWait))
+		stdin.Close()
+		return exitCode(process.Wait())
+	}
+
+	if code := run("fail-fast"); code != 6 {
+		t.Fatalf("Exit code %d missmatch", code)
+	}
+	if code := run("best-effort"); code != 0 {
+		t.Fatalf("Exit code %d missmatch", code)
+	}
+
+	if code := exitCode(exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--error-mode", "sometimes").Run()); code != 3 {
+		t.Fatalf("Exit code %d missmatch", code)
+	}
+	if code := exitCode(exec.Command("./rotee", "--no-such-flag").Run()); code != 3 {
+		t.Fatalf("Exit code %d missmatch", code)
+	}
+}
+
+func TestTriggerRotationRunning(t *testing.T) {
+
+	const testOutputDirectory string = "output_trigger_rotation_running"
+	const firstTrigger string = "first.trigger"
+	const secondTrigger string = "second.trigger"
+	const thirdTrigger string = "third.trigger"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every rotation takes a second because of the pre script
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", filepath.Join(testOutputDirectory, firstTrigger),
+		"-t", filepath.Join(testOutputDirectory, secondTrigger),
+		"-t", filepath.Join(testOutputDirectory, thirdTrigger),
+		"-f", "0.01", "-s", "sleep 1", "--skip-empty",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	trigger := func(name string) {
+		if err := os.WriteFile(filepath.Join(testOutputDirectory, name), []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	status := func(name string) string {
+		result, err := os.ReadFile(filepath.Join(testOutputDirectory, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(result)
+	}
+
+	// The second and third trigger come in while the first rotates, they share the next rotation
+	trigger(firstTrigger)
+	time.Sleep(300 * time.Millisecond)
+	if _, err := io.WriteString(stdin, "More text\n"); err != nil {
+		t.Fatal(err)
+	}
+	trigger(secondTrigger)
+	time.Sleep(100 * time.Millisecond)
+	trigger(thirdTrigger)
+	time.Sleep(2500 * time.Millisecond)
+
+	if status(firstTrigger) != "0" || status(secondTrigger) != "0" || status(thirdTrigger) != "5" {
+		t.Fatal("Trigger status missmatch")
+	}
+	if result, err := os.ReadFile(filepath.Join(testOutputDirectory, testLogFileName+".1")); err != nil ||
+		string(result) != "More text\n" {
+		t.Fatal("Archive content missmatch")
+	}
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".3")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("Coalesced triggers should not rotate again")
+	}
+
+	// Nothing was written since, there is nothing to do
+	trigger(firstTrigger)
+	time.Sleep(200 * time.Millisecond)
+	if status(firstTrigger) != "4" {
+		t.Fatal("Trigger status missmatch")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTriggerResponse(t *testing.T) {
+
+	const testOutputDirectory string = "output_trigger_response"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	triggerFile := filepath.Join(testOutputDirectory, testTriggerFileName)
+	for _, mode := range []string{"json", "status-file"} {
+
+		process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+			"-t", triggerFile, "-f", "0.01", "--trigger-response", mode,
+		)
+		stdin, err := process.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = process.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		if err := os.WriteFile(triggerFile, []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(200 * time.Millisecond)
+
+		statusFile := triggerFile
+		if mode == "status-file" {
+			statusFile = triggerFile + ".status"
+			if result, err := os.ReadFile(triggerFile); err != nil || string(result) != "0" {
+				t.Fatal("Trigger status missmatch")
+			}
+		}
+		content, err := os.ReadFile(statusFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var response struct {
+			Status     int    `json:"status"`
+			Result     string `json:"result"`
+			RotationID string `json:"rotation_id"`
+			Archive    string `json:"archive"`
+		}
+		if err := json.Unmarshal(content, &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Status != 0 || response.Result != "rotated" || response.RotationID == "" ||
+			filepath.Base(response.Archive) != testLogFileName+".1" {
+			t.Fatal("Trigger response missmatch")
+		}
+
+		if err := stdin.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := process.Wait(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMultipleTriggerFiles(t *testing.T) {
+
+	const testOutputDirectory string = "output_multiple_trigger_files"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	firstTrigger := filepath.Join(testOutputDirectory, "deploy.trigger")
+	secondTrigger := filepath.Join(testOutputDirectory, "backup.trigger")
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", firstTrigger, "-t", secondTrigger, "-f", "0.01",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each trigger file gets the result of its own request, the other one stays untouched
+	for i, triggerFile := range []string{firstTrigger, secondTrigger} {
+		if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := os.WriteFile(triggerFile, []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(200 * time.Millisecond)
+		if result, err := os.ReadFile(triggerFile); err != nil || string(result) != "0" {
+			t.Fatal("Trigger status missmatch")
+		}
+		if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+"."+strconv.Itoa(i+1))); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if _, err := os.Stat(secondTrigger); !os.IsNotExist(err) {
+				t.Fatal("Trigger file missmatch")
+			}
+		}
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two watchers of the same file would both answer it
+	process = exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", firstTrigger, "-t", firstTrigger,
+	)
+	var exitError *exec.ExitError
+	if err := process.Run(); !errors.As(err, &exitError) || exitError.ExitCode() != 3 {
+		t.Fatal("Exit code missmatch")
+	}
+}
+
+func TestTriggerModeTouch(t *testing.T) {
+
+	const testOutputDirectory string = "output_trigger_mode_touch"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	triggerFile := filepath.Join(testOutputDirectory, testTriggerFileName)
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", triggerFile, "-f", "0.01", "--trigger-mode", "touch", "--trigger-response", "status-file",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// An empty file is enough and goes away once the rotation is done
+	time.Sleep(100 * time.Millisecond)
+	if err := os.WriteFile(triggerFile, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if _, err := os.Stat(triggerFile); !os.IsNotExist(err) {
+		t.Fatal("Trigger file missmatch")
+	}
+	if _, err := os.Stat(filepath.Join(testOutputDirectory, testLogFileName+".1")); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(triggerFile + ".status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response struct {
+		Result string `json:"result"`
+	}
+	if err := json.Unmarshal(content, &response); err != nil || response.Result != "rotated" {
+		t.Fatal("Trigger response missmatch")
+	}
+
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// There is no trigger file left to hold the JSON object
+	process = exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"-t", triggerFile, "--trigger-mode", "touch", "--trigger-response", "json",
+	)
+	var exitError *exec.ExitError
+	if err := process.Run(); !errors.As(err, &exitError) || exitError.ExitCode() != 3 {
+		t.Fatal("Exit code missmatch")
+	}
+}
+
+func TestImportLogrotate(t *testing.T) {
+
+	const testOutputDirectory string = "output_import_logrotate"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Directives in front of the block apply to it as well
+	config := filepath.Join(testOutputDirectory, "app")
+	if err := os.WriteFile(config, []byte(`compress
+/var/log/app.log {
+    rotate 7
+    daily
+    minsize 1M
+    olddir archive
+    missingok
+    notifempty
+    postrotate
+        kill -HUP $(cat /run/app.pid)
+    endscript
+}
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := exec.Command("./rotee", "import-logrotate", config).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var imported struct {
+		Pipelines []struct {
+			Input string   `json:"input"`
+			Args  []string `json:"args"`
+		} `json:"pipelines"`
+	}
+	if err := json.Unmarshal(output, &imported); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"-o", "/var/log/app.log", "-a", "86400", "-m", "1048576", "--trigger-policy", "all",
+		"-n", "7", "-c", "--skip-empty", "--archive-dir", "/var/log/archive", "-p", "kill -HUP $(cat /run/app.pid)"}
+	if len(imported.Pipelines) != 1 || imported.Pipelines[0].Input != "" ||
+		strings.Join(imported.Pipelines[0].Args, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Imported pipelines missmatch: %s", string(output))
+	}
+
+	// A block that is never closed is refused
+	if err := os.WriteFile(config, []byte("/var/log/app.log {\n    daily\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	process := exec.Command("./rotee", "import-logrotate", config)
+	if err := process.Run(); err == nil || process.ProcessState.ExitCode() != 3 {
+		t.Fatal("Exit code missmatch")
+	}
+}
+
+func TestForeignArchives(t *testing.T) {
+
+	const testOutputDirectory string = "output_foreign_archives"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// What logrotate with dateext and savelog left behind, and a file that only looks similar
+	logFile := filepath.Join(testOutputDirectory, testLogFileName)
+	foreign := map[string]time.Duration{
+		logFile + "-20240101.gz": 48 * time.Hour,
+		logFile + ".0":           time.Hour,
+		logFile + "-backup":      72 * time.Hour,
+	}
+	for path, age := range foreign {
+		if err := os.WriteFile(path, []byte("Old lines\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modified := time.Now().Add(-age)
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	process := exec.Command("./rotee", "-o", logFile, "-t", filepath.Join(testOutputDirectory, testTriggerFileName),
+		"-f", "0.01", "-n", "2",
+	)
+	stdin, err := process.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = process.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(stdin, "Text and stuff\n"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := os.WriteFile(filepath.Join(testOutputDirectory, testTriggerFileName), []byte{'1'}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if err := stdin.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new archive and the newest foreign one are the two that are kept
+	for _, kept := range []string{logFile + ".1", logFile + ".0", logFile + "-backup"} {
+		if _, err := os.Stat(kept); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(logFile + "-20240101.gz"); !os.IsNotExist(err) {
+		t.Fatal("Foreign archive was not pruned")
+	}
+}
+
+func TestMigrateArchives(t *testing.T) {
+
+	const testOutputDirectory string = "output_migrate_archives"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Three numbered archives, two rotated on the same day
+	logFile := filepath.Join(testOutputDirectory, testLogFileName)
+	days := []time.Time{
+		time.Date(2024, 6, 2, 12, 0, 0, 0, time.UTC),
+		time.Date(2024, 6, 1, 18, 0, 0, 0, time.UTC),
+		time.Date(2024, 6, 1, 6, 0, 0, 0, time.UTC),
+	}
+	for i, day := range days {
+		path := logFile + "." + strconv.Itoa(i+1)
+		if err := os.WriteFile(path, []byte("Archive "+strconv.Itoa(i+1)+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, day, day); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Another tool padded the number or put the extension first
+	variants := map[string]time.Time{
+		logFile + ".04":    time.Date(2024, 5, 31, 12, 0, 0, 0, time.UTC),
+		logFile + ".gz.05": time.Date(2024, 5, 30, 18, 0, 0, 0, time.UTC),
+	}
+	for path, day := range variants {
+		if err := os.WriteFile(path, []byte(filepath.Base(path)+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, day, day); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// And one logrotate left behind with dateext, its day comes from the name
+	if err := os.WriteFile(logFile+"-20240530.gz", []byte("Archive 6\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := exec.Command("./rotee", "migrate", "-o", logFile, "--to", "date", "--timezone", "UTC").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(output), "\n") != 6 {
+		t.Fatalf("Expected six renamed archives, got %s", string(output))
+	}
+	expected := map[string]string{
+		logFile + ".2024-06-02.1":    "Archive 1\n",
+		logFile + ".2024-06-01.2":    "Archive 2\n",
+		logFile + ".2024-06-01.1":    "Archive 3\n",
+		logFile + ".2024-05-31.1":    testLogFileName + ".04\n",
+		logFile + ".2024-05-30.2.gz": testLogFileName + ".gz.05\n",
+		logFile + ".2024-05-30.1.gz": "Archive 6\n",
+	}
+	for path, content := range expected {
+		if log_content, err := os.ReadFile(path); err != nil || string(log_content) != content {
+			t.Fatal("Migrated archive output missmatch")
+		}
+	}
+
+	// And back, the newest is .1 again
+	if err := exec.Command("./rotee", "migrate", "-o", logFile, "--to", "index").Run(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if log_content, err := os.ReadFile(logFile + "." + strconv.Itoa(i)); err != nil ||
+			string(log_content) != "Archive "+strconv.Itoa(i)+"\n" {
+			t.Fatal("Migrated archive output missmatch")
+		}
+	}
+	expected = map[string]string{
+		logFile + ".4":    testLogFileName + ".04\n",
+		logFile + ".5.gz": testLogFileName + ".gz.05\n",
+		logFile + ".6.gz": "Archive 6\n",
+	}
+	for path, content := range expected {
+		if log_content, err := os.ReadFile(path); err != nil || string(log_content) != content {
+			t.Fatal("Migrated foreign archive output missmatch")
+		}
+	}
+}
+
+func TestShowArchive(t *testing.T) {
+
+	const testOutputDirectory string = "output_show_archive"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// A plain and a compressed numbered archive and two dated ones of the same day
+	logFile := filepath.Join(testOutputDirectory, testLogFileName)
+	archives := map[string]string{
+		logFile + ".1":                "Archive 1\n",
+		logFile + ".2.gz":             "Archive 2\n",
+		logFile + ".2024-06-01.1.gz":  "Morning\n",
+		logFile + ".2024-06-01.2.zst": "Evening\n",
+	}
+	for path, content := range archives {
+		var compressed bytes.Buffer
+		switch filepath.Ext(path) {
+		case ".gz":
+			writer := gzip.NewWriter(&compressed)
+			writer.Write([]byte(content))
+			writer.Close()
+		case ".zst":
+			writer, _ := zstd.NewWriter(&compressed)
+			writer.Write([]byte(content))
+			writer.Close()
+		default:
+			compressed.WriteString(content)
+		}
+		if err := os.WriteFile(path, compressed.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"--index", "1"}, "Archive 1\n"},
+		{[]string{"--index", "2"}, "Archive 2\n"},
+		{[]string{"--date", "2024-06-01", "--index", "2"}, "Evening\n"},
+		{[]string{"--date", "2024-06-01"}, "Morning\nEvening\n"},
+	} {
+		output, err := exec.Command("./rotee", append([]string{"show", "-o", logFile}, test.args...)...).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(output) != test.expected {
+			t.Fatalf("Archive content missmatch for %v: %s", test.args, string(output))
+		}
+	}
+
+	process := exec.Command("./rotee", "show", "-o", logFile, "--index", "3")
+	if err := process.Run(); err == nil || process.ProcessState.ExitCode() != 4 {
+		t.Fatal("Exit code missmatch")
+	}
+}
+
+func TestRecordFraming(t *testing.T) {
+
+	const testOutputDirectory string = "output_record_framing"
+
+	defer func() {
+		if err := os.RemoveAll(testOutputDirectory); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	if err := os.Mkdir(testOutputDirectory, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Binary records with their length in front, newlines in them mean nothing
+	length32 := func(data string) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, uint32(len(data))), data...)
+	}
+	varint := func(data string) []byte {
+		return append(binary.AppendUvarint(nil, uint64(len(data))), data...)
+	}
+
+	for _, framing := range []struct {
+		name   string
+		record func(data string) []byte
+	}{{"length32", length32}, {"varint", varint}} {
+
+		logFile := filepath.Join(testOutputDirectory, framing.name+".log")
+		triggerFile := filepath.Join(testOutputDirectory, framing.name+".trigger")
+		process := exec.Command("./rotee", "-o", logFile, "-t", triggerFile, "-f", "0.01", "--framing", framing.name)
+		stdin, err := process.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = process.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The trigger arrives while the second record is only half written, it stays in one piece
+		first, second := framing.record("First\nrecord"), framing.record("Second record")
+		if _, err := stdin.Write(append(first, second[:5]...)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if err := os.WriteFile(triggerFile, []byte{'1'}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(200 * time.Millisecond)
+		if _, err := stdin.Write(second[5:]); err != nil {
+			t.Fatal(err)
+		}
+
+		// A record cut off by the end of the input is left out
+		if _, err := stdin.Write(framing.record("Third record")[:6]); err != nil {
+			t.Fatal(err)
+		}
+		if err := stdin.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := process.Wait(); err != nil {
+			t.Fatal(err)
+		}
+
+		if log_content, err := os.ReadFile(logFile + ".1"); err != nil || !bytes.Equal(log_content, first) {
+			t.Fatal("Archive output missmatch")
+		}
+		if log_content, err := os.ReadFile(logFile); err != nil || !bytes.Equal(log_content, second) {
+			t.Fatal("Log output missmatch")
+		}
+	}
+
+	// Lines in records are no lines
+	process := exec.Command("./rotee", "-o", filepath.Join(testOutputDirectory, testLogFileName),
+		"--framing", "varint", "--format", "rfc5424")
+	if err := process.Run(); err == nil || process.ProcessState.ExitCode() != 3 {
+		t.Fatal("Exit code missmatch")
 	}
 }
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/akamensky/argparse"
+)
+
+// Streams of these formats can simply be appended to each other, their readers
+// continue with the next stream. Everything else would have to be compressed again.
+func canConcatenateArchives(extension string) bool {
+	switch extension {
+	case "", ".gz", ".zst", ".bz2", ".sz":
+		return true
+	}
+	return false
+}
+
+// Find runs of adjacent archives smaller than minSize that can be merged without
+// growing beyond maxSize. Archives are newest first, so are the returned runs.
+func findCompactRuns(archives []archiveFile, manifest *archiveManifest, minSize int64, maxSize int64) [][]archiveFile {
+
+	runs := make([][]archiveFile, 0)
+	run := make([]archiveFile, 0)
+	var runSize int64
+	endRun := func() {
+		if len(run) > 1 {
+			runs = append(runs, run)
+		}
+		run = make([]archiveFile, 0)
+		runSize = 0
+	}
+
+	for _, archive := range archives {
+		stat, err := os.Stat(archive.getPath())
+		if err != nil || stat.Size() >= minSize || !canConcatenateArchives(archive.extension) {
+			endRun()
+			continue
+		}
+
+		// Merged archives could not be uploaded under their own names anymore
+		if record := manifest.get(archive); record != nil && record.uploadPending() {
+			endRun()
+			continue
+		}
+
+		// Dated archives keep the day they belong to
+		if len(run) > 0 && (archive.extension != run[0].extension || archive.date != run[0].date ||
+			runSize+stat.Size() > maxSize) {
+			endRun()
+		}
+		run = append(run, archive)
+		runSize += stat.Size()
+	}
+	endRun()
+
+	return runs
+}
+
+// Write the content of all archives of a run, oldest first, into the place of the newest one.
+// A crash before the others are deleted leaves their data in there twice, but never loses it.
+func mergeArchives(run []archiveFile, manifest *archiveManifest) error {
+
+	target := run[0].getPath()
+	stat, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+
+	partialPath := target + partialArchiveSuffix
+	output, err := os.OpenFile(partialPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partialPath)
+	defer output.Close()
+
+	for i := len(run) - 1; i >= 0; i-- {
+		input, err := os.Open(run[i].getPath())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(output, input)
+		input.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := output.Sync(); err != nil {
+		return err
+	}
+	if err := output.Close(); err != nil {
+		return err
+	}
+
+	// The merged archive is as old as its newest data, like every other archive
+	if err := copyExtendedAttributes(target, partialPath); err != nil {
+		logActivity("Failed to copy extended attributes to %s. Error: %s", partialPath, err)
+	}
+	if err := os.Chtimes(partialPath, stat.ModTime(), stat.ModTime()); err != nil {
+		return err
+	}
+	if err := renameFile(partialPath, target); err != nil {
+		return err
+	}
+
+	// It now covers the time range of all merged archives
+	if record := manifest.get(run[0]); record != nil {
+		if oldest := manifest.get(run[len(run)-1]); oldest != nil {
+			record.FirstWrite = oldest.FirstWrite
+		}
+	}
+
+	for _, archive := range run[1:] {
+		audit("", "compact", archive.getPath(), target)
+		if err := removeArchiveFile(archive.name, archive.getPath()); err != nil {
+			return err
+		}
+		audit("", "delete", archive.getPath(), "")
+		manifest.forget(archive)
+	}
+	return nil
+}
+
+// Merge runs of small adjacent archives into fewer larger ones, keeping the order
+// of all lines. Numbered archives are moved down afterwards so there is no hole.
+func compactArchives(archiveBase string, minSize int64, maxSize int64) ([]string, error) {
+
+	merged := make([]string, 0)
+	targets := make(map[string]bool)
+	removed := make(map[string]bool)
+	archives := findAllArchives(archiveBase)
+	manifest := loadManifest(archiveBase, archives)
+	defer func() {
+		if err := manifest.save(); err != nil {
+			logActivity("Failed to write manifest for %s. Error: %s", archiveBase, err)
+		}
+	}()
+
+	for _, run := range findCompactRuns(archives, manifest, minSize, maxSize) {
+		logActivity("Merging %d archives into %s", len(run), run[0].getPath())
+		if err := mergeArchives(run, manifest); err != nil {
+			return merged, err
+		}
+		targets[run[0].getPath()] = true
+		for _, archive := range run[1:] {
+			removed[archive.getPath()] = true
+		}
+	}
+
+	// Archive discovery stops at the first missing index, going up from the
+	// bottom the target of every move is free already
+	index := 1
+	for _, archive := range archives {
+		path := archive.getPath()
+		if removed[path] {
+			continue
+		}
+		if archive.date == "" {
+			if archive.index != index {
+				target := makeArchivePath(archive.name, index, archive.extension)
+				if err := renameFile(path, target); err != nil {
+					return merged, err
+				}
+				audit("", "rename", path, target)
+				manifest.move(archive.index, index)
+				archive.index = index
+			}
+			index++
+		}
+		if targets[path] {
+			merged = append(merged, archive.getPath())
+		}
+	}
+
+	return merged, nil
+}
+
+func runCompactCommand(args []string) {
+
+	parser := argparse.NewParser("rotee compact",
+		"Merge many small adjacent archives of an output file into fewer larger ones, keeping their order")
+	outputFile := parser.String("o", "output-file",
+		&argparse.Options{Required: true, Help: "Output file whose archives should be compacted."})
+	archiveDir := parser.String("", "archive-dir",
+		&argparse.Options{Required: false, Help: "Directory the archives are kept in, if not next to the output file."})
+	minSize := parser.String("", "min-size",
+		&argparse.Options{Required: false, Help: "Only merge archives smaller than this, like 1mb", Default: "1mb"})
+	maxSize := parser.String("", "max-size",
+		&argparse.Options{Required: false, Help: "Never merge archives into one larger than this, like 64mb", Default: "64mb"})
+	activityFilePath := parser.String("v", "verbose-output-file",
+		&argparse.Options{Required: false, Help: "Log rotee activity to this file."})
+	auditFilePath := parser.String("", "audit-file",
+		&argparse.Options{Required: false, Help: "Append a JSON line for every rename and delete of log data to this file"})
+
+	if err := parser.Parse(args); err != nil {
+		fmt.Print(parser.Usage(err))
+		os.Exit(exitConfigError)
+	}
+
+	minSizeBytes, err := parse_memory_size_string(*minSize)
+	if err != nil {
+		exitf(exitConfigError, "Could not parse min size: %s", *minSize)
+	}
+	maxSizeBytes, err := parse_memory_size_string(*maxSize)
+	if err != nil {
+		exitf(exitConfigError, "Could not parse max size: %s", *maxSize)
+	}
+
+	setupProcess(*activityFilePath, *auditFilePath, "", defaultRenameRetries, 0, false)
+
+	merged, err := compactArchives(makeArchiveBase(*outputFile, rotateConfig{archiveDir: *archiveDir}), minSizeBytes, maxSizeBytes)
+	for _, target := range merged {
+		fmt.Println(target)
+	}
+	if err != nil {
+		exitf(exitRotationError, "Compacting failed: %s", err)
+	}
+}
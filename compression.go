@@ -0,0 +1,259 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/s2"
+	"github.com/pierrec/lz4/v4"
+)
+
+type compressionOptions struct {
+	level               int
+	zstdWindowLog       int
+	zstdDictionary      string
+	zstdTrainDictionary bool
+
+	// Formats that compress in parallel use at most this many goroutines, 0 for one per CPU
+	maxCPUs int
+}
+
+// A compression format rotee can create archives in. Archives of all
+// formats are found and pruned, no matter what rotee currently creates.
+type compressionFormat struct {
+	name      string
+	extension string
+	newWriter func(output io.Writer, archiveBase string, options compressionOptions) (io.WriteCloser, error)
+	newReader func(input *os.File, archiveBase string, options compressionOptions) (io.ReadCloser, error)
+}
+
+var compressionFormats = []*compressionFormat{
+	{name: "gzip", extension: ".gz", newWriter: newGzipWriter, newReader: newGzipReader},
+	{name: "zstd", extension: ".zst", newWriter: newZstdWriter, newReader: newZstdReader},
+	{name: "bzip2", extension: ".bz2", newWriter: newBzip2Writer, newReader: newBzip2Reader},
+	{name: "lz4", extension: ".lz4", newWriter: newLz4Writer, newReader: newLz4Reader},
+	{name: "brotli", extension: ".br", newWriter: newBrotliWriter, newReader: newBrotliReader},
+	{name: "snappy", extension: ".sz", newWriter: newSnappyWriter, newReader: newSnappyReader},
+	{name: "zip", extension: ".zip", newWriter: newZipWriter, newReader: newZipReader},
+}
+
+// How many rotations of all pipelines and routes may compress at the same time, set
+// from --compress-max-jobs. Further rotations wait before they move the output file,
+// so a storm of rotations can not pile up temporary files. nil means no limit.
+var compressionSlots chan struct{}
+
+func acquireCompressionSlot(rotationID string) {
+	if compressionSlots == nil {
+		return
+	}
+	select {
+	case compressionSlots <- struct{}{}:
+	default:
+		logRotation(rotationID, "All %d compression slots are busy, waiting", cap(compressionSlots))
+		started := time.Now()
+		compressionSlots <- struct{}{}
+		logRotation(rotationID, "Got a compression slot after %s", time.Since(started).Round(time.Millisecond))
+	}
+}
+
+func releaseCompressionSlot() {
+	if compressionSlots != nil {
+		<-compressionSlots
+	}
+}
+
+func findCompressionFormat(name string) (*compressionFormat, error) {
+	for _, format := range compressionFormats {
+		if format.name == name {
+			return format, nil
+		}
+	}
+	return nil, errors.New("Unknown compression format " + name)
+}
+
+func findCompressionByExtension(extension string) *compressionFormat {
+	for _, format := range compressionFormats {
+		if format.extension == extension {
+			return format
+		}
+	}
+	return nil
+}
+
+// Like "ratio 4.20, saved 76.2%", an empty log saves nothing
+func describeCompressionSavings(originalSize int64, compressedSize int64) string {
+	if originalSize == 0 || compressedSize == 0 {
+		return "nothing saved"
+	}
+	return fmt.Sprintf("ratio %.2f, saved %.1f%%", float64(originalSize)/float64(compressedSize),
+		100-float64(compressedSize)*100/float64(originalSize))
+}
+
+func newGzipWriter(output io.Writer, archiveBase string, options compressionOptions) (io.WriteCloser, error) {
+	if options.level == 0 {
+		return gzip.NewWriter(output), nil
+	}
+	return gzip.NewWriterLevel(output, options.level)
+}
+
+func newBzip2Writer(output io.Writer, archiveBase string, options compressionOptions) (io.WriteCloser, error) {
+	return bzip2.NewWriter(output, &bzip2.WriterConfig{Level: options.level})
+}
+
+func newLz4Writer(output io.Writer, archiveBase string, options compressionOptions) (io.WriteCloser, error) {
+
+	// Level 0 is the fast mode, which is the point of lz4. Levels 1 to 9 trade speed for ratio.
+	if options.level < 0 || options.level > 9 {
+		return nil, errors.New("lz4 compression level must be between 0 and 9")
+	}
+	level := lz4.Fast
+	if options.level > 0 {
+		level = lz4.CompressionLevel(1 << (8 + options.level))
+	}
+
+	writer := lz4.NewWriter(output)
+	if err := writer.Apply(lz4.CompressionLevelOption(level)); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func newBrotliWriter(output io.Writer, archiveBase string, options compressionOptions) (io.WriteCloser, error) {
+	if options.level == 0 {
+		return brotli.NewWriter(output), nil
+	}
+	if options.level < brotli.BestSpeed || options.level > brotli.BestCompression {
+		return nil, errors.New("brotli compression level must be between 0 and 11")
+	}
+	return brotli.NewWriterLevel(output, options.level), nil
+}
+
+// Snappy framing splits the data into independent chunks of at most 64 KB,
+// which Hadoop and Spark like because they decompress cheaply and in parallel.
+func newSnappyWriter(output io.Writer, archiveBase string, options compressionOptions) (io.WriteCloser, error) {
+	if options.level != 0 {
+		return nil, errors.New("snappy has no compression levels")
+	}
+	writerOptions := []s2.WriterOption{s2.WriterSnappyCompat()}
+	if options.maxCPUs > 0 {
+		writerOptions = append(writerOptions, s2.WriterConcurrency(options.maxCPUs))
+	}
+	return s2.NewWriter(output, writerOptions...), nil
+}
+
+// A zip archive holding the rotated log as its only entry
+type zipEntryWriter struct {
+	io.Writer
+	archive *zip.Writer
+}
+
+func (writer *zipEntryWriter) Close() error {
+	return writer.archive.Close()
+}
+
+// Zip can be opened on windows without extra tools, which is all this is for.
+// The entry is named after the output file so extracting it gives a familiar name.
+func newZipWriter(output io.Writer, archiveBase string, options compressionOptions) (io.WriteCloser, error) {
+
+	if options.level < flate.HuffmanOnly || options.level > flate.BestCompression {
+		return nil, errors.New("zip compression level must be between -2 and 9")
+	}
+
+	archive := zip.NewWriter(output)
+	if options.level != 0 {
+		archive.RegisterCompressor(zip.Deflate, func(output io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(output, options.level)
+		})
+	}
+
+	entry, err := archive.CreateHeader(&zip.FileHeader{
+		Name:     filepath.Base(archiveBase),
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &zipEntryWriter{Writer: entry, archive: archive}, nil
+}
+
+// Reading archives back, whatever format they were written in
+type archiveReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (reader *archiveReader) Close() error {
+	var err error
+	for i := len(reader.closers) - 1; i >= 0; i-- {
+		if closeErr := reader.closers[i].Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Open an archive and return its content as it was before compression
+func openArchive(archive archiveFile, options compressionOptions) (io.ReadCloser, error) {
+
+	input, err := os.Open(archive.getPath())
+	if err != nil {
+		return nil, err
+	}
+	format := findCompressionByExtension(archive.extension)
+	if format == nil {
+		return input, nil
+	}
+	reader, err := format.newReader(input, archive.name, options)
+	if err != nil {
+		input.Close()
+		return nil, err
+	}
+	return &archiveReader{Reader: reader, closers: []io.Closer{input, reader}}, nil
+}
+
+func newGzipReader(input *os.File, archiveBase string, options compressionOptions) (io.ReadCloser, error) {
+	return gzip.NewReader(input)
+}
+
+func newBzip2Reader(input *os.File, archiveBase string, options compressionOptions) (io.ReadCloser, error) {
+	return bzip2.NewReader(input, nil)
+}
+
+func newLz4Reader(input *os.File, archiveBase string, options compressionOptions) (io.ReadCloser, error) {
+	return io.NopCloser(lz4.NewReader(input)), nil
+}
+
+func newBrotliReader(input *os.File, archiveBase string, options compressionOptions) (io.ReadCloser, error) {
+	return io.NopCloser(brotli.NewReader(input)), nil
+}
+
+func newSnappyReader(input *os.File, archiveBase string, options compressionOptions) (io.ReadCloser, error) {
+	return io.NopCloser(s2.NewReader(input)), nil
+}
+
+// The log is the only entry of archives we write, with archives from elsewhere we take the first one
+func newZipReader(input *os.File, archiveBase string, options compressionOptions) (io.ReadCloser, error) {
+
+	stat, err := input.Stat()
+	if err != nil {
+		return nil, err
+	}
+	archive, err := zip.NewReader(input, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+	if len(archive.File) == 0 {
+		return nil, errors.New("zip archive " + input.Name() + " is empty")
+	}
+	return archive.File[0].Open()
+}
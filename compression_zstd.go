@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// How much of the rotated log is used to train a dictionary
+const zstdTrainingSampleBytes int = 16 * 1024 * 1024
+const zstdDictionaryHistoryBytes int = 64 * 1024
+const zstdTrainingChunkBytes int = 4 * 1024
+
+func makeZstdDictionaryPath(archiveBase string, options compressionOptions) string {
+	if options.zstdDictionary != "" {
+		return options.zstdDictionary
+	}
+	return archiveBase + ".zdict"
+}
+
+func newZstdWriter(output io.Writer, archiveBase string, options compressionOptions) (io.WriteCloser, error) {
+
+	encoderOptions := make([]zstd.EOption, 0)
+	if options.level != 0 {
+		encoderOptions = append(encoderOptions, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(options.level)))
+	}
+	if options.zstdWindowLog != 0 {
+		encoderOptions = append(encoderOptions, zstd.WithWindowSize(1<<options.zstdWindowLog))
+	}
+	if options.maxCPUs > 0 {
+		encoderOptions = append(encoderOptions, zstd.WithEncoderConcurrency(options.maxCPUs))
+	}
+
+	dictionary, err := loadZstdDictionary(archiveBase, options)
+	if err != nil {
+		return nil, err
+	}
+	if dictionary != nil {
+		encoderOptions = append(encoderOptions, zstd.WithEncoderDict(dictionary))
+	}
+
+	return zstd.NewWriter(output, encoderOptions...)
+}
+
+// Archives might have been written with a dictionary, use it if there is one
+func newZstdReader(input *os.File, archiveBase string, options compressionOptions) (io.ReadCloser, error) {
+
+	decoderOptions := make([]zstd.DOption, 0)
+	dictionary, err := os.ReadFile(makeZstdDictionaryPath(archiveBase, options))
+	if err == nil {
+		decoderOptions = append(decoderOptions, zstd.WithDecoderDicts(dictionary))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	decoder, err := zstd.NewReader(input, decoderOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
+
+func loadZstdDictionary(archiveBase string, options compressionOptions) ([]byte, error) {
+
+	if options.zstdDictionary == "" && !options.zstdTrainDictionary {
+		return nil, nil
+	}
+
+	dictionary, err := os.ReadFile(makeZstdDictionaryPath(archiveBase, options))
+	if errors.Is(err, os.ErrNotExist) && options.zstdTrainDictionary {
+
+		// Nothing trained yet, this rotation goes without and trains for the next ones
+		return nil, nil
+	}
+	return dictionary, err
+}
+
+// Build a dictionary from a rotated log file and store it next to the archives.
+// Archives made with it can only be read with the dictionary, so an existing one is never replaced.
+func trainZstdDictionary(inputFilePath string, archiveBase string, options compressionOptions) error {
+
+	path := makeZstdDictionaryPath(archiveBase, options)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	input, err := os.Open(inputFilePath)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	sample, err := io.ReadAll(io.LimitReader(input, int64(zstdTrainingSampleBytes)))
+	if err != nil {
+		return err
+	}
+
+	// The most recent lines make up the dictionary content, the whole sample
+	// is used to tune the entropy tables. Cut at line ends where possible.
+	history := sample[max(len(sample)-zstdDictionaryHistoryBytes, 0):]
+	if newline := bytes.IndexByte(history, '\n'); newline >= 0 && newline < len(history)-1 {
+		history = history[newline+1:]
+	}
+	contents := make([][]byte, 0)
+	for len(sample) > 0 {
+		chunk := sample[:min(zstdTrainingChunkBytes, len(sample))]
+		if newline := bytes.LastIndexByte(chunk, '\n'); newline > 0 {
+			chunk = chunk[:newline+1]
+		}
+		contents = append(contents, chunk)
+		sample = sample[len(chunk):]
+	}
+
+	// IDs below 32768 are reserved
+	var id [4]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+
+	// Tune the tables for the level we compress with, the default is the slowest one
+	level := zstd.SpeedDefault
+	if options.level != 0 {
+		level = zstd.EncoderLevelFromZstd(options.level)
+	}
+
+	dictionary, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       binary.BigEndian.Uint32(id[:])%(1<<31-32768) + 32768,
+		Contents: contents,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    level,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path+".tmp", dictionary, 0644); err != nil {
+		return err
+	}
+	return renameFile(path+".tmp", path)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Everything a rotation condition can look at
+type rotationFacts struct {
+	size  int64
+	age   time.Duration
+	idle  time.Duration
+	lines int64
+	now   time.Time
+}
+
+// A parsed --rotate-when expression like size > 100mb && age > 1h
+type rotationCondition struct {
+	text      string
+	holds     func(facts rotationFacts) bool
+	usesLines bool
+}
+
+// Variables are compared as numbers, sizes in bytes and ages in seconds.
+// Units on numbers are only allowed for the variable they make sense for.
+const (
+	conditionUnitNone int = iota
+	conditionUnitSize
+	conditionUnitDuration
+)
+
+type conditionVariable struct {
+	unit  int
+	value func(facts rotationFacts) float64
+}
+
+var conditionVariables = map[string]conditionVariable{
+	"size":    {conditionUnitSize, func(facts rotationFacts) float64 { return float64(facts.size) }},
+	"age":     {conditionUnitDuration, func(facts rotationFacts) float64 { return facts.age.Seconds() }},
+	"idle":    {conditionUnitDuration, func(facts rotationFacts) float64 { return facts.idle.Seconds() }},
+	"lines":   {conditionUnitNone, func(facts rotationFacts) float64 { return float64(facts.lines) }},
+	"hour":    {conditionUnitNone, func(facts rotationFacts) float64 { return float64(facts.now.Hour()) }},
+	"minute":  {conditionUnitNone, func(facts rotationFacts) float64 { return float64(facts.now.Minute()) }},
+	"weekday": {conditionUnitNone, func(facts rotationFacts) float64 { return float64(facts.now.Weekday()) }},
+}
+
+var conditionUnits = map[string]struct {
+	unit   int
+	factor float64
+}{
+	"b":  {conditionUnitSize, 1},
+	"kb": {conditionUnitSize, 1000},
+	"mb": {conditionUnitSize, 1000000},
+	"gb": {conditionUnitSize, 1000000000},
+	"ms": {conditionUnitDuration, 0.001},
+	"s":  {conditionUnitDuration, 1},
+	"m":  {conditionUnitDuration, 60},
+	"h":  {conditionUnitDuration, 3600},
+	"d":  {conditionUnitDuration, 86400},
+}
+
+// Recursive descent over the tokens, || binds weaker than && binds weaker than !
+type conditionParser struct {
+	tokens    []string
+	position  int
+	usesLines bool
+}
+
+func tokenizeCondition(text string) ([]string, error) {
+
+	tokens := make([]string, 0)
+	for i := 0; i < len(text); {
+		c := rune(text[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.HasPrefix(text[i:], "&&") || strings.HasPrefix(text[i:], "||") ||
+			strings.HasPrefix(text[i:], ">=") || strings.HasPrefix(text[i:], "<=") ||
+			strings.HasPrefix(text[i:], "==") || strings.HasPrefix(text[i:], "!="):
+			tokens = append(tokens, text[i:i+2])
+			i += 2
+		case strings.ContainsRune("()<>!", c):
+			tokens = append(tokens, text[i:i+1])
+			i++
+
+		// Numbers keep their unit, identifiers are words
+		case unicode.IsDigit(c) || c == '.' || unicode.IsLetter(c):
+			start := i
+			for i < len(text) && (unicode.IsDigit(rune(text[i])) || text[i] == '.' || unicode.IsLetter(rune(text[i]))) {
+				i++
+			}
+			tokens = append(tokens, strings.ToLower(text[start:i]))
+		default:
+			return nil, fmt.Errorf("unexpected %q at position %d", c, i+1)
+		}
+	}
+	return tokens, nil
+}
+
+func parseRotationCondition(text string) (*rotationCondition, error) {
+
+	tokens, err := tokenizeCondition(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rotation condition %s: %s", text, err)
+	}
+	parser := &conditionParser{tokens: tokens}
+	holds, err := parser.parseOr()
+	if err == nil && parser.position < len(tokens) {
+		err = errors.New("unexpected " + tokens[parser.position])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid rotation condition %s: %s", text, err)
+	}
+	return &rotationCondition{text: text, holds: holds, usesLines: parser.usesLines}, nil
+}
+
+func (parser *conditionParser) peek() string {
+	if parser.position < len(parser.tokens) {
+		return parser.tokens[parser.position]
+	}
+	return ""
+}
+
+func (parser *conditionParser) next() string {
+	token := parser.peek()
+	parser.position++
+	return token
+}
+
+func (parser *conditionParser) parseOr() (func(rotationFacts) bool, error) {
+	left, err := parser.parseAnd()
+	for err == nil && parser.peek() == "||" {
+		parser.next()
+		var right func(rotationFacts) bool
+		if right, err = parser.parseAnd(); err == nil {
+			first := left
+			left = func(facts rotationFacts) bool { return first(facts) || right(facts) }
+		}
+	}
+	return left, err
+}
+
+func (parser *conditionParser) parseAnd() (func(rotationFacts) bool, error) {
+	left, err := parser.parseNot()
+	for err == nil && parser.peek() == "&&" {
+		parser.next()
+		var right func(rotationFacts) bool
+		if right, err = parser.parseNot(); err == nil {
+			first := left
+			left = func(facts rotationFacts) bool { return first(facts) && right(facts) }
+		}
+	}
+	return left, err
+}
+
+func (parser *conditionParser) parseNot() (func(rotationFacts) bool, error) {
+	switch parser.peek() {
+	case "!":
+		parser.next()
+		inner, err := parser.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(facts rotationFacts) bool { return !inner(facts) }, nil
+	case "(":
+		parser.next()
+		inner, err := parser.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if parser.next() != ")" {
+			return nil, errors.New("missing )")
+		}
+		return inner, nil
+	}
+	return parser.parseComparison()
+}
+
+// A variable compared to a number, like size > 100mb
+func (parser *conditionParser) parseComparison() (func(rotationFacts) bool, error) {
+
+	name := parser.next()
+	variable, ok := conditionVariables[name]
+	if !ok {
+		return nil, errors.New("unknown variable " + name + ", use size, age, idle, lines, hour, minute or weekday")
+	}
+	if name == "lines" {
+		parser.usesLines = true
+	}
+
+	operator := parser.next()
+	compare, ok := map[string]func(a, b float64) bool{
+		">":  func(a, b float64) bool { return a > b },
+		">=": func(a, b float64) bool { return a >= b },
+		"<":  func(a, b float64) bool { return a < b },
+		"<=": func(a, b float64) bool { return a <= b },
+		"==": func(a, b float64) bool { return a == b },
+		"!=": func(a, b float64) bool { return a != b },
+	}[operator]
+	if !ok {
+		return nil, errors.New("expected a comparison after " + name)
+	}
+
+	literal := parser.next()
+	number := strings.TrimRightFunc(literal, unicode.IsLetter)
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return nil, errors.New("expected a number after " + name + " " + operator)
+	}
+	if suffix := literal[len(number):]; suffix != "" {
+		unit, ok := conditionUnits[suffix]
+		if !ok || unit.unit != variable.unit {
+			return nil, errors.New("unit " + suffix + " does not fit " + name)
+		}
+		value *= unit.factor
+	}
+
+	return func(facts rotationFacts) bool { return compare(variable.value(facts), value) }, nil
+}
+
+// A duration like 60s, 5m or 1.5h, a number without unit is seconds
+func parseDurationString(text string) (time.Duration, error) {
+
+	number := strings.TrimRightFunc(strings.ToLower(text), unicode.IsLetter)
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, err
+	}
+	if suffix := strings.ToLower(text[len(number):]); suffix != "" {
+		unit, ok := conditionUnits[suffix]
+		if !ok || unit.unit != conditionUnitDuration {
+			return 0, errors.New("unknown unit " + suffix)
+		}
+		value *= unit.factor
+	}
+	return time.Duration(value * float64(time.Second)), nil
+}
@@ -0,0 +1,8 @@
+//go:build !windows && !linux && !darwin && !netbsd && !openbsd && !solaris && !aix
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// FreeBSD and dragonfly have no O_DSYNC, waiting for timestamps as well is the closest there is
+const openDataSync int = unix.O_SYNC
@@ -0,0 +1,8 @@
+//go:build linux || darwin || netbsd || openbsd || solaris || aix
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// Every write waits for the data and the size, but not for timestamps
+const openDataSync int = unix.O_DSYNC
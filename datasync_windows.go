@@ -0,0 +1,8 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// Windows only knows write through, which covers all metadata
+const openDataSync int = os.O_SYNC
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"os"
+	"unsafe"
+)
+
+// O_DIRECT needs memory, offsets and lengths aligned to the logical block size of the disk,
+// 4096 is a multiple of it everywhere we know of.
+const directAlignment int = 4096
+
+// Memory aligned for O_DIRECT, Go only guarantees alignment for the element type
+func alignedBuffer(size int) []byte {
+	size = (size + directAlignment - 1) / directAlignment * directAlignment
+	buffer := make([]byte, size+directAlignment)
+	offset := 0
+	if remainder := int(uintptr(unsafe.Pointer(&buffer[0])) % uintptr(directAlignment)); remainder != 0 {
+		offset = directAlignment - remainder
+	}
+	return buffer[offset : offset+size]
+}
+
+// With --buffering direct the writer keeps a second descriptor opened with O_DIRECT next
+// to the output file. Whole blocks go through it and never touch the page cache, the
+// last partial block is written through the output file so readers see every line and
+// written again once it is full. The caller holds outputFileLock.
+func (state *pipelineState) openDirectFile(outputFile string, output *os.File, blockBytes int) error {
+
+	state.closeDirectFile()
+	direct, err := openDirect(outputFile)
+	if err != nil {
+		return err
+	}
+
+	// Continue after what is in the file, its last partial block is held back again
+	stat, err := output.Stat()
+	if err != nil {
+		direct.Close()
+		return err
+	}
+	tail := stat.Size() % int64(directAlignment)
+	state.directOffset = stat.Size() - tail
+	if state.pendingWrites, err = readFileRange(outputFile, state.directOffset, tail); err != nil {
+		direct.Close()
+		return err
+	}
+	state.pendingFlushed = len(state.pendingWrites)
+	state.pendingFile = output
+	state.directFile = direct
+	if len(state.directBuffer) < blockBytes {
+		state.directBuffer = alignedBuffer(blockBytes)
+	}
+	return nil
+}
+
+func (state *pipelineState) closeDirectFile() {
+	if state.directFile != nil {
+		state.directFile.Close()
+		state.directFile = nil
+	}
+}
+
+func readFileRange(path string, offset int64, length int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data := make([]byte, length)
+	_, err = io.ReadFull(io.NewSectionReader(file, offset, length), data)
+	return data, err
+}
+
+// Whole blocks through O_DIRECT, the rest through the output file. The caller holds outputFileLock.
+func (state *pipelineState) flushDirectWrites() error {
+
+	if len(state.pendingWrites) == state.pendingFlushed {
+		return nil
+	}
+	aligned := len(state.pendingWrites) / directAlignment * directAlignment
+	for written := 0; written < aligned; {
+		n := copy(state.directBuffer, state.pendingWrites[written:aligned])
+		if _, err := state.directFile.WriteAt(state.directBuffer[:n], state.directOffset); err != nil {
+			return err
+		}
+		state.directOffset += int64(n)
+		written += n
+	}
+
+	tail := state.pendingWrites[aligned:]
+	if len(tail) > 0 {
+		if _, err := state.pendingFile.WriteAt(tail, state.directOffset); err != nil {
+			return err
+		}
+	}
+	state.pendingWrites = append(state.pendingWrites[:0], tail...)
+	state.pendingFlushed = len(state.pendingWrites)
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const directIOSupported bool = true
+
+func openDirect(outputFile string) (*os.File, error) {
+	return os.OpenFile(outputFile, os.O_WRONLY|unix.O_DIRECT, 0644)
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Other systems have their own ways to bypass the cache, none of them is O_DIRECT
+const directIOSupported bool = false
+
+func openDirect(outputFile string) (*os.File, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// The Drain call of the control service ends the input as if the producer had closed it.
+// Everything read so far, queued for the writer or spilled to the spool still goes to the
+// output file, then the pipeline finishes like on the end of its input.
+func (state *pipelineState) startDrain(rotate bool) {
+	state.drainOnce.Do(func() {
+		state.rotateAfterDrain.Store(rotate)
+		close(state.drain)
+	})
+}
+
+// Never true for a nil channel, without --grpc-listen there is nothing to drain
+func drained(drain chan struct{}) bool {
+	select {
+	case <-drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// Reads in the background so the reader can walk away from a read that never returns,
+// a quiet producer would otherwise keep rotee from ever draining. One goroutine does all
+// reads, it is handed the size of each read and only reads while Read waits for it.
+type drainableReader struct {
+	input    io.Reader
+	drain    chan struct{}
+	buffer   []byte
+	start    sync.Once
+	requests chan int
+	results  chan drainableRead
+}
+
+type drainableRead struct {
+	n   int
+	err error
+}
+
+func newDrainableReader(input io.Reader, drain chan struct{}) *drainableReader {
+	return &drainableReader{input: input, drain: drain, requests: make(chan int), results: make(chan drainableRead, 1)}
+}
+
+// The buffer only belongs to this goroutine between a request and its result
+func (reader *drainableReader) readRequested() {
+	for size := range reader.requests {
+		n, err := reader.input.Read(reader.buffer[:size])
+		reader.results <- drainableRead{n, err}
+	}
+}
+
+func (reader *drainableReader) Read(data []byte) (int, error) {
+
+	// A read abandoned because of a drain still owns the buffer, nothing may read after it
+	if drained(reader.drain) {
+		return 0, io.EOF
+	}
+	reader.start.Do(func() { go reader.readRequested() })
+	if len(reader.buffer) < len(data) {
+		reader.buffer = make([]byte, len(data))
+	}
+	reader.requests <- len(data)
+
+	select {
+	case read := <-reader.results:
+		return copy(data, reader.buffer[:read.n]), read.err
+	case <-reader.drain:
+		return 0, io.EOF
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// What to do with lines for stdout when the echo buffer is full
+const (
+	echoDropNewest string = "newest"
+	echoDropOldest string = "oldest"
+	echoDropNever  string = "never"
+)
+
+func parseEchoDropPolicy(policy string) (string, error) {
+	switch policy {
+	case echoDropNewest, echoDropOldest, echoDropNever:
+		return policy, nil
+	}
+	return "", errors.New("Unknown echo drop policy " + policy + ", use newest, oldest or never")
+}
+
+// What to do when writing to stdout fails, because the reader closed the pipe or the terminal is gone
+const (
+	echoErrorIgnore  string = "ignore"
+	echoErrorDisable string = "disable"
+	echoErrorExit    string = "exit"
+)
+
+func parseEchoErrorPolicy(policy string) (string, error) {
+	switch policy {
+	case echoErrorIgnore, echoErrorDisable, echoErrorExit:
+		return policy, nil
+	}
+	return "", errors.New("Unknown echo error policy " + policy + ", use ignore, disable or exit")
+}
+
+// Lines for stdout go through their own goroutine, so a paused terminal or a
+// slow reader of our stdout only loses echoed lines and never stalls the output file.
+// Line sinks get their lines the same way.
+type echoWriter struct {
+
+	// Each entry holds the lines of one read, not a single line. The buffer is bounded
+	// by the lines in it, a read with more lines than fit takes the whole buffer.
+	lines    chan string
+	lock     sync.Mutex
+	room     *sync.Cond
+	queued   int
+	capacity int
+	policy   string
+	onError  string
+	dropped  atomic.Int64
+	done     chan struct{}
+
+	// Where the lines go, for the activity log
+	name string
+}
+
+func newEchoWriter(name string, output io.Writer, bufferLines int, policy string, onError string) *echoWriter {
+	echo := &echoWriter{
+		lines:    make(chan string, bufferLines),
+		capacity: bufferLines,
+		policy:   policy,
+		onError:  onError,
+		done:     make(chan struct{}),
+		name:     name,
+	}
+	echo.room = sync.NewCond(&echo.lock)
+	go echo.run(output)
+	return echo
+}
+
+// Lines an entry takes up in the buffer, the rest of a line counts as one
+func (echo *echoWriter) size(text string) int {
+	return min(max(strings.Count(text, "\n"), 1), echo.capacity)
+}
+
+func (echo *echoWriter) write(text string) {
+
+	size := echo.size(text)
+	echo.lock.Lock()
+	for echo.queued+size > echo.capacity {
+		if echo.policy == echoDropNewest {
+			echo.lock.Unlock()
+			echo.dropped.Add(int64(strings.Count(text, "\n")))
+			return
+		}
+
+		// Make room by throwing away the oldest lines, unless the echo goroutine is about to
+		if echo.policy == echoDropOldest {
+			select {
+			case oldest := <-echo.lines:
+				echo.queued -= echo.size(oldest)
+				echo.dropped.Add(int64(strings.Count(oldest, "\n")))
+				continue
+			default:
+			}
+		}
+		echo.room.Wait()
+	}
+	echo.queued += size
+	echo.lock.Unlock()
+
+	// Every entry takes at least one line, so the channel always has room
+	echo.lines <- text
+}
+
+// The echo goroutine took an entry out of the buffer
+func (echo *echoWriter) taken(text string) {
+	echo.lock.Lock()
+	echo.queued -= echo.size(text)
+	echo.room.Broadcast()
+	echo.lock.Unlock()
+}
+
+func (echo *echoWriter) run(output io.Writer) {
+
+	defer close(echo.done)
+	writer := bufio.NewWriter(output)
+	failing := false
+	disabled := false
+
+	// Unless asked to exit, a broken stdout is no reason to stop writing the output file.
+	// The buffer keeps its error, with ignore we start over with an empty one and try again.
+	failed := func(err error) {
+		switch {
+		case echo.onError == echoErrorExit:
+			logActivity("Failed to write to %s, exiting. Error: %s", echo.name, err)
+			exitf(exitOutputError, "Failed to write to %s: %s", echo.name, err)
+		case echo.onError == echoErrorDisable:
+			logActivity("Failed to write to %s, not writing to it anymore. Error: %s", echo.name, err)
+			disabled = true
+		case !failing:
+			logActivity("Failed to write to %s, dropping lines until it works again. Error: %s", echo.name, err)
+			failing = true
+		}
+		writer.Reset(output)
+	}
+
+	for text := range echo.lines {
+		echo.taken(text)
+
+		// Keep taking lines, nobody waits for a disabled echo
+		if disabled {
+			continue
+		}
+		_, err := writer.WriteString(text)
+
+		// Batch up what is already waiting, flush once we caught up
+		if err == nil && len(echo.lines) == 0 {
+			if dropped := echo.dropped.Swap(0); dropped > 0 {
+				logActivity("%s could not keep up, dropped %d lines", echo.name, dropped)
+			}
+			err = writer.Flush()
+		}
+		if err != nil {
+			failed(err)
+		} else if failing && writer.Buffered() == 0 {
+			logActivity("Writing to %s works again", echo.name)
+			failing = false
+		}
+	}
+	if !disabled {
+		if err := writer.Flush(); err != nil {
+			logActivity("Failed to write the last lines to %s. Error: %s", echo.name, err)
+		}
+	}
+}
+
+// Wait until everything buffered made it to the output
+func (echo *echoWriter) close() {
+	close(echo.lines)
+	<-echo.done
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Indexes lines into Elasticsearch or OpenSearch, one _bulk request for every batch
+type elasticsearchIndexer struct {
+	url      string
+	index    string
+	host     string
+	failures sinkFailures
+}
+
+type elasticsearchDocument struct {
+	Timestamp time.Time `json:"@timestamp"`
+	Message   string    `json:"message"`
+	Host      string    `json:"host"`
+}
+
+// Only what we need of the answer, which lines did not make it
+type elasticsearchBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// Index names like rotee-%Y.%m.%d get the date of the batch in UTC
+func formatIndexPattern(pattern string, now time.Time) string {
+	now = now.UTC()
+	return strings.NewReplacer(
+		"%Y", now.Format("2006"),
+		"%m", now.Format("01"),
+		"%d", now.Format("02"),
+		"%H", now.Format("15"),
+	).Replace(pattern)
+}
+
+func newElasticsearchIndexer(target string, index string) (*elasticsearchIndexer, error) {
+
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, errors.New("expected an Elasticsearch URL like http://elasticsearch:9200")
+	}
+	parsed.Path = strings.TrimSuffix(parsed.Path, "/") + "/_bulk"
+
+	// Elasticsearch wants lowercase index names without a few special characters
+	if name := formatIndexPattern(index, time.Now()); name == "" || name != strings.ToLower(name) ||
+		strings.ContainsAny(name, " \\/*?\"<>|,#") {
+		return nil, errors.New("invalid index pattern " + index)
+	}
+
+	hostname, _ := os.Hostname()
+	return &elasticsearchIndexer{url: parsed.String(), index: index, host: hostname,
+		failures: sinkFailures{name: "Elasticsearch"}}, nil
+}
+
+func (indexer *elasticsearchIndexer) sendLines(lines [][]byte) {
+
+	now := time.Now()
+	action, err := json.Marshal(map[string]any{"index": map[string]string{"_index": formatIndexPattern(indexer.index, now)}})
+	if err != nil {
+		indexer.failures.failed(err, len(lines))
+		return
+	}
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, line := range lines {
+		body.Write(action)
+		body.WriteByte('\n')
+		encoder.Encode(elasticsearchDocument{Timestamp: now, Message: string(line), Host: indexer.host})
+	}
+
+	var result elasticsearchBulkResponse
+	err = sendWithRetries(func() error {
+		response, err := webhookClient.Post(indexer.url, "application/x-ndjson", bytes.NewReader(body.Bytes()))
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500 {
+			return fmt.Errorf("Elasticsearch returned status %s", response.Status)
+		} else if response.StatusCode < 200 || response.StatusCode > 299 {
+			return permanentSinkError{fmt.Errorf("Elasticsearch returned status %s", response.Status)}
+		}
+		return json.NewDecoder(response.Body).Decode(&result)
+	})
+	if err != nil {
+		indexer.failures.failed(err, len(lines))
+		return
+	}
+
+	// A bulk request can succeed while single documents in it were rejected
+	rejected := 0
+	var reason error
+	for _, item := range result.Items {
+		for _, outcome := range item {
+			if outcome.Status < 200 || outcome.Status > 299 {
+				rejected++
+				reason = fmt.Errorf("%s: %s", outcome.Error.Type, outcome.Error.Reason)
+			}
+		}
+	}
+	if rejected > 0 {
+		indexer.failures.failed(reason, rejected)
+	} else {
+		indexer.failures.succeeded()
+	}
+}
+
+func (indexer *elasticsearchIndexer) close() {
+	indexer.failures.close()
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// Short names for the encodings legacy applications use most,
+// everything else is looked up in the IANA registry
+var inputEncodings = map[string]encoding.Encoding{
+	"latin1":  charmap.ISO8859_1,
+	"cp1252":  charmap.Windows1252,
+	"utf16":   unicode.UTF16(unicode.LittleEndian, unicode.UseBOM),
+	"utf16le": unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	"utf16be": unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+}
+
+// Find the encoding the input is in, nil means it is UTF-8 already
+func parseInputEncoding(name string) (encoding.Encoding, error) {
+
+	name = strings.ToLower(name)
+	if name == "" || name == "utf8" || name == "utf-8" {
+		return nil, nil
+	}
+	if enc, ok := inputEncodings[name]; ok {
+		return enc, nil
+	}
+	if enc, err := ianaindex.IANA.Encoding(name); err == nil && enc != nil {
+		return enc, nil
+	}
+	return nil, errors.New("Unknown input encoding " + name + ", use latin1, cp1252, utf16, utf16le, utf16be or an IANA name")
+}
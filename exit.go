@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+)
+
+// Exit codes, so whatever supervises rotee can tell what went wrong without reading logs.
+// 1 is anything unexpected, go itself exits with 2 on a panic.
+const (
+	exitConfigError   int = 3
+	exitInputError    int = 4
+	exitOutputError   int = 5
+	exitRotationError int = 6
+)
+
+// Log like log.Fatalf and exit with the given code
+func exitf(code int, format string, v ...any) {
+	log.Printf(format, v...)
+	os.Exit(code)
+}
+
+// Whether a failed rotation that nobody waits for, like a timed one, stops rotee.
+// Writes that fail always do, the data would be lost otherwise.
+const (
+	errorModeFailFast   string = "fail-fast"
+	errorModeBestEffort string = "best-effort"
+)
+
+func parseErrorMode(mode string) (string, error) {
+	switch mode {
+	case errorModeFailFast, errorModeBestEffort:
+		return mode, nil
+	}
+	return "", errors.New("Unknown error mode " + mode + ", use fail-fast or best-effort")
+}
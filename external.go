@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// With --external-rotation the system logrotate moves the output file away and rotee only
+// writes. The output file is reopened on SIGHUP, like from a postrotate script, and whenever
+// the path no longer leads to the file that was there before, for logrotate without a postrotate.
+// copytruncate needs neither, the output file is opened for appending.
+func watchExternalRotation(outputFile string, config rotateConfig) {
+
+	logActivity("Leaving rotation of %s to logrotate, reopening it on SIGHUP or when it was moved", outputFile)
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	known, _ := os.Stat(outputFile)
+	for {
+		select {
+		case <-hangup:
+			logActivity("Got SIGHUP, reopening %s", outputFile)
+			config.state.reloadOutputFile.Store(true)
+		case <-time.After(time.Millisecond * time.Duration(config.scanFrequencySeconds*1000)):
+		}
+
+		// A missing file is created by the writer with the next line, whoever
+		// creates it first, the path is the one to follow from then on
+		current, err := os.Stat(outputFile)
+		if err != nil {
+			if known != nil {
+				logActivity("%s was moved away, reopening", outputFile)
+				config.state.reloadOutputFile.Store(true)
+			}
+			known = nil
+			continue
+		}
+		if known != nil && !os.SameFile(known, current) {
+			logActivity("%s was replaced, reopening", outputFile)
+			config.state.reloadOutputFile.Store(true)
+		}
+		known = current
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+	"os"
+	"syscall"
+	"time"
+)
+
+// How often renames and deletes are retried when another process has the file open.
+// Set from --rename-retries, only windows ever reports this.
+var renameRetries int
+
+const defaultRenameRetries int = 5
+
+const renameRetryDelay time.Duration = 100 * time.Millisecond
+
+// Set from --network-fs, file operations are also retried when the server does not answer
+// in time or the client's view of a file went stale.
+var networkFS bool
+
+func isTransientNetworkError(err error) bool {
+	return errors.Is(err, syscall.ESTALE) || errors.Is(err, syscall.ETIMEDOUT) ||
+		errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EAGAIN)
+}
+
+// Antivirus scanners and indexers open new files for a moment, on windows that
+// makes renaming or deleting them fail. Wait a little longer every attempt.
+func retryWhileInUse(path string, operation func() error) error {
+	err := operation()
+	for attempt := 0; attempt < renameRetries; attempt++ {
+		delay := renameRetryDelay << attempt
+		if networkFS && isTransientNetworkError(err) {
+
+			// Several clients of the same server should not all come back at the same moment
+			logActivity("File %s is not available on the network file system, retrying. Error: %s", path, err)
+			delay += rand.N(delay)
+		} else if isSharingViolation(err) {
+			logActivity("File %s is in use by another process, retrying. Error: %s", path, err)
+		} else {
+			break
+		}
+		time.Sleep(delay)
+		err = operation()
+	}
+	return err
+}
+
+func renameFile(from string, to string) error {
+	return retryWhileInUse(from, func() error { return os.Rename(from, to) })
+}
+
+func removeFile(path string) error {
+	return retryWhileInUse(path, func() error { return os.Remove(path) })
+}
+
+func statFile(path string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := retryWhileInUse(path, func() (err error) {
+		info, err = os.Stat(path)
+		return err
+	})
+	return info, err
+}
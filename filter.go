@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"unicode/utf8"
+)
+
+// Changes the data on its way to the output file. Filters see the input chunk
+// by chunk and may keep state in between, they append their result to dst.
+type dataFilter interface {
+	filter(dst []byte, src []byte) []byte
+}
+
+// Run data through all filters, scratch holds the buffers so they can be reused
+func applyFilters(filters []dataFilter, data []byte, scratch *[2][]byte) []byte {
+	for i, filter := range filters {
+		scratch[i%2] = filter.filter(scratch[i%2][:0], data)
+		data = scratch[i%2]
+	}
+	return data
+}
+
+// Turns CRLF and lone CR into LF. A CR at the end of one chunk is remembered,
+// so a CRLF split between two chunks still becomes a single LF.
+type newlineNormalizer struct {
+	afterCR bool
+}
+
+func (normalizer *newlineNormalizer) filter(dst []byte, src []byte) []byte {
+	for len(src) > 0 {
+		if normalizer.afterCR && src[0] == '\n' {
+			src = src[1:]
+		}
+		normalizer.afterCR = false
+
+		i := bytes.IndexByte(src, '\r')
+		if i < 0 {
+			return append(dst, src...)
+		}
+		dst = append(dst, src[:i]...)
+		dst = append(dst, '\n')
+		normalizer.afterCR = true
+		src = src[i+1:]
+	}
+	return dst
+}
+
+// What to do with bytes that are not valid UTF-8
+const (
+	utf8PolicyPass    string = "pass"
+	utf8PolicyReplace string = "replace"
+	utf8PolicyEscape  string = "escape"
+)
+
+func parseUtf8Policy(policy string) (string, error) {
+	switch policy {
+	case utf8PolicyPass, utf8PolicyReplace, utf8PolicyEscape:
+		return policy, nil
+	}
+	return "", errors.New("Unknown utf8 policy " + policy + ", use pass, replace or escape")
+}
+
+// Replaces every byte that is not part of valid UTF-8 with U+FFFD or escapes it
+// as \xff. A character cut off at the end of a chunk waits for the rest of it.
+type utf8Sanitizer struct {
+	escape  bool
+	pending []byte
+}
+
+func (sanitizer *utf8Sanitizer) filter(dst []byte, src []byte) []byte {
+
+	if len(sanitizer.pending) > 0 {
+		src = append(sanitizer.pending, src...)
+		sanitizer.pending = nil
+	}
+
+	start := 0
+	for i := 0; i < len(src); {
+		if src[i] < utf8.RuneSelf {
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(src[i:])
+		if r != utf8.RuneError || size > 1 {
+			i += size
+			continue
+		}
+		dst = append(dst, src[start:i]...)
+		if !utf8.FullRune(src[i:]) {
+			sanitizer.pending = append([]byte{}, src[i:]...)
+			return dst
+		}
+		if sanitizer.escape {
+			dst = append(dst, '\\', 'x', "0123456789abcdef"[src[i]>>4], "0123456789abcdef"[src[i]&15])
+		} else {
+			dst = utf8.AppendRune(dst, utf8.RuneError)
+		}
+		i++
+		start = i
+	}
+	return append(dst, src[start:]...)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const fluentDialTimeout = 5 * time.Second
+const fluentWriteTimeout = 10 * time.Second
+
+// Timestamps with nanoseconds, the EventTime extension of the forward protocol
+type fluentEventTime time.Time
+
+func init() {
+	msgpack.RegisterExt(0, (*fluentEventTime)(nil))
+}
+
+func (eventTime *fluentEventTime) MarshalMsgpack() ([]byte, error) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, uint32(time.Time(*eventTime).Unix()))
+	binary.BigEndian.PutUint32(data[4:], uint32(time.Time(*eventTime).Nanosecond()))
+	return data, nil
+}
+
+func (eventTime *fluentEventTime) UnmarshalMsgpack(data []byte) error {
+	if len(data) != 8 {
+		return errors.New("EventTime must be 8 bytes")
+	}
+	*eventTime = fluentEventTime(time.Unix(int64(binary.BigEndian.Uint32(data)), int64(binary.BigEndian.Uint32(data[4:]))))
+	return nil
+}
+
+// Sends lines to fluentd or fluent-bit with the forward protocol, one
+// message in forward mode for every batch. The connection is opened on first use
+// and again after it broke.
+type fluentForwarder struct {
+	address  string
+	tag      string
+	conn     net.Conn
+	failures sinkFailures
+}
+
+func newFluentForwarder(address string, tag string) *fluentForwarder {
+	return &fluentForwarder{address: address, tag: tag, failures: sinkFailures{name: "fluent at " + address}}
+}
+
+func (forwarder *fluentForwarder) sendLines(lines [][]byte) {
+
+	now := fluentEventTime(time.Now())
+	entries := make([]any, len(lines))
+	for i, line := range lines {
+		entries[i] = []any{&now, map[string]string{"message": string(line)}}
+	}
+	message, err := msgpack.Marshal([]any{forwarder.tag, entries})
+	if err != nil {
+		forwarder.failures.failed(err, len(lines))
+		return
+	}
+
+	err = sendWithRetries(func() error {
+		if forwarder.conn == nil {
+			conn, err := net.DialTimeout("tcp", forwarder.address, fluentDialTimeout)
+			if err != nil {
+				return err
+			}
+			forwarder.conn = conn
+		}
+		forwarder.conn.SetWriteDeadline(time.Now().Add(fluentWriteTimeout))
+		if _, err := forwarder.conn.Write(message); err != nil {
+			forwarder.conn.Close()
+			forwarder.conn = nil
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		forwarder.failures.failed(err, len(lines))
+	} else {
+		forwarder.failures.succeeded()
+	}
+}
+
+func (forwarder *fluentForwarder) close() {
+	if forwarder.conn != nil {
+		forwarder.conn.Close()
+	}
+	forwarder.failures.close()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+const gelfDialTimeout = 5 * time.Second
+const gelfWriteTimeout = 10 * time.Second
+
+// Graylog puts chunks back together from at most 128 datagrams
+const gelfMaxChunks = 128
+const gelfChunkHeaderSize = 12
+
+// One line as a GELF 1.1 message, additional fields start with an underscore
+type gelfMessage struct {
+	Version      string  `json:"version"`
+	Host         string  `json:"host"`
+	ShortMessage string  `json:"short_message"`
+	Timestamp    float64 `json:"timestamp"`
+	Level        int     `json:"level"`
+	LogFile      string  `json:"_log_file"`
+}
+
+// Sends lines to Graylog, either as UDP datagrams that get chunked when they are
+// too big or as null terminated messages over TCP. The TCP connection is opened
+// on first use and again after it broke.
+type gelfSender struct {
+	network   string
+	address   string
+	chunkSize int
+	host      string
+	logFile   string
+	conn      net.Conn
+	failures  sinkFailures
+}
+
+// The target looks like udp://graylog:12201 or tcp://graylog:12201
+func newGELFSender(target string, chunkSize int, logFile string) (*gelfSender, error) {
+
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if (parsed.Scheme != "udp" && parsed.Scheme != "tcp") || parsed.Host == "" {
+		return nil, errors.New("expected a target like udp://graylog:12201 or tcp://graylog:12201")
+	}
+	if chunkSize <= gelfChunkHeaderSize {
+		return nil, errors.New("GELF chunk size must be bigger than the chunk header")
+	}
+
+	hostname, _ := os.Hostname()
+	return &gelfSender{
+		network:   parsed.Scheme,
+		address:   parsed.Host,
+		chunkSize: chunkSize,
+		host:      hostname,
+		logFile:   logFile,
+		failures:  sinkFailures{name: "Graylog at " + parsed.Host},
+	}, nil
+}
+
+func (sender *gelfSender) sendLines(lines [][]byte) {
+
+	now := float64(time.Now().UnixMicro()) / 1e6
+	for _, line := range lines {
+		message, err := json.Marshal(gelfMessage{Version: "1.1", Host: sender.host, ShortMessage: string(line),
+			Timestamp: now, Level: 6, LogFile: sender.logFile})
+		if err == nil {
+			err = sendWithRetries(func() error { return sender.send(message) })
+		}
+		if err != nil {
+			sender.failures.failed(err, 1)
+		} else {
+			sender.failures.succeeded()
+		}
+	}
+}
+
+func (sender *gelfSender) send(message []byte) error {
+
+	if sender.conn == nil {
+		conn, err := net.DialTimeout(sender.network, sender.address, gelfDialTimeout)
+		if err != nil {
+			return err
+		}
+		sender.conn = conn
+	}
+	sender.conn.SetWriteDeadline(time.Now().Add(gelfWriteTimeout))
+
+	var err error
+	if sender.network == "tcp" {
+		_, err = sender.conn.Write(append(message, 0))
+	} else {
+		err = sender.sendDatagrams(message)
+	}
+	if err != nil {
+		sender.conn.Close()
+		sender.conn = nil
+	}
+	return err
+}
+
+// Messages that do not fit into one datagram are split into chunks, each
+// starting with the magic bytes, the message id, its number and the count
+func (sender *gelfSender) sendDatagrams(message []byte) error {
+
+	if len(message) <= sender.chunkSize {
+		_, err := sender.conn.Write(message)
+		return err
+	}
+
+	payloadSize := sender.chunkSize - gelfChunkHeaderSize
+	count := (len(message) + payloadSize - 1) / payloadSize
+	if count > gelfMaxChunks {
+		return permanentSinkError{errors.New("message too long for GELF over UDP, it needs more than 128 chunks")}
+	}
+
+	chunk := make([]byte, 0, sender.chunkSize)
+	id := make([]byte, 8)
+	rand.Read(id)
+	for i := 0; i < count; i++ {
+		end := min((i+1)*payloadSize, len(message))
+		chunk = append(chunk[:0], 0x1e, 0x0f)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, message[i*payloadSize:end]...)
+		if _, err := sender.conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sender *gelfSender) close() {
+	if sender.conn != nil {
+		sender.conn.Close()
+	}
+	sender.failures.close()
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Implements the Control service of control.proto for one pipeline
+type controlServer struct {
+	wg         *sync.WaitGroup
+	outputFile string
+	config     rotateConfig
+}
+
+// Written by hand like protoc-gen-go-grpc would, the messages are all well known types
+var controlServiceDesc = grpc.ServiceDesc{
+	ServiceName: "rotee.Control",
+	HandlerType: (*any)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "Rotate", Handler: controlUnaryHandler(func(server *controlServer) (any, error) {
+			return server.rotate()
+		})},
+		{MethodName: "Flush", Handler: controlUnaryHandler(func(server *controlServer) (any, error) {
+			return server.flush()
+		})},
+		{MethodName: "Prune", Handler: controlUnaryHandler(func(server *controlServer) (any, error) {
+			return server.prune()
+		})},
+		{MethodName: "Status", Handler: controlUnaryHandler(func(server *controlServer) (any, error) {
+			return server.status()
+		})},
+		{MethodName: "Hold", Handler: controlUnaryHandler(func(server *controlServer) (any, error) {
+			return server.setHold(true)
+		})},
+		{MethodName: "Resume", Handler: controlUnaryHandler(func(server *controlServer) (any, error) {
+			return server.setHold(false)
+		})},
+		{MethodName: "PauseWriter", Handler: controlUnaryHandler(func(server *controlServer) (any, error) {
+			return server.pauseWriter(true)
+		})},
+		{MethodName: "ResumeWriter", Handler: controlUnaryHandler(func(server *controlServer) (any, error) {
+			return server.pauseWriter(false)
+		})},
+		{MethodName: "Drain", Handler: func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+			rotate := new(wrapperspb.BoolValue)
+			if err := dec(rotate); err != nil {
+				return nil, err
+			}
+			return srv.(*controlServer).drain(ctx, rotate.Value)
+		}},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "Tail", ServerStreams: true, Handler: func(srv any, stream grpc.ServerStream) error {
+			if err := stream.RecvMsg(new(emptypb.Empty)); err != nil {
+				return err
+			}
+			return srv.(*controlServer).tail(stream)
+		}},
+	},
+	Metadata: "control.proto",
+}
+
+// Every unary call but Drain takes an Empty, so only the answer differs
+func controlUnaryHandler(call func(server *controlServer) (any, error)) grpc.MethodHandler {
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		if err := dec(new(emptypb.Empty)); err != nil {
+			return nil, err
+		}
+		return call(srv.(*controlServer))
+	}
+}
+
+// Let other services rotate, sync, prune and follow the output file. Like the
+// HTTP listener this has no authentication, only bind it where that is fine.
+func serveGRPC(wg *sync.WaitGroup, address string, outputFile string, config rotateConfig) {
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		exitf(exitConfigError, "Can not listen on %s: %s", address, err)
+	}
+	logActivity("Serving gRPC control service on %s", listener.Addr())
+
+	server := grpc.NewServer()
+	server.RegisterService(&controlServiceDesc, &controlServer{wg: wg, outputFile: outputFile, config: config})
+
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			logActivity("gRPC listener on %s stopped. Error: %s", address, err)
+		}
+	}()
+}
+
+func (server *controlServer) rotate() (*wrapperspb.StringValue, error) {
+
+	// Do not let rotee exit while we rotate
+	server.wg.Add(1)
+	defer server.wg.Done()
+
+	config := server.config
+	if config.externalRotation {
+		return nil, status.Error(codes.FailedPrecondition, "rotation is left to logrotate")
+	}
+	if config.hold.held() {
+		return nil, status.Error(codes.FailedPrecondition, "rotations are on hold")
+	}
+	config.rotationID = newRotationID()
+	logRotation(config.rotationID, "Starting rotate because of a gRPC request")
+	if err := requestRotation(config); errors.Is(err, errRotationRateLimited) {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	} else if err != nil && !errors.Is(err, errNothingToRotate) {
+		logRotation(config.rotationID, "Error during logrotate: %s", err)
+		reportFailure(config, "rotate", server.outputFile, "", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return wrapperspb.String(config.rotationID), nil
+}
+
+// Writes held back by --buffering block go out first, after that syncing any handle of the file syncs all of them
+func (server *controlServer) flush() (*emptypb.Empty, error) {
+
+	server.config.state.outputFileLock.Lock()
+	defer server.config.state.outputFileLock.Unlock()
+
+	if err := server.config.state.flushPendingWrites(); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	resolved, err := resolveOutputFile(server.outputFile, server.config)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	output, err := os.Open(resolved)
+	if errors.Is(err, os.ErrNotExist) {
+		return &emptypb.Empty{}, nil
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer output.Close()
+	if err := output.Sync(); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	logActivity("Synced %s to disk because of a gRPC request", resolved)
+	return &emptypb.Empty{}, nil
+}
+
+// Resume only lifts the hold of Hold, a --hold-file keeps holding as long as it exists
+func (server *controlServer) setHold(held bool) (*emptypb.Empty, error) {
+	server.config.hold.requested.Store(held)
+	server.config.hold.held()
+	return &emptypb.Empty{}, nil
+}
+
+// The main writer feeds the routes, so it pauses first and resumes last
+func (server *controlServer) pauseWriter(pause bool) (*emptypb.Empty, error) {
+
+	states := []*pipelineState{server.config.state}
+	for _, route := range server.config.routes {
+		states = append(states, route.config.state)
+	}
+	if !pause {
+		slices.Reverse(states)
+	}
+	for _, state := range states {
+		if err := requestWriterPause(state, pause); errors.Is(err, errWriterNotAnswering) {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		} else if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// Answers right away, the pipeline finishes like at the end of its input. A paused writer has to
+// resume for that, a rotation on hold is left out.
+func (server *controlServer) drain(ctx context.Context, rotate bool) (*emptypb.Empty, error) {
+
+	if rotate && server.config.externalRotation {
+		return nil, status.Error(codes.FailedPrecondition, "rotation is left to logrotate")
+	}
+
+	// The context ends once the answer went out, rotee must not exit before that
+	server.wg.Add(1)
+	go func() {
+		<-ctx.Done()
+		server.wg.Done()
+	}()
+	logActivity("Draining %s because of a gRPC request, no more input is read", server.outputFile)
+
+	// The routes finish after the main writer, they have to know before it does
+	for _, route := range server.config.routes {
+		route.config.state.rotateAfterDrain.Store(rotate)
+	}
+	server.config.state.startDrain(rotate)
+	if server.config.state.writerPaused.Load() {
+		return server.pauseWriter(false)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (server *controlServer) prune() (*structpb.ListValue, error) {
+
+	server.wg.Add(1)
+	defer server.wg.Done()
+
+	// Rotations move the archives around, wait for them
+	config := server.config
+	config.rotationID = newRotationID()
+	config.state.rotateLock.Lock()
+	defer config.state.rotateLock.Unlock()
+
+	resolved, err := resolveOutputFile(server.outputFile, config)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	logRotation(config.rotationID, "Applying retention rules because of a gRPC request")
+	archiveBase := makeArchiveBase(resolved, config)
+	archives := orderArchives(findAllArchives(archiveBase), config.archiveNaming)
+	pruned := applyRetentionRules(archives, loadManifest(archiveBase, archives), archiveBase, resolved, config)
+	if config.pruneOrphans {
+		pruned = append(pruned, pruneOrphans(archiveBase, config, 0)...)
+	}
+	if len(pruned) > 0 {
+		notify(config, notifyEvent{Event: "prune", OutputFile: resolved, Pruned: pruned})
+	}
+
+	paths := make([]any, len(pruned))
+	for i, path := range pruned {
+		paths[i] = path
+	}
+	list, err := structpb.NewList(paths)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return list, nil
+}
+
+func (server *controlServer) status() (*structpb.Struct, error) {
+
+	resolved, err := resolveOutputFile(server.outputFile, server.config)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	var size int64
+	if stat, err := os.Stat(resolved); err == nil {
+		size = stat.Size()
+	}
+
+	fields := map[string]any{
+		"output_file":            resolved,
+		"size":                   size,
+		"archives":               len(findAllArchives(makeArchiveBase(resolved, server.config))),
+		"seconds_since_rotation": server.config.state.timeSinceRotation().Seconds(),
+		"seconds_since_write":    server.config.state.timeSinceWrite().Seconds(),
+		"queued_rotations":       server.config.state.rotationQueueDepth(),
+		"rotations_held":         server.config.hold.held(),
+		"writer_paused":          server.config.state.writerPaused.Load(),
+	}
+	if server.config.countLines {
+		fields["lines"] = server.config.state.linesWritten.Load()
+	}
+	if original := server.config.state.bytesBeforeCompression.Load(); original > 0 {
+		compressed := server.config.state.bytesAfterCompression.Load()
+		fields["compression_original_bytes"] = original
+		fields["compression_compressed_bytes"] = compressed
+		fields["compression_saved_bytes"] = original - compressed
+	}
+	result, err := structpb.NewStruct(fields)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return result, nil
+}
+
+// Follow the output file like tail -F. A rotation renames it away, we finish
+// reading what is left in there and continue with the new one from the start.
+func (server *controlServer) tail(stream grpc.ServerStream) error {
+
+	var input *os.File
+	defer func() {
+		if input != nil {
+			input.Close()
+		}
+	}()
+
+	buffer := make([]byte, 32*1024)
+	for {
+		if input == nil {
+			if resolved, err := resolveOutputFile(server.outputFile, server.config); err == nil {
+				if input, err = os.Open(resolved); err == nil {
+					input.Seek(0, io.SeekEnd)
+				}
+			}
+		}
+
+		if input != nil {
+			n, err := input.Read(buffer)
+			if n > 0 {
+				if err := stream.SendMsg(wrapperspb.Bytes(buffer[:n])); err != nil {
+					return err
+				}
+				continue
+			}
+			if err != nil && err != io.EOF {
+				return status.Error(codes.Internal, err.Error())
+			}
+
+			// Nothing new in here, check whether the output file is still this one
+			if next := server.reopenTail(input); next != input {
+				input.Close()
+				input = next
+				continue
+			}
+		}
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-time.After(time.Millisecond * time.Duration(server.config.scanFrequencySeconds*1000)):
+		}
+	}
+}
+
+// The file to continue tailing after input ran dry, input itself if nothing changed
+func (server *controlServer) reopenTail(input *os.File) *os.File {
+
+	current, err := input.Stat()
+	if err != nil {
+		return input
+	}
+	resolved, err := resolveOutputFile(server.outputFile, server.config)
+	if err != nil {
+		return input
+	}
+	stat, err := os.Stat(resolved)
+	if err != nil {
+		return input
+	}
+
+	// Copy and truncate keeps the file, only its size gives it away
+	if os.SameFile(current, stat) {
+		if position, err := input.Seek(0, io.SeekCurrent); err == nil && stat.Size() < position {
+			input.Seek(0, io.SeekStart)
+		}
+		return input
+	}
+	next, err := os.Open(resolved)
+	if err != nil {
+		return input
+	}
+	return next
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// While a backup copies the archives or somebody looks at the output file nothing should move.
+// Rotations are held while the control service says so or while the --hold-file exists.
+// Writes go on, triggers that fire in the meantime rotate once the hold is lifted.
+// The output file and all routes share one hold.
+type rotationHold struct {
+	file string
+
+	// Set by the Hold and Resume calls of the control service
+	requested atomic.Bool
+
+	// What the last check found, so starting and ending a hold is only logged once
+	active atomic.Bool
+}
+
+func newRotationHold(holdFile string) *rotationHold {
+	return &rotationHold{file: holdFile}
+}
+
+func (hold *rotationHold) held() bool {
+
+	held := hold.requested.Load()
+	if !held && hold.file != "" {
+		if _, err := os.Stat(hold.file); err == nil {
+			held = true
+		}
+	}
+	if hold.active.CompareAndSwap(!held, held) {
+		if held {
+			logActivity("Rotations are on hold, writes continue")
+		} else {
+			logActivity("Rotations are no longer on hold")
+		}
+	}
+	return held
+}
+
+// Block a trigger that is due until the hold is lifted, rotee may exit meanwhile
+func (hold *rotationHold) waitUntilLifted(wg *sync.WaitGroup, scanFrequencySeconds float64) {
+	for hold.held() {
+		wg.Done()
+		time.Sleep(time.Millisecond * time.Duration(scanFrequencySeconds*1000))
+		wg.Add(1)
+	}
+}
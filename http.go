@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// What the archive list tells about each archive
+type httpArchiveEntry struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// Serve the output file and its archives read-only over HTTP, so logs can be
+// pulled without shell access. Nothing here can change or delete anything.
+func serveHTTP(address string, outputFile string, config rotateConfig) {
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		exitf(exitConfigError, "Can not listen on %s: %s", address, err)
+	}
+	logActivity("Serving logs on http://%s", listener.Addr())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /current", func(w http.ResponseWriter, r *http.Request) {
+		serveCurrentFile(w, r, outputFile, config)
+	})
+	mux.HandleFunc("GET /archives", func(w http.ResponseWriter, r *http.Request) {
+		serveArchiveList(w, outputFile, config)
+	})
+	mux.HandleFunc("GET /archives/{name}", func(w http.ResponseWriter, r *http.Request) {
+		serveArchive(w, r, outputFile, config)
+	})
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			logActivity("HTTP listener on %s stopped. Error: %s", address, err)
+		}
+	}()
+}
+
+func serveCurrentFile(w http.ResponseWriter, r *http.Request, outputFile string, config rotateConfig) {
+
+	resolved, err := resolveOutputFile(outputFile, config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// A rotation while we send only renames the file, we keep reading what we opened
+	input, err := os.Open(resolved)
+	if err != nil {
+		http.Error(w, "output file not found", http.StatusNotFound)
+		return
+	}
+	defer input.Close()
+	stat, err := input.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(w, r, "", stat.ModTime(), io.NewSectionReader(input, 0, stat.Size()))
+}
+
+// Archives of the output file right now, the names change with every rotation
+func findServedArchives(outputFile string, config rotateConfig) []archiveFile {
+	resolved, err := resolveOutputFile(outputFile, config)
+	if err != nil {
+		return nil
+	}
+	return orderArchives(findAllArchives(makeArchiveBase(resolved, config)), config.archiveNaming)
+}
+
+func serveArchiveList(w http.ResponseWriter, outputFile string, config rotateConfig) {
+
+	entries := make([]httpArchiveEntry, 0)
+	for _, archive := range findServedArchives(outputFile, config) {
+		if stat, err := os.Stat(archive.getPath()); err == nil {
+			entries = append(entries, httpArchiveEntry{
+				Name:     filepath.Base(archive.getPath()),
+				Size:     stat.Size(),
+				Modified: stat.ModTime(),
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func serveArchive(w http.ResponseWriter, r *http.Request, outputFile string, config rotateConfig) {
+
+	// Only names from the list are served, nothing else from the directory
+	var archive *archiveFile
+	for _, candidate := range findServedArchives(outputFile, config) {
+		if filepath.Base(candidate.getPath()) == r.PathValue("name") {
+			archive = &candidate
+			break
+		}
+	}
+	if archive == nil {
+		http.Error(w, "archive not found", http.StatusNotFound)
+		return
+	}
+
+	// Decompressed content is streamed, there is no way to seek in it
+	if r.URL.Query().Get("decompress") == "true" {
+		reader, err := openArchive(*archive, config.compressionOptions)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer reader.Close()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if _, err := io.Copy(w, reader); err != nil {
+			logActivity("Failed to send %s. Error: %s", archive.getPath(), err)
+		}
+		return
+	}
+
+	input, err := os.Open(archive.getPath())
+	if err != nil {
+		http.Error(w, "archive not found", http.StatusNotFound)
+		return
+	}
+	defer input.Close()
+	stat, err := input.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, stat.Name(), stat.ModTime(), input)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// How long to wait for Kafka to take the last lines before rotee exits
+const kafkaFlushTimeout = 10 * time.Second
+
+// Ships every line as one Kafka message, the client batches and retries on its own
+type kafkaProducer struct {
+	client *kgo.Client
+	failed atomic.Int64
+}
+
+func newKafkaProducer(brokers string, topic string) (*kafkaProducer, error) {
+
+	seeds := make([]string, 0)
+	for _, broker := range strings.Split(brokers, ",") {
+		if broker = strings.TrimSpace(broker); broker != "" {
+			seeds = append(seeds, broker)
+		}
+	}
+
+	// Idempotent writes need extra permissions on older clusters, a line twice is fine for logs
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(seeds...),
+		kgo.DefaultProduceTopic(topic),
+		kgo.DisableIdempotentWrite(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &kafkaProducer{client: client}, nil
+}
+
+// Blocks once the client buffered as much as it is allowed to, the sink buffer fills up behind it
+func (producer *kafkaProducer) sendLines(lines [][]byte) {
+	for _, line := range lines {
+		record := &kgo.Record{Value: append([]byte(nil), line...)}
+		producer.client.Produce(context.Background(), record, func(record *kgo.Record, err error) {
+			if err != nil && producer.failed.Add(1) == 1 {
+				logActivity("Failed to send lines to Kafka. Error: %s", err)
+			}
+		})
+	}
+}
+
+func (producer *kafkaProducer) close() {
+
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaFlushTimeout)
+	defer cancel()
+	if err := producer.client.Flush(ctx); err != nil {
+		logActivity("Kafka did not take all lines before exit. Error: %s", err)
+	}
+	producer.client.Close()
+	if failed := producer.failed.Load(); failed > 0 {
+		logActivity("Failed to send %d lines to Kafka", failed)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+func makeLatestLinkPath(archiveBase string, extension string) string {
+	return archiveBase + ".latest" + extension
+}
+
+func parseLatestLinkMode(mode string) (string, error) {
+	switch mode {
+	case "", "symlink", "hardlink":
+		return mode, nil
+	}
+	return "", errors.New("Unknown latest link mode " + mode + ", use symlink or hardlink")
+}
+
+// Point app.log.latest.gz at the newest archive, so downstream jobs can fetch
+// the last rotated chunk without knowing how archives are named.
+func updateLatestLink(archiveBase string, archives []archiveFile, mode string) error {
+
+	// Retention rules might have deleted archives from the list in the meantime
+	var newest *archiveFile
+	for i := range archives {
+		if _, err := os.Stat(archives[i].getPath()); err == nil {
+			newest = &archives[i]
+			break
+		}
+	}
+
+	// A link with another extension is left over from a different format
+	for _, format := range append([]*compressionFormat{{}}, compressionFormats...) {
+		if newest == nil || format.extension != newest.extension {
+			if err := os.Remove(makeLatestLinkPath(archiveBase, format.extension)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	if newest == nil {
+		return nil
+	}
+
+	// Replace the link in one go so readers never see it missing
+	linkPath := makeLatestLinkPath(archiveBase, newest.extension)
+	tempLinkPath := linkPath + ".tmp"
+	os.Remove(tempLinkPath)
+	if mode == "hardlink" {
+		if err := os.Link(newest.getPath(), tempLinkPath); err != nil {
+			return err
+		}
+	} else {
+
+		// Relative, so the archive directory can be moved or mounted elsewhere
+		if err := os.Symlink(filepath.Base(newest.getPath()), tempLinkPath); err != nil {
+			return err
+		}
+	}
+	return renameFile(tempLinkPath, linkPath)
+}
+
+// Keep a fixed path pointing at the file we write to, viewers can tail that
+// no matter how the output file is called.
+func updateCurrentSymlink(link string, outputFile string) error {
+
+	target, err := filepath.Abs(outputFile)
+	if err != nil {
+		return err
+	}
+
+	// Never replace anything that is not a link, that could be somebody's data
+	if stat, err := os.Lstat(link); err == nil && stat.Mode()&os.ModeSymlink == 0 {
+		return errors.New(link + " exists and is not a symlink")
+	} else if current, err := os.Readlink(link); err == nil && current == target {
+		return nil
+	}
+
+	tempLink := link + ".tmp"
+	os.Remove(tempLink)
+	if err := os.Symlink(target, tempLink); err != nil {
+		return err
+	}
+	return renameFile(tempLink, link)
+}
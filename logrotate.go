@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/akamensky/argparse"
+)
+
+// One block of a logrotate config, the directives in front of all blocks apply to every one of them
+type logrotateSection struct {
+	paths      []string
+	directives [][]string
+	scripts    map[string]string
+}
+
+// Directives that need nothing from rotee, rotee writes the file itself and keeps going
+var logrotateIgnored = map[string]bool{
+	"missingok": true, "nomissingok": true, "create": true,
+	"copytruncate": true, "nocopytruncate": true, "sharedscripts": true, "nosharedscripts": true,
+	"nomail": true, "nodelaycompress": true, "compressoptions": true, "su": true, "tabooext": true,
+}
+
+// Seconds between rotations for the time directives
+var logrotateIntervals = map[string]float64{
+	"hourly":  3600,
+	"daily":   86400,
+	"weekly":  7 * 86400,
+	"monthly": 30 * 86400,
+	"yearly":  365 * 86400,
+}
+
+func parseLogrotateConfig(content string) ([]logrotateSection, error) {
+
+	sections := make([]logrotateSection, 0)
+	global := logrotateSection{scripts: make(map[string]string)}
+	var current *logrotateSection
+	script := ""
+	var scriptLines []string
+
+	for number, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		// Script bodies are copied as they are up to endscript
+		if script != "" {
+			if trimmed != "endscript" {
+				scriptLines = append(scriptLines, trimmed)
+				continue
+			}
+			target := &global
+			if current != nil {
+				target = current
+			}
+			target.scripts[script] = strings.TrimSpace(strings.Join(scriptLines, "\n"))
+			script = ""
+			continue
+		}
+
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(trimmed, "{"):
+			if current != nil {
+				return nil, fmt.Errorf("line %d: block inside a block", number+1)
+			}
+			section := logrotateSection{directives: append([][]string{}, global.directives...), scripts: make(map[string]string)}
+			for name, body := range global.scripts {
+				section.scripts[name] = body
+			}
+			for _, path := range strings.Fields(strings.TrimSuffix(trimmed, "{")) {
+				section.paths = append(section.paths, strings.Trim(path, "\"'"))
+			}
+			if len(section.paths) == 0 {
+				return nil, fmt.Errorf("line %d: block without a log file", number+1)
+			}
+			current = &section
+		case trimmed == "}":
+			if current == nil {
+				return nil, fmt.Errorf("line %d: } without a block", number+1)
+			}
+			sections = append(sections, *current)
+			current = nil
+		default:
+			fields := strings.Fields(trimmed)
+			switch fields[0] {
+			case "prerotate", "postrotate", "firstaction", "lastaction", "preremove":
+				script, scriptLines = fields[0], nil
+			default:
+				if current != nil {
+					current.directives = append(current.directives, fields)
+				} else {
+					global.directives = append(global.directives, fields)
+				}
+			}
+		}
+	}
+	if script != "" {
+		return nil, errors.New(script + " without endscript")
+	}
+	if current != nil {
+		return nil, errors.New("block of " + strings.Join(current.paths, " ") + " is not closed")
+	}
+	return sections, nil
+}
+
+// Sizes of logrotate count k, M and G in powers of 1024, rotee gets plain bytes
+func parseLogrotateSize(size string) (string, error) {
+
+	factor := int64(1)
+	switch {
+	case strings.HasSuffix(size, "k"), strings.HasSuffix(size, "K"):
+		factor = 1024
+	case strings.HasSuffix(size, "M"):
+		factor = 1024 * 1024
+	case strings.HasSuffix(size, "G"):
+		factor = 1024 * 1024 * 1024
+	}
+	if factor > 1 {
+		size = size[:len(size)-1]
+	}
+	bytes, err := strconv.ParseInt(strings.TrimPrefix(size, "+"), 10, 64)
+	if err != nil || bytes <= 0 {
+		return "", errors.New("invalid size " + size)
+	}
+	return strconv.FormatInt(bytes*factor, 10), nil
+}
+
+// The rotee arguments for one log file of a section, and what could not be carried over
+func logrotateArguments(path string, section logrotateSection) ([]string, []string, error) {
+
+	args := []string{"-o", path}
+	warnings := make([]string, 0)
+	interval := 0.0
+	size, minSize, maxSize := "", "", ""
+	rotate, maxAge, archiveDir := "", "", ""
+	compress, dateNaming, noCreate, skipEmpty := false, false, false, false
+
+	for _, directive := range section.directives {
+		name := directive[0]
+		value := ""
+		if len(directive) > 1 {
+			value = directive[1]
+		}
+		var err error
+		switch {
+		case logrotateIntervals[name] > 0:
+			interval = logrotateIntervals[name]
+		case name == "rotate":
+			rotate = value
+			_, err = strconv.Atoi(value)
+		case name == "maxage":
+			maxAge = value
+			_, err = strconv.Atoi(value)
+		case name == "size":
+			size, err = parseLogrotateSize(value)
+		case name == "minsize":
+			minSize, err = parseLogrotateSize(value)
+		case name == "maxsize":
+			maxSize, err = parseLogrotateSize(value)
+		case name == "compress" || name == "nocompress":
+			compress = name == "compress"
+		case name == "dateext" || name == "nodateext":
+			dateNaming = name == "dateext"
+		case name == "nocreate":
+			noCreate = true
+		case name == "notifempty" || name == "ifempty":
+			skipEmpty = name == "notifempty"
+		case name == "olddir":
+			if archiveDir = value; !filepath.IsAbs(archiveDir) {
+				archiveDir = filepath.Join(filepath.Dir(path), archiveDir)
+			}
+		case name == "noolddir":
+			archiveDir = ""
+		case !logrotateIgnored[name]:
+			warnings = append(warnings, "Ignoring "+strings.Join(directive, " ")+" of "+path+", rotee has nothing like it")
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s of %s: %s", name, path, err)
+		}
+	}
+
+	// size rotates whatever the time, minsize needs both, maxsize either of them
+	switch {
+	case size != "":
+		args = append(args, "-m", size)
+	case interval > 0 && minSize != "":
+		args = append(args, "-a", strconv.FormatFloat(interval, 'f', -1, 64), "-m", minSize, "--trigger-policy", "all")
+		if maxSize != "" {
+			warnings = append(warnings, "Ignoring maxsize of "+path+", rotee can not combine it with minsize")
+		}
+	case interval > 0 && maxSize != "":
+		args = append(args, "-a", strconv.FormatFloat(interval, 'f', -1, 64), "-m", maxSize)
+	case interval > 0:
+		args = append(args, "-a", strconv.FormatFloat(interval, 'f', -1, 64))
+	case maxSize != "":
+		args = append(args, "-m", maxSize)
+	case minSize != "":
+		args = append(args, "-m", minSize)
+	default:
+		warnings = append(warnings, path+" has no size or time to rotate at, add a trigger file")
+	}
+
+	if rotate != "" {
+		args = append(args, "-n", rotate)
+	}
+	if maxAge != "" {
+		args = append(args, "-d", maxAge)
+	}
+	if compress {
+		args = append(args, "-c")
+	}
+	if dateNaming {
+		args = append(args, "--archive-naming", archiveNamingDate)
+	}
+	if noCreate {
+		args = append(args, "--no-create")
+	}
+	if skipEmpty {
+		args = append(args, "--skip-empty")
+	}
+	if archiveDir != "" {
+		args = append(args, "--archive-dir", archiveDir)
+	}
+	if body := section.scripts["prerotate"]; body != "" {
+		args = append(args, "-s", body)
+	}
+	if body := section.scripts["postrotate"]; body != "" {
+		args = append(args, "-p", body)
+	}
+	for _, name := range []string{"firstaction", "lastaction", "preremove"} {
+		if section.scripts[name] != "" {
+			warnings = append(warnings, "Ignoring "+name+" script of "+path+", rotee has nothing like it")
+		}
+	}
+	return args, warnings, nil
+}
+
+// Turn a logrotate config into a pipeline file for rotee multi. A single log reads stdin,
+// several read a named pipe next to their log file each.
+func importLogrotateConfig(content string) (pipelineFile, []string, error) {
+
+	imported := pipelineFile{Pipelines: make([]pipelineDefinition, 0)}
+	warnings := make([]string, 0)
+	sections, err := parseLogrotateConfig(content)
+	if err != nil {
+		return imported, warnings, err
+	}
+	for _, section := range sections {
+		for _, path := range section.paths {
+			if strings.ContainsAny(path, "*?[") {
+				warnings = append(warnings, "Skipping "+path+", rotee needs one pipeline per log file")
+				continue
+			}
+			args, sectionWarnings, err := logrotateArguments(path, section)
+			if err != nil {
+				return imported, warnings, err
+			}
+			warnings = append(warnings, sectionWarnings...)
+			imported.Pipelines = append(imported.Pipelines, pipelineDefinition{Args: args})
+		}
+	}
+	if len(imported.Pipelines) > 1 {
+		for i := range imported.Pipelines {
+			imported.Pipelines[i].Input = imported.Pipelines[i].Args[1] + ".pipe"
+		}
+		warnings = append(warnings, "Every log reads the named pipe next to it, create them with mkfifo")
+	}
+	return imported, warnings, nil
+}
+
+func runImportLogrotateCommand(args []string) {
+
+	parser := argparse.NewParser("rotee import-logrotate",
+		"Print a pipeline file for rotee multi with the policies of a logrotate config")
+	configFile := parser.StringPositional(
+		&argparse.Options{Help: "logrotate config to import, like /etc/logrotate.d/app"})
+	activityFilePath := parser.String("v", "verbose-output-file",
+		&argparse.Options{Required: false, Help: "Log what could not be imported to this file instead of stderr."})
+
+	if err := parser.Parse(args); err != nil || *configFile == "" {
+		fmt.Print(parser.Usage(err))
+		os.Exit(exitConfigError)
+	}
+
+	// What could not be imported is the one thing to read after an import, so without
+	// an activity log it goes to stderr instead of nowhere
+	verbose = true
+	setupProcess(*activityFilePath, "", "", defaultRenameRetries, 0, false)
+
+	content, err := os.ReadFile(*configFile)
+	if err != nil {
+		exitf(exitConfigError, "Can not read %s: %s", *configFile, err)
+	}
+	imported, warnings, err := importLogrotateConfig(string(content))
+	if err != nil {
+		exitf(exitConfigError, "Can not import %s: %s", *configFile, err)
+	}
+	for _, warning := range warnings {
+		logActivity("%s", warning)
+	}
+	if len(imported.Pipelines) == 0 {
+		exitf(exitConfigError, "No log files to import in %s", *configFile)
+	}
+
+	encoded, err := json.MarshalIndent(imported, "", "  ")
+	if err != nil {
+		exitf(exitConfigError, "Can not encode the imported config: %s", err)
+	}
+	fmt.Println(string(encoded))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pushes lines to Loki, one request with one stream for every batch
+type lokiPusher struct {
+	url      string
+	labels   map[string]string
+	failures sinkFailures
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+type lokiPushRequest struct {
+	Streams []lokiStream `json:"streams"`
+}
+
+var lokiLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Labels given like job=rotee,env=prod
+func parseLokiLabels(text string) (map[string]string, error) {
+
+	labels := make(map[string]string)
+	for _, label := range strings.Split(text, ",") {
+		if label = strings.TrimSpace(label); label == "" {
+			continue
+		}
+		name, value, found := strings.Cut(label, "=")
+		if !found || !lokiLabelName.MatchString(name) || value == "" {
+			return nil, errors.New("invalid Loki label " + label + ", use name=value")
+		}
+		labels[name] = value
+	}
+	if len(labels) == 0 {
+		return nil, errors.New("Loki needs at least one label")
+	}
+	return labels, nil
+}
+
+// A Loki address without path gets the push API path
+func newLokiPusher(target string, labels string) (*lokiPusher, error) {
+
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, errors.New("expected a Loki URL like http://loki:3100")
+	}
+	if parsed.Path == "" || parsed.Path == "/" {
+		parsed.Path = "/loki/api/v1/push"
+	}
+
+	streamLabels, err := parseLokiLabels(labels)
+	if err != nil {
+		return nil, err
+	}
+	return &lokiPusher{url: parsed.String(), labels: streamLabels, failures: sinkFailures{name: "Loki"}}, nil
+}
+
+func (pusher *lokiPusher) sendLines(lines [][]byte) {
+
+	// Lines that arrived together get the same time, nanoseconds keep their order
+	now := time.Now().UnixNano()
+	stream := lokiStream{Stream: pusher.labels, Values: make([][2]string, len(lines))}
+	for i, line := range lines {
+		stream.Values[i] = [2]string{strconv.FormatInt(now+int64(i), 10), string(line)}
+	}
+	body, err := json.Marshal(lokiPushRequest{Streams: []lokiStream{stream}})
+	if err != nil {
+		pusher.failures.failed(err, len(lines))
+		return
+	}
+
+	err = sendWithRetries(func() error {
+		response, err := webhookClient.Post(pusher.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		io.Copy(io.Discard, response.Body)
+
+		// Loki says too many requests or is unwell, anything else it would reject again
+		if response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500 {
+			return fmt.Errorf("Loki returned status %s", response.Status)
+		} else if response.StatusCode < 200 || response.StatusCode > 299 {
+			return permanentSinkError{fmt.Errorf("Loki returned status %s", response.Status)}
+		}
+		return nil
+	})
+	if err != nil {
+		pusher.failures.failed(err, len(lines))
+	} else {
+		pusher.failures.succeeded()
+	}
+}
+
+func (pusher *lokiPusher) close() {
+	pusher.failures.close()
+}
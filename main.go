@@ -1,8 +1,7 @@
 package main
 
 import (
-	"bufio"
-	"compress/gzip"
+	"bytes"
 	_ "embed"
 	"errors"
 	"fmt"
@@ -11,131 +10,518 @@ import (
 	"math"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/akamensky/argparse"
 )
 
 type rotateConfig struct {
-	maxFiles             int
-	maxAgeDays           int
-	scanFrequencySeconds float64
-	useCompression       bool
-	preScript            *string
-	postScript           *string
+	maxFiles              int
+	maxAgeDays            int
+	scanFrequencySeconds  float64
+	compression           *compressionFormat
+	compressionOptions    compressionOptions
+	preScript             *string
+	postScript            *string
+	followSymlink         bool
+	externalRotation      bool
+	outputTemplate        bool
+	currentSymlink        string
+	location              *time.Location
+	uploader              archiveUploader
+	uploadRetries         int
+	uploadDeleteAfter     bool
+	localMaxFiles         int
+	syncDestination       string
+	syncUploader          archiveUploader
+	onErrorScript         string
+	onErrorWebhook        string
+	email                 emailOptions
+	slack                 slackOptions
+	mqtt                  mqttOptions
+	scriptCredentials     *scriptCredentials
+	rotationID            string
+	maxRotationsPerHour   int
+	archiveDir            string
+	compressBufferBytes   int
+	compressNice          int
+	compressIOPriority    int
+	bundleAfterDays       int
+	archiveNaming         string
+	noCreate              bool
+	skipEmpty             bool
+	archiveReadonly       bool
+	pruneOrphans          bool
+	latestLink            string
+	echo                  *echoWriter
+	sinks                 []*lineSink
+	read                  readOptions
+	filters               []dataFilter
+	filterStdout          bool
+	countLines            bool
+	syncAfterIdle         time.Duration
+	heartbeatInterval     time.Duration
+	heartbeatText         string
+	exitAfterIdle         time.Duration
+	rotationWarnThreshold time.Duration
+	spoolFile             string
+	spoolMaxBytes         int64
+	stallTimeout          time.Duration
+	stallFallback         string
+	routes                []*outputRoute
+	buffering             string
+	flushInterval         time.Duration
+	blockBytes            int
+	preallocateBytes      int64
+	syncOpen              bool
+	rotateOnExit          bool
+	summaryMode           string
+	hold                  *rotationHold
+	errorMode             string
+	triggerMode           string
+	triggerResponse       string
+	state                 *pipelineState
+}
+
+// User and group the pre, post and error scripts run as, nil means unchanged
+type scriptCredentials struct {
+	uid uint32
+	gid uint32
+}
+
+// Extension of newly created archives, empty without compression
+func (config *rotateConfig) archiveExtension() string {
+	if config.compression == nil {
+		return ""
+	}
+	return config.compression.extension
+}
+
+// Everything that needs to look at the data or at every write rules out passthrough
+func (config *rotateConfig) canPassthrough() bool {
+	return config.echo == nil && len(config.sinks) == 0 && len(config.filters) == 0 && config.read.encoding == nil &&
+		!config.read.decompress && !config.countLines && config.syncAfterIdle == 0 && config.heartbeatInterval == 0 &&
+		config.exitAfterIdle == 0 && !config.rotateOnExit && config.buffering == bufferingLine && config.stallTimeout == 0 &&
+		config.spoolFile == "" && config.read.acks == nil && len(config.routes) == 0 && !config.outputTemplate &&
+		!config.syncOpen && config.read.drain == nil && config.read.recordFraming == ""
 }
 
 type archiveFile struct {
-	name       string
-	index      int
-	compressed bool
+	name      string
+	index     int
+	extension string
+
+	// Day of rotation for dated archives, index is the counter within that day
+	date string
+
+	// Path of an archive logrotate or savelog left behind, rotee never renames these
+	foreign string
 }
 
 //go:generate sh -c "printf %s $(git rev-parse --short HEAD) > commit.txt"
 //go:embed commit.txt
 var Commit string
 
-var outputFileLock sync.Mutex
-var rotateLock sync.Mutex
-var reloadOutputFile atomic.Bool
+// Suffix of archives that are still being written
+const partialArchiveSuffix string = ".part"
+
+// How often to log progress while compressing a large file
+const compressProgressInterval time.Duration = 5 * time.Second
+
 var verbose bool
 
-func read(wg *sync.WaitGroup, inputData chan string) {
+func read(wg *sync.WaitGroup, inputData chan *lineChunk, options readOptions) {
 
 	logActivity("Reader thread started")
 	defer wg.Done()
 	defer close(inputData)
 
-	reader := bufio.NewReader(os.Stdin)
-
-	for {
-
-		// Exit if we read EOF.
-		// The only other error ReadString can return happens if the last character
-		// is not a delimiter, but thats not an issue for us.
-		if text, err := reader.ReadString('\n'); err != nil && err == io.EOF {
-			break
-		} else {
-			inputData <- text
-		}
-	}
+	readLines(os.Stdin, inputData, options)
 
 	logActivity("Reader thread stopped")
 }
 
-func write(wg *sync.WaitGroup, inputData chan string, outputFile string, truncateOnStart bool) {
+func write(wg *sync.WaitGroup, inputData chan *lineChunk, outputFile string, truncateOnStart bool, config rotateConfig) {
 
 	logActivity("Writer thread started")
 	defer wg.Done()
 
-	// Open output file so we need to take the lock
-	outputFileLock.Lock()
-	openFlags := os.O_APPEND | os.O_CREATE | os.O_WRONLY
-	if truncateOnStart {
-		openFlags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	// From here on outputFile is the file the template renders to right now
+	outputTemplate := outputFile
+	if config.outputTemplate {
+		outputFile = currentTemplatedFile(outputTemplate, config)
+		config.state.templatedOutputFile.Store(outputFile)
 	}
-	output_file, err := os.OpenFile(outputFile, openFlags, 0644)
+
+	// Open output file so we need to take the lock
+	config.state.outputFileLock.Lock()
+	output_file, err := openOutputFile(outputFile, truncateOnStart, config)
 
 	// Fail early: let user know that we cant write to output file
 	if err != nil {
 		logActivity("Can not write to file %s", outputFile)
-		log.Fatalf("Can not write to file %s", outputFile)
+		exitf(exitOutputError, "Can not write to file %s", outputFile)
 	}
 	defer output_file.Close()
-	outputFileLock.Unlock()
+	if config.buffering == bufferingDirect {
+		defer config.state.closeDirectFile()
+	}
+	config.state.outputFileLock.Unlock()
 
-	// Write until the reader closes the input pipe
-	for {
-		text, ok := <-inputData
+	if truncateOnStart {
+		audit("", "truncate", outputFile, "")
+	}
 
-		if !ok {
-			logActivity("Writer thread stopped")
-			return
-		}
+	// Buffers for filtered data, reused for every chunk
+	var scratch [2][]byte
+
+	// Lines for other output files are handed to their writers
+	var router *lineRouter
+	if len(config.routes) > 0 {
+		router = newLineRouter(config.routes)
+	}
+
+	// Once the output file stalled for good everything goes to the fallback, which is never rotated
+	if config.stallTimeout > 0 {
+		go watchWriter(outputFile, inputData, config)
+	}
+	usingFallback := false
+
+	// Write to output file, we need to take the lock
+	writeOutputFile := func(data []byte) {
+		config.state.writeStartedAt.Store(time.Now().UnixNano())
+		defer config.state.writeStartedAt.Store(0)
+		config.state.outputFileLock.Lock()
+		defer config.state.outputFileLock.Unlock()
+
+		// The rendered name changed, leave the old file to be compressed and pruned
+		if config.outputTemplate && !usingFallback {
+			if rendered := renderOutputTemplate(outputTemplate, time.Now().In(config.location)); rendered != outputFile {
+				if err := config.state.flushPendingWrites(); err != nil {
+					reportFailure(config, "write", outputFile, "", err)
+					exitf(exitOutputError, "Failed to write to %s", outputFile)
+				}
+				output_file.Close()
+				closedFile := outputFile
+				outputFile = rendered
+
+				// Known before it exists, so it is never mistaken for a file left behind
+				config.state.templatedOutputFile.Store(outputFile)
+				if output_file, err = openOutputFile(outputFile, false, config); err != nil {
+					exitf(exitOutputError, "Can not write to file %s", outputFile)
+				}
+				logActivity("Switched output file from %s to %s", closedFile, outputFile)
+				config.state.firstWriteTime.Store(0)
+				config.state.linesWritten.Store(0)
+				config.state.reloadOutputFile.Store(false)
+				if config.currentSymlink != "" {
+					if err := updateCurrentSymlink(config.currentSymlink, outputFile); err != nil {
+						logActivity("Failed to link %s to %s. Error: %s", config.currentSymlink, outputFile, err)
+					}
+				}
 
-		// Write to output file, we need to take the lock
-		outputFileLock.Lock()
+				// Exiting waits for this, the last file must not be left half compressed
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					finishTemplatedFiles(outputTemplate, config)
+				}()
+			}
+		}
 
 		// Check if we need to reopen the output file after rotation
-		if reloadOutputFile.Swap(false) {
+		if config.state.reloadOutputFile.Swap(false) && !usingFallback {
 
-			// Close current file and reopen
+			// Close current file and reopen, held back data still belongs to the old one
+			if err := config.state.flushPendingWrites(); err != nil {
+				reportFailure(config, "write", outputFile, "", err)
+				exitf(exitOutputError, "Failed to write to %s", outputFile)
+			}
 			output_file.Close()
-			output_file, err = os.OpenFile(outputFile,
-				os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			output_file, err = openOutputFile(outputFile, false, config)
 
 			// Fail if we cant open the file again...
 			if err != nil {
-				log.Fatalf("Can not write to file %s", outputFile)
+				exitf(exitOutputError, "Can not write to file %s", outputFile)
 			}
 		}
 
 		// Crash if write fails
-		if _, err := output_file.WriteString(text); err != nil {
-			log.Fatalf("Failed to write to %s", outputFile)
+		config.state.firstWriteTime.CompareAndSwap(0, time.Now().UnixNano())
+		if config.holdsWrites() {
+			err = config.state.bufferWrite(output_file, data, config.blockBytes)
+		} else if config.stallFallback != "" && !usingFallback {
+			err = writeUnlessStalled(output_file, data, config.state.writerStalled)
+		} else {
+			_, err = output_file.Write(data)
+		}
+
+		// The abandoned write might still get through later, so the data could end up in both files
+		if errors.Is(err, errWriterStalled) {
+			logActivity("Writing to fallback %s instead of %s from now on", config.stallFallback, outputFile)
+			usingFallback = true
+			if output_file, err = os.OpenFile(config.stallFallback, outputOpenFlags(config, false), 0644); err != nil {
+				exitf(exitOutputError, "Can not write to file %s", config.stallFallback)
+			}
+			_, err = output_file.Write(data)
+		}
+		if err != nil {
+			reportFailure(config, "write", outputFile, "", err)
+			exitf(exitOutputError, "Failed to write to %s", outputFile)
+		}
+		if config.countLines {
+			config.state.linesWritten.Add(int64(bytes.Count(data, []byte{'\n'})))
 		}
-		outputFileLock.Unlock()
+	}
+
+	// Fires once the input went quiet after a write, never without --fsync-after-idle
+	idleTimer := time.NewTimer(time.Hour)
+	idleTimer.Stop()
+
+	// Fires whenever the input was quiet for the heartbeat interval, never without --heartbeat
+	heartbeatTimer := time.NewTimer(time.Hour)
+	heartbeatTimer.Stop()
+	if config.heartbeatInterval > 0 {
+		heartbeatTimer.Reset(config.heartbeatInterval)
+	}
 
-		// Write to stdout
-		fmt.Print(text)
+	// Writes out held back data regularly, never without --buffering block
+	flushTicker := time.NewTicker(time.Hour)
+	flushTicker.Stop()
+	if config.holdsWrites() {
+		flushTicker.Reset(config.flushInterval)
+	}
+	defer flushTicker.Stop()
+
+	// Fires once the input was quiet for too long, never without --exit-after-idle
+	exitTimer := time.NewTimer(time.Hour)
+	exitTimer.Stop()
+	if config.exitAfterIdle > 0 {
+		exitTimer.Reset(config.exitAfterIdle)
+	}
+
+	// Write until the reader closes the input pipe
+	for {
+		var chunk *lineChunk
+		var ok bool
+		select {
+		case chunk, ok = <-inputData:
+		case <-flushTicker.C:
+			config.state.outputFileLock.Lock()
+			if err := config.state.flushPendingWrites(); err != nil {
+				reportFailure(config, "write", outputFile, "", err)
+				exitf(exitOutputError, "Failed to write to %s", outputFile)
+			}
+			config.state.outputFileLock.Unlock()
+			continue
+		case <-idleTimer.C:
+			config.state.outputFileLock.Lock()
+			if err := config.state.flushPendingWrites(); err != nil {
+				logActivity("Failed to write to %s. Error: %s", outputFile, err)
+			}
+			if err := output_file.Sync(); err != nil {
+				logActivity("Failed to sync %s to disk. Error: %s", outputFile, err)
+			} else {
+				logActivity("Input is idle, synced %s to disk", outputFile)
+			}
+			config.state.outputFileLock.Unlock()
+			continue
+		case request := <-config.state.writerRequests:
+			if !request.pause {
+				request.done <- nil
+				continue
+			}
+
+			// Rotations go on meanwhile unless they are held, the file is reopened on resume anyway
+			config.state.outputFileLock.Lock()
+			err := closeForPause(outputFile, output_file, config)
+			config.state.outputFileLock.Unlock()
+			if err != nil {
+				request.done <- err
+				reportFailure(config, "write", outputFile, "", err)
+				exitf(exitOutputError, "Failed to write to %s", outputFile)
+			}
+			request.done <- nil
+			resumed := waitForResume(outputFile, config)
+
+			config.state.outputFileLock.Lock()
+			if usingFallback {
+				output_file, err = os.OpenFile(config.stallFallback, outputOpenFlags(config, false), 0644)
+			} else {
+				output_file, err = openOutputFile(outputFile, false, config)
+			}
+			config.state.reloadOutputFile.Store(false)
+			config.state.outputFileLock.Unlock()
+			if err != nil {
+				resumed <- err
+				exitf(exitOutputError, "Can not write to file %s", outputFile)
+			}
+			resumed <- nil
+
+			// Nothing was read during the pause, that does not count as idle input
+			if config.exitAfterIdle > 0 {
+				exitTimer.Reset(config.exitAfterIdle)
+			}
+			continue
+		case <-exitTimer.C:
+			exitOnIdle(outputFile, output_file, config)
+		case <-heartbeatTimer.C:
+			writeOutputFile([]byte(config.heartbeatText + "\n"))
+			heartbeatTimer.Reset(config.heartbeatInterval)
+			continue
+		}
+
+		if !ok {
+			config.state.outputFileLock.Lock()
+			if err := config.state.flushPendingWrites(); err != nil {
+				reportFailure(config, "write", outputFile, "", err)
+				exitf(exitOutputError, "Failed to write to %s", outputFile)
+			}
+			config.state.outputFileLock.Unlock()
+			if config.read.checkpoint != nil {
+				config.read.checkpoint.advance(0, true)
+			}
+			if router != nil {
+				router.close()
+			}
+			if config.echo != nil {
+				config.echo.close()
+			}
+			for _, sink := range config.sinks {
+				sink.close()
+			}
+			if config.rotateOnExit || config.state.rotateAfterDrain.Load() {
+				output_file.Close()
+				rotateBeforeExit(outputFile, config)
+			}
+			logActivity("Writer thread stopped")
+			return
+		}
+
+		// Stdout gets the input as it came unless asked otherwise, routed lines still go there
+		data := applyFilters(config.filters, chunk.data, &scratch)
+		config.state.lastWriteTime.Store(time.Now().UnixNano())
+		if router == nil {
+			writeOutputFile(data)
+		} else if unrouted := router.route(data); len(unrouted) > 0 {
+			writeOutputFile(unrouted)
+		}
+		if config.read.acks != nil {
+			config.state.outputFileLock.Lock()
+			if err := output_file.Sync(); err != nil {
+				reportFailure(config, "write", outputFile, "", err)
+				exitf(exitOutputError, "Failed to sync %s to disk", outputFile)
+			}
+			config.state.outputFileLock.Unlock()
+		}
+		if config.read.checkpoint != nil {
+			config.read.checkpoint.advance(len(chunk.data), false)
+		}
+		if config.syncAfterIdle > 0 {
+			idleTimer.Reset(config.syncAfterIdle)
+		}
+		if config.heartbeatInterval > 0 {
+			heartbeatTimer.Reset(config.heartbeatInterval)
+		}
+		if config.exitAfterIdle > 0 {
+			exitTimer.Reset(config.exitAfterIdle)
+		}
+
+		// Write to stdout, the chunk goes back to the reader afterwards
+		if config.echo != nil && config.filterStdout {
+			config.echo.write(string(data))
+		} else if config.echo != nil {
+			config.echo.write(string(chunk.data))
+		}
+		for _, sink := range config.sinks {
+			sink.write(string(data))
+		}
+		chunk.release()
+		if config.read.acks != nil {
+			config.read.acks <- struct{}{}
+		}
 	}
 }
 
-func makeArchivePath(fileName string, index int, compressed bool) string {
-	if compressed {
-		return fileName + "." + strconv.Itoa(index) + ".gz"
-	} else {
-		return fileName + "." + strconv.Itoa(index)
+// Nothing arrived for --exit-after-idle, treat it like the end of the input. The reader
+// is stuck in a read that might never return, so we leave without waiting for it.
+func exitOnIdle(outputFile string, output *os.File, config rotateConfig) {
+
+	logActivity("No input for %s, exiting", config.exitAfterIdle)
+	if config.echo != nil {
+		config.echo.close()
+	}
+	for _, sink := range config.sinks {
+		sink.close()
 	}
+
+	config.state.outputFileLock.Lock()
+	if err := config.state.flushPendingWrites(); err != nil {
+		logActivity("Failed to write to %s. Error: %s", outputFile, err)
+	}
+	if err := output.Sync(); err != nil {
+		logActivity("Failed to sync %s to disk. Error: %s", outputFile, err)
+	}
+	output.Close()
+	config.state.outputFileLock.Unlock()
+	if config.read.checkpoint != nil {
+		config.read.checkpoint.advance(0, true)
+	}
+
+	if config.rotateOnExit {
+		rotateBeforeExit(outputFile, config)
+	}
+
+	// Rotations, uploads and orphan collection that already started get to finish
+	config.state.shipLock.Lock()
+	config.state.rotateLock.Lock()
+	os.Exit(0)
+}
+
+// Rotate whatever was written since the last rotation, an empty file is left alone
+func rotateBeforeExit(outputFile string, config rotateConfig) {
+
+	if stat, err := statFile(outputFile); err != nil || stat.Size() == 0 {
+		return
+	}
+	if config.hold.held() {
+		logActivity("Rotations are on hold, leaving %s as it is", outputFile)
+		return
+	}
+
+	config.rotationID = newRotationID()
+	logRotation(config.rotationID, "Rotating before exit")
+	if err := requestRotation(config); errors.Is(err, errRotationRateLimited) {
+		logRotation(config.rotationID, "Skipping rotation before exit because of the rate limit")
+	} else if err != nil {
+		logRotation(config.rotationID, "Rotation before exit failed! Error: %s", err)
+		reportFailure(config, "rotate", outputFile, "", err)
+	} else if config.uploader != nil || config.syncDestination != "" {
+
+		// The last archive should not wait for the next start to leave the machine
+		shipArchives(outputFile, config)
+	}
+}
+
+func makeArchivePath(fileName string, index int, extension string) string {
+	return fileName + "." + strconv.Itoa(index) + extension
 }
 
 func (archive *archiveFile) getPath() string {
-	return makeArchivePath(archive.name, archive.index, archive.compressed)
+	if archive.foreign != "" {
+		return archive.foreign
+	}
+	if archive.date != "" {
+		return makeDatedArchivePath(archive.name, archive.date, archive.index, archive.extension)
+	}
+	return makeArchivePath(archive.name, archive.index, archive.extension)
 }
 
 func findAllArchives(outputFile string) []archiveFile {
@@ -144,10 +530,10 @@ func findAllArchives(outputFile string) []archiveFile {
 	// Walk archive files until we get a file not found error
 	// This way we know the next free index we can place an archive on
 	for i := 1; ; i++ {
-		if compressed, err := isArchiveCompressed(outputFile, i); err == nil {
-			archives = append(archives, archiveFile{name: outputFile, compressed: compressed, index: i})
+		if extension, err := findArchiveExtension(outputFile, i); err == nil {
+			archives = append(archives, archiveFile{name: outputFile, extension: extension, index: i})
 		} else {
-			return archives
+			return append(archives, findDatedArchives(outputFile)...)
 		}
 	}
 }
@@ -170,10 +556,14 @@ func copyFile(inputFilePath string, outputFilePath string) error {
 		return err
 	}
 
-	return nil
+	// Make sure the data is on disk before anyone renames or deletes the source
+	if err := outputFile.Sync(); err != nil {
+		return err
+	}
+	return outputFile.Close()
 }
 
-func gzipFile(inputFilePath string, outputFilePath string) error {
+func compressFile(inputFilePath string, outputFilePath string, archiveBase string, config rotateConfig) error {
 
 	inputFile, err := os.Open(inputFilePath)
 	if err != nil {
@@ -181,22 +571,104 @@ func gzipFile(inputFilePath string, outputFilePath string) error {
 	}
 	defer inputFile.Close()
 
+	// Only used for progress reports, so it is fine if this fails
+	var inputSize int64
+	if stat, err := inputFile.Stat(); err == nil {
+		inputSize = stat.Size()
+	}
+
 	outputFile, err := os.Create(outputFilePath)
 	if err != nil {
 		return err
 	}
 	defer outputFile.Close()
 
-	gzipWriter := gzip.NewWriter(outputFile)
-	defer gzipWriter.Close()
+	// Stream through a fixed buffer, rotated files can be much larger than memory
+	compressWriter, err := config.compression.newWriter(outputFile, archiveBase, config.compressionOptions)
+	if err != nil {
+		return err
+	}
+	buffer := make([]byte, config.compressBufferBytes)
+	var compressed int64
+	lastReport := time.Now()
+	for {
+		n, err := inputFile.Read(buffer)
+		if n > 0 {
+			if _, err := compressWriter.Write(buffer[:n]); err != nil {
+				return err
+			}
+			compressed += int64(n)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		// Small files are done long before this, only big ones ever report
+		if time.Since(lastReport) >= compressProgressInterval {
+			logActivity("Compressed %d of %d bytes of %s (%d%%)",
+				compressed, inputSize, inputFilePath, compressed*100/max(inputSize, 1))
+			lastReport = time.Now()
+		}
+	}
+
+	// Closing writes the footer, without it the archive is truncated
+	if err := compressWriter.Close(); err != nil {
+		return err
+	}
+	if err := outputFile.Sync(); err != nil {
+		return err
+	}
+	return outputFile.Close()
+}
+
+// Write the archive under a temporary name and only rename it into place once
+// it is complete, a crash mid compression must never leave a truncated archive.
+func createArchive(inputFilePath string, archive archiveFile, config rotateConfig) error {
 
-	if _, err := io.Copy(gzipWriter, inputFile); err != nil {
+	partialPath := archive.getPath() + partialArchiveSuffix
+	var err error
+	if config.compression != nil {
+		err = withCompressPriority(config, func() error {
+			return compressFile(inputFilePath, partialPath, archive.name, config)
+		})
+	} else {
+		err = copyFile(inputFilePath, partialPath)
+	}
+	if err != nil {
+		os.Remove(partialPath)
 		return err
 	}
 
+	// Readers of the log should be able to read its archives too
+	if err := copyExtendedAttributes(inputFilePath, partialPath); err != nil {
+		logActivity("Failed to copy extended attributes to %s. Error: %s", partialPath, err)
+	}
+
+	// The archive is as old as the last line in it, not as the time we compressed it
+	if stat, err := os.Stat(inputFilePath); err == nil {
+		if err := os.Chtimes(partialPath, stat.ModTime(), stat.ModTime()); err != nil {
+			logActivity("Failed to set modification time of %s. Error: %s", partialPath, err)
+		}
+	}
+
+	if err := renameFile(partialPath, archive.getPath()); err != nil {
+		os.Remove(partialPath)
+		return err
+	}
 	return nil
 }
 
+// Remove all write permissions, whatever else the umask or ACLs allow stays
+func makeReadonly(path string) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path, stat.Mode().Perm()&^0222)
+}
+
 func nextFreeFile(outputFile string) string {
 	i := 1
 	for {
@@ -208,55 +680,100 @@ func nextFreeFile(outputFile string) string {
 	}
 }
 
-func moveOutputFile(outputFile string) (string, error) {
+func moveOutputFile(outputFile string, archiveBase string, config rotateConfig) (string, time.Time, error) {
 
 	// We are touching the output file so we need the lock
-	outputFileLock.Lock()
-	defer outputFileLock.Unlock()
+	config.state.outputFileLock.Lock()
+	defer config.state.outputFileLock.Unlock()
+
+	// The writer is blocked, so this is exactly the data we move out
+	if err := config.state.flushPendingWrites(); err != nil {
+		return "", time.Time{}, err
+	}
+	var firstWrite time.Time
+	if nanos := config.state.firstWriteTime.Swap(0); nanos > 0 {
+		firstWrite = time.Unix(0, nanos)
+	}
+	config.state.linesWritten.Store(0)
 
 	// Move the main log file out of the way
 	// The idea is that rename is fast and we want to defer
 	// copying / zipping this file so the main writer thread
 	// can continue as fast as possible
 
-	// Find a free output filename
-	tempOutputFile := nextFreeFile(outputFile + ".tmp")
-	if err := os.Rename(outputFile, tempOutputFile); err != nil {
+	// Find a free output filename next to the archives
+	tempOutputFile := nextFreeFile(archiveBase + ".tmp")
+	if err := renameFile(outputFile, tempOutputFile); errors.Is(err, syscall.EXDEV) {
+
+		// The archive directory is on another filesystem so rename can not work.
+		// Copy and truncate instead, the writer is blocked by the lock so nothing gets lost.
+		logActivity("Archive directory is on another filesystem, copying %s to %s", outputFile, tempOutputFile)
+		stat, err := os.Stat(outputFile)
+		if err != nil {
+			return tempOutputFile, firstWrite, err
+		}
+		if err := copyFile(outputFile, tempOutputFile); err != nil {
+			os.Remove(tempOutputFile)
+			return tempOutputFile, firstWrite, err
+		}
+
+		// Keep the time of the last write, like rename does
+		if err := os.Chtimes(tempOutputFile, stat.ModTime(), stat.ModTime()); err != nil {
+			os.Remove(tempOutputFile)
+			return tempOutputFile, firstWrite, err
+		}
+		if err := copyExtendedAttributes(outputFile, tempOutputFile); err != nil {
+			logActivity("Failed to copy extended attributes to %s. Error: %s", tempOutputFile, err)
+		}
+		if err := os.Truncate(outputFile, 0); err != nil {
+			os.Remove(tempOutputFile)
+			return tempOutputFile, firstWrite, err
+		}
+
+		// Appending writers carry on at the new end by themselves, direct writes need to know
+		config.state.reloadOutputFile.Store(true)
+		return tempOutputFile, firstWrite, nil
+	} else if err != nil {
 		logActivity("Moved log file to temporary %s", tempOutputFile)
-		return tempOutputFile, err
+		return tempOutputFile, firstWrite, err
 	}
 
 	// Recreate the output file
 	// We do this so a new empty log file is available immediatly
 	// If we defer this to the next write there might be no file
-	// available until then.
+	// available until then, unless the user asked for exactly that.
 	// If this fails its also not a super big problem...
-	if empty, err := os.Create(outputFile); err == nil {
-		empty.Close()
+	if !config.noCreate {
+		if empty, err := os.Create(outputFile); err == nil {
+			empty.Close()
+			if err := copyExtendedAttributes(tempOutputFile, outputFile); err != nil {
+				logActivity("Failed to copy extended attributes to %s. Error: %s", outputFile, err)
+			}
+		}
 	}
 
 	// Let writer know to open the new output file
-	reloadOutputFile.Store(true)
-	return tempOutputFile, nil
+	config.state.reloadOutputFile.Store(true)
+	return tempOutputFile, firstWrite, nil
 }
 
-func isArchiveCompressed(outputFile string, index int) (bool, error) {
+func findArchiveExtension(outputFile string, index int) (string, error) {
 
-	// Archive files can be compressed or non compressed
+	// Archive files can be compressed in any format or non compressed
 	// We need to check in what category the file we are looking for is
-
-	// Check if compressed
-	if _, err := os.Stat(makeArchivePath(outputFile, index, true)); err == nil {
-		return true, nil
+	for _, format := range compressionFormats {
+		if _, err := os.Stat(makeArchivePath(outputFile, index, format.extension)); err == nil {
+			return format.extension, nil
+		}
 	}
 
 	// Input file might be non compressed
-	if _, err := os.Stat(makeArchivePath(outputFile, index, false)); err == nil {
-		return false, nil
+	if _, err := os.Stat(makeArchivePath(outputFile, index, "")); err == nil {
+		return "", nil
 	} else {
 
 		// We cant find the input file
-		return false, err
+		return "", err
 	}
 }
 
@@ -272,11 +789,11 @@ func moveArchiveFileUp(archive *archiveFile) error {
 	// If target path we want to rotate to exists we stop
 	// before overwriting any data...
 	inputFile := archive.getPath()
-	outputFile := makeArchivePath(archive.name, archive.index+1, archive.compressed)
+	outputFile := makeArchivePath(archive.name, archive.index+1, archive.extension)
 	if _, err := os.Stat(outputFile); err == nil {
 		return errors.New("Rotate target file exists! " + outputFile)
 	}
-	if err := os.Rename(inputFile, outputFile); err != nil {
+	if err := renameFile(inputFile, outputFile); err != nil {
 		return err
 	}
 
@@ -286,19 +803,67 @@ func moveArchiveFileUp(archive *archiveFile) error {
 
 func rotateFile(outputFile string, config rotateConfig) error {
 
-	// There are multiple threads using this function at the same
-	// time potentially, ensure that rotate finishes before we do another.
-	logActivity("Starting logrotate...")
-	rotateLock.Lock()
-	defer rotateLock.Unlock()
+	// Tag everything this rotation does so it can be followed across systems,
+	// callers that want to report errors under the same id pass one in.
+	if config.rotationID == "" {
+		config.rotationID = newRotationID()
+	}
+
+	// Rotations only come from the rotation goroutine, but retried uploads and
+	// orphan collection touch the archives too, ensure they wait for us.
+	logRotation(config.rotationID, "Starting logrotate...")
+	config.state.rotateLock.Lock()
+	defer config.state.rotateLock.Unlock()
+
+	// A misbehaving trigger writer or a tiny size threshold must not shred the history
+	if !config.state.allowRotation(config.maxRotationsPerHour, time.Now()) {
+		logRotation(config.rotationID, "Warning: refusing to rotate, already rotated %d times in the last hour",
+			config.maxRotationsPerHour)
+		return errRotationRateLimited
+	}
+
+	// If the output file is a symlink we rotate whatever it points to right now,
+	// renaming the link itself would leave a regular file in its place.
+	outputFile, err := resolveOutputFile(outputFile, config)
+	if err != nil {
+		return err
+	}
+
+	// Nothing was written since the last rotation, so the writer has not created the file yet
+	if config.noCreate {
+		if _, err := os.Stat(outputFile); errors.Is(err, os.ErrNotExist) {
+			logRotation(config.rotationID, "Output file %s does not exist, nothing to rotate", outputFile)
+			return errNothingToRotate
+		}
+	}
+	if config.skipEmpty {
+		if stat, err := statFile(outputFile); err == nil && stat.Size() == 0 {
+			logRotation(config.rotationID, "Output file %s is empty, nothing to rotate", outputFile)
+			return errNothingToRotate
+		}
+	}
+
+	// The output file stays where it is until compression can start right away
+	if config.compression != nil {
+		acquireCompressionSlot(config.rotationID)
+		defer releaseCompressionSlot()
+	}
+
+	// Remember when the rotation happened, this is used to name uploaded archives
+	rotatedAt := time.Now()
+	phases := newRotationPhases()
+	defer phases.warnIfSlow(config.rotationID, config.rotationWarnThreshold)
 
 	// Quickly move the output file out of the way so the writer
 	// can continue.
 	// The rest of the function now has plenty of time - its not blocking anything
-	tempOutputFile, err := moveOutputFile(outputFile)
+	archiveBase := makeArchiveBase(outputFile, config)
+	tempOutputFile, firstWrite, err := moveOutputFile(outputFile, archiveBase, config)
 	if err != nil {
 		return err
 	}
+	audit(config.rotationID, "rename", outputFile, tempOutputFile)
+	phases.mark("rename")
 
 	// Apply pre script if there is one
 	if config.preScript != nil && *config.preScript != "" {
@@ -309,58 +874,148 @@ func rotateFile(outputFile string, config rotateConfig) error {
 
 			// Run user script, pass output file as arg
 			process := exec.Command("/bin/sh", "-c", *config.preScript, preScriptOperatorFile)
+			process.Env = append(os.Environ(), "ROTEE_ROTATION_ID="+config.rotationID)
+			config.scriptCredentials.apply(process)
 
 			// Run process
-			logActivity("Running user defined pre script...")
+			logRotation(config.rotationID, "Running user defined pre script...")
 			if err := process.Run(); err != nil {
-				logActivity("Error while running user defined pre script!")
+				logRotation(config.rotationID, "Error while running user defined pre script!")
 				return err
 			}
 
 			// Sanity check that the user script did not delete the output file
-			if _, err := os.Stat(tempOutputFile); err != nil {
+			if _, err := statFile(tempOutputFile); err != nil {
 
 				// We cant stat the file, assume that something evil
 				// happened and error out...
-				logActivity("Can not find logfile after user script. Aborting...")
+				logRotation(config.rotationID, "Can not find logfile after user script. Aborting...")
 				return err
 			}
 		} else {
-			logActivity("Can not find path to logfile. Error: %s", err)
+			logRotation(config.rotationID, "Can not find path to logfile. Error: %s", err)
 			return err
 		}
 	}
 
+	phases.mark("hooks")
+
+	// Remember how much data we rotate out for notifications
+	// and when the last line was written
+	var rotatedSize int64
+	var lastWrite time.Time
+	if stat, err := statFile(tempOutputFile); err == nil {
+		rotatedSize = stat.Size()
+		lastWrite = stat.ModTime()
+	}
+
+	// File times come from a coarser clock, a single write can look like it ended before it started
+	if !firstWrite.IsZero() && !lastWrite.IsZero() && firstWrite.After(lastWrite) {
+		firstWrite = lastWrite
+	}
+
+	// Count before the footer goes in, it is not part of the log
+	var rotatedLines int64
+	if config.summaryMode != summaryModeNone {
+		if rotatedLines, err = countFileLines(tempOutputFile); err != nil {
+			logRotation(config.rotationID, "Failed to count lines of %s. Error: %s", tempOutputFile, err)
+		}
+	}
+	if config.summaryMode == summaryModeFooter {
+		if err := appendSummaryFooter(tempOutputFile, rotatedLines, rotatedSize, firstWrite, lastWrite, config.rotationID); err != nil {
+			logRotation(config.rotationID, "Failed to append summary to %s. Error: %s", tempOutputFile, err)
+		}
+	}
+
+	if config.summaryMode != summaryModeNone {
+		phases.mark("summary")
+	}
+
 	// Move all archive files up by 1
 	// Bubble this "hole" up, so there is no .1.gz archive
-	logActivity("Moving archives up...")
-	archives := findAllArchives(outputFile)
-	logActivity("Have %d archives", len(archives))
+	logRotation(config.rotationID, "Moving archives up...")
+	archives := orderArchives(findAllArchives(archiveBase), config.archiveNaming)
+	logRotation(config.rotationID, "Have %d archives", len(archives))
+
+	// Records have to follow the archives around, write them back whatever happens below
+	manifest := loadManifest(archiveBase, archives)
+	defer func() {
+		if err := manifest.save(); err != nil {
+			logRotation(config.rotationID, "Failed to write manifest for %s. Error: %s", outputFile, err)
+		}
+	}()
+
 	for i := len(archives) - 1; i >= 0; i-- {
+
+		// Dated archives keep their name forever, only numbered ones make room for the new one
+		if config.archiveNaming == archiveNamingDate || archives[i].date != "" {
+			continue
+		}
+		previousPath := archives[i].getPath()
 		if err := moveArchiveFileUp(&archives[i]); err != nil {
-			logActivity("Error while moving archive files: %s", err)
+			logRotation(config.rotationID, "Error while moving archive files: %s", err)
 			return err
 		}
+		audit(config.rotationID, "rename", previousPath, archives[i].getPath())
+		manifest.move(archives[i].index-1, archives[i].index)
 	}
+	phases.mark("shift")
 
 	// Compress / copy the file we are currently rotating out
-	newArchive := archiveFile{outputFile, 1, config.useCompression}
-	if config.useCompression {
-		if err := gzipFile(tempOutputFile, newArchive.getPath()); err != nil {
-			logActivity("Error while gziping logfile: %s", err)
-			return err
+	newArchive := archiveFile{name: archiveBase, index: 1, extension: config.archiveExtension()}
+	if config.archiveNaming == archiveNamingDate {
+		newArchive = nextDatedArchive(archiveBase, rotatedAt.In(config.location), config.archiveExtension(), archives)
+	}
+	if err := createArchive(tempOutputFile, newArchive, config); err != nil {
+		if config.compression != nil {
+			logRotation(config.rotationID, "Error while compressing logfile: %s", err)
+		} else {
+			logRotation(config.rotationID, "Error while copying logfile: %s", err)
 		}
-	} else {
-		if err := copyFile(tempOutputFile, newArchive.getPath()); err != nil {
-			logActivity("Error while copying logfile: %s", err)
-			return err
+		return err
+	}
+
+	// Let the user judge whether compression is worth the CPU
+	var originalSize, compressedSize int64
+	if config.compression != nil {
+		originalStat, originalErr := os.Stat(tempOutputFile)
+		compressedStat, compressedErr := os.Stat(newArchive.getPath())
+		if originalErr == nil && compressedErr == nil {
+			originalSize, compressedSize = originalStat.Size(), compressedStat.Size()
+			config.state.bytesBeforeCompression.Add(originalSize)
+			config.state.bytesAfterCompression.Add(compressedSize)
+			logRotation(config.rotationID, "Compressed %d bytes to %d bytes, %s", originalSize, compressedSize,
+				describeCompressionSavings(originalSize, compressedSize))
+		}
+	}
+
+	// Later archives benefit from a dictionary trained on this one
+	if config.compression != nil && config.compression.name == "zstd" && config.compressionOptions.zstdTrainDictionary {
+		if err := trainZstdDictionary(tempOutputFile, archiveBase, config.compressionOptions); err != nil {
+			logRotation(config.rotationID, "Failed to train zstd dictionary. Error: %s", err)
 		}
 	}
 	archives = prepend(archives, newArchive)
+	record := archiveRecord{Index: newArchive.index, Date: newArchive.date, Extension: newArchive.extension,
+		Rotated: rotatedAt, RotationID: config.rotationID}
+	if !firstWrite.IsZero() {
+		record.FirstWrite = &firstWrite
+	}
+	if !lastWrite.IsZero() {
+		record.LastWrite = &lastWrite
+	}
+	if config.summaryMode != summaryModeNone {
+		record.Lines, record.Bytes = rotatedLines, rotatedSize
+	}
+	record.OriginalSize, record.CompressedSize = originalSize, compressedSize
+	manifest.add(record)
 
 	// Rotate done, remove temporary file
-	logActivity("Removing temporary logfile...")
-	os.Remove(tempOutputFile)
+	logRotation(config.rotationID, "Removing temporary logfile...")
+	if err := removeFile(tempOutputFile); err == nil {
+		audit(config.rotationID, "delete", tempOutputFile, "")
+	}
+	phases.mark("compress")
 
 	// Apply post script if there is one
 	// We do this before applying delete rules.
@@ -368,67 +1023,115 @@ func rotateFile(outputFile string, config rotateConfig) error {
 
 		// Obtain abs path to the file the post script is supposed to operate on
 		// If we fail to make abs path just dont run the pre scipt, something is weird...
-		logActivity("Running user defined post script...")
+		logRotation(config.rotationID, "Running user defined post script...")
 		if postScriptOperatorFile, err := filepath.Abs(newArchive.getPath()); err == nil {
 
 			// Run user script, pass archive file name
 			process := exec.Command("/bin/sh", "-c", *config.postScript, postScriptOperatorFile)
+			process.Env = append(os.Environ(), "ROTEE_ROTATION_ID="+config.rotationID)
+			config.scriptCredentials.apply(process)
 
 			// Run process
 			if err := process.Run(); err != nil {
-				logActivity("Error while running user defined post script!")
+				logRotation(config.rotationID, "Error while running user defined post script!")
 				return err
 			}
 		} else {
-			logActivity("Can not find path to logfile. Error: %s", err)
+			logRotation(config.rotationID, "Can not find path to logfile. Error: %s", err)
 			return err
 		}
 	}
 
-	// Apply max files rule
-	if config.maxFiles >= 0 {
-		logActivity("Limit max number of archives to %d", config.maxFiles)
-		for i, archive := range archives {
-			if i >= config.maxFiles {
+	// The post script was the last chance to modify the archive
+	if config.archiveReadonly {
+		if err := makeReadonly(newArchive.getPath()); err != nil {
+			logRotation(config.rotationID, "Failed to make %s read-only. Error: %s", newArchive.getPath(), err)
+		}
+	}
+
+	phases.mark("hooks")
 
-				// Its okay if remove fails here
-				if err := os.Remove(archive.getPath()); err != nil {
-					logActivity("Failed to delete %s", archive.getPath())
-					continue
-				}
+	// Tell the chat and the broker what we just did, the archive might be uploaded and gone below
+	event := notifyEvent{
+		Event:      "rotation",
+		OutputFile: outputFile,
+		Archive:    newArchive.getPath(),
+		Size:       rotatedSize,
+		Duration:   time.Since(rotatedAt).Round(time.Millisecond),
+	}
+	if stat, err := os.Stat(newArchive.getPath()); err == nil {
+		event.ArchiveSize = stat.Size()
+	}
+	notify(config, event)
+	phases.mark("notify")
+	config.state.rotatedArchive = newArchive.getPath()
+
+	// Collect everything the retention rules delete for a single notification
+	pruned := make([]string, 0)
+
+	// Ship the new archive, we do this after the post script so the
+	// user can still modify the archive before it leaves the machine.
+	// The upload goroutine does it, the remote must not hold up rotations.
+	if config.uploader != nil {
+		manifest.get(newArchive).UploadName = makeRemoteArchiveName(newArchive, rotatedAt)
+		if config.localMaxFiles >= 0 {
+			var localPruned []string
+			archives, localPruned = applyLocalMaxFiles(archives, manifest, outputFile, config)
+			pruned = append(pruned, localPruned...)
+		}
+	}
+
+	// Pin the archives for the mirror before the retention rules get to them, the
+	// upload goroutine copies them once we are done. A newer pin replaces an older one.
+	if config.syncDestination != "" {
+		for _, pin := range pinMirrorArchives(findAllArchives(archiveBase), archiveBase, manifest, true) {
+			if previous, found := config.state.mirrorPins[pin.name]; found {
+				os.Remove(previous.path)
 			}
+			config.state.mirrorPins[pin.name] = pin
 		}
 	}
+	if config.uploader != nil || config.syncDestination != "" {
+		config.state.wakeShipping()
+	}
+	phases.mark("upload")
 
-	// Apply file age rule
-	if config.maxAgeDays >= 0 {
-		logActivity("Limit max number of archives to %d days", config.maxAgeDays)
+	// Old archives go into monthly bundles, the retention rules only see what is left
+	if config.bundleAfterDays >= 0 {
+		archives = bundleArchives(archives, manifest, config)
+		pruned = append(pruned, pruneBundles(archiveBase, config)...)
+	}
 
-		today := time.Now()
+	// Apply max files and file age rules
+	pruned = append(pruned, applyRetentionRules(archives, manifest, archiveBase, outputFile, config)...)
 
-		for _, archive := range archives {
-			if stat, err := os.Stat(archive.getPath()); err == nil {
-				fileAge := int(math.Floor(today.Sub(stat.ModTime()).Hours() / 24))
-				if fileAge >= config.maxAgeDays {
+	// Leftovers of failed rotations, the data in them never made it into an archive
+	if config.pruneOrphans {
+		pruned = append(pruned, pruneOrphans(archiveBase, config, 0)...)
+	}
 
-					// Its okay if remove fails here
-					logActivity("Removing file %s because of age %d days is larger than %d days",
-						archive.getPath(), fileAge, config.maxAgeDays)
-					if err := os.Remove(archive.getPath()); err != nil {
-						logActivity("Failed to delete %s", archive.getPath())
-						continue
-					}
-				}
-			} else {
-				logActivity("Failed to stat %s", archive.getPath())
-			}
+	if len(pruned) > 0 {
+		notify(config, notifyEvent{Event: "prune", OutputFile: outputFile, Pruned: pruned})
+	}
+
+	// Its okay if this fails, the archives themselves are fine
+	if config.latestLink != "" {
+		if err := updateLatestLink(archiveBase, archives, config.latestLink); err != nil {
+			logRotation(config.rotationID, "Failed to update latest archive link. Error: %s", err)
 		}
 	}
+	phases.mark("prune")
 
+	config.state.consecutiveRotateFailures.Store(0)
 	return nil
 }
 
-func shouldTrigger(triggerFile string) bool {
+func shouldTrigger(triggerFile string, triggerMode string) bool {
+
+	if triggerMode == triggerModeTouch {
+		_, err := os.Stat(triggerFile)
+		return err == nil
+	}
 
 	// Check if file containts exactly a single '1'
 	// We are generous and allow a newline after the '1'
@@ -449,25 +1152,42 @@ func watchForTrigger(wg *sync.WaitGroup, outputFile string, triggerFile string,
 		// Start work, tell wait group that we are busy and cant exit.
 		wg.Add(1)
 
-		// Check if trigger files meets conditions to initiate rotate
-		if shouldTrigger(triggerFile) {
+		// Check if trigger files meets conditions to initiate rotate.
+		// During a hold the file keeps its 1 and we rotate once the hold is lifted.
+		if shouldTrigger(triggerFile, config.triggerMode) && !config.hold.held() {
 
 			// Perform rotation, success we write '0' to the trigger file else '2'
-			logActivity("Starting rotate because of trigger file %s", triggerFile)
-			result := "0"
-			if err := rotateFile(outputFile, config); err != nil {
-				logActivity("Error during logrotate: %s", err)
-				result = "2"
+			// If the rate limit refused to rotate we write '3', if there was nothing to rotate '4'
+			// and if the request shared a rotation with one that came in earlier '5'
+			config.rotationID = newRotationID()
+			status := 0
+			logRotation(config.rotationID, "Starting rotate because of trigger file %s", triggerFile)
+			result := requestRotationResult(config)
+			if errors.Is(result.err, errRotationRateLimited) {
+				status = 3
+			} else if errors.Is(result.err, errNothingToRotate) {
+				status = 4
+			} else if result.err != nil {
+				logRotation(config.rotationID, "Error during logrotate: %s", result.err)
+				reportFailure(config, "rotate", outputFile, "", result.err)
+				status = 2
+			} else if result.coalesced {
+				status = 5
+			}
+			if config.triggerMode == triggerModeTouch {
+				logActivity("Deleting %s, status %d", triggerFile, status)
+			} else {
+				logActivity("Writing status %d to %s", status, triggerFile)
 			}
-			logActivity("Writing status %s to %s", result, triggerFile)
 
 			// Write the result bit
 			// If this fails we have to hard crash, to prevent unintended data loss
 			// The trigger file would still contain 1 which would trigger another rotation
 			// and failure and so on, rotating all the user data away.
-			if err := os.WriteFile(triggerFile, []byte(result), 0644); err != nil {
+			response := newTriggerResponse(status, config.rotationID, result)
+			if err := writeTriggerResponse(triggerFile, config.triggerMode, config.triggerResponse, response); err != nil {
 				logActivity("Can not write to %s, shutting down in order to prevent data loss...", triggerFile)
-				log.Fatalf("Can not write to %s, shutting down in order to prevent data loss...", triggerFile)
+				exitf(exitRotationError, "Can not write to %s, shutting down in order to prevent data loss...", triggerFile)
 			}
 		}
 
@@ -492,43 +1212,88 @@ func automaticTimedRotation(wg *sync.WaitGroup, autoRotateFrequency float64, out
 		// Sleep over, we are actually doing something so we tell the wait group
 		// that we can not exit
 		wg.Add(1)
-
-		if err := rotateFile(outputFile, config); err != nil {
-			logActivity("Timed rotate failed!")
-			log.Fatal("Timed rotate failed!")
+		config.hold.waitUntilLifted(wg, config.scanFrequencySeconds)
+
+		config.rotationID = newRotationID()
+		if err := requestRotation(config); errors.Is(err, errRotationRateLimited) {
+			logRotation(config.rotationID, "Skipping timed rotate because of the rate limit")
+		} else if errors.Is(err, errNothingToRotate) {
+			logRotation(config.rotationID, "Skipping timed rotate, nothing was written")
+		} else if err != nil {
+			logRotation(config.rotationID, "Timed rotate failed!")
+			reportFailure(config, "rotate", outputFile, "", err)
+			if config.errorMode == errorModeFailFast {
+				exitf(exitRotationError, "Timed rotate failed!")
+			}
 		}
 	}
 }
 
-func automaticFileSizeRotation(wg *sync.WaitGroup, maxFileSizeBytes int64, outputFile string, config rotateConfig) {
+// Archives are named after the output file, but may live in a different directory
+func makeArchiveBase(outputFile string, config rotateConfig) string {
+	if config.archiveDir == "" {
+		return outputFile
+	}
+	return filepath.Join(config.archiveDir, filepath.Base(outputFile))
+}
 
-	logActivity("Running logrotate once file has size %d, checking every %f seconds",
-		maxFileSizeBytes, config.scanFrequencySeconds)
-	for {
+func resolveOutputFile(outputFile string, config rotateConfig) (string, error) {
 
-		// Start work, tell wait group that we are busy and cant exit.
-		wg.Add(1)
+	if config.outputTemplate {
+		return currentTemplatedFile(outputFile, config), nil
+	}
+	if !config.followSymlink {
+		return outputFile, nil
+	}
 
-		if stat, err := os.Stat(outputFile); err == nil {
+	target, err := resolveSymlink(outputFile)
+	if err != nil {
+		logActivity("Can not resolve symlink %s. Error: %s", outputFile, err)
+		return "", err
+	}
+	logActivity("Output file %s currently resolves to %s", outputFile, target)
+	return target, nil
+}
 
-			// Check if file is larger than trigger threshold, if yes do logrotate
-			if stat.Size() >= maxFileSizeBytes {
+func resolveSymlink(link string) (string, error) {
 
-				logActivity("Log file is now %d bytes, trigger at %d bytes", stat.Size(), maxFileSizeBytes)
-				if err := rotateFile(outputFile, config); err != nil {
-					logActivity("Filed size based rotation failed!")
-					log.Fatal("Filed size based rotation failed!")
-				}
-			}
-		} else {
-			logActivity("Filed size based rotation could not stat file %s", outputFile)
-		}
+	// We only read the link itself, its target might not exist yet.
+	// The writer creates it when reopening.
+	target, err := os.Readlink(link)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(link), target)
+	}
+	return target, nil
+}
 
-		// Tell the wait group that we could exit here while we are asleep.
-		wg.Done()
+func watchSymlink(outputFile string, config rotateConfig) {
 
-		// Wait time before checking file size
+	logActivity("Following symlink %s, checking every %f seconds", outputFile, config.scanFrequencySeconds)
+
+	// Remember where the link pointed when we started, the writer has this file open
+	lastTarget, _ := resolveSymlink(outputFile)
+	for {
+
+		// Wait time before resolving the link again
 		time.Sleep(time.Millisecond * time.Duration(config.scanFrequencySeconds*1000))
+
+		// The link might be missing for a moment while it is being swapped,
+		// just try again next time.
+		target, err := resolveSymlink(outputFile)
+		if err != nil {
+			logActivity("Can not resolve symlink %s. Error: %s", outputFile, err)
+			continue
+		}
+
+		// Link was swapped, let writer know to open the new target
+		if target != lastTarget {
+			logActivity("Symlink %s now points to %s, reopening", outputFile, target)
+			lastTarget = target
+			config.state.reloadOutputFile.Store(true)
+		}
 	}
 }
 
@@ -579,13 +1344,93 @@ func touchFile(path string) error {
 
 func main() {
 
+	// Maintenance subcommands have their own arguments
+	if len(os.Args) > 1 && os.Args[1] == "sync" {
+		runSyncCommand(os.Args[1:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "compact" {
+		runCompactCommand(os.Args[1:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "multi" {
+		runMultiCommand(os.Args[1:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		runMigrateCommand(os.Args[1:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "show" {
+		runShowCommand(os.Args[1:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import-logrotate" {
+		runImportLogrotateCommand(os.Args[1:])
+		return
+	}
+
+	// Set up a wait group to prevent shutting down before all writes
+	// and rotates are complete.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	start, ok := startPipeline(os.Args, "", true, false, &wg)
+	if !ok {
+		os.Exit(exitConfigError)
+	}
+	start()
+}
+
+// Set up everything that only exists once per process
+func setupProcess(activityFilePath string, auditFilePath string, umask string, retries int, compressJobs int, networkFileSystem bool) {
+
+	renameRetries = retries
+	networkFS = networkFileSystem
+	if compressJobs < 0 {
+		exitf(exitConfigError, "Compression job limit can not be negative")
+	} else if compressJobs > 0 {
+		compressionSlots = make(chan struct{}, compressJobs)
+	}
+
+	// Has to happen before we create any file
+	if err := applyUmask(umask); err != nil {
+		exitf(exitConfigError, "Can not set umask: %s", err)
+	}
+
+	// The activity log and audit file stay open until rotee exits
+	if activityFilePath != "" {
+		if f, err := os.OpenFile(activityFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+			exitf(exitConfigError, "Cant open activity log file at %s", activityFilePath)
+		} else {
+			log.SetOutput(f)
+			verbose = true
+		}
+	}
+
+	if auditFilePath != "" {
+		if err := openAuditFile(auditFilePath); err != nil {
+			exitf(exitConfigError, "Cant open audit file at %s", auditFilePath)
+		}
+	}
+}
+
+// Parse the arguments of one output file and start rotating it. Lines come from
+// inputPath or stdin if empty, reading and writing starts once the returned function is called.
+// With multi the process wide options are not allowed, rotee multi sets them for all pipelines.
+func startPipeline(args []string, inputPath string, echo bool, multi bool, wg *sync.WaitGroup) (func(), bool) {
+
 	parser := argparse.NewParser("rotee",
 		fmt.Sprintf("tee with integrated logrotate (rev: %s)", Commit))
 	outputFile := parser.String("o", "output-file",
 		&argparse.Options{Required: true, Help: "File to redirect output to."})
-	triggerFile := parser.String("t", "trigger-file",
+	triggerFiles := parser.StringList("t", "trigger-file",
 		&argparse.Options{Required: false, Help: "Write 1 to this file to trigger logrotate." +
-			"If logrotate succeeds we write '0' to this file, on error we write '2'."})
+			"If logrotate succeeds we write '0' to this file, on error we write '2'. " +
+			"Can be given multiple times, each file gets its own result"})
+	holdFile := parser.String("", "hold-file",
+		&argparse.Options{Required: false, Help: "Do not rotate while this file exists, writes continue. " +
+			"Rotations that became due meanwhile happen once it is deleted"})
 	maxFiles := parser.Int("n", "max-files",
 		&argparse.Options{Required: false, Help: "Max number of files to keep." +
 			"Set to negative number to disable." +
@@ -601,84 +1446,1004 @@ func main() {
 		&argparse.Options{Required: false, Help: "How much time to wait between checking the trigger file in seconds", Default: 1.0})
 	useCompression := parser.Flag("c", "compress",
 		&argparse.Options{Required: false, Help: "Whether to compress the output", Default: false})
+	compressionName := parser.String("", "compression",
+		&argparse.Options{Required: false, Help: "Compression format to use, gzip, zstd, bzip2, lz4, brotli, snappy or zip. -c is the same as gzip"})
+	compressionLevel := parser.Int("", "compression-level",
+		&argparse.Options{Required: false, Help: "Compression level, 0 uses the default of the format", Default: 0})
+	zstdLong := parser.Int("", "zstd-long",
+		&argparse.Options{Required: false, Help: "zstd window size as power of 2 (10 - 29) for long distance matching, " +
+			"0 uses the default of the level", Default: 0})
+	zstdDictionary := parser.String("", "zstd-dictionary",
+		&argparse.Options{Required: false, Help: "zstd dictionary to compress with, " +
+			"with --zstd-train-dictionary this is where the trained dictionary is stored"})
+	zstdTrainDictionary := parser.Flag("", "zstd-train-dictionary",
+		&argparse.Options{Required: false, Help: "Train a zstd dictionary from the first rotated log and use it for all later archives", Default: false})
+	compressBufferBytes := parser.Int("", "compress-buffer-bytes",
+		&argparse.Options{Required: false, Help: "Size of the buffer used to stream files through compression", Default: 32 * 1024})
+	compressMaxCPUs := parser.Int("", "compress-max-cpus",
+		&argparse.Options{Required: false, Help: "Most CPU cores zstd and snappy compression may use at once, " +
+			"0 uses all of them", Default: 0})
+	compressMaxJobs := parser.Int("", "compress-max-jobs",
+		&argparse.Options{Required: false, Help: "Most rotations of the output file and all routes that compress at the same time, " +
+			"further rotations wait. 0 for no limit", Default: 0})
+	compressNice := parser.Int("", "compress-nice",
+		&argparse.Options{Required: false, Help: "Nice value from 1 to 19 to compress with, 0 leaves it as it is, so rotations do not take CPU " +
+			"from the program that writes the log. Only on linux", Default: 0})
+	compressIONice := parser.String("", "compress-ionice",
+		&argparse.Options{Required: false, Help: "I/O priority to compress with, idle or best-effort:0 to best-effort:7. Only on linux"})
 	preScript := parser.String("s", "pre-script",
 		&argparse.Options{Required: false, Help: "Script to run before rotate, " +
 			"passes the absolute path to the file about to be rotated to the script"})
+	archiveDir := parser.String("", "archive-dir",
+		&argparse.Options{Required: false, Help: "Directory to keep archives in, defaults to the directory of the output file. " +
+			"May be on another filesystem"})
+	timezone := parser.String("", "timezone",
+		&argparse.Options{Required: false, Help: "Timezone like Europe/Berlin for the hour, minute and weekday of --rotate-when, " +
+			"date patterns in the output file and dated archive names. Defaults to the timezone of the host"})
+	archiveNaming := parser.String("", "archive-naming",
+		&argparse.Options{Required: false, Help: "How to name archives, index (app.log.1.gz, shifted on every rotation) " +
+			"or date (app.log.2024-06-01.1.gz, counting up within the day)", Default: archiveNamingIndex})
+	umask := parser.String("", "umask",
+		&argparse.Options{Required: false, Help: "Umask for all files rotee creates, in octal like 027. " +
+			"Defaults to the umask rotee was started with"})
+	noCreate := parser.Flag("", "no-create",
+		&argparse.Options{Required: false, Help: "Do not create a new empty output file after rotation, " +
+			"it is created with the next write", Default: false})
+	skipEmpty := parser.Flag("", "skip-empty",
+		&argparse.Options{Required: false, Help: "Do not rotate an empty output file, like notifempty of logrotate", Default: false})
+	currentSymlink := parser.String("", "current-symlink",
+		&argparse.Options{Required: false, Help: "Keep a symlink at this path pointing to the output file currently written to"})
+	renameRetriesFlag := parser.Int("", "rename-retries",
+		&argparse.Options{Required: false, Help: "How often to retry renaming or deleting a file that another process has open, " +
+			"only happens on windows", Default: defaultRenameRetries})
+	networkFileSystem := parser.Flag("", "network-fs",
+		&argparse.Options{Required: false, Help: "The output file and archives are on NFS or SMB. Retries renames, deletes and stats " +
+			"that fail for a moment and takes the age of archives for --max-days from the manifest instead of the server", Default: false})
+	archiveReadonly := parser.Flag("", "archive-readonly",
+		&argparse.Options{Required: false, Help: "Remove write permissions from archives after the post script ran", Default: false})
+	pruneOrphans := parser.Flag("", "prune-orphans",
+		&argparse.Options{Required: false, Help: "Also delete temporary files (app.log.tmp.1) left behind by failed rotations " +
+			"when applying retention rules", Default: false})
+	orphanMaxAge := parser.Float("", "orphan-max-age",
+		&argparse.Options{Required: false, Help: "Look for temporary files (app.log.tmp.1) of failed rotations that are older " +
+			"than this many seconds and handle them as --orphan-policy says. Set to negative number to disable", Default: -1.0})
+	orphanPolicyFlag := parser.String("", "orphan-policy",
+		&argparse.Options{Required: false, Help: "What to do with old temporary files, archive or delete them", Default: orphanPolicyArchive})
+	latestLink := parser.String("", "latest-link",
+		&argparse.Options{Required: false, Help: "Keep a link (app.log.latest.gz) pointing to the newest archive, " +
+			"either symlink or hardlink"})
+	bundleAfterDays := parser.Int("", "bundle-after-days",
+		&argparse.Options{Required: false, Help: "Bundle archives older than this many days into one tar.zst per month. " +
+			"Set to negative number to disable", Default: -1})
+	maxRotationsPerHour := parser.Int("", "max-rotations-per-hour",
+		&argparse.Options{Required: false, Help: "Refuse to rotate more often than this per hour, " +
+			"the trigger file gets result 3 then. Set to negative number to disable", Default: -1})
+	auditFilePath := parser.String("", "audit-file",
+		&argparse.Options{Required: false, Help: "Append a JSON line for every rename, delete, truncate and upload " +
+			"of log data to this file"})
 	postScript := parser.String("p", "post-script",
 		&argparse.Options{Required: false, Help: "Script to run after rotate, " +
 			"passes the absolute path to the rotated file to the script"})
+	scriptUser := parser.String("", "script-user",
+		&argparse.Options{Required: false, Help: "Run pre, post and error scripts as this user (name or uid), " +
+			"useful when rotee runs as root"})
+	scriptGroup := parser.String("", "script-group",
+		&argparse.Options{Required: false, Help: "Run pre, post and error scripts with this group (name or gid), " +
+			"defaults to the primary group of --script-user"})
 	autoRotateFrequency := parser.Float("a", "auto-rotate-frequency",
 		&argparse.Options{Required: false, Help: "How long to wait between rotating the file." +
 			"Set to a positive number of seconds to activate", Default: -1.0})
 	maxLogFileSize := parser.String("m", "max-logfile-size",
 		&argparse.Options{Required: false, Help: "Max logfile size before triggering logrotate." +
 			"Set to a positive number of bytes to activate, allowed formats are: kb, mb, gb", Default: ""})
+	buffering := parser.String("", "buffering",
+		&argparse.Options{Required: false, Help: "How writes reach the output file: line writes every read right away, " +
+			"block collects them and writes every --flush-interval, none waits for the disk on every write, " +
+			"direct is like block but writes with O_DIRECT past the page cache (linux only)", Default: bufferingLine})
+	flushInterval := parser.Float("", "flush-interval",
+		&argparse.Options{Required: false, Help: "Seconds between writes with --buffering block", Default: 1.0})
+	syncOpen := parser.Flag("", "sync-open",
+		&argparse.Options{Required: false, Help: "Open the output file with O_DSYNC, every write waits until its data is on disk " +
+			"without waiting for timestamps like --buffering none does", Default: false})
+	preallocateSize := parser.String("", "preallocate",
+		&argparse.Options{Required: false, Help: "Reserve this much disk space for the output file whenever it is opened, " +
+			"like 100mb. Less fragmentation and a full disk is noticed early, only on linux"})
+	blockSize := parser.String("", "block-size",
+		&argparse.Options{Required: false, Help: "Write early once this much is held back with --buffering block, like 64kb", Default: "64kb"})
+	fsyncAfterIdle := parser.Float("", "fsync-after-idle",
+		&argparse.Options{Required: false, Help: "Sync the output file to disk once no input arrived for this many seconds. " +
+			"Set to negative number to disable", Default: -1.0})
+	summaryModeFlag := parser.String("", "summary",
+		&argparse.Options{Required: false, Help: "Record lines, bytes and the covered time range of every archive, " +
+			"none, manifest to write them to the manifest or footer to also end the archive with a summary line", Default: summaryModeNone})
+	rotationWarnThreshold := parser.String("", "rotation-warn-threshold",
+		&argparse.Options{Required: false, Help: "Log a warning with the time spent in each phase when a rotation takes longer than this, " +
+			"like 30s", Default: ""})
+	ackMode := parser.String("", "ack-mode",
+		&argparse.Options{Required: false, Help: "none reads ahead of the writer, durable only takes more input once " +
+			"everything read so far is synced to disk", Default: ackModeNone})
+	routes := parser.StringList("", "route",
+		&argparse.Options{Required: false, Help: "Write lines matching a regular expression to another output file, " +
+			"like 'ERROR|WARN=>errors.log'. Can be given multiple times, the first match wins"})
+	routesFile := parser.String("", "routes-file",
+		&argparse.Options{Required: false, Help: "JSON file with more routes, each can have its own compression, " +
+			"max_files and max_days. See README for the format"})
+	positionFile := parser.String("", "position-file",
+		&argparse.Options{Required: false, Help: "Remember in this file how far a file input was read, " +
+			"so the next run continues after the last line written. Only for inputs of rotee multi", Default: ""})
+	spoolFile := parser.String("", "spool-file",
+		&argparse.Options{Required: false, Help: "Spill input to this file while the writer can not keep up, " +
+			"instead of holding up the program that writes the log", Default: ""})
+	spoolMaxSize := parser.String("", "spool-max-size",
+		&argparse.Options{Required: false, Help: "Largest the spool file may grow before the input is held up again, " +
+			"like 1gb. Set to 0 for no limit", Default: "1gb"})
+	stallTimeout := parser.String("", "stall-timeout",
+		&argparse.Options{Required: false, Help: "Report a critical failure when a write to the output file makes no progress for this long, " +
+			"like 30s for a hung NFS mount", Default: ""})
+	stallFallback := parser.String("", "stall-fallback",
+		&argparse.Options{Required: false, Help: "Write to this file instead once --stall-timeout found the output file stuck", Default: ""})
+	exitAfterIdle := parser.String("", "exit-after-idle",
+		&argparse.Options{Required: false, Help: "Exit once no input arrived for this long, like 10m, " +
+			"for inputs that never reach their end. A number without unit is seconds"})
+	rotateOnExit := parser.Flag("", "rotate-on-exit",
+		&argparse.Options{Required: false, Help: "Rotate the output file when rotee exits at the end of the input " +
+			"or because of --exit-after-idle", Default: false})
+	heartbeat := parser.String("", "heartbeat",
+		&argparse.Options{Required: false, Help: "Write --heartbeat-text to the output file whenever no input arrived for this long, " +
+			"like 60s or 5m. A number without unit is seconds"})
+	heartbeatText := parser.String("", "heartbeat-text",
+		&argparse.Options{Required: false, Help: "Line to write for --heartbeat", Default: "-- MARK --"})
+	httpListen := parser.String("", "http-listen",
+		&argparse.Options{Required: false, Help: "Serve the output file and its archives read-only over HTTP on this address, " +
+			"like localhost:8080. There is no authentication, so do not expose it"})
+	grpcListen := parser.String("", "grpc-listen",
+		&argparse.Options{Required: false, Help: "Serve the gRPC control service of control.proto on this address, " +
+			"like localhost:9090, to rotate, flush, prune and tail from other programs. There is no authentication, so do not expose it"})
+	rotateWhen := parser.String("", "rotate-when",
+		&argparse.Options{Required: false, Help: "Rotate once this condition holds, like 'size > 100mb && age > 1h'. " +
+			"Knows size, age since the last rotation, lines, hour, minute and weekday, see README"})
+	rotateIfIdle := parser.String("", "rotate-if-idle",
+		&argparse.Options{Required: false, Help: "Rotate once no input arrived for this long and the file is not empty, " +
+			"like 300s, 5m or 1h. A number without unit is seconds"})
+	triggerPolicyFlag := parser.String("", "trigger-policy",
+		&argparse.Options{Required: false, Help: "How -a and -m combine, any rotates when either of them triggers, " +
+			"all only once the file reached the size and the last rotation is at least that long ago", Default: triggerPolicyAny})
+	triggerModeFlag := parser.String("", "trigger-mode",
+		&argparse.Options{Required: false, Help: "content to rotate when the trigger file contains 1, " +
+			"touch to rotate when it exists and delete it afterwards", Default: triggerModeContent})
+	triggerResponseFlag := parser.String("", "trigger-response",
+		&argparse.Options{Required: false, Help: "What to write back after a trigger, digit for the status digit, json for " +
+			"a JSON object with rotation id, archive and error, status-file for the digit and the JSON object in <trigger file>.status",
+			Default: triggerResponseDigit})
 	activityFilePath := parser.String("v", "verbose-output-file",
 		&argparse.Options{Required: false, Help: "Specify an output file for activity logging"})
-
-	if err := parser.Parse(os.Args); err != nil {
+	uploadTarget := parser.String("", "upload",
+		&argparse.Options{Required: false, Help: "Upload every new archive after rotation, " +
+			"for example s3://bucket/prefix, gs://bucket/prefix, azblob://container/prefix or sftp://user@host/path"})
+	uploadRetries := parser.Int("", "upload-retries",
+		&argparse.Options{Required: false, Help: "How often to retry a failed upload, waiting exponentially longer each time", Default: 3})
+	uploadDeleteAfter := parser.Flag("", "upload-delete",
+		&argparse.Options{Required: false, Help: "Delete the local archive after it was uploaded", Default: false})
+	uploadRetryInterval := parser.Float("", "upload-retry-interval",
+		&argparse.Options{Required: false, Help: "How long to wait between retrying queued uploads in seconds. " +
+			"Uploads that failed are queued and retried until they succeed, even across restarts", Default: 60.0})
+	uploadTimeout := parser.Float("", "upload-timeout",
+		&argparse.Options{Required: false, Help: "Give up a single upload attempt after this many seconds, it is retried like any failed upload", Default: 300.0})
+	localMaxFiles := parser.Int("", "local-max-files",
+		&argparse.Options{Required: false, Help: "Max number of archives to keep locally once they are uploaded. " +
+			"Archives that were not uploaded yet are never deleted by this rule. Set to negative number to disable", Default: -1})
+	s3Endpoint := parser.String("", "s3-endpoint",
+		&argparse.Options{Required: false, Help: "Custom S3 endpoint for S3 compatible storage (MinIO, Ceph, ...), " +
+			"for example https://minio.local:9000"})
+	s3Region := parser.String("", "s3-region",
+		&argparse.Options{Required: false, Help: "S3 region, defaults to AWS_REGION or us-east-1"})
+	s3PathStyle := parser.Flag("", "s3-path-style",
+		&argparse.Options{Required: false, Help: "Put the bucket into the path instead of the host name", Default: false})
+	s3AccessKey := parser.String("", "s3-access-key",
+		&argparse.Options{Required: false, Help: "Static S3 access key, defaults to AWS_ACCESS_KEY_ID"})
+	s3SecretKey := parser.String("", "s3-secret-key",
+		&argparse.Options{Required: false, Help: "Static S3 secret key, defaults to AWS_SECRET_ACCESS_KEY"})
+	azureConnectionString := parser.String("", "azure-connection-string",
+		&argparse.Options{Required: false, Help: "Azure storage connection string, defaults to AZURE_STORAGE_CONNECTION_STRING"})
+	azureAccount := parser.String("", "azure-account",
+		&argparse.Options{Required: false, Help: "Azure storage account to upload to using the managed identity, " +
+			"defaults to AZURE_STORAGE_ACCOUNT"})
+	sftpKey := parser.String("", "sftp-key",
+		&argparse.Options{Required: false, Help: "Private key for SFTP upload, defaults to ~/.ssh/id_ed25519, id_ecdsa or id_rsa"})
+	sftpKnownHosts := parser.String("", "sftp-known-hosts",
+		&argparse.Options{Required: false, Help: "Known hosts file to verify the SFTP server, defaults to ~/.ssh/known_hosts"})
+	syncDestination := parser.String("", "sync-to",
+		&argparse.Options{Required: false, Help: "Mirror all archives to this directory or remote after every rotation, " +
+			"only missing archives are copied. Remotes are given like for --upload and use the same credentials"})
+	onErrorScript := parser.String("", "on-error-script",
+		&argparse.Options{Required: false, Help: "Script to run when a rotation, prune or upload fails, " +
+			"details are passed in ROTEE_STAGE, ROTEE_ERROR, ROTEE_OUTPUT_FILE, ROTEE_ARCHIVE, ROTEE_ROTATION_ID and ROTEE_TIME"})
+	onErrorWebhook := parser.String("", "on-error-webhook",
+		&argparse.Options{Required: false, Help: "URL to POST a JSON description to when a rotation, prune or upload fails"})
+	alertEmail := parser.StringList("", "alert-email",
+		&argparse.Options{Required: false, Help: "Send an email to this address when rotations keep failing or the disk is full, " +
+			"can be given multiple times"})
+	alertAfter := parser.Int("", "alert-after",
+		&argparse.Options{Required: false, Help: "Number of rotations that have to fail in a row before an alert email is sent", Default: 3})
+	smtpServer := parser.String("", "smtp-server",
+		&argparse.Options{Required: false, Help: "SMTP server to send alert emails through", Default: "localhost:25"})
+	smtpFrom := parser.String("", "smtp-from",
+		&argparse.Options{Required: false, Help: "Sender address of alert emails, defaults to rotee@<hostname>"})
+	smtpUser := parser.String("", "smtp-user",
+		&argparse.Options{Required: false, Help: "SMTP user name, the password is read from ROTEE_SMTP_PASSWORD"})
+	notifySlackWebhook := parser.String("", "notify-slack",
+		&argparse.Options{Required: false, Help: "Slack or Mattermost incoming webhook URL to send notifications to"})
+	notifyEvents := parser.String("", "notify-events",
+		&argparse.Options{Required: false, Help: "Comma separated list of events to send to the chat webhook, " +
+			"any of rotation, failure and prune", Default: "rotation,failure"})
+	notifyTemplate := parser.String("", "notify-template",
+		&argparse.Options{Required: false, Help: "Go template for chat messages, see README for available fields"})
+	mqttTarget := parser.String("", "mqtt",
+		&argparse.Options{Required: false, Help: "Publish events as JSON to this MQTT broker and topic, like tcp://broker:1883/fleet/rotee. " +
+			"User and password can be given in the URL"})
+	mqttEvents := parser.String("", "mqtt-events",
+		&argparse.Options{Required: false, Help: "Comma separated list of events to publish to MQTT, " +
+			"any of rotation, failure and prune", Default: "rotation,failure"})
+	normalizeNewlines := parser.Flag("", "normalize-newlines",
+		&argparse.Options{Required: false, Help: "Turn CRLF and CR line endings into LF in the output file", Default: false})
+	utf8Policy := parser.String("", "utf8-policy",
+		&argparse.Options{Required: false, Help: "What to do with invalid UTF-8 in the output file, pass it on unchanged, " +
+			"replace it with U+FFFD or escape it like \\xff", Default: utf8PolicyPass})
+	inputEncoding := parser.String("", "input-encoding",
+		&argparse.Options{Required: false, Help: "Encoding of the input, like latin1, cp1252, utf16, utf16le, utf16be " +
+			"or any IANA name. It is converted to UTF-8 for the output file and stdout", Default: "utf8"})
+	decompressInput := parser.Flag("", "decompress-input",
+		&argparse.Options{Required: false, Help: "Unpack the input if it is gzip compressed, like from curl. " +
+			"Input that is not compressed is read as it is", Default: false})
+	outputFormat := parser.String("", "format",
+		&argparse.Options{Required: false, Help: "Write lines as they are (raw) or with an RFC 5424 syslog header (rfc5424)", Default: formatRaw})
+	syslogFacility := parser.String("", "syslog-facility",
+		&argparse.Options{Required: false, Help: "Facility for --format rfc5424, like user, daemon or local0", Default: "user"})
+	syslogSeverity := parser.String("", "syslog-severity",
+		&argparse.Options{Required: false, Help: "Severity for --format rfc5424, like notice, info or err", Default: "notice"})
+	syslogAppName := parser.String("", "syslog-app-name",
+		&argparse.Options{Required: false, Help: "App name for --format rfc5424", Default: "rotee"})
+	convertStdout := parser.Flag("", "convert-stdout",
+		&argparse.Options{Required: false, Help: "Also apply --normalize-newlines, --utf8-policy and --format to what goes to stdout, " +
+			"by default stdout gets the input unchanged", Default: false})
+	maxLineSize := parser.String("", "max-line-size",
+		&argparse.Options{Required: false, Help: "Longest line to keep in memory as a whole, like 16mb. " +
+			"Longer lines are written in pieces and can be split by a rotation. Set to 0 for no limit", Default: "16mb"})
+	framingFlag := parser.String("", "framing",
+		&argparse.Options{Required: false, Help: "How the input is split up, lines or binary records with their length in front, " +
+			"as 4 byte big endian (length32) or as a protobuf varint (varint). Rotations only happen between records", Default: framingLines})
+	maxRecordSize := parser.String("", "max-record-size",
+		&argparse.Options{Required: false, Help: "Largest record to accept with --framing length32 or varint, like 64mb. " +
+			"A larger length means the input is not framed as expected and reading stops", Default: "64mb"})
+	noStdout := parser.Flag("", "no-stdout",
+		&argparse.Options{Required: false, Help: "Only write to the output file and not to stdout. " +
+			"On linux the input is then moved to the output file without copying it through rotee", Default: false})
+	echoBuffer := parser.Int("", "echo-buffer",
+		&argparse.Options{Required: false, Help: "Number of lines to buffer for stdout, " +
+			"so a slow reader of stdout does not hold up writing the output file", Default: 1000})
+	echoDrop := parser.String("", "echo-drop",
+		&argparse.Options{Required: false, Help: "Which lines to drop from stdout when the echo buffer is full, " +
+			"newest, oldest or never to wait for stdout", Default: echoDropNever})
+	errorMode := parser.String("", "error-mode",
+		&argparse.Options{Required: false, Help: "fail-fast to exit when a timed or conditional rotation fails, " +
+			"best-effort to report it and keep writing", Default: errorModeFailFast})
+	onEchoError := parser.String("", "on-echo-error",
+		&argparse.Options{Required: false, Help: "What to do when writing to stdout fails, ignore to drop the lines and try again " +
+			"with the next ones, disable to stop writing to stdout or exit", Default: echoErrorDisable})
+	kafkaBrokers := parser.String("", "kafka-brokers",
+		&argparse.Options{Required: false, Help: "Comma separated Kafka brokers to also send every line to, like kafka1:9092,kafka2:9092"})
+	kafkaTopic := parser.String("", "kafka-topic",
+		&argparse.Options{Required: false, Help: "Kafka topic for the lines, required with --kafka-brokers"})
+	kafkaBuffer := parser.Int("", "kafka-buffer",
+		&argparse.Options{Required: false, Help: "Number of lines to buffer for Kafka", Default: 1000})
+	kafkaDrop := parser.String("", "kafka-drop",
+		&argparse.Options{Required: false, Help: "Which lines to drop from Kafka when its buffer is full, " +
+			"newest, oldest or never to wait for Kafka", Default: echoDropNewest})
+	fluentForward := parser.String("", "fluent-forward",
+		&argparse.Options{Required: false, Help: "Send every line to fluentd or fluent-bit at this host:port with the forward protocol"})
+	fluentTag := parser.String("", "fluent-tag",
+		&argparse.Options{Required: false, Help: "Tag for the records sent with --fluent-forward", Default: "rotee"})
+	fluentBuffer := parser.Int("", "fluent-buffer",
+		&argparse.Options{Required: false, Help: "Number of lines to buffer for fluent", Default: 1000})
+	fluentDrop := parser.String("", "fluent-drop",
+		&argparse.Options{Required: false, Help: "Which lines to drop from fluent when its buffer is full, " +
+			"newest, oldest or never to wait for fluent", Default: echoDropNewest})
+	lokiURL := parser.String("", "loki-url",
+		&argparse.Options{Required: false, Help: "Push every line to Loki at this URL, like http://loki:3100"})
+	lokiLabels := parser.String("", "loki-labels",
+		&argparse.Options{Required: false, Help: "Comma separated labels of the Loki stream, like job=app,env=prod", Default: "job=rotee"})
+	lokiBuffer := parser.Int("", "loki-buffer",
+		&argparse.Options{Required: false, Help: "Number of lines to buffer for Loki", Default: 1000})
+	lokiDrop := parser.String("", "loki-drop",
+		&argparse.Options{Required: false, Help: "Which lines to drop from Loki when its buffer is full, " +
+			"newest, oldest or never to wait for Loki", Default: echoDropNewest})
+	elasticsearchURL := parser.String("", "elasticsearch-url",
+		&argparse.Options{Required: false, Help: "Index every line in Elasticsearch or OpenSearch at this URL, like http://elasticsearch:9200"})
+	elasticsearchIndex := parser.String("", "elasticsearch-index",
+		&argparse.Options{Required: false, Help: "Index to write the lines to, %Y, %m, %d and %H are replaced with the date in UTC",
+			Default: "rotee-%Y.%m.%d"})
+	elasticsearchBuffer := parser.Int("", "elasticsearch-buffer",
+		&argparse.Options{Required: false, Help: "Number of lines to buffer for Elasticsearch", Default: 1000})
+	elasticsearchDrop := parser.String("", "elasticsearch-drop",
+		&argparse.Options{Required: false, Help: "Which lines to drop from Elasticsearch when its buffer is full, " +
+			"newest, oldest or never to wait for Elasticsearch", Default: echoDropNewest})
+	otlpEndpoint := parser.String("", "otlp-endpoint",
+		&argparse.Options{Required: false, Help: "Export every line as an OpenTelemetry log record to the collector at this URL, " +
+			"like http://collector:4317"})
+	otlpProtocol := parser.String("", "otlp-protocol",
+		&argparse.Options{Required: false, Help: "Protocol to talk to the collector, grpc or http/protobuf", Default: otlpProtocolGRPC})
+	otlpResource := parser.String("", "otlp-resource",
+		&argparse.Options{Required: false, Help: "Comma separated resource attributes of the log records, like service.name=app. " +
+			"host.name is added unless given", Default: "service.name=rotee"})
+	otlpBuffer := parser.Int("", "otlp-buffer",
+		&argparse.Options{Required: false, Help: "Number of lines to buffer for the collector", Default: 1000})
+	otlpDrop := parser.String("", "otlp-drop",
+		&argparse.Options{Required: false, Help: "Which lines to drop from the collector when its buffer is full, " +
+			"newest, oldest or never to wait for the collector", Default: echoDropNewest})
+	gelfTarget := parser.String("", "gelf",
+		&argparse.Options{Required: false, Help: "Send every line to Graylog as a GELF message, like udp://graylog:12201 or tcp://graylog:12201"})
+	gelfChunkSize := parser.Int("", "gelf-chunk-size",
+		&argparse.Options{Required: false, Help: "Largest UDP datagram to send to Graylog, longer messages are chunked. " +
+			"Use 8192 on a local network", Default: 1420})
+	gelfBuffer := parser.Int("", "gelf-buffer",
+		&argparse.Options{Required: false, Help: "Number of lines to buffer for Graylog", Default: 1000})
+	gelfDrop := parser.String("", "gelf-drop",
+		&argparse.Options{Required: false, Help: "Which lines to drop from Graylog when its buffer is full, " +
+			"newest, oldest or never to wait for Graylog", Default: echoDropNewest})
+	followSymlink := parser.Flag("", "follow-symlink",
+		&argparse.Options{Required: false, Help: "Output file is a symlink that might be swapped (e.g. kubelet container logs)." +
+			"The link is re-resolved every scan-frequency seconds and the new target is reopened", Default: false})
+	externalRotation := parser.Flag("", "external-rotation",
+		&argparse.Options{Required: false, Help: "Never rotate, leave it to the system logrotate. The output file is reopened " +
+			"on SIGHUP and when it was moved away, checked every scan-frequency seconds", Default: false})
+
+	if err := parser.Parse(args); err != nil {
 		fmt.Print(parser.Usage(err))
-		return
+		return nil, false
 	}
 
-	if *activityFilePath != "" {
-		if f, err := os.OpenFile(*activityFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
-			log.Fatalf("Cant open activity log file at %s", *activityFilePath)
-		} else {
-			defer f.Close()
-			log.SetOutput(f)
-			verbose = true
+	if !multi {
+		setupProcess(*activityFilePath, *auditFilePath, *umask, *renameRetriesFlag, *compressMaxJobs, *networkFileSystem)
+	} else if *activityFilePath != "" || *auditFilePath != "" || *umask != "" || *renameRetriesFlag != defaultRenameRetries ||
+		*compressMaxJobs != 0 || *networkFileSystem {
+		exitf(exitConfigError, "-v, --audit-file, --umask, --rename-retries, --compress-max-jobs and --network-fs apply to all pipelines, set them for rotee multi")
+	}
+	if multi && *exitAfterIdle != "" {
+		exitf(exitConfigError, "--exit-after-idle would stop all pipelines, it can not be used with rotee multi")
+	}
+
+	state := newPipelineState()
+
+	location, err := parseTimezone(*timezone)
+	if err != nil {
+		exitf(exitConfigError, "%s", err)
+	}
+
+	// Output files like app-%Y-%m-%d.log start with the file for right now
+	startOutputFile := *outputFile
+	if isOutputTemplate(*outputFile) {
+		if err := parseOutputTemplate(*outputFile); err != nil {
+			exitf(exitConfigError, "%s", err)
+		}
+		if *followSymlink {
+			exitf(exitConfigError, "--follow-symlink does not work with a date pattern in the output file")
 		}
+		if *externalRotation {
+			exitf(exitConfigError, "--external-rotation does not work with a date pattern in the output file")
+		}
+		startOutputFile = renderOutputTemplate(*outputFile, time.Now().In(location))
+		state.templatedOutputFile.Store(startOutputFile)
 	}
 
 	// Before we do anything make sure we can touch the output file
-	if err := touchFile(*outputFile); err != nil {
-		log.Fatalf("Can not write file %s", *outputFile)
+	if err := touchFile(startOutputFile); err != nil {
+		exitf(exitOutputError, "Can not write file %s", startOutputFile)
 	}
 
-	// Set up a wait group to prevent shutting down before all writes
-	// and rotates are complete.
-	var wg sync.WaitGroup
-	wg.Add(2)
-	defer wg.Wait()
+	// Data that is already in the file was written before we started, we can not tell when
+	if stat, err := os.Stat(startOutputFile); err == nil && stat.Size() > 0 && !*truncateOnStart {
+		state.firstWriteTime.Store(-1)
+	}
 
-	// Set up channel between reader and writer and initialize
-	// logfile reload flag.
-	inputData := make(chan string, 50)
-	reloadOutputFile.Store(false)
+	if *currentSymlink != "" {
+		if err := updateCurrentSymlink(*currentSymlink, startOutputFile); err != nil {
+			exitf(exitConfigError, "Can not link %s to the output file: %s", *currentSymlink, err)
+		}
+	}
+
+	if *compressBufferBytes <= 0 {
+		exitf(exitConfigError, "Compress buffer size must be positive")
+	}
+	if *compressMaxCPUs < 0 {
+		exitf(exitConfigError, "Compression CPU limit can not be negative")
+	}
+	if *compressNice < 0 || *compressNice > 19 {
+		exitf(exitConfigError, "Compression nice value must be between 1 and 19, or 0 to leave it as it is")
+	}
+	compressIOPriority, err := parseIOPriority(*compressIONice)
+	if err != nil {
+		exitf(exitConfigError, "%s", err)
+	}
+	if *zstdLong != 0 && (*zstdLong < 10 || *zstdLong > 29) {
+		exitf(exitConfigError, "zstd window size must be between 10 and 29")
+	}
+
+	if *archiveDir != "" {
+		if err := os.MkdirAll(*archiveDir, 0755); err != nil {
+			exitf(exitOutputError, "Can not create archive directory %s", *archiveDir)
+		}
+	}
 
 	config := rotateConfig{
 		maxFiles:             *maxFiles,
 		maxAgeDays:           *maxAgeDays,
 		scanFrequencySeconds: *scanFrequencySeconds,
-		useCompression:       *useCompression,
 		preScript:            preScript,
 		postScript:           postScript,
+		followSymlink:        *followSymlink,
+		externalRotation:     *externalRotation,
+		outputTemplate:       isOutputTemplate(*outputFile),
+		currentSymlink:       *currentSymlink,
+		location:             location,
+		noCreate:             *noCreate,
+		skipEmpty:            *skipEmpty,
+		archiveReadonly:      *archiveReadonly,
+		pruneOrphans:         *pruneOrphans,
+		uploadRetries:        *uploadRetries,
+		uploadDeleteAfter:    *uploadDeleteAfter,
+		localMaxFiles:        *localMaxFiles,
+		maxRotationsPerHour:  *maxRotationsPerHour,
+		archiveDir:           *archiveDir,
+		compressBufferBytes:  *compressBufferBytes,
+		compressNice:         *compressNice,
+		compressIOPriority:   compressIOPriority,
+		bundleAfterDays:      *bundleAfterDays,
+		hold:                 newRotationHold(*holdFile),
+		state:                state,
+		compressionOptions: compressionOptions{
+			level:               *compressionLevel,
+			zstdWindowLog:       *zstdLong,
+			maxCPUs:             *compressMaxCPUs,
+			zstdDictionary:      *zstdDictionary,
+			zstdTrainDictionary: *zstdTrainDictionary,
+		},
+		syncDestination: *syncDestination,
+		onErrorScript:   *onErrorScript,
+		onErrorWebhook:  *onErrorWebhook,
+		email: emailOptions{
+			to:         *alertEmail,
+			from:       *smtpFrom,
+			server:     *smtpServer,
+			user:       *smtpUser,
+			password:   os.Getenv("ROTEE_SMTP_PASSWORD"),
+			alertAfter: *alertAfter,
+		},
+	}
+
+	if credentials, err := lookupScriptCredentials(*scriptUser, *scriptGroup); err == nil {
+		config.scriptCredentials = credentials
+	} else {
+		exitf(exitConfigError, "Can not run scripts as %s:%s: %s", *scriptUser, *scriptGroup, err)
+	}
+
+	if naming, err := parseArchiveNaming(*archiveNaming); err == nil {
+		config.archiveNaming = naming
+	} else {
+		exitf(exitConfigError, "%s", err)
+	}
+
+	if mode, err := parseLatestLinkMode(*latestLink); err == nil {
+		config.latestLink = mode
+	} else {
+		exitf(exitConfigError, "%s", err)
+	}
+
+	orphanPolicy, err := parseOrphanPolicy(*orphanPolicyFlag)
+	if err != nil {
+		exitf(exitConfigError, "%s", err)
+	}
+
+	triggerPolicy, err := parseTriggerPolicy(*triggerPolicyFlag)
+	if err != nil {
+		exitf(exitConfigError, "%s", err)
+	}
+
+	// Nothing may rotate behind the back of logrotate
+	if *externalRotation && (len(*triggerFiles) > 0 || *autoRotateFrequency > 0 || *maxLogFileSize != "" ||
+		*rotateWhen != "" || *rotateIfIdle != "" || *rotateOnExit) {
+		exitf(exitConfigError, "--external-rotation leaves rotating to logrotate, "+
+			"it can not be combined with -t, -a, -m, --rotate-when, --rotate-if-idle or --rotate-on-exit")
+	}
+
+	// Two watchers of one file would both answer the same request
+	for i, triggerFile := range *triggerFiles {
+		if slices.Contains((*triggerFiles)[:i], triggerFile) {
+			exitf(exitConfigError, "Trigger file %s is given more than once", triggerFile)
+		}
+	}
+
+	// The size trigger and --rotate-when are checked by the same goroutine, -a joins
+	// them with --trigger-policy all. Otherwise it is a timer of its own.
+	conditions := make([]string, 0)
+	if *maxLogFileSize != "" {
+		maxLogFileSizeBytes, err := parse_memory_size_string(*maxLogFileSize)
+		if err != nil {
+			exitf(exitConfigError, "Could not parse max log file size: %s", err)
+		}
+		if triggerPolicy == triggerPolicyAll && *autoRotateFrequency > 0 {
+			conditions = append(conditions, fmt.Sprintf("size >= %d && age >= %g", maxLogFileSizeBytes, *autoRotateFrequency))
+		} else {
+			conditions = append(conditions, fmt.Sprintf("size >= %d", maxLogFileSizeBytes))
+		}
+	}
+	if *rotateWhen != "" {
+		conditions = append(conditions, *rotateWhen)
+	}
+	if *rotateIfIdle != "" {
+		idleTime, err := parseDurationString(*rotateIfIdle)
+		if err != nil {
+			exitf(exitConfigError, "Could not parse idle time: %s", *rotateIfIdle)
+		}
+		conditions = append(conditions, fmt.Sprintf("idle >= %g && size > 0", idleTime.Seconds()))
+	}
+	var condition *rotationCondition
+	if len(conditions) > 0 {
+		text := conditions[0]
+		if len(conditions) > 1 {
+			text = "(" + strings.Join(conditions, ") || (") + ")"
+		}
+		if condition, err = parseRotationCondition(text); err != nil {
+			exitf(exitConfigError, "%s", err)
+		}
+		config.countLines = condition.usesLines
+	}
+
+	if maxLineBytes, err := parse_memory_size_string(*maxLineSize); err == nil && maxLineBytes >= 0 {
+		config.read.maxLineBytes = int(maxLineBytes)
+	} else {
+		exitf(exitConfigError, "Could not parse max line size: %s", *maxLineSize)
+	}
+
+	if config.read.encoding, err = parseInputEncoding(*inputEncoding); err != nil {
+		exitf(exitConfigError, "%s", err)
+	}
+	config.read.decompress = *decompressInput
+
+	// Everything that changes the data on its way to the output file
+	if *normalizeNewlines {
+		config.read.crIsLineEnd = true
+		config.filters = append(config.filters, &newlineNormalizer{})
+	}
+	if policy, err := parseUtf8Policy(*utf8Policy); err != nil {
+		exitf(exitConfigError, "%s", err)
+	} else if policy != utf8PolicyPass {
+		config.filters = append(config.filters, &utf8Sanitizer{escape: policy == utf8PolicyEscape})
+	}
+	if format, err := parseOutputFormat(*outputFormat); err != nil {
+		exitf(exitConfigError, "%s", err)
+	} else if format == formatRFC5424 {
+		formatter, err := newSyslogFormatter(*syslogFacility, *syslogSeverity, *syslogAppName)
+		if err != nil {
+			exitf(exitConfigError, "%s", err)
+		}
+		config.filters = append(config.filters, formatter)
+	}
+	config.filterStdout = *convertStdout
+	if config.buffering, err = parseBufferingMode(*buffering); err != nil {
+		exitf(exitConfigError, "%s", err)
+	}
+	if config.buffering == bufferingDirect && !directIOSupported {
+		exitf(exitConfigError, "--buffering direct only works on linux")
+	}
+	if *flushInterval <= 0 {
+		exitf(exitConfigError, "Flush interval must be positive")
+	}
+	config.flushInterval = time.Millisecond * time.Duration(*flushInterval*1000)
+	config.syncOpen = *syncOpen
+	if *preallocateSize != "" {
+		if preallocateBytes, err := parse_memory_size_string(*preallocateSize); err == nil && preallocateBytes > 0 {
+			config.preallocateBytes = preallocateBytes
+		} else {
+			exitf(exitConfigError, "Invalid preallocation size %s", *preallocateSize)
+		}
+	}
+	if blockBytes, err := parse_memory_size_string(*blockSize); err == nil && blockBytes > 0 {
+		config.blockBytes = int(blockBytes)
+	} else {
+		exitf(exitConfigError, "Could not parse block size: %s", *blockSize)
+	}
+	if *fsyncAfterIdle > 0 {
+		config.syncAfterIdle = time.Millisecond * time.Duration(*fsyncAfterIdle*1000)
+	}
+	if *rotationWarnThreshold != "" {
+		if config.rotationWarnThreshold, err = parseDurationString(*rotationWarnThreshold); err != nil || config.rotationWarnThreshold <= 0 {
+			exitf(exitConfigError, "Could not parse rotation warn threshold: %s", *rotationWarnThreshold)
+		}
+	}
+	if *positionFile != "" {
+		if stat, err := os.Stat(inputPath); inputPath == "" || inputPath == "-" || err != nil || !stat.Mode().IsRegular() {
+			exitf(exitConfigError, "--position-file needs an input that is a regular file")
+		}
+		if config.read.decompress || config.read.encoding != nil {
+			exitf(exitConfigError, "--position-file does not work with --decompress-input or --input-encoding")
+		}
+		if config.holdsWrites() {
+			exitf(exitConfigError, "--position-file does not work with --buffering block or direct")
+		}
+		config.read.checkpoint = newInputCheckpoint(*positionFile)
+	}
+	if *grpcListen != "" {
+		config.read.drain = state.drain
+	}
+	config.spoolFile = *spoolFile
+	if config.spoolMaxBytes, err = parse_memory_size_string(*spoolMaxSize); err != nil || config.spoolMaxBytes < 0 {
+		exitf(exitConfigError, "Could not parse spool max size: %s", *spoolMaxSize)
+	}
+	if *stallTimeout != "" {
+		if config.stallTimeout, err = parseDurationString(*stallTimeout); err != nil || config.stallTimeout <= 0 {
+			exitf(exitConfigError, "Could not parse stall timeout: %s", *stallTimeout)
+		}
+	}
+	if *stallFallback != "" {
+		if config.stallTimeout == 0 {
+			exitf(exitConfigError, "--stall-fallback needs a --stall-timeout")
+		}
+		if config.holdsWrites() {
+			exitf(exitConfigError, "--stall-fallback does not work with --buffering block or direct")
+		}
+		config.stallFallback = *stallFallback
+	}
+	if mode, err := parseAckMode(*ackMode); err != nil {
+		exitf(exitConfigError, "%s", err)
+	} else if mode == ackModeDurable {
+		if config.spoolFile != "" || config.holdsWrites() || config.stallFallback != "" {
+			exitf(exitConfigError, "--ack-mode durable does not work with --spool-file, --buffering block or direct or --stall-fallback")
+		}
+		config.read.acks = make(chan struct{}, 1)
+	}
+	if *exitAfterIdle != "" {
+		if config.exitAfterIdle, err = parseDurationString(*exitAfterIdle); err != nil || config.exitAfterIdle <= 0 {
+			exitf(exitConfigError, "Could not parse idle time: %s", *exitAfterIdle)
+		}
+	}
+	config.rotateOnExit = *rotateOnExit
+	if config.errorMode, err = parseErrorMode(*errorMode); err != nil {
+		exitf(exitConfigError, "%s", err)
+	}
+	if config.triggerResponse, err = parseTriggerResponse(*triggerResponseFlag); err != nil {
+		exitf(exitConfigError, "%s", err)
+	}
+	if config.triggerMode, err = parseTriggerMode(*triggerModeFlag); err != nil {
+		exitf(exitConfigError, "%s", err)
+	}
+	if config.triggerMode == triggerModeTouch && config.triggerResponse == triggerResponseJSON {
+		exitf(exitConfigError, "--trigger-mode touch deletes the trigger file, use --trigger-response status-file for the details")
+	}
+	if config.summaryMode, err = parseSummaryMode(*summaryModeFlag); err != nil {
+		exitf(exitConfigError, "%s", err)
+	}
+	if *heartbeat != "" {
+		if config.heartbeatInterval, err = parseDurationString(*heartbeat); err != nil || config.heartbeatInterval <= 0 {
+			exitf(exitConfigError, "Could not parse heartbeat interval: %s", *heartbeat)
+		}
+		config.heartbeatText = *heartbeatText
+	}
+
+	// Lines only go to stdout when rotee is used like tee
+	if echo && !*noStdout {
+		policy, err := parseEchoDropPolicy(*echoDrop)
+		if err != nil {
+			exitf(exitConfigError, "%s", err)
+		}
+		if *echoBuffer < 1 {
+			exitf(exitConfigError, "Echo buffer must hold at least one line")
+		}
+		onError, err := parseEchoErrorPolicy(*onEchoError)
+		if err != nil {
+			exitf(exitConfigError, "%s", err)
+		}
+
+		// Without this a closed pipe on stdout kills rotee with SIGPIPE before anyone sees the error
+		signal.Notify(make(chan os.Signal, 1), syscall.SIGPIPE)
+		config.echo = newEchoWriter("Stdout", os.Stdout, *echoBuffer, policy, onError)
+	}
+
+	// Sinks get what goes to the output file, the local copy stays the one to trust
+	addSink := func(name string, output lineOutput, bufferSize int, drop string) {
+		policy, err := parseEchoDropPolicy(drop)
+		if err != nil {
+			exitf(exitConfigError, "%s", err)
+		}
+		if bufferSize < 1 {
+			exitf(exitConfigError, "%s buffer must hold at least one line", name)
+		}
+		config.sinks = append(config.sinks, newLineSink(name, output, bufferSize, policy))
+	}
+	if *kafkaBrokers != "" {
+		if *kafkaTopic == "" {
+			exitf(exitConfigError, "--kafka-brokers needs a --kafka-topic")
+		}
+		producer, err := newKafkaProducer(*kafkaBrokers, *kafkaTopic)
+		if err != nil {
+			exitf(exitConfigError, "Can not send lines to Kafka: %s", err)
+		}
+		addSink("Kafka", producer, *kafkaBuffer, *kafkaDrop)
+	}
+	if *fluentForward != "" {
+		addSink("Fluent", newFluentForwarder(*fluentForward, *fluentTag), *fluentBuffer, *fluentDrop)
+	}
+	if *lokiURL != "" {
+		pusher, err := newLokiPusher(*lokiURL, *lokiLabels)
+		if err != nil {
+			exitf(exitConfigError, "Can not push lines to Loki: %s", err)
+		}
+		addSink("Loki", pusher, *lokiBuffer, *lokiDrop)
+	}
+	if *elasticsearchURL != "" {
+		indexer, err := newElasticsearchIndexer(*elasticsearchURL, *elasticsearchIndex)
+		if err != nil {
+			exitf(exitConfigError, "Can not index lines in Elasticsearch: %s", err)
+		}
+		addSink("Elasticsearch", indexer, *elasticsearchBuffer, *elasticsearchDrop)
+	}
+	if *otlpEndpoint != "" {
+		protocol, err := parseOTLPProtocol(*otlpProtocol)
+		if err != nil {
+			exitf(exitConfigError, "%s", err)
+		}
+		exporter, err := newOTLPExporter(*otlpEndpoint, protocol, *otlpResource, *outputFile)
+		if err != nil {
+			exitf(exitConfigError, "Can not export lines to OpenTelemetry: %s", err)
+		}
+		addSink("OpenTelemetry collector", exporter, *otlpBuffer, *otlpDrop)
+	}
+	if *gelfTarget != "" {
+		sender, err := newGELFSender(*gelfTarget, *gelfChunkSize, *outputFile)
+		if err != nil {
+			exitf(exitConfigError, "Can not send lines to Graylog: %s", err)
+		}
+		addSink("Graylog", sender, *gelfBuffer, *gelfDrop)
 	}
 
+	if *useCompression && *compressionName == "" {
+		*compressionName = "gzip"
+	}
+	if *compressionName != "" {
+		format, err := findCompressionFormat(*compressionName)
+		if err != nil {
+			exitf(exitConfigError, "%s", err)
+		}
+		config.compression = format
+
+		// A level the format does not take would otherwise only show up after the output file was moved
+		options := config.compressionOptions
+		options.zstdDictionary, options.zstdTrainDictionary = "", false
+		writer, err := format.newWriter(io.Discard, "", options)
+		if err != nil {
+			exitf(exitConfigError, "Can not compress with %s: %s", format.name, err)
+		}
+		writer.Close()
+	}
+
+	if *notifySlackWebhook != "" {
+		chatTemplate, err := parseSlackTemplate(*notifyTemplate)
+		if err != nil {
+			exitf(exitConfigError, "Could not parse notification template: %s", err)
+		}
+		config.slack = slackOptions{webhook: *notifySlackWebhook, events: make(map[string]bool), template: chatTemplate}
+		for _, event := range strings.Split(*notifyEvents, ",") {
+			switch event = strings.TrimSpace(event); event {
+			case "rotation", "failure", "prune":
+				config.slack.events[event] = true
+			default:
+				exitf(exitConfigError, "Unknown notification event %s", event)
+			}
+		}
+	}
+
+	if *mqttTarget != "" {
+		client, topic, err := newMQTTClient(*mqttTarget)
+		if err != nil {
+			exitf(exitConfigError, "Can not publish to MQTT %s: %s", *mqttTarget, err)
+		}
+		config.mqtt = mqttOptions{client: client, topic: topic, events: make(map[string]bool)}
+		for _, event := range strings.Split(*mqttEvents, ",") {
+			switch event = strings.TrimSpace(event); event {
+			case "rotation", "failure", "prune":
+				config.mqtt.events[event] = true
+			default:
+				exitf(exitConfigError, "Unknown notification event %s", event)
+			}
+		}
+	}
+
+	if config.email.from == "" {
+		hostname, _ := os.Hostname()
+		config.email.from = "rotee@" + hostname
+	}
+
+	// Set up archive upload, fail early if the target makes no sense
+	if *uploadTimeout <= 0 {
+		exitf(exitConfigError, "Upload timeout must be positive")
+	}
+	uploadOptions := uploadConfig{
+		target:  *uploadTarget,
+		timeout: time.Millisecond * time.Duration(*uploadTimeout*1000),
+		s3: s3Options{
+			endpoint:  *s3Endpoint,
+			region:    *s3Region,
+			pathStyle: *s3PathStyle,
+			accessKey: *s3AccessKey,
+			secretKey: *s3SecretKey,
+		},
+		azure: azureOptions{
+			connectionString: *azureConnectionString,
+			account:          *azureAccount,
+		},
+		sftp: sftpOptions{
+			keyFile:        *sftpKey,
+			knownHostsFile: *sftpKnownHosts,
+		},
+	}
+	if *uploadTarget != "" {
+		uploader, err := newArchiveUploader(uploadOptions)
+		if err != nil {
+			exitf(exitConfigError, "Can not set up upload to %s: %s", *uploadTarget, err)
+		}
+		config.uploader = uploader
+	}
+	if *syncDestination != "" {
+		uploader, err := newSyncUploader(*syncDestination, uploadOptions)
+		if err != nil {
+			exitf(exitConfigError, "Can not set up sync to %s: %s", *syncDestination, err)
+		}
+		config.syncUploader = uploader
+	}
+
+	// Routed outputs copy the finished config, they rotate by the same rules
+	routeDefinitions := make([]routeDefinition, 0)
+	for _, text := range *routes {
+		definition, err := parseRoute(text)
+		if err != nil {
+			exitf(exitConfigError, "%s", err)
+		}
+		routeDefinitions = append(routeDefinitions, definition)
+	}
+	if *routesFile != "" {
+		definitions, err := loadRouteFile(*routesFile)
+		if err != nil {
+			exitf(exitConfigError, "Can not load routes: %s", err)
+		}
+		routeDefinitions = append(routeDefinitions, definitions...)
+	}
+	outputRoutes := make([]*outputRoute, 0)
+	for _, definition := range routeDefinitions {
+		if definition.Output == *outputFile {
+			exitf(exitConfigError, "Route %s writes to the main output file", definition.Pattern)
+		}
+		if config.read.acks != nil {
+			exitf(exitConfigError, "--ack-mode durable does not work with --route")
+		}
+		route, err := newOutputRoute(definition, config)
+		if err != nil {
+			exitf(exitConfigError, "Invalid route: %s", err)
+		}
+		outputRoutes = append(outputRoutes, route)
+	}
+	config.routes = outputRoutes
+
+	// Records are binary, everything that looks for lines in them would break them
+	if framing, err := parseFraming(*framingFlag); err != nil {
+		exitf(exitConfigError, "%s", err)
+	} else if framing != framingLines {
+		if len(config.filters) > 0 || config.read.encoding != nil || len(config.routes) > 0 || len(config.sinks) > 0 ||
+			config.countLines || config.heartbeatInterval > 0 || config.summaryMode == summaryModeFooter {
+			exitf(exitConfigError, "--framing %s does not work with --normalize-newlines, --utf8-policy, --format, --input-encoding, "+
+				"--route, sinks, lines in --rotate-when, --heartbeat or --summary footer", framing)
+		}
+		maxRecordBytes, err := parse_memory_size_string(*maxRecordSize)
+		if err != nil || maxRecordBytes <= 0 {
+			exitf(exitConfigError, "Could not parse max record size: %s", *maxRecordSize)
+		}
+		config.read.recordFraming, config.read.maxRecordBytes = framing, int(maxRecordBytes)
+	}
+
+	// Nothing else runs yet, so this is the time to clean up after a crash
+	if resolvedOutputFile, err := resolveOutputFile(*outputFile, config); err == nil {
+		recoverInterruptedRotations(resolvedOutputFile, config, 0)
+	}
+	if config.outputTemplate {
+		go finishTemplatedFiles(*outputFile, config)
+	}
+
+	// The trigger file and the control interfaces only rotate the main output file
+	for _, route := range config.routes {
+		if resolvedOutputFile, err := resolveOutputFile(route.outputFile, route.config); err == nil {
+			recoverInterruptedRotations(resolvedOutputFile, route.config, 0)
+		}
+		if route.config.outputTemplate {
+			go finishTemplatedFiles(route.outputFile, route.config)
+		}
+		go rotationWorker(route.outputFile, route.config)
+		if config.uploader != nil || config.syncDestination != "" {
+			go shipArchivesPeriodically(wg, route.outputFile, *uploadRetryInterval, route.config)
+		}
+		if condition != nil {
+			go automaticConditionRotation(wg, condition, route.outputFile, route.config)
+		}
+		if autoRotateFrequency != nil && *autoRotateFrequency > 0 && !(triggerPolicy == triggerPolicyAll && *maxLogFileSize != "") {
+			wg.Add(1)
+			go automaticTimedRotation(wg, *autoRotateFrequency, route.outputFile, route.config)
+		}
+	}
+
+	// All triggers below hand their rotations to this one
+	go rotationWorker(*outputFile, config)
+
 	// Start the desired rotate trigger processes
-	if autoRotateFrequency != nil && *autoRotateFrequency > 0 {
+	if condition != nil {
+		go automaticConditionRotation(wg, condition, *outputFile, config)
+	}
+	if autoRotateFrequency != nil && *autoRotateFrequency > 0 && !(triggerPolicy == triggerPolicyAll && *maxLogFileSize != "") {
 
 		// This function does not instantly do a rotate check
 		// Instead it starts on sleep so we need to inform the wait group.
 		wg.Add(1)
-		go automaticTimedRotation(&wg, *autoRotateFrequency, *outputFile, config)
+		go automaticTimedRotation(wg, *autoRotateFrequency, *outputFile, config)
 	}
 
-	if maxLogFileSize != nil && *maxLogFileSize != "" {
-		if maxLogFileSizeBytes, err := parse_memory_size_string(*maxLogFileSize); err == nil {
-			go automaticFileSizeRotation(&wg, maxLogFileSizeBytes, *outputFile, config)
-		} else {
-			log.Fatalf("Could not parse max log file size: %s", err)
-		}
+	for _, triggerFile := range *triggerFiles {
+		go watchForTrigger(wg, *outputFile, triggerFile, config)
 	}
 
-	if triggerFile != nil && *triggerFile != "" {
-		go watchForTrigger(&wg, *outputFile, *triggerFile, config)
+	if config.followSymlink {
+		go watchSymlink(*outputFile, config)
+	}
+	if config.externalRotation {
+		go watchExternalRotation(*outputFile, config)
+	}
+
+	if *orphanMaxAge > 0 {
+		go collectOrphans(wg, *outputFile, *orphanMaxAge, orphanPolicy, config)
+	}
+
+	if config.uploader != nil || config.syncDestination != "" {
+		go shipArchivesPeriodically(wg, *outputFile, *uploadRetryInterval, config)
+	}
+
+	if *httpListen != "" {
+		serveHTTP(*httpListen, *outputFile, config)
+	}
+	if *grpcListen != "" {
+		serveGRPC(wg, *grpcListen, *outputFile, config)
 	}
 
-	// Start reading and writing last.
-	go write(&wg, inputData, *outputFile, *truncateOnStart)
-	go read(&wg, inputData)
+	// Start writing and reading last, the caller decides when
+	return func() {
 
+		// Without echo and filters the data does not have to pass through our memory at all
+		if (inputPath == "" || inputPath == "-") && config.canPassthrough() &&
+			passthrough(wg, *outputFile, *truncateOnStart, config) {
+			return
+		}
+
+		// Set up channel between reader and writer
+		inputData := make(chan *lineChunk, lineChunkQueueSize)
+		writerData := inputData
+		if config.spoolFile != "" {
+			writerData = make(chan *lineChunk, lineChunkQueueSize)
+			go spoolChunks(inputData, writerData, config.spoolFile, config.spoolMaxBytes)
+		}
+		for _, route := range config.routes {
+			wg.Add(1)
+			go write(wg, route.data, route.outputFile, *truncateOnStart, route.config)
+		}
+		wg.Add(2)
+		go write(wg, writerData, *outputFile, *truncateOnStart, config)
+		if inputPath == "" || inputPath == "-" {
+			go read(wg, inputData, config.read)
+		} else {
+			go readInput(wg, inputPath, inputData, config.read)
+		}
+	}, true
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+)
+
+type archiveRecord struct {
+	Index      int       `json:"index"`
+	Date       string    `json:"date,omitempty"`
+	Extension  string    `json:"extension"`
+	Rotated    time.Time `json:"rotated"`
+	RotationID string    `json:"rotation_id,omitempty"`
+	UploadName string    `json:"upload_name,omitempty"`
+	Remote     string    `json:"remote,omitempty"`
+
+	// Time range covered by the archive, if known
+	FirstWrite *time.Time `json:"first_write,omitempty"`
+	LastWrite  *time.Time `json:"last_write,omitempty"`
+
+	// What the archive holds, only recorded with --summary
+	Lines int64 `json:"lines,omitempty"`
+	Bytes int64 `json:"bytes,omitempty"`
+
+	// Size of the log before and after compression, only for compressed archives
+	OriginalSize   int64 `json:"original_size,omitempty"`
+	CompressedSize int64 `json:"compressed_size,omitempty"`
+}
+
+func (record *archiveRecord) uploadPending() bool {
+	return record.UploadName != "" && record.Remote == ""
+}
+
+// The manifest remembers what rotee knows about each archive, like whether it
+// was uploaded. Archives are renamed on every rotation so records are keyed
+// by archive index and have to be moved along with the files.
+type archiveManifest struct {
+	outputFile string
+	records    []archiveRecord
+}
+
+func makeManifestPath(outputFile string) string {
+	return outputFile + ".manifest"
+}
+
+func loadManifest(outputFile string, archives []archiveFile) *archiveManifest {
+
+	manifest := &archiveManifest{outputFile: outputFile}
+
+	// A missing or broken manifest is not a problem, we just know less
+	stored := make([]archiveRecord, 0)
+	if content, err := os.ReadFile(makeManifestPath(outputFile)); err == nil {
+		if err := json.Unmarshal(content, &stored); err != nil {
+			logActivity("Ignoring broken manifest %s. Error: %s", makeManifestPath(outputFile), err)
+			stored = stored[:0]
+		}
+	}
+
+	// Only keep records for archives that still exist, the user might have deleted some.
+	// Archives we have never seen before get a record based on their mtime.
+	for _, archive := range archives {
+		found := false
+		for _, record := range stored {
+			if record.Index == archive.index && record.Date == archive.date && record.Extension == archive.extension {
+				manifest.records = append(manifest.records, record)
+				found = true
+				break
+			}
+		}
+		if !found {
+			record := archiveRecord{Index: archive.index, Date: archive.date, Extension: archive.extension}
+			if stat, err := os.Stat(archive.getPath()); err == nil {
+				record.Rotated = stat.ModTime()
+			}
+			manifest.records = append(manifest.records, record)
+		}
+	}
+
+	return manifest
+}
+
+func (manifest *archiveManifest) get(archive archiveFile) *archiveRecord {
+	for i := range manifest.records {
+		if manifest.records[i].Index == archive.index && manifest.records[i].Date == archive.date {
+			return &manifest.records[i]
+		}
+	}
+	return nil
+}
+
+func (manifest *archiveManifest) add(record archiveRecord) {
+	manifest.records = append(manifest.records, record)
+}
+
+// Only numbered archives ever move
+func (manifest *archiveManifest) move(from int, to int) {
+	if record := manifest.get(archiveFile{index: from}); record != nil {
+		record.Index = to
+	}
+}
+
+func (manifest *archiveManifest) forget(archive archiveFile) {
+	for i := range manifest.records {
+		if manifest.records[i].Index == archive.index && manifest.records[i].Date == archive.date {
+			manifest.records = append(manifest.records[:i], manifest.records[i+1:]...)
+			return
+		}
+	}
+}
+
+func (manifest *archiveManifest) save() error {
+
+	// Drop whatever was deleted in the meantime and keep newest first
+	records := make([]archiveRecord, 0, len(manifest.records))
+	for _, record := range manifest.records {
+		archive := archiveFile{name: manifest.outputFile, index: record.Index, extension: record.Extension, date: record.Date}
+		if _, err := os.Stat(archive.getPath()); err == nil {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Date != records[j].Date {
+			return records[i].Date > records[j].Date
+		}
+		return records[i].Index < records[j].Index
+	})
+
+	content, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a half written manifest
+	path := makeManifestPath(manifest.outputFile)
+	if err := os.WriteFile(path+".tmp", content, 0644); err != nil {
+		return err
+	}
+	return renameFile(path+".tmp", path)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akamensky/argparse"
+)
+
+// Rename all archives of an output file to the given naming scheme. The archives of the other
+// scheme are the newest, like for a rotee that ran with it until now. Archives with a zero padded
+// number or the extension in front of it come next and what logrotate left behind is the oldest.
+// Numbered archives are counted from the newest, dated ones get the day of their rotation and
+// count up within it.
+func migrateArchives(archiveBase string, naming string, location *time.Location) ([]string, error) {
+
+	migrated := make([]string, 0)
+	from := archiveNamingIndex
+	if naming == archiveNamingIndex {
+		from = archiveNamingDate
+	}
+	archives := orderArchives(findAllArchives(archiveBase), from)
+	manifest := loadManifest(archiveBase, archives)
+	archives = slices.Concat(archives, findVariantArchives(archiveBase), findForeignArchives(archiveBase))
+	defer func() {
+		if err := manifest.save(); err != nil {
+			logActivity("Failed to write manifest for %s. Error: %s", archiveBase, err)
+		}
+	}()
+
+	// Records are looked up by the old names, so find all of them before anything moves
+	records := make([]*archiveRecord, len(archives))
+	targets := make([]archiveFile, len(archives))
+	rotated := make([]time.Time, len(archives))
+	for i, archive := range archives {
+		extension := archive.extension
+		if archive.foreign != "" {
+			extension, rotated[i] = parseForeignArchive(archiveBase, archive.foreign, location)
+		} else if records[i] = manifest.get(archive); records[i] != nil {
+			rotated[i] = records[i].Rotated
+		}
+		if rotated[i].IsZero() {
+			var err error
+			if rotated[i], err = archiveCreated(archive, manifest); err != nil {
+				return migrated, err
+			}
+		}
+		targets[i] = archiveFile{name: archiveBase, index: i + 1, extension: extension}
+	}
+	if naming == archiveNamingDate {
+		counters := make(map[string]int)
+		for i := len(archives) - 1; i >= 0; i-- {
+			date := rotated[i].In(location).Format(archiveDateLayout)
+			counters[date]++
+			targets[i].date, targets[i].index = date, counters[date]
+		}
+	}
+
+	// A target can be the current name of another archive, so everything
+	// takes a detour over a temporary name. Archives already in place stay.
+	moving := make([]int, 0)
+	for i, archive := range archives {
+		if archive.getPath() == targets[i].getPath() {
+			continue
+		}
+		if err := renameFile(archive.getPath(), archive.getPath()+".migrate"); err != nil {
+			for _, moved := range slices.Backward(moving) {
+				renameFile(archives[moved].getPath()+".migrate", archives[moved].getPath())
+			}
+			return migrated, err
+		}
+		moving = append(moving, i)
+	}
+
+	// Put everything back where it was if one fails, so no archive is left under its temporary name
+	for n, i := range moving {
+		if err := renameFile(archives[i].getPath()+".migrate", targets[i].getPath()); err != nil {
+			for _, moved := range slices.Backward(moving[:n]) {
+				if err := renameFile(targets[moved].getPath(), archives[moved].getPath()+".migrate"); err != nil {
+					logActivity("Failed to move %s back. Error: %s", targets[moved].getPath(), err)
+				}
+			}
+			for _, moved := range slices.Backward(moving) {
+				if err := renameFile(archives[moved].getPath()+".migrate", archives[moved].getPath()); err != nil {
+					logActivity("Failed to move %s back. Error: %s", archives[moved].getPath(), err)
+				}
+			}
+			return migrated, err
+		}
+	}
+
+	// Archives rotee did not name are rotee archives from now on and get a record like one.
+	// They are added at the end, the records above point into the manifest.
+	added := make([]archiveRecord, 0)
+	for _, i := range moving {
+		audit("", "rename", archives[i].getPath(), targets[i].getPath())
+		logActivity("Renamed %s to %s", archives[i].getPath(), targets[i].getPath())
+		if records[i] != nil {
+			records[i].Index, records[i].Date = targets[i].index, targets[i].date
+		} else if archives[i].foreign != "" {
+			added = append(added, archiveRecord{Index: targets[i].index, Date: targets[i].date,
+				Extension: targets[i].extension, Rotated: rotated[i]})
+		}
+		migrated = append(migrated, targets[i].getPath())
+	}
+	for _, record := range added {
+		manifest.add(record)
+	}
+	return migrated, nil
+}
+
+// Archives named like rotee names them, but with a zero padded number or the compression extension
+// in front of the number, like app.log.01.gz or app.log.gz.2024-06-01.1 as other tools write them
+func variantArchivePattern(archiveBase string) *regexp.Regexp {
+	extensions := make([]string, 0, len(compressionFormats))
+	for _, format := range compressionFormats {
+		extensions = append(extensions, regexp.QuoteMeta(format.extension))
+	}
+	extension := "(" + strings.Join(extensions, "|") + ")"
+	date := `(?:([0-9]{4}-[0-9]{2}-[0-9]{2})\.)?`
+	return regexp.MustCompile("^" + regexp.QuoteMeta(filepath.Base(archiveBase)) +
+		`(?:\.` + date + `(0[0-9]+)` + extension + `?|` + extension + `\.` + date + `([0-9]+))$`)
+}
+
+// The extension, day and number of an archive matching variantArchivePattern
+func parseVariantArchive(pattern *regexp.Regexp, name string) (string, string, int, bool) {
+
+	match := pattern.FindStringSubmatch(name)
+	if match == nil {
+		return "", "", 0, false
+	}
+	if match[2] != "" {
+		index, err := strconv.Atoi(match[2])
+		return match[3], match[1], index, err == nil
+	}
+	index, err := strconv.Atoi(match[6])
+	return match[4], match[5], index, err == nil
+}
+
+// Archives named like variantArchivePattern, newest first. Numbered ones are newer than dated
+// ones, like after switching to numbered archives.
+func findVariantArchives(archiveBase string) []archiveFile {
+
+	archives := make([]archiveFile, 0)
+	entries, err := os.ReadDir(filepath.Dir(archiveBase))
+	if err != nil {
+		return archives
+	}
+	pattern := variantArchivePattern(archiveBase)
+	parsed := make(map[string]archiveFile)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		if extension, date, index, ok := parseVariantArchive(pattern, entry.Name()); ok {
+			path := filepath.Join(filepath.Dir(archiveBase), entry.Name())
+			archives = append(archives, archiveFile{name: archiveBase, foreign: path})
+			parsed[path] = archiveFile{index: index, date: date, extension: extension}
+		}
+	}
+	sort.SliceStable(archives, func(i, j int) bool {
+		a, b := parsed[archives[i].foreign], parsed[archives[j].foreign]
+		switch {
+		case a.date != b.date:
+			return a.date == "" || (b.date != "" && a.date > b.date)
+		case a.date == "":
+			return a.index < b.index
+		}
+		return a.index > b.index
+	})
+	return archives
+}
+
+// The compression extension of an archive rotee did not name, and the day in its name.
+// The time is zero for names without a date.
+func parseForeignArchive(archiveBase string, path string, location *time.Location) (string, time.Time) {
+
+	if extension, date, _, ok := parseVariantArchive(variantArchivePattern(archiveBase), filepath.Base(path)); ok {
+		if day, err := time.ParseInLocation(archiveDateLayout, date, location); err == nil {
+			return extension, day
+		}
+		return extension, time.Time{}
+	}
+
+	match := foreignArchivePattern(archiveBase).FindStringSubmatch(filepath.Base(path))
+	if match == nil {
+		return "", time.Time{}
+	}
+	extension := match[len(match)-1]
+	date := strings.ReplaceAll(strings.TrimPrefix(match[1], "-"), "-", "")
+	if len(date) < 8 {
+		return extension, time.Time{}
+	}
+	day, err := time.ParseInLocation("20060102", date[:8], location)
+	if err != nil {
+		return extension, time.Time{}
+	}
+	return extension, day
+}
+
+func runMigrateCommand(args []string) {
+
+	parser := argparse.NewParser("rotee migrate",
+		"Rename the archives of an output file to another naming scheme, keeping their order")
+	outputFile := parser.String("o", "output-file",
+		&argparse.Options{Required: true, Help: "Output file whose archives should be renamed."})
+	archiveDir := parser.String("", "archive-dir",
+		&argparse.Options{Required: false, Help: "Directory the archives are kept in, if not next to the output file."})
+	naming := parser.String("", "to",
+		&argparse.Options{Required: true, Help: "Naming scheme to rename the archives to, index or date"})
+	timezone := parser.String("", "timezone",
+		&argparse.Options{Required: false, Help: "Zone for the dates in archive names, like Europe/Berlin or UTC. Defaults to the host zone"})
+	activityFilePath := parser.String("v", "verbose-output-file",
+		&argparse.Options{Required: false, Help: "Log rotee activity to this file."})
+	auditFilePath := parser.String("", "audit-file",
+		&argparse.Options{Required: false, Help: "Append a JSON line for every rename and delete of log data to this file"})
+
+	if err := parser.Parse(args); err != nil {
+		fmt.Print(parser.Usage(err))
+		os.Exit(exitConfigError)
+	}
+
+	to, err := parseArchiveNaming(*naming)
+	if err != nil {
+		exitf(exitConfigError, "%s", err)
+	}
+	location, err := parseTimezone(*timezone)
+	if err != nil {
+		exitf(exitConfigError, "%s", err)
+	}
+
+	setupProcess(*activityFilePath, *auditFilePath, "", defaultRenameRetries, 0, false)
+
+	migrated, err := migrateArchives(makeArchiveBase(*outputFile, rotateConfig{archiveDir: *archiveDir}), to, location)
+	for _, target := range migrated {
+		fmt.Println(target)
+	}
+	if err != nil {
+		exitf(exitRotationError, "Migrating failed: %s", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	// Hosts and containers without a zoneinfo database still know every --timezone
+	_ "time/tzdata"
+)
+
+// Archives are either numbered (app.log.1.gz, shifted up on every rotation)
+// or carry the day they were rotated on and a counter for that day
+// (app.log.2024-06-01.2.gz), these never move once created.
+const (
+	archiveNamingIndex string = "index"
+	archiveNamingDate  string = "date"
+)
+
+const archiveDateLayout string = "2006-01-02"
+
+func parseArchiveNaming(naming string) (string, error) {
+	switch naming {
+	case archiveNamingIndex, archiveNamingDate:
+		return naming, nil
+	}
+	return "", errors.New("Unknown archive naming " + naming + ", use index or date")
+}
+
+// Days, hours and dates in file names are in this zone, the host zone if empty
+func parseTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errors.New("Unknown timezone " + name + ", use a name like Europe/Berlin or UTC")
+	}
+	return location, nil
+}
+
+func makeDatedArchivePath(fileName string, date string, index int, extension string) string {
+	return fileName + "." + date + "." + strconv.Itoa(index) + extension
+}
+
+// Matches the extension of archives in any format, including none at all
+func archiveExtensionPattern() string {
+	extensions := make([]string, 0, len(compressionFormats))
+	for _, format := range compressionFormats {
+		extensions = append(extensions, regexp.QuoteMeta(format.extension))
+	}
+	return "(" + strings.Join(extensions, "|") + ")?"
+}
+
+// Dated archives of the output file, newest first
+func findDatedArchives(outputFile string) []archiveFile {
+
+	archives := make([]archiveFile, 0)
+	entries, err := os.ReadDir(filepath.Dir(outputFile))
+	if err != nil {
+		return archives
+	}
+
+	pattern := regexp.MustCompile("^" + regexp.QuoteMeta(filepath.Base(outputFile)) +
+		`\.([0-9]{4}-[0-9]{2}-[0-9]{2})\.([0-9]+)` + archiveExtensionPattern() + "$")
+	for _, entry := range entries {
+		if match := pattern.FindStringSubmatch(entry.Name()); match != nil {
+			index, _ := strconv.Atoi(match[2])
+			archives = append(archives, archiveFile{name: outputFile, index: index, extension: match[3], date: match[1]})
+		}
+	}
+
+	// The date format sorts like a string, within a day the counter decides
+	sort.Slice(archives, func(i, j int) bool {
+		if archives[i].date != archives[j].date {
+			return archives[i].date > archives[j].date
+		}
+		return archives[i].index > archives[j].index
+	})
+	return archives
+}
+
+// logrotate with dateext (app.log-20240601.gz) and savelog (app.log.0) name archives
+// differently. Once rotee took over they are older than anything it rotated itself.
+func foreignArchivePattern(archiveBase string) *regexp.Regexp {
+	return regexp.MustCompile("^" + regexp.QuoteMeta(filepath.Base(archiveBase)) +
+		`(-[0-9]{4}-?[0-9]{2}-?[0-9]{2}([-_]?[0-9]+)?|\.0)` + archiveExtensionPattern() + "$")
+}
+
+// Archives logrotate or savelog left behind, newest first by their modification time
+func findForeignArchives(archiveBase string) []archiveFile {
+
+	archives := make([]archiveFile, 0)
+	entries, err := os.ReadDir(filepath.Dir(archiveBase))
+	if err != nil {
+		return archives
+	}
+	pattern := foreignArchivePattern(archiveBase)
+	modified := make(map[string]time.Time)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !pattern.MatchString(entry.Name()) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			path := filepath.Join(filepath.Dir(archiveBase), entry.Name())
+			archives = append(archives, archiveFile{name: archiveBase, foreign: path})
+			modified[path] = info.ModTime()
+		}
+	}
+	sort.Slice(archives, func(i, j int) bool { return modified[archives[i].foreign].After(modified[archives[j].foreign]) })
+	return archives
+}
+
+// The next free archive for a rotation at the given time, continuing the counter of that day
+func nextDatedArchive(archiveBase string, rotatedAt time.Time, extension string, archives []archiveFile) archiveFile {
+
+	date := rotatedAt.Format(archiveDateLayout)
+	index := 1
+	for _, archive := range archives {
+		if archive.date == date && archive.index >= index {
+			index = archive.index + 1
+		}
+	}
+	return archiveFile{name: archiveBase, index: index, extension: extension, date: date}
+}
+
+// Puts the archives of the naming scheme in use first. Archives of the other
+// scheme are left over from before a switch, so they are the oldest ones.
+func orderArchives(archives []archiveFile, naming string) []archiveFile {
+	sort.SliceStable(archives, func(i, j int) bool {
+		return (archives[i].date != "") == (naming == archiveNamingDate) &&
+			(archives[j].date != "") != (naming == archiveNamingDate)
+	})
+	return archives
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+type failureEvent struct {
+	Stage      string    `json:"stage"`
+	Error      string    `json:"error"`
+	OutputFile string    `json:"output_file"`
+	Archive    string    `json:"archive,omitempty"`
+	RotationID string    `json:"rotation_id,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+type emailOptions struct {
+	to         []string
+	from       string
+	server     string
+	user       string
+	password   string
+	alertAfter int
+}
+
+type slackOptions struct {
+	webhook  string
+	events   map[string]bool
+	template *template.Template
+}
+
+// Everything a chat message template can refer to
+type notifyEvent struct {
+	Event       string        `json:"event"`
+	RotationID  string        `json:"rotation_id,omitempty"`
+	Host        string        `json:"host"`
+	OutputFile  string        `json:"output_file"`
+	Archive     string        `json:"archive,omitempty"`
+	Pruned      []string      `json:"pruned,omitempty"`
+	Size        int64         `json:"size,omitempty"`
+	ArchiveSize int64         `json:"archive_size,omitempty"`
+	Duration    time.Duration `json:"-"`
+	Stage       string        `json:"stage,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+const defaultSlackTemplate string = `rotee on {{.Host}}: ` +
+	`{{if eq .Event "rotation"}}rotated {{.OutputFile}} to {{.Archive}} ({{.Size}} -> {{.ArchiveSize}} bytes) in {{.Duration}}` +
+	`{{else if eq .Event "prune"}}deleted {{len .Pruned}} old archive(s) of {{.OutputFile}}: {{join .Pruned ", "}}` +
+	`{{else}}{{.Stage}} failed for {{.OutputFile}}{{if .Archive}} ({{.Archive}}){{end}}: {{.Error}}{{end}}`
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Sending an alert email as a whole, from connecting to the last reply
+const smtpTimeout = 30 * time.Second
+
+func reportFailure(config rotateConfig, stage string, outputFile string, archive string, failure error) {
+
+	event := failureEvent{
+		Stage:      stage,
+		Error:      failure.Error(),
+		OutputFile: outputFile,
+		Archive:    archive,
+		RotationID: config.rotationID,
+		Time:       time.Now(),
+	}
+
+	// Run user script, context is passed in the environment
+	if config.onErrorScript != "" {
+		logRotation(config.rotationID, "Running user defined error script for failed %s...", stage)
+		process := exec.Command("/bin/sh", "-c", config.onErrorScript)
+		config.scriptCredentials.apply(process)
+		process.Env = append(os.Environ(),
+			"ROTEE_STAGE="+event.Stage,
+			"ROTEE_ERROR="+event.Error,
+			"ROTEE_OUTPUT_FILE="+event.OutputFile,
+			"ROTEE_ARCHIVE="+event.Archive,
+			"ROTEE_ROTATION_ID="+event.RotationID,
+			"ROTEE_TIME="+event.Time.Format(time.RFC3339),
+		)
+		if err := process.Run(); err != nil {
+			logRotation(config.rotationID, "Error while running user defined error script: %s", err)
+		}
+	}
+
+	notify(config, notifyEvent{
+		Event:      "failure",
+		OutputFile: outputFile,
+		Archive:    archive,
+		Stage:      stage,
+		Error:      event.Error,
+	})
+
+	if config.onErrorWebhook != "" {
+		logRotation(config.rotationID, "Calling error webhook for failed %s...", stage)
+		if err := postJSON(config.onErrorWebhook, event); err != nil {
+			logRotation(config.rotationID, "Error while calling error webhook: %s", err)
+		}
+	}
+
+	// Mail is for things a human has to fix: a full disk or rotations failing over and over.
+	// We only send once when the threshold is reached so nobody gets flooded.
+	failures := int64(0)
+	if stage == "rotate" {
+		failures = config.state.consecutiveRotateFailures.Add(1)
+	}
+	if len(config.email.to) > 0 {
+		diskFull := errors.Is(failure, syscall.ENOSPC)
+		if diskFull || failures == int64(config.email.alertAfter) {
+			logRotation(config.rotationID, "Sending alert mail for failed %s...", stage)
+			if err := sendAlertMail(config.email, event, failures, diskFull); err != nil {
+				logRotation(config.rotationID, "Error while sending alert mail: %s", err)
+			}
+		}
+	}
+}
+
+func sendAlertMail(options emailOptions, event failureEvent, failures int64, diskFull bool) error {
+
+	hostname, _ := os.Hostname()
+	subject := fmt.Sprintf("rotee on %s: %s failed for %s", hostname, event.Stage, event.OutputFile)
+	if diskFull {
+		subject = fmt.Sprintf("rotee on %s: disk full while writing %s", hostname, event.OutputFile)
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "Stage: %s\r\n", event.Stage)
+	fmt.Fprintf(&body, "Output file: %s\r\n", event.OutputFile)
+	if event.Archive != "" {
+		fmt.Fprintf(&body, "Archive: %s\r\n", event.Archive)
+	}
+	if event.RotationID != "" {
+		fmt.Fprintf(&body, "Rotation: %s\r\n", event.RotationID)
+	}
+	if failures > 0 {
+		fmt.Fprintf(&body, "Failed rotations in a row: %d\r\n", failures)
+	}
+	fmt.Fprintf(&body, "Time: %s\r\n", event.Time.Format(time.RFC3339))
+	fmt.Fprintf(&body, "Error: %s\r\n", event.Error)
+
+	message := "From: " + options.from + "\r\n" +
+		"To: " + strings.Join(options.to, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + event.Time.Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body.String()
+
+	// Only authenticate if we have a user, plenty of internal relays do not want it
+	var auth smtp.Auth
+	if options.user != "" {
+		host, _, err := net.SplitHostPort(options.server)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", options.user, options.password, host)
+	}
+
+	return sendMail(options.server, auth, options.from, options.to, []byte(message))
+}
+
+// Like smtp.SendMail, but a mail server that stopped answering can not hang whoever reports the failure
+func sendMail(server string, auth smtp.Auth, from string, to []string, message []byte) error {
+
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return err
+	}
+	connection, err := net.DialTimeout("tcp", server, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	if err := connection.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		return err
+	}
+
+	client, err := smtp.NewClient(connection, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, recipient := range to {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func postJSON(url string, payload any) error {
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	response, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %s", response.Status)
+	}
+	return nil
+}
+
+func parseSlackTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultSlackTemplate
+	}
+	return template.New("slack").Funcs(template.FuncMap{"join": strings.Join}).Parse(text)
+}
+
+// Hand an event to every configured notification channel
+func notify(config rotateConfig, event notifyEvent) {
+	event.Host, _ = os.Hostname()
+	event.RotationID = config.rotationID
+	notifySlack(config, event)
+	publishMQTT(config, event)
+}
+
+func notifySlack(config rotateConfig, event notifyEvent) {
+
+	if config.slack.webhook == "" || !config.slack.events[event.Event] {
+		return
+	}
+
+	var text strings.Builder
+	if err := config.slack.template.Execute(&text, event); err != nil {
+		logRotation(config.rotationID, "Error while rendering chat message: %s", err)
+		return
+	}
+
+	// Slack and Mattermost incoming webhooks both understand this
+	logRotation(config.rotationID, "Sending %s notification to chat webhook...", event.Event)
+	if err := postJSON(config.slack.webhook, map[string]string{"text": text.String()}); err != nil {
+		logRotation(config.rotationID, "Error while calling chat webhook: %s", err)
+	}
+}
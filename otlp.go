@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	collogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	common "go.opentelemetry.io/proto/otlp/common/v1"
+	logs "go.opentelemetry.io/proto/otlp/logs/v1"
+	resource "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// How the lines get to the collector, like OTEL_EXPORTER_OTLP_PROTOCOL
+const (
+	otlpProtocolGRPC string = "grpc"
+	otlpProtocolHTTP string = "http/protobuf"
+)
+
+func parseOTLPProtocol(protocol string) (string, error) {
+	switch protocol {
+	case otlpProtocolGRPC, otlpProtocolHTTP:
+		return protocol, nil
+	}
+	return "", errors.New("Unknown OTLP protocol " + protocol + ", use grpc or http/protobuf")
+}
+
+const otlpTimeout = 10 * time.Second
+
+// Exports every batch of lines as one request with one LogRecord per line
+type otlpExporter struct {
+	resource *resource.Resource
+	logFile  string
+
+	// Either a gRPC connection or the URL to post protobuf to
+	connection *grpc.ClientConn
+	client     collogs.LogsServiceClient
+	url        string
+
+	failures sinkFailures
+}
+
+// Resource attributes given like service.name=app,deployment.environment=prod.
+// host.name is added unless it was given.
+func parseOTLPResource(text string) (*resource.Resource, error) {
+
+	attributes := make([]*common.KeyValue, 0)
+	hasHost := false
+	for _, attribute := range strings.Split(text, ",") {
+		if attribute = strings.TrimSpace(attribute); attribute == "" {
+			continue
+		}
+		key, value, found := strings.Cut(attribute, "=")
+		if !found || key == "" {
+			return nil, errors.New("invalid resource attribute " + attribute + ", use key=value")
+		}
+		hasHost = hasHost || key == "host.name"
+		attributes = append(attributes, &common.KeyValue{Key: key,
+			Value: &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: value}}})
+	}
+	if hostname, err := os.Hostname(); err == nil && !hasHost {
+		attributes = append(attributes, &common.KeyValue{Key: "host.name",
+			Value: &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: hostname}}})
+	}
+	return &resource.Resource{Attributes: attributes}, nil
+}
+
+// The endpoint is http://collector:4317 for gRPC or http://collector:4318 for http/protobuf,
+// https encrypts the connection. Without path http/protobuf posts to /v1/logs.
+func newOTLPExporter(endpoint string, protocol string, resourceAttributes string, logFile string) (*otlpExporter, error) {
+
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, errors.New("expected an endpoint like http://collector:4317")
+	}
+	logResource, err := parseOTLPResource(resourceAttributes)
+	if err != nil {
+		return nil, err
+	}
+	exporter := &otlpExporter{resource: logResource, logFile: logFile, failures: sinkFailures{name: "OpenTelemetry collector"}}
+
+	if protocol == otlpProtocolHTTP {
+		if parsed.Path == "" || parsed.Path == "/" {
+			parsed.Path = "/v1/logs"
+		}
+		exporter.url = parsed.String()
+		return exporter, nil
+	}
+
+	transport := insecure.NewCredentials()
+	if parsed.Scheme == "https" {
+		transport = credentials.NewTLS(&tls.Config{})
+	}
+	if exporter.connection, err = grpc.NewClient(parsed.Host, grpc.WithTransportCredentials(transport)); err != nil {
+		return nil, err
+	}
+	exporter.client = collogs.NewLogsServiceClient(exporter.connection)
+	return exporter, nil
+}
+
+func (exporter *otlpExporter) sendLines(lines [][]byte) {
+
+	now := uint64(time.Now().UnixNano())
+	records := make([]*logs.LogRecord, len(lines))
+	for i, line := range lines {
+		records[i] = &logs.LogRecord{
+			TimeUnixNano:         now,
+			ObservedTimeUnixNano: now,
+			Body:                 &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: string(line)}},
+			Attributes: []*common.KeyValue{{Key: "log.file.path",
+				Value: &common.AnyValue{Value: &common.AnyValue_StringValue{StringValue: exporter.logFile}}}},
+		}
+	}
+	request := &collogs.ExportLogsServiceRequest{ResourceLogs: []*logs.ResourceLogs{{
+		Resource:  exporter.resource,
+		ScopeLogs: []*logs.ScopeLogs{{Scope: &common.InstrumentationScope{Name: "rotee"}, LogRecords: records}},
+	}}}
+
+	var response *collogs.ExportLogsServiceResponse
+	err := sendWithRetries(func() (err error) {
+		if exporter.client != nil {
+			response, err = exporter.exportGRPC(request)
+		} else {
+			response, err = exporter.exportHTTP(request)
+		}
+		return err
+	})
+	if err != nil {
+		exporter.failures.failed(err, len(lines))
+	} else if rejected := response.GetPartialSuccess().GetRejectedLogRecords(); rejected > 0 {
+		exporter.failures.failed(errors.New(response.GetPartialSuccess().GetErrorMessage()), int(rejected))
+	} else {
+		exporter.failures.succeeded()
+	}
+}
+
+func (exporter *otlpExporter) exportGRPC(request *collogs.ExportLogsServiceRequest) (*collogs.ExportLogsServiceResponse, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), otlpTimeout)
+	defer cancel()
+	response, err := exporter.client.Export(ctx, request)
+
+	// The codes the OTLP spec calls retryable, anything else would fail again
+	switch status.Code(err) {
+	case codes.OK, codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted,
+		codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+		return response, err
+	}
+	return nil, permanentSinkError{err}
+}
+
+func (exporter *otlpExporter) exportHTTP(request *collogs.ExportLogsServiceRequest) (*collogs.ExportLogsServiceResponse, error) {
+
+	body, err := proto.Marshal(request)
+	if err != nil {
+		return nil, permanentSinkError{err}
+	}
+	answer, err := webhookClient.Post(exporter.url, "application/x-protobuf", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer answer.Body.Close()
+	content, err := io.ReadAll(answer.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case answer.StatusCode == http.StatusTooManyRequests || answer.StatusCode == http.StatusBadGateway ||
+		answer.StatusCode == http.StatusServiceUnavailable || answer.StatusCode == http.StatusGatewayTimeout:
+		return nil, fmt.Errorf("collector returned status %s", answer.Status)
+	case answer.StatusCode < 200 || answer.StatusCode > 299:
+		return nil, permanentSinkError{fmt.Errorf("collector returned status %s", answer.Status)}
+	}
+	response := &collogs.ExportLogsServiceResponse{}
+	if err := proto.Unmarshal(content, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (exporter *otlpExporter) close() {
+	if exporter.connection != nil {
+		exporter.connection.Close()
+	}
+	exporter.failures.close()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// How much to move into the output file at once
+const passthroughSize int = 16 * lineChunkSize
+
+// Move stdin into the output file inside the kernel, splice for pipes and
+// copy_file_range for files. Returns false if stdin can not be used that way.
+func passthrough(wg *sync.WaitGroup, outputFile string, truncateOnStart bool, config rotateConfig) bool {
+
+	stat, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	pipe := stat.Mode()&os.ModeNamedPipe != 0
+	if !pipe && !stat.Mode().IsRegular() {
+		return false
+	}
+
+	wg.Add(1)
+	go spliceInput(wg, os.Stdin, pipe, outputFile, truncateOnStart, config)
+	return true
+}
+
+// Splice can not write to files opened for appending, so we track the end ourselves
+func openPassthroughOutput(outputFile string, truncate bool) *os.File {
+	openFlags := os.O_CREATE | os.O_WRONLY
+	if truncate {
+		openFlags |= os.O_TRUNC
+	}
+	output, err := os.OpenFile(outputFile, openFlags, 0644)
+	if err != nil {
+		logActivity("Can not write to file %s", outputFile)
+		exitf(exitOutputError, "Can not write to file %s", outputFile)
+	}
+	return output
+}
+
+func spliceInput(wg *sync.WaitGroup, input *os.File, pipe bool, outputFile string, truncateOnStart bool, config rotateConfig) {
+
+	logActivity("Writer thread started, moving input to %s without copying", outputFile)
+
+	config.state.outputFileLock.Lock()
+	output := openPassthroughOutput(outputFile, truncateOnStart)
+	preallocateOutputFile(output, outputFile, config)
+	config.state.outputFileLock.Unlock()
+	if truncateOnStart {
+		audit("", "truncate", outputFile, "")
+	}
+
+	inputFd := int(input.Fd())
+	for {
+
+		// Wait for input without the lock, rotation must not wait for the next line
+		if pipe {
+			fds := []unix.PollFd{{Fd: int32(inputFd), Events: unix.POLLIN}}
+			if _, err := unix.Poll(fds, -1); err != nil && !errors.Is(err, unix.EINTR) {
+				exitf(exitInputError, "Failed to wait for input: %s", err)
+			}
+		}
+
+		config.state.outputFileLock.Lock()
+
+		// Check if we need to reopen the output file after rotation
+		if config.state.reloadOutputFile.Swap(false) {
+			output.Close()
+			output = openPassthroughOutput(outputFile, false)
+			preallocateOutputFile(output, outputFile, config)
+		}
+
+		// The file might have been truncated after copying it to another filesystem
+		var moved int64
+		var err error
+		var outputStat unix.Stat_t
+		if err = unix.Fstat(int(output.Fd()), &outputStat); err == nil {
+			offset := outputStat.Size
+			writeStarted := time.Now().UnixNano()
+			if pipe {
+
+				// Splice returns an int on 32 bit platforms and an int64 on the others
+				spliced, spliceErr := unix.Splice(inputFd, nil, int(output.Fd()), &offset, passthroughSize,
+					unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+				moved, err = int64(spliced), spliceErr
+			} else {
+				var copied int
+				copied, err = unix.CopyFileRange(inputFd, nil, int(output.Fd()), &offset, passthroughSize, 0)
+				moved = int64(copied)
+			}
+			if moved > 0 {
+				config.state.firstWriteTime.CompareAndSwap(0, writeStarted)
+				config.state.lastWriteTime.Store(writeStarted)
+			}
+		}
+		config.state.outputFileLock.Unlock()
+
+		switch {
+		case errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR):
+			continue
+
+		// Older kernels and some filesystems can not do this, everything moved so far is in place
+		case errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS) ||
+			errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EOPNOTSUPP):
+			logActivity("Can not move input to %s without copying, falling back. Error: %s", outputFile, err)
+			output.Close()
+			inputData := make(chan *lineChunk, lineChunkQueueSize)
+			wg.Add(1)
+			go read(wg, inputData, config.read)
+			write(wg, inputData, outputFile, false, config)
+			return
+
+		// Crash if write fails
+		case err != nil:
+			reportFailure(config, "write", outputFile, "", err)
+			exitf(exitOutputError, "Failed to write to %s", outputFile)
+
+		case moved == 0:
+			output.Close()
+			logActivity("Writer thread stopped")
+			wg.Done()
+			return
+		}
+	}
+}
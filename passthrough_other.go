@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "sync"
+
+// Only linux can move data between files without copying it through rotee
+func passthrough(wg *sync.WaitGroup, outputFile string, truncateOnStart bool, config rotateConfig) bool {
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// The control service can pause the writer, for example to remount the file system of the
+// output file. The output file is closed meanwhile and the input waits in the channel to the
+// writer, in the spool file with --spool-file, and in the end in the pipe of the producer.
+type writerRequest struct {
+	pause bool
+	done  chan error
+}
+
+// A writer that does not take a request within this time is stuck or finished
+const writerRequestTimeout time.Duration = 5 * time.Second
+
+var errWriterNotAnswering = errors.New("the writer did not answer, it is stalled or finished")
+
+// Ask the writer to pause or resume and wait until it did
+func requestWriterPause(state *pipelineState, pause bool) error {
+
+	request := writerRequest{pause: pause, done: make(chan error, 1)}
+	select {
+	case state.writerRequests <- request:
+	case <-time.After(writerRequestTimeout):
+		return errWriterNotAnswering
+	}
+	return <-request.done
+}
+
+// Write out everything held back and close the output file, the caller holds outputFileLock
+func closeForPause(outputFile string, output *os.File, config rotateConfig) error {
+
+	if err := config.state.flushPendingWrites(); err != nil {
+		return err
+	}
+	if err := output.Sync(); err != nil {
+		logActivity("Failed to sync %s to disk. Error: %s", outputFile, err)
+	}
+	config.state.closeDirectFile()
+	return output.Close()
+}
+
+// Block the writer until it is asked to resume, pausing again changes nothing.
+// Returns where to answer the resume once the output file is open again.
+func waitForResume(outputFile string, config rotateConfig) chan error {
+
+	logActivity("Writer paused, closed %s", outputFile)
+	config.state.writerPaused.Store(true)
+	for request := range config.state.writerRequests {
+		if !request.pause {
+			config.state.writerPaused.Store(false)
+			logActivity("Writer resumed, reopening %s", outputFile)
+			return request.done
+		}
+		request.done <- nil
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/akamensky/argparse"
+)
+
+// Everything that belongs to one output file. Usually rotee has exactly one,
+// rotee multi runs many of them side by side in one process.
+type pipelineState struct {
+	outputFileLock   sync.Mutex
+	rotateLock       sync.Mutex
+	reloadOutputFile atomic.Bool
+
+	// Unix nanoseconds of the first write into the current output file,
+	// 0 if nothing was written yet and -1 if we do not know
+	firstWriteTime atomic.Int64
+
+	// Start times of recent rotations, only touched while holding rotateLock
+	recentRotations []time.Time
+
+	// Number of rotations that failed in a row, reset by every successful rotation
+	consecutiveRotateFailures atomic.Int64
+
+	// Unix nanoseconds of the last successful rotation, or of the start if there was none yet
+	lastRotationTime atomic.Int64
+
+	// Unix nanoseconds of the last write into the output file, or of the start if there was none yet
+	lastWriteTime atomic.Int64
+
+	// Lines written into the current output file, only counted if a rotation condition needs them
+	linesWritten atomic.Int64
+
+	// Bytes that went into compression and came out of it since the start
+	bytesBeforeCompression atomic.Int64
+	bytesAfterCompression  atomic.Int64
+
+	// Unix nanoseconds since the writer tries to get data into the output file, 0 while it waits for input
+	writeStartedAt atomic.Int64
+
+	// Closed once the watchdog gave up on the output file and the writer should use --stall-fallback
+	writerStalled chan struct{}
+
+	// The file an output file like app-%Y-%m-%d.log currently renders to, once the writer opened it
+	templatedOutputFile atomic.Value
+
+	// Writes held back by --buffering block and the file they go to, only touched while holding outputFileLock
+	pendingWrites []byte
+	pendingFile   *os.File
+
+	// With --buffering direct the descriptor opened with O_DIRECT, where the held back data starts
+	// in the output file and how much of it is already there. Only touched while holding outputFileLock.
+	directFile     *os.File
+	directOffset   int64
+	directBuffer   []byte
+	pendingFlushed int
+
+	// Rotation requests for the rotation goroutine and how many of them wait
+	rotationQueue   chan rotationRequest
+	queuedRotations atomic.Int64
+
+	// The archive the last rotation created, only touched by the rotation goroutine
+	rotatedArchive string
+
+	// Held while archives are uploaded or mirrored, rotations only wake the goroutine doing it.
+	// Rotations pin the archives for the mirror by name, only touched while holding rotateLock.
+	shipLock   sync.Mutex
+	shipWake   chan struct{}
+	mirrorPins map[string]pinnedArchive
+
+	// Pause and resume requests for the writer and whether it is paused right now
+	writerRequests chan writerRequest
+	writerPaused   atomic.Bool
+
+	// Closed once the control service asked to drain, and whether to rotate after that
+	drain            chan struct{}
+	drainOnce        sync.Once
+	rotateAfterDrain atomic.Bool
+}
+
+type pipelineDefinition struct {
+
+	// File or named pipe to read lines from, stdin if empty.
+	// fd:3 reads a file descriptor inherited from the parent process.
+	Input string `json:"input"`
+
+	// Also write the lines to stdout like tee does
+	Stdout bool `json:"stdout"`
+
+	// The same arguments as for a single rotee, e.g. ["-o", "app.log", "-c", "-n", "5"]
+	Args []string `json:"args"`
+}
+
+type pipelineFile struct {
+	Pipelines []pipelineDefinition `json:"pipelines"`
+}
+
+func loadPipelineFile(path string) ([]pipelineDefinition, error) {
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var definitions pipelineFile
+	if err := json.Unmarshal(content, &definitions); err != nil {
+		return nil, err
+	}
+	if len(definitions.Pipelines) == 0 {
+		return nil, fmt.Errorf("no pipelines defined in %s", path)
+	}
+
+	// Only one pipeline can have stdin or any other inherited file descriptor
+	stdinUsers := 0
+	fdUsers := make(map[uintptr]bool)
+	for _, definition := range definitions.Pipelines {
+		if definition.Input == "" || definition.Input == "-" {
+			stdinUsers++
+		}
+		if fd, ok, err := parseInputFD(definition.Input); err != nil {
+			return nil, err
+		} else if ok && fdUsers[fd] {
+			return nil, fmt.Errorf("several pipelines read from %s, only one can", definition.Input)
+		} else if ok {
+			fdUsers[fd] = true
+		}
+	}
+	if stdinUsers > 1 {
+		return nil, fmt.Errorf("%d pipelines read from stdin, only one can", stdinUsers)
+	}
+	return definitions.Pipelines, nil
+}
+
+// Inputs like fd:3 name a file descriptor the parent process passed on, 0 to 2 are ours
+func parseInputFD(input string) (uintptr, bool, error) {
+	number, found := strings.CutPrefix(input, "fd:")
+	if !found {
+		return 0, false, nil
+	}
+	fd, err := strconv.Atoi(number)
+	if err != nil || fd < 3 {
+		return 0, false, fmt.Errorf("invalid input %s, use fd:3 or higher", input)
+	}
+	return uintptr(fd), true, nil
+}
+
+// Read lines from a file or named pipe. When the writer of a named pipe goes
+// away we wait for the next one, like a long running log collector should.
+func readInput(wg *sync.WaitGroup, inputPath string, inputData chan *lineChunk, options readOptions) {
+
+	logActivity("Reader thread for %s started", inputPath)
+	defer wg.Done()
+	defer close(inputData)
+
+	// An inherited file descriptor is read once like stdin, there is nothing to reopen
+	if fd, ok, _ := parseInputFD(inputPath); ok {
+		input := os.NewFile(fd, inputPath)
+		readLines(input, inputData, options)
+		input.Close()
+		logActivity("Reader thread for %s stopped", inputPath)
+		return
+	}
+
+	for {
+
+		// Opening a named pipe blocks until somebody opens it for writing
+		input, err := os.Open(inputPath)
+		if err != nil {
+			exitf(exitInputError, "Can not read from %s: %s", inputPath, err)
+		}
+		if options.checkpoint != nil {
+			if err := options.checkpoint.resume(input); err != nil {
+				exitf(exitInputError, "Can not resume %s: %s", inputPath, err)
+			}
+		}
+		readLines(input, inputData, options)
+		input.Close()
+
+		if stat, err := os.Stat(inputPath); err != nil || stat.Mode()&os.ModeNamedPipe == 0 || drained(options.drain) {
+			break
+		}
+		logActivity("Writer of %s went away, waiting for the next one", inputPath)
+	}
+
+	logActivity("Reader thread for %s stopped", inputPath)
+}
+
+func runMultiCommand(args []string) {
+
+	parser := argparse.NewParser("rotee multi",
+		"Run several independent pipelines from a config file in one process")
+	configFile := parser.String("c", "config",
+		&argparse.Options{Required: true, Help: "JSON file with the pipelines to run, see README for the format."})
+	activityFilePath := parser.String("v", "verbose-output-file",
+		&argparse.Options{Required: false, Help: "Log rotee activity of all pipelines to this file."})
+	auditFilePath := parser.String("", "audit-file",
+		&argparse.Options{Required: false, Help: "Append a JSON line for every rename, delete, truncate and upload " +
+			"of log data of all pipelines to this file"})
+	umask := parser.String("", "umask",
+		&argparse.Options{Required: false, Help: "Umask for all files rotee creates, in octal like 027. " +
+			"Defaults to the umask rotee was started with"})
+	compressJobs := parser.Int("", "compress-max-jobs",
+		&argparse.Options{Required: false, Help: "Most rotations of all pipelines that compress at the same time, " +
+			"further rotations wait. 0 for no limit", Default: 0})
+	retries := parser.Int("", "rename-retries",
+		&argparse.Options{Required: false, Help: "How often to retry renaming or deleting a file that another process has open, " +
+			"only happens on windows", Default: defaultRenameRetries})
+	networkFileSystem := parser.Flag("", "network-fs",
+		&argparse.Options{Required: false, Help: "Output files and archives of the pipelines are on NFS or SMB. Retries renames, deletes " +
+			"and stats that fail for a moment and takes the age of archives for --max-days from the manifest", Default: false})
+
+	if err := parser.Parse(args); err != nil {
+		fmt.Print(parser.Usage(err))
+		os.Exit(exitConfigError)
+	}
+
+	definitions, err := loadPipelineFile(*configFile)
+	if err != nil {
+		exitf(exitConfigError, "Can not load pipelines: %s", err)
+	}
+
+	setupProcess(*activityFilePath, *auditFilePath, *umask, *retries, *compressJobs, *networkFileSystem)
+
+	// Set up a wait group to prevent shutting down before all writes
+	// and rotates of all pipelines are complete.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// Set up every pipeline before reading anything, a broken one stops rotee right away
+	starts := make([]func(), len(definitions))
+	for i, definition := range definitions {
+		start, ok := startPipeline(append([]string{"rotee"}, definition.Args...), definition.Input, definition.Stdout, true, &wg)
+		if !ok {
+			exitf(exitConfigError, "Invalid arguments for pipeline %d", i+1)
+		}
+		starts[i] = start
+	}
+
+	// Start reading last
+	for _, start := range starts {
+		start()
+	}
+}
@@ -0,0 +1,14 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reserve the blocks without changing the size, appends still go to the end of the data
+func preallocate(file *os.File, size int64) error {
+	return unix.Fallocate(int(file.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Only linux can reserve blocks beyond the end of a file
+func preallocate(file *os.File, size int64) error {
+	return errors.ErrUnsupported
+}
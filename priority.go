@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// I/O scheduling classes of ioprio_set, realtime is left out on purpose
+const (
+	ioPriorityClassBestEffort int = 2
+	ioPriorityClassIdle       int = 3
+)
+
+// Parses idle or best-effort with an optional level from 0 (highest) to 7 like best-effort:7,
+// 0 means the priority is left alone
+func parseIOPriority(text string) (int, error) {
+	class, level, hasLevel := strings.Cut(text, ":")
+	switch {
+	case text == "":
+		return 0, nil
+	case class == "idle" && !hasLevel:
+		return ioPriorityClassIdle << 13, nil
+	case class == "best-effort":
+		data := 4
+		if hasLevel {
+			var err error
+			if data, err = strconv.Atoi(level); err != nil || data < 0 || data > 7 {
+				return 0, errors.New("I/O priority level must be between 0 and 7")
+			}
+		}
+		return ioPriorityClassBestEffort<<13 | data, nil
+	}
+	return 0, errors.New("Unknown I/O priority " + text + ", use idle or best-effort:0 to best-effort:7")
+}
+
+// Compression runs on a thread of its own with --compress-nice and --compress-ionice, so
+// the writer and everything else in rotee keep their priority. The thread is thrown away
+// afterwards, without privileges a lowered priority can not be raised again.
+func withCompressPriority(config rotateConfig, compress func() error) error {
+
+	if config.compressNice == 0 && config.compressIOPriority == 0 {
+		return compress()
+	}
+	result := make(chan error, 1)
+	go func() {
+
+		// Never unlocked, so the thread ends with this goroutine
+		runtime.LockOSThread()
+		if err := lowerThreadPriority(config.compressNice, config.compressIOPriority); err != nil {
+			logActivity("Failed to lower the priority of compression. Error: %s", err)
+		}
+		result <- compress()
+	}()
+	return <-result
+}
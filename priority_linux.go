@@ -0,0 +1,23 @@
+//go:build linux
+
+package main
+
+import "golang.org/x/sys/unix"
+
+const ioPriorityWhoProcess int = 1
+
+// On linux both apply to the calling thread alone when given its thread id
+func lowerThreadPriority(nice int, ioPriority int) error {
+	tid := unix.Gettid()
+	if nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, tid, nice); err != nil {
+			return err
+		}
+	}
+	if ioPriority != 0 {
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, uintptr(ioPriorityWhoProcess), uintptr(tid), uintptr(ioPriority)); errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
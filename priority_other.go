@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// Elsewhere the priority belongs to the whole process, lowering it would slow down the writer too
+func lowerThreadPriority(nice int, ioPriority int) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// What the periodic collection does with temporary files of failed rotations
+const (
+	orphanPolicyArchive string = "archive"
+	orphanPolicyDelete  string = "delete"
+)
+
+func parseOrphanPolicy(policy string) (string, error) {
+	switch policy {
+	case orphanPolicyArchive, orphanPolicyDelete:
+		return policy, nil
+	}
+	return "", errors.New("Unknown orphan policy " + policy + ", use archive or delete")
+}
+
+// Names rotee gives to archives and bundles of the output file and those of archives
+// logrotate left behind, retention rules must never touch anything else in the archive directory.
+func isRoteeArchive(archiveBase string, path string) bool {
+
+	if filepath.Clean(filepath.Dir(path)) != filepath.Clean(filepath.Dir(archiveBase)) {
+		return false
+	}
+	pattern := regexp.MustCompile("^" + regexp.QuoteMeta(filepath.Base(archiveBase)) +
+		`\.((([0-9]{4}-[0-9]{2}-[0-9]{2}\.)?[0-9]+` + archiveExtensionPattern() + `)|[0-9]{4}-[0-9]{2}\.tar\.zst)$`)
+	return pattern.MatchString(filepath.Base(path)) || foreignArchivePattern(archiveBase).MatchString(filepath.Base(path))
+}
+
+// Delete an archive for a retention rule, but only if it really is one
+func removeArchiveFile(archiveBase string, path string) error {
+
+	if !isRoteeArchive(archiveBase, path) {
+		return errors.New("Refusing to delete " + path + ", it is not named like an archive of " + archiveBase)
+	}
+
+	// Somebody might have put a directory or a link there, we only ever create regular files
+	stat, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() {
+		return errors.New("Refusing to delete " + path + ", it is not a regular file")
+	}
+	return removeFile(path)
+}
+
+// Delete archives beyond --max-files and older than --max-days, archives are newest first
+func applyRetentionRules(archives []archiveFile, manifest *archiveManifest, archiveBase string, outputFile string, config rotateConfig) []string {
+
+	pruned := make([]string, 0)
+
+	// What logrotate left behind counts as well, as the oldest archives it is the first to be deleted
+	archives = slices.Concat(archives, findForeignArchives(archiveBase))
+
+	// Archives still waiting for their upload stay until the remote has them, whatever the rules say.
+	// Numbered archives newer than one of them stay as well, discovery stops at the first missing number.
+	keepBelow := 0
+	pending := func(archive archiveFile) bool {
+		record := manifest.get(archive)
+		return config.uploader != nil && archive.foreign == "" && record != nil && record.uploadPending()
+	}
+	for _, archive := range archives {
+		if archive.date == "" && pending(archive) {
+			keepBelow = max(keepBelow, archive.index)
+		}
+	}
+	uploadPending := func(archive archiveFile) bool {
+		if pending(archive) {
+			logRotation(config.rotationID, "Keeping %s, it was not uploaded yet", archive.getPath())
+			return true
+		}
+		if archive.foreign == "" && archive.date == "" && archive.index < keepBelow {
+			logRotation(config.rotationID, "Keeping %s, an older archive was not uploaded yet", archive.getPath())
+			return true
+		}
+		return false
+	}
+
+	// Apply max files rule
+	if config.maxFiles >= 0 {
+		logRotation(config.rotationID, "Limit max number of archives to %d", config.maxFiles)
+		for i, archive := range archives {
+			if i >= config.maxFiles && !uploadPending(archive) {
+
+				// Its okay if remove fails here
+				if err := removeArchiveFile(archiveBase, archive.getPath()); err != nil {
+					logRotation(config.rotationID, "Failed to delete %s", archive.getPath())
+					reportFailure(config, "prune", outputFile, archive.getPath(), err)
+					continue
+				}
+				audit(config.rotationID, "delete", archive.getPath(), "")
+				pruned = append(pruned, archive.getPath())
+			}
+		}
+	}
+
+	// Apply file age rule
+	if config.maxAgeDays >= 0 {
+		logRotation(config.rotationID, "Limit max number of archives to %d days", config.maxAgeDays)
+
+		today := time.Now()
+
+		for _, archive := range archives {
+			created, err := archiveCreated(archive, manifest)
+			if err != nil {
+				logRotation(config.rotationID, "Failed to stat %s", archive.getPath())
+				continue
+			}
+			fileAge := int(math.Floor(today.Sub(created).Hours() / 24))
+			if fileAge >= config.maxAgeDays && !uploadPending(archive) {
+
+				// Its okay if remove fails here
+				logRotation(config.rotationID, "Removing file %s because of age %d days is larger than %d days",
+					archive.getPath(), fileAge, config.maxAgeDays)
+				if err := removeArchiveFile(archiveBase, archive.getPath()); err != nil {
+					logRotation(config.rotationID, "Failed to delete %s", archive.getPath())
+					reportFailure(config, "prune", outputFile, archive.getPath(), err)
+					continue
+				}
+				audit(config.rotationID, "delete", archive.getPath(), "")
+				pruned = append(pruned, archive.getPath())
+			}
+		}
+	}
+	return pruned
+}
+
+// The modification time of an archive is set by the file server with its own clock,
+// on a network file system the time rotee recorded at rotation is more reliable.
+func archiveCreated(archive archiveFile, manifest *archiveManifest) (time.Time, error) {
+	if networkFS {
+		if record := manifest.get(archive); record != nil && !record.Rotated.IsZero() {
+			return record.Rotated, nil
+		}
+	}
+	stat, err := statFile(archive.getPath())
+	if err != nil {
+		return time.Time{}, err
+	}
+	return stat.ModTime(), nil
+}
+
+// Temporary files of rotations that failed half way hold the data that was
+// rotated out. Only delete them when the user asked for it.
+func pruneOrphans(archiveBase string, config rotateConfig, minAge time.Duration) []string {
+
+	pruned := make([]string, 0)
+	entries, err := os.ReadDir(filepath.Dir(archiveBase))
+	if err != nil {
+		return pruned
+	}
+
+	// We hold the rotate lock, so none of these belongs to a running rotation
+	tempPattern := regexp.MustCompile("^" + regexp.QuoteMeta(filepath.Base(archiveBase)) + `\.tmp\.[0-9]+$`)
+	for _, entry := range entries {
+		if !tempPattern.MatchString(entry.Name()) || !entry.Type().IsRegular() {
+			continue
+		}
+		orphan := filepath.Join(filepath.Dir(archiveBase), entry.Name())
+		if stat, err := os.Stat(orphan); err != nil || time.Since(stat.ModTime()) < minAge {
+			continue
+		}
+		logRotation(config.rotationID, "Removing leftover temporary file %s", orphan)
+		if err := removeFile(orphan); err != nil {
+			logRotation(config.rotationID, "Failed to delete %s", orphan)
+			reportFailure(config, "prune", archiveBase, orphan, err)
+			continue
+		}
+		audit(config.rotationID, "delete", orphan, "")
+		pruned = append(pruned, orphan)
+	}
+	return pruned
+}
+
+// Without this a rotation that fails while rotee keeps running leaks its
+// temporary file until the next restart.
+func collectOrphans(wg *sync.WaitGroup, outputFile string, maxAgeSeconds float64, policy string, config rotateConfig) {
+
+	maxAge := time.Millisecond * time.Duration(maxAgeSeconds*1000)
+	logActivity("Looking for temporary files older than %f seconds every %f seconds", maxAgeSeconds, maxAgeSeconds)
+	for {
+
+		// Wait time before looking again, so an orphan is handled at most twice the age after it was left
+		time.Sleep(maxAge)
+
+		// Start work, tell wait group that we are busy and cant exit.
+		wg.Add(1)
+
+		// Nothing is rotating while we hold the lock, so every temporary file is an orphan
+		config.state.rotateLock.Lock()
+		if resolvedOutputFile, err := resolveOutputFile(outputFile, config); err == nil {
+			if policy == orphanPolicyDelete {
+				pruneOrphans(makeArchiveBase(resolvedOutputFile, config), config, maxAge)
+			} else {
+				recoverInterruptedRotations(resolvedOutputFile, config, maxAge)
+			}
+		}
+		config.state.rotateLock.Unlock()
+
+		// Tell the wait group that we could exit here while we are asleep.
+		wg.Done()
+	}
+}
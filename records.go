@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+)
+
+// How the input is split up. Lines end with a newline, binary records like protobuf
+// messages start with their length, either as 4 byte big endian or as a varint like
+// writeDelimitedTo of protobuf writes them. Records go to the output file with their
+// length in front as they came, a rotation never ends up within one.
+const (
+	framingLines    string = "lines"
+	framingLength32 string = "length32"
+	framingVarint   string = "varint"
+)
+
+func parseFraming(framing string) (string, error) {
+	switch framing {
+	case framingLines, framingLength32, framingVarint:
+		return framing, nil
+	}
+	return "", errors.New("Unknown framing " + framing + ", use lines, length32 or varint")
+}
+
+// The length in front of the next record and the bytes it took, exactly as they were read
+func readRecordLength(reader *bufio.Reader, framing string) (uint64, []byte, error) {
+
+	if framing == framingLength32 {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return 0, nil, err
+		}
+		return uint64(binary.BigEndian.Uint32(header)), header, nil
+	}
+
+	header := make([]byte, 0, binary.MaxVarintLen64)
+	for len(header) < binary.MaxVarintLen64 {
+		next, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		header = append(header, next)
+		if next < 0x80 {
+			length, _ := binary.Uvarint(header)
+			return length, header, nil
+		}
+	}
+	return 0, nil, errors.New("record length is not a valid varint")
+}
+
+// Whether the next record is complete in the buffer of the reader
+func recordBuffered(reader *bufio.Reader, framing string) bool {
+
+	buffered, _ := reader.Peek(reader.Buffered())
+	length, header := uint64(0), 0
+	if framing == framingLength32 {
+		if len(buffered) < 4 {
+			return false
+		}
+		length, header = uint64(binary.BigEndian.Uint32(buffered)), 4
+	} else if length, header = binary.Uvarint(buffered); header <= 0 {
+		return false
+	}
+	return uint64(len(buffered)-header) >= length
+}
+
+// Like the line loop of readLines, but a chunk always holds whole records. A record that is
+// cut off by the end of the input is left out like a last line without delimiter. A length beyond
+// the limit means the input is not framed like we think, reading stops there.
+func readRecords(reader *bufio.Reader, send func(chunk *lineChunk), options readOptions) {
+
+	chunk := newLineChunk()
+	for {
+		length, header, err := readRecordLength(reader, options.recordFraming)
+		if err == nil && length > uint64(options.maxRecordBytes) {
+			logActivity("Record of %d bytes is larger than %d bytes, the input is not framed as %s. Stopped reading",
+				length, options.maxRecordBytes, options.recordFraming)
+			err = errors.New("record too large")
+		}
+		recordStart := len(chunk.data)
+		if err == nil {
+			chunk.data = slices.Grow(chunk.data, len(header)+int(length))
+			chunk.data = append(chunk.data, header...)
+			body := len(chunk.data)
+			chunk.data = chunk.data[:body+int(length)]
+			_, err = io.ReadFull(reader, chunk.data[body:])
+		}
+
+		if err != nil {
+			chunk.data = chunk.data[:recordStart]
+			if len(chunk.data) > 0 {
+				send(chunk)
+			} else {
+				chunk.release()
+			}
+			return
+		}
+
+		// Hand over once the chunk is full or the next record is not there yet,
+		// a producer that writes a record in pieces must not hold back the ones before it
+		if len(chunk.data) >= lineChunkSize || !recordBuffered(reader, options.recordFraming) {
+			send(chunk)
+			chunk = newLineChunk()
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A crash during rotation can leave the rotated out data in a .tmp file,
+// the archives moved up with a hole where the new archive should be and a
+// partially written archive. Finish those rotations before doing anything else.
+// While running this needs the rotate lock, .tmp and partial files younger than minAge are left alone then.
+func recoverInterruptedRotations(outputFile string, config rotateConfig, minAge time.Duration) {
+
+	archiveBase := makeArchiveBase(outputFile, config)
+	entries, err := os.ReadDir(filepath.Dir(archiveBase))
+	if err != nil {
+		logActivity("Can not look for interrupted rotations in %s. Error: %s", filepath.Dir(archiveBase), err)
+		return
+	}
+
+	archivePattern := regexp.MustCompile("^" + regexp.QuoteMeta(filepath.Base(archiveBase)) +
+		`\.([0-9]+)` + archiveExtensionPattern() + "$")
+	tempPattern := regexp.MustCompile("^" + regexp.QuoteMeta(filepath.Base(archiveBase)) + `\.tmp\.([0-9]+)$`)
+
+	// Only partial archives and bundles of this output file, not those of another one with the same prefix
+	partialPattern := regexp.MustCompile("^" + regexp.QuoteMeta(filepath.Base(archiveBase)) +
+		`\.((([0-9]{4}-[0-9]{2}-[0-9]{2}\.)?[0-9]+` + archiveExtensionPattern() + `)|[0-9]{4}-[0-9]{2}\.tar\.zst)` +
+		regexp.QuoteMeta(partialArchiveSuffix) + "$")
+
+	archives := make([]archiveFile, 0)
+	tempIndexes := make([]int, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(filepath.Dir(archiveBase), name)
+
+		// Partial archives are useless, the data is still in the .tmp file
+		if partialPattern.MatchString(name) {
+			if stat, err := os.Stat(path); err != nil || time.Since(stat.ModTime()) < minAge {
+				continue
+			}
+			logActivity("Removing partial archive %s", path)
+			if err := removeFile(path); err == nil {
+				audit("", "delete", path, "")
+			}
+			continue
+		}
+
+		if match := archivePattern.FindStringSubmatch(name); match != nil {
+			index, _ := strconv.Atoi(match[1])
+			archives = append(archives, archiveFile{name: archiveBase, index: index, extension: match[2]})
+		} else if match := tempPattern.FindStringSubmatch(name); match != nil {
+			if stat, err := os.Stat(path); err != nil || time.Since(stat.ModTime()) < minAge {
+				continue
+			}
+			index, _ := strconv.Atoi(match[1])
+			tempIndexes = append(tempIndexes, index)
+		}
+	}
+
+	if len(tempIndexes) == 0 {
+		return
+	}
+
+	// Oldest rotation first, it has the lowest temporary index
+	sort.Ints(tempIndexes)
+	sort.Slice(archives, func(i, j int) bool { return archives[i].index < archives[j].index })
+
+	datedArchives := findDatedArchives(archiveBase)
+	manifest := loadManifest(archiveBase, append(append([]archiveFile{}, archives...), datedArchives...))
+	defer func() {
+		if err := manifest.save(); err != nil {
+			logActivity("Failed to write manifest for %s. Error: %s", archiveBase, err)
+		}
+	}()
+
+	for _, tempIndex := range tempIndexes {
+		tempOutputFile := archiveBase + ".tmp." + strconv.Itoa(tempIndex)
+		logActivity("Finishing interrupted rotation of %s", tempOutputFile)
+
+		// Archives might have been moved up only partially, put them back into
+		// a gapless order starting at 2. Moving up goes from the top, down from the bottom.
+		// Dated archives are never moved, so there is nothing to repair then.
+		for i := len(archives) - 1; i >= 0 && config.archiveNaming != archiveNamingDate; i-- {
+			if archives[i].index < i+2 {
+				if !moveRecoveredArchive(&archives[i], i+2, manifest) {
+					return
+				}
+			}
+		}
+		for i := 0; i < len(archives) && config.archiveNaming != archiveNamingDate; i++ {
+			if archives[i].index > i+2 {
+				if !moveRecoveredArchive(&archives[i], i+2, manifest) {
+					return
+				}
+			}
+		}
+
+		// If we crashed right after the archive was created this archives the data twice,
+		// we can not tell for sure and losing it would be worse.
+		record := archiveRecord{}
+		if stat, err := os.Stat(tempOutputFile); err == nil {
+			record.Rotated = stat.ModTime()
+		}
+		newArchive := archiveFile{name: archiveBase, index: 1, extension: config.archiveExtension()}
+		if config.archiveNaming == archiveNamingDate {
+			newArchive = nextDatedArchive(archiveBase, record.Rotated.In(config.location), config.archiveExtension(), datedArchives)
+		}
+		if err := createArchive(tempOutputFile, newArchive, config); err != nil {
+			logActivity("Can not create archive from %s. Error: %s", tempOutputFile, err)
+			return
+		}
+		if config.archiveReadonly {
+			if err := makeReadonly(newArchive.getPath()); err != nil {
+				logActivity("Failed to make %s read-only. Error: %s", newArchive.getPath(), err)
+			}
+		}
+		record.Index, record.Date, record.Extension = newArchive.index, newArchive.date, newArchive.extension
+		if config.uploader != nil {
+			record.UploadName = makeRemoteArchiveName(newArchive, record.Rotated)
+		}
+		manifest.add(record)
+		if newArchive.date != "" {
+			datedArchives = prepend(datedArchives, newArchive)
+		} else {
+			archives = prepend(archives, newArchive)
+		}
+
+		if err := removeFile(tempOutputFile); err == nil {
+			audit("", "delete", tempOutputFile, "")
+		}
+	}
+}
+
+func moveRecoveredArchive(archive *archiveFile, index int, manifest *archiveManifest) bool {
+
+	target := makeArchivePath(archive.name, index, archive.extension)
+	if err := renameFile(archive.getPath(), target); err != nil {
+		logActivity("Can not move %s to %s. Error: %s", archive.getPath(), target, err)
+		return false
+	}
+	audit("", "rename", archive.getPath(), target)
+	manifest.move(archive.index, index)
+	archive.index = index
+	return true
+}
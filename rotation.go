@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+)
+
+var errRotationRateLimited = errors.New("too many rotations in the last hour")
+
+// With --no-create the output file only exists once something was written after the last rotation,
+// with --skip-empty an empty one is left alone
+var errNothingToRotate = errors.New("output file does not exist, nothing to rotate")
+
+const crockfordAlphabet string = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Every rotation gets a ULID, this way the activity log, scripts, webhooks
+// and the manifest can be matched up. ULIDs sort by time which is handy in log search.
+func newRotationID() string {
+
+	// 48 bit millisecond timestamp followed by 80 random bits
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[0:8], uint64(time.Now().UnixMilli())<<16)
+	if _, err := rand.Read(id[6:]); err != nil {
+		logActivity("Failed to generate random rotation id. Error: %s", err)
+	}
+
+	// Encode all 128 bits in 26 characters of crockford base32, 5 bits at a time from the end
+	hi := binary.BigEndian.Uint64(id[0:8])
+	lo := binary.BigEndian.Uint64(id[8:16])
+	encoded := make([]byte, 26)
+	for i := len(encoded) - 1; i >= 0; i-- {
+		encoded[i] = crockfordAlphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(encoded)
+}
+
+func logRotation(rotationID string, message string, v ...any) {
+	if rotationID == "" {
+		logActivity(message, v...)
+		return
+	}
+	logActivity("["+rotationID+"] "+message, v...)
+}
+
+// Check the rotation rate limit and count this rotation if it may go ahead.
+// Must be called with rotateLock held.
+func (state *pipelineState) allowRotation(maxRotationsPerHour int, now time.Time) bool {
+
+	if maxRotationsPerHour < 0 {
+		return true
+	}
+
+	// Forget everything that left the one hour window
+	kept := state.recentRotations[:0]
+	for _, rotatedAt := range state.recentRotations {
+		if now.Sub(rotatedAt) < time.Hour {
+			kept = append(kept, rotatedAt)
+		}
+	}
+	state.recentRotations = kept
+
+	if len(state.recentRotations) >= maxRotationsPerHour {
+		return false
+	}
+	state.recentRotations = append(state.recentRotations, now)
+	return true
+}
+
+// Triggers, timers and the size check do not rotate themselves, they queue a
+// request for the single rotation goroutine of the pipeline and wait for its result.
+type rotationRequest struct {
+	rotationID string
+	done       chan rotationResult
+}
+
+// The archive is empty unless the rotation created one.
+// Coalesced requests were served by a rotation an earlier request asked for.
+type rotationResult struct {
+	archive   string
+	err       error
+	coalesced bool
+}
+
+// Requests beyond this wait for a free slot, by then they coalesce anyway
+const rotationQueueSize int = 16
+
+func newPipelineState() *pipelineState {
+	state := &pipelineState{rotationQueue: make(chan rotationRequest, rotationQueueSize), writerStalled: make(chan struct{}),
+		writerRequests: make(chan writerRequest), drain: make(chan struct{}), shipWake: make(chan struct{}, 1),
+		mirrorPins: make(map[string]pinnedArchive)}
+	state.lastRotationTime.Store(time.Now().UnixNano())
+	state.lastWriteTime.Store(time.Now().UnixNano())
+	return state
+}
+
+// A wake up that is already pending covers this one as well
+func (state *pipelineState) wakeShipping() {
+	select {
+	case state.shipWake <- struct{}{}:
+	default:
+	}
+}
+
+// Time since the last successful rotation or since rotee started
+func (state *pipelineState) timeSinceRotation() time.Duration {
+	return time.Since(time.Unix(0, state.lastRotationTime.Load()))
+}
+
+// Time since input last arrived or since rotee started
+func (state *pipelineState) timeSinceWrite() time.Duration {
+	return time.Since(time.Unix(0, state.lastWriteTime.Load()))
+}
+
+// Number of rotation requests waiting for the rotation goroutine
+func (state *pipelineState) rotationQueueDepth() int64 {
+	return state.queuedRotations.Load()
+}
+
+// Ask for a rotation and wait until one that started after this call is done
+func requestRotation(config rotateConfig) error {
+	return requestRotationResult(config).err
+}
+
+// Same as requestRotation, but also tells which archive the rotation created
+func requestRotationResult(config rotateConfig) rotationResult {
+
+	request := rotationRequest{rotationID: config.rotationID, done: make(chan rotationResult, 1)}
+	depth := config.state.queuedRotations.Add(1)
+	logRotation(config.rotationID, "Queueing rotation, %d requests waiting", depth)
+	config.state.rotationQueue <- request
+	return <-request.done
+}
+
+func rotationWorker(outputFile string, config rotateConfig) {
+
+	for request := range config.state.rotationQueue {
+
+		// Everything that queued up while the last rotation ran is served by
+		// the next one, rotating the same data twice in a row gains nothing.
+		waiting := []rotationRequest{request}
+	drain:
+		for {
+			select {
+			case next := <-config.state.rotationQueue:
+				waiting = append(waiting, next)
+			default:
+				break drain
+			}
+		}
+		config.state.queuedRotations.Add(-int64(len(waiting)))
+		for _, coalesced := range waiting[1:] {
+			logRotation(coalesced.rotationID, "Coalesced into rotation %s", request.rotationID)
+		}
+		logRotation(request.rotationID, "Rotating for %d requests, %d waiting for the next rotation",
+			len(waiting), config.state.rotationQueueDepth())
+
+		config.rotationID = request.rotationID
+		config.state.rotatedArchive = ""
+		err := rotateFile(outputFile, config)
+		if err == nil {
+			config.state.lastRotationTime.Store(time.Now().UnixNano())
+		}
+		for i, finished := range waiting {
+			finished.done <- rotationResult{archive: config.state.rotatedArchive, err: err, coalesced: i > 0}
+		}
+	}
+}
+
+// Time spent in each phase of a rotation, so a slow rotation can tell what made it slow
+type rotationPhases struct {
+	started   time.Time
+	lastMark  time.Time
+	names     []string
+	durations map[string]time.Duration
+}
+
+func newRotationPhases() *rotationPhases {
+	now := time.Now()
+	return &rotationPhases{started: now, lastMark: now, durations: make(map[string]time.Duration)}
+}
+
+// Everything since the last mark belongs to this phase, phases that come up twice add up
+func (phases *rotationPhases) mark(name string) {
+	now := time.Now()
+	if _, found := phases.durations[name]; !found {
+		phases.names = append(phases.names, name)
+	}
+	phases.durations[name] += now.Sub(phases.lastMark)
+	phases.lastMark = now
+}
+
+// Like "rename 1ms, hooks 2.5s, compress 800ms"
+func (phases *rotationPhases) String() string {
+	parts := make([]string, len(phases.names))
+	for i, name := range phases.names {
+		parts[i] = name + " " + phases.durations[name].Round(time.Millisecond).String()
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (phases *rotationPhases) warnIfSlow(rotationID string, threshold time.Duration) {
+	if total := time.Since(phases.started); threshold > 0 && total > threshold {
+		logRotation(rotationID, "Warning: rotation took %s, more than the threshold of %s. Breakdown: %s",
+			total.Round(time.Millisecond), threshold, phases)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Lines matching the pattern go to their own output file instead of the main one
+type outputRoute struct {
+	pattern    *regexp.Regexp
+	outputFile string
+	config     rotateConfig
+	data       chan *lineChunk
+}
+
+// A route from --route or --routes-file. Settings that are not given are the same as for the main output file.
+type routeDefinition struct {
+	Pattern string `json:"pattern"`
+	Output  string `json:"output"`
+
+	// Compression format of the archives, none for uncompressed
+	Compression *string `json:"compression"`
+
+	// Retention rules like -n and -d
+	MaxFiles *int `json:"max_files"`
+	MaxDays  *int `json:"max_days"`
+}
+
+type routeFile struct {
+	Routes []routeDefinition `json:"routes"`
+}
+
+// Routes are given like 'ERROR|WARN=>errors.log', the pattern may contain => itself
+func parseRoute(text string) (routeDefinition, error) {
+	index := strings.LastIndex(text, "=>")
+	if index < 0 {
+		return routeDefinition{}, errors.New("invalid route " + text + ", use pattern=>file")
+	}
+	return routeDefinition{Pattern: text[:index], Output: strings.TrimSpace(text[index+2:])}, nil
+}
+
+func loadRouteFile(path string) ([]routeDefinition, error) {
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var definitions routeFile
+	if err := json.Unmarshal(content, &definitions); err != nil {
+		return nil, err
+	}
+	return definitions.Routes, nil
+}
+
+func newOutputRoute(definition routeDefinition, config rotateConfig) (*outputRoute, error) {
+
+	if definition.Output == "" {
+		return nil, fmt.Errorf("route %s has no output file", definition.Pattern)
+	}
+	pattern, err := regexp.Compile(definition.Pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	routeConfig := newRouteConfig(config)
+	routeConfig.outputTemplate = isOutputTemplate(definition.Output)
+	if routeConfig.outputTemplate {
+		if err := parseOutputTemplate(definition.Output); err != nil {
+			return nil, err
+		}
+		routeConfig.state.templatedOutputFile.Store(renderOutputTemplate(definition.Output, time.Now().In(config.location)))
+	}
+	if definition.Compression != nil {
+		routeConfig.compression = nil
+		if *definition.Compression != "" && *definition.Compression != "none" {
+			if routeConfig.compression, err = findCompressionFormat(*definition.Compression); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if definition.MaxFiles != nil {
+		routeConfig.maxFiles = *definition.MaxFiles
+	}
+	if definition.MaxDays != nil {
+		routeConfig.maxAgeDays = *definition.MaxDays
+	}
+	return &outputRoute{pattern: pattern, outputFile: definition.Output, config: routeConfig,
+		data: make(chan *lineChunk, lineChunkQueueSize)}, nil
+}
+
+// A routed output rotates by the same rules as the main one but keeps its own state.
+// Everything that looks at the data or the input happened before routing.
+func newRouteConfig(config rotateConfig) rotateConfig {
+	routeConfig := config
+	routeConfig.state = newPipelineState()
+	routeConfig.echo = nil
+	routeConfig.sinks = nil
+	routeConfig.filters = nil
+	routeConfig.routes = nil
+	routeConfig.read = readOptions{}
+	routeConfig.heartbeatInterval = 0
+	routeConfig.exitAfterIdle = 0
+	routeConfig.stallFallback = ""
+	routeConfig.currentSymlink = ""
+	return routeConfig
+}
+
+// Splits the data of the main writer line by line, the first route that matches takes
+// the line. What no route wants is returned for the main output file.
+type lineRouter struct {
+	routes []*outputRoute
+	main   []byte
+
+	// Where the rest of a line that did not fit into the last chunk goes, -1 for the main output
+	midLine    bool
+	continuing int
+}
+
+func newLineRouter(routes []*outputRoute) *lineRouter {
+	return &lineRouter{routes: routes}
+}
+
+func (router *lineRouter) route(data []byte) []byte {
+
+	router.main = router.main[:0]
+	chunks := make([]*lineChunk, len(router.routes))
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+		line := data[:end]
+		data = data[end:]
+
+		// A line split into pieces stays together
+		destination := router.continuing
+		if !router.midLine {
+			destination = -1
+			for i, route := range router.routes {
+				if route.pattern.Match(line) {
+					destination = i
+					break
+				}
+			}
+		}
+		router.midLine = line[len(line)-1] != '\n'
+		router.continuing = destination
+
+		if destination < 0 {
+			router.main = append(router.main, line...)
+			continue
+		}
+		if chunks[destination] == nil {
+			chunks[destination] = newLineChunk()
+		}
+		chunks[destination].data = append(chunks[destination].data, line...)
+	}
+
+	for i, chunk := range chunks {
+		if chunk != nil {
+			router.routes[i].data <- chunk
+		}
+	}
+	return router.main
+}
+
+func (router *lineRouter) close() {
+	for _, route := range router.routes {
+		close(route.data)
+	}
+}
@@ -0,0 +1,72 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Resolve a user or group given by name or numeric id
+func lookupScriptCredentials(userName string, groupName string) (*scriptCredentials, error) {
+
+	if userName == "" && groupName == "" {
+		return nil, nil
+	}
+
+	credentials := &scriptCredentials{}
+
+	if userName != "" {
+		account, err := user.Lookup(userName)
+		if err != nil {
+			if account, err = user.LookupId(userName); err != nil {
+				return nil, fmt.Errorf("unknown user %s", userName)
+			}
+		}
+		uid, err := strconv.ParseUint(account.Uid, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		gid, err := strconv.ParseUint(account.Gid, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		credentials.uid = uint32(uid)
+		credentials.gid = uint32(gid)
+	} else {
+
+		// Only the group changes, keep running as ourselves
+		credentials.uid = uint32(syscall.Getuid())
+	}
+
+	if groupName != "" {
+		group, err := user.LookupGroup(groupName)
+		if err != nil {
+			if group, err = user.LookupGroupId(groupName); err != nil {
+				return nil, fmt.Errorf("unknown group %s", groupName)
+			}
+		}
+		gid, err := strconv.ParseUint(group.Gid, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		credentials.gid = uint32(gid)
+	}
+
+	return credentials, nil
+}
+
+func (credentials *scriptCredentials) apply(process *exec.Cmd) {
+
+	if credentials == nil {
+		return
+	}
+
+	// Drop supplementary groups as well, otherwise the script keeps root's groups
+	process.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: credentials.uid, Gid: credentials.gid, Groups: []uint32{}},
+	}
+}
@@ -0,0 +1,19 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func lookupScriptCredentials(userName string, groupName string) (*scriptCredentials, error) {
+
+	if userName == "" && groupName == "" {
+		return nil, nil
+	}
+	return nil, errors.New("running scripts as a different user is not supported on windows")
+}
+
+func (credentials *scriptCredentials) apply(process *exec.Cmd) {
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+// Open files never stop renames or deletes outside of windows
+func isSharingViolation(err error) bool {
+	return false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/akamensky/argparse"
+)
+
+// The archives to show, a day without a counter means all archives of that day, oldest first
+func selectArchives(archives []archiveFile, index int, date string) []archiveFile {
+
+	selected := make([]archiveFile, 0)
+	for _, archive := range archives {
+		if archive.date == date && (index == 0 || archive.index == index) {
+			selected = append(selected, archive)
+		}
+	}
+	slices.SortFunc(selected, func(a archiveFile, b archiveFile) int { return a.index - b.index })
+	return selected
+}
+
+func runShowCommand(args []string) {
+
+	parser := argparse.NewParser("rotee show",
+		"Print the content of an archive of an output file to stdout, decompressed whatever its format")
+	outputFile := parser.String("o", "output-file",
+		&argparse.Options{Required: true, Help: "Output file whose archive should be shown."})
+	archiveDir := parser.String("", "archive-dir",
+		&argparse.Options{Required: false, Help: "Directory the archives are kept in, if not next to the output file."})
+	index := parser.Int("", "index",
+		&argparse.Options{Required: false, Help: "Number of the archive, 1 is the newest. With --date the counter within that day", Default: 0})
+	date := parser.String("", "date",
+		&argparse.Options{Required: false, Help: "Day of a dated archive like 2024-06-01, all archives of the day without --index"})
+	zstdDictionary := parser.String("", "zstd-dictionary",
+		&argparse.Options{Required: false, Help: "Dictionary the zstd archives were compressed with, if not the one next to them"})
+
+	if err := parser.Parse(args); err != nil {
+		fmt.Print(parser.Usage(err))
+		os.Exit(exitConfigError)
+	}
+
+	if *index < 0 || (*index == 0 && *date == "") {
+		exitf(exitConfigError, "Use --index, --date or both to choose an archive")
+	}
+	if *date != "" {
+		if _, err := time.Parse(archiveDateLayout, *date); err != nil {
+			exitf(exitConfigError, "Could not parse date %s, use a day like 2024-06-01", *date)
+		}
+	}
+
+	archiveBase := makeArchiveBase(*outputFile, rotateConfig{archiveDir: *archiveDir})
+	archives := selectArchives(findAllArchives(archiveBase), *index, *date)
+	if len(archives) == 0 {
+		exitf(exitInputError, "No such archive of %s", *outputFile)
+	}
+
+	options := compressionOptions{zstdDictionary: *zstdDictionary}
+	for _, archive := range archives {
+		reader, err := openArchive(archive, options)
+		if err != nil {
+			exitf(exitInputError, "Can not open %s: %s", archive.getPath(), err)
+		}
+		_, err = io.Copy(os.Stdout, reader)
+		reader.Close()
+		if err != nil {
+			exitf(exitInputError, "Can not read %s: %s", archive.getPath(), err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// Somewhere besides the output file and stdout that gets every line written to the output file
+type lineOutput interface {
+
+	// Lines come without their newline and are only valid during the call
+	sendLines(lines [][]byte)
+
+	// Everything buffered was handed to sendLines
+	close()
+}
+
+// Every sink gets its own buffer, like stdout, so a slow or unreachable one
+// only loses its own lines and never holds up the output file, unless asked to.
+type lineSink struct {
+	echo   *echoWriter
+	output lineOutput
+}
+
+func newLineSink(name string, output lineOutput, bufferSize int, policy string) *lineSink {
+	return &lineSink{echo: newEchoWriter(name, &lineWriter{output: output}, bufferSize, policy, echoErrorIgnore), output: output}
+}
+
+func (sink *lineSink) write(text string) {
+	sink.echo.write(text)
+}
+
+func (sink *lineSink) close() {
+	sink.echo.close()
+	sink.output.close()
+}
+
+// The echo goroutine writes in pieces that do not end on line boundaries
+type lineWriter struct {
+	output  lineOutput
+	partial []byte
+}
+
+func (writer *lineWriter) Write(data []byte) (int, error) {
+
+	text := append(writer.partial, data...)
+	lines := make([][]byte, 0)
+	for {
+		end := bytes.IndexByte(text, '\n')
+		if end < 0 {
+			break
+		}
+		lines = append(lines, text[:end])
+		text = text[end+1:]
+	}
+	if len(lines) > 0 {
+		writer.output.sendLines(lines)
+	}
+
+	// The input only ever ends with whole lines, so nothing is left here in the end
+	writer.partial = append([]byte(nil), text...)
+	return len(data), nil
+}
+
+// Sinks that send over the network try a few times before they give up on a batch
+const sinkRetries int = 5
+const sinkRetryDelay time.Duration = 100 * time.Millisecond
+
+// The receiver will answer the same way again, retrying gains nothing
+type permanentSinkError struct {
+	error
+}
+
+func sendWithRetries(send func() error) error {
+	delay := sinkRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := send()
+		var permanent permanentSinkError
+		if err == nil || attempt == sinkRetries || errors.As(err, &permanent) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Log when a sink stops working and how much it lost once it works again,
+// not every single batch in between
+type sinkFailures struct {
+	name string
+	lost int
+}
+
+func (failures *sinkFailures) failed(err error, lines int) {
+	if failures.lost == 0 {
+		logActivity("Failed to send lines to %s, dropping them until it works again. Error: %s", failures.name, err)
+	}
+	failures.lost += lines
+}
+
+func (failures *sinkFailures) succeeded() {
+	if failures.lost > 0 {
+		logActivity("Sending lines to %s works again, lost %d lines", failures.name, failures.lost)
+		failures.lost = 0
+	}
+}
+
+func (failures *sinkFailures) close() {
+	if failures.lost > 0 {
+		logActivity("Failed to send the last %d lines to %s", failures.lost, failures.name)
+	}
+}
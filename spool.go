@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// Chunks the writer could not take yet, in a file next to the output file.
+// Every chunk is stored with its length in front so it comes back exactly as it went in.
+type chunkSpool struct {
+	path     string
+	file     *os.File
+	readAt   int64
+	writeAt  int64
+	maxBytes int64
+	spilled  int
+}
+
+func (spool *chunkSpool) empty() bool {
+	return spool.readAt == spool.writeAt
+}
+
+func (spool *chunkSpool) full() bool {
+	return spool.maxBytes > 0 && spool.writeAt >= spool.maxBytes
+}
+
+func (spool *chunkSpool) push(chunk *lineChunk) error {
+
+	if spool.file == nil {
+		file, err := os.OpenFile(spool.path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		spool.file = file
+	}
+	if spool.empty() {
+		logActivity("Writer can not keep up, spilling input to %s", spool.path)
+	}
+
+	record := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(chunk.data)), uint32(len(chunk.data)))
+	record = append(record, chunk.data...)
+	if _, err := spool.file.WriteAt(record, spool.writeAt); err != nil {
+		return err
+	}
+	spool.writeAt += int64(len(record))
+	spool.spilled++
+	chunk.release()
+	return nil
+}
+
+// The oldest chunk in the spool, it stays there until pop
+func (spool *chunkSpool) peek() (*lineChunk, error) {
+
+	var length [4]byte
+	if _, err := spool.file.ReadAt(length[:], spool.readAt); err != nil {
+		return nil, err
+	}
+	chunk := newLineChunk()
+	chunk.data = append(chunk.data, make([]byte, binary.BigEndian.Uint32(length[:]))...)
+	if _, err := spool.file.ReadAt(chunk.data, spool.readAt+4); err != nil && err != io.EOF {
+		chunk.release()
+		return nil, err
+	}
+	return chunk, nil
+}
+
+// Drop the oldest chunk, size is what it took up in the spool.
+// The chunk itself may already be reused by the writer, so it is not passed here.
+func (spool *chunkSpool) pop(size int64) {
+
+	spool.readAt += size
+
+	// Start over at the beginning once everything is out, so the file does not grow forever
+	if spool.empty() {
+		logActivity("Writer caught up, %d chunks went through %s", spool.spilled, spool.path)
+		spool.readAt, spool.writeAt, spool.spilled = 0, 0, 0
+		if err := spool.file.Truncate(0); err != nil {
+			logActivity("Failed to truncate %s. Error: %s", spool.path, err)
+		}
+	}
+}
+
+func (spool *chunkSpool) close() {
+	if spool.file != nil {
+		spool.file.Close()
+		os.Remove(spool.path)
+	}
+}
+
+// Sits between reader and writer. While the writer keeps up chunks pass straight through,
+// once its queue is full they go to the spool and come back in order. Only a full spool
+// holds up the reader again.
+func spoolChunks(input chan *lineChunk, output chan *lineChunk, path string, maxBytes int64) {
+
+	defer close(output)
+	spool := &chunkSpool{path: path, maxBytes: maxBytes}
+	defer spool.close()
+
+	// Losing the spool would lose the lines in it, there is no way to go on
+	spill := func(chunk *lineChunk) {
+		if err := spool.push(chunk); err != nil {
+			exitf(exitOutputError, "Failed to spill input to %s: %s", path, err)
+		}
+	}
+
+	inputOpen := true
+	for inputOpen || !spool.empty() {
+
+		// Nothing waits in the spool, hand over directly while there is room
+		if spool.empty() {
+			chunk, ok := <-input
+			if !ok {
+				inputOpen = false
+				continue
+			}
+			select {
+			case output <- chunk:
+			default:
+				spill(chunk)
+			}
+			continue
+		}
+
+		// Older chunks wait in the spool, new ones have to queue up behind them
+		next, err := spool.peek()
+		if err != nil {
+			exitf(exitOutputError, "Failed to read spilled input from %s: %s", path, err)
+		}
+		receive := input
+		if !inputOpen || spool.full() {
+			receive = nil
+		}
+		size := 4 + int64(len(next.data))
+		select {
+		case output <- next:
+			spool.pop(size)
+		case chunk, ok := <-receive:
+			next.release()
+			if !ok {
+				inputOpen = false
+			} else {
+				spill(chunk)
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Where to describe what an archive holds. The manifest gets the numbers with
+// manifest and footer, footer also ends the archive itself with a summary line.
+const (
+	summaryModeNone     string = "none"
+	summaryModeManifest string = "manifest"
+	summaryModeFooter   string = "footer"
+)
+
+func parseSummaryMode(mode string) (string, error) {
+	switch mode {
+	case summaryModeNone, summaryModeManifest, summaryModeFooter:
+		return mode, nil
+	}
+	return "", errors.New("Unknown summary mode " + mode + ", use none, manifest or footer")
+}
+
+func countFileLines(path string) (int64, error) {
+
+	input, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer input.Close()
+
+	var lines int64
+	buffer := make([]byte, lineChunkSize)
+	for {
+		n, err := input.Read(buffer)
+		lines += int64(bytes.Count(buffer[:n], []byte{'\n'}))
+		if err == io.EOF {
+			return lines, nil
+		} else if err != nil {
+			return lines, err
+		}
+	}
+}
+
+func formatSummaryTime(t time.Time) string {
+	if t.IsZero() {
+		return "unknown"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Append the summary line to the rotated out file before it is archived.
+// The file keeps its modification time, the archive is as old as the last real line.
+func appendSummaryFooter(path string, lines int64, size int64, firstWrite time.Time, lastWrite time.Time, rotationID string) error {
+
+	output, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	// A last line without newline must not swallow the footer
+	footer := fmt.Sprintf("-- rotee: %d lines, %d bytes, from %s to %s, rotation %s --\n",
+		lines, size, formatSummaryTime(firstWrite), formatSummaryTime(lastWrite), rotationID)
+	if size > 0 {
+		last := make([]byte, 1)
+		if _, err := output.ReadAt(last, size-1); err != nil {
+			return err
+		}
+		if last[0] != '\n' {
+			footer = "\n" + footer
+		}
+	}
+	if _, err := output.WriteString(footer); err != nil {
+		return err
+	}
+	if err := output.Close(); err != nil {
+		return err
+	}
+	if !lastWrite.IsZero() {
+		return os.Chtimes(path, lastWrite, lastWrite)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/akamensky/argparse"
+)
+
+// A destination that looks like a URL is mirrored to with the uploader --upload would use
+// for it, anything else is a local directory and gets a nil uploader
+func newSyncUploader(destination string, options uploadConfig) (archiveUploader, error) {
+
+	if !strings.Contains(destination, "://") {
+		return nil, nil
+	}
+	options.target = destination
+	return newArchiveUploader(options)
+}
+
+// Mirrors use the same time based names as uploads, taken from the manifest
+// so an archive keeps its name no matter how often it is touched
+func mirrorArchiveName(archive archiveFile, manifest *archiveManifest) (string, error) {
+
+	record := manifest.get(archive)
+	if record != nil && record.UploadName != "" {
+		return record.UploadName, nil
+	}
+	if record != nil && !record.Rotated.IsZero() {
+		return makeRemoteArchiveName(archive, record.Rotated), nil
+	}
+	stat, err := os.Stat(archive.getPath())
+	if err != nil {
+		return "", err
+	}
+	return makeRemoteArchiveName(archive, stat.ModTime()), nil
+}
+
+// The archives for the mirror with their names, pinned if rotations go on meanwhile
+func pinMirrorArchives(archives []archiveFile, archiveBase string, manifest *archiveManifest, pin bool) []pinnedArchive {
+
+	pins := make([]pinnedArchive, 0)
+	used := make(map[string]bool)
+	for _, archive := range archives {
+
+		name, err := mirrorArchiveName(archive, manifest)
+		if err != nil {
+			logActivity("Failed to stat %s", archive.getPath())
+			continue
+		}
+
+		// Archives rotee found without a record can share their time, move the
+		// later ones on so none is skipped. The manifest keeps the new time.
+		for record := manifest.get(archive); used[name] && record != nil && record.UploadName == ""; {
+			record.Rotated = record.Rotated.Add(time.Millisecond)
+			name = makeRemoteArchiveName(archive, record.Rotated)
+		}
+		used[name] = true
+
+		path := archive.getPath()
+		if pin {
+			if path, err = pinArchive(archive, archiveBase, name, "sync"); err != nil {
+				logActivity("Failed to pin %s for syncing. Error: %s", archive.getPath(), err)
+				continue
+			}
+		}
+		pins = append(pins, pinnedArchive{archive: archive, path: path, name: name})
+	}
+	return pins
+}
+
+// Copy what the destination is missing
+func mirrorPinnedArchives(pins []pinnedArchive, destination string, uploader archiveUploader) ([]string, error) {
+
+	copied := make([]string, 0)
+
+	if uploader == nil {
+		if err := os.MkdirAll(destination, 0755); err != nil {
+			return copied, err
+		}
+	}
+
+	for _, pin := range pins {
+
+		if uploader != nil {
+			if exists, err := uploader.exists(pin.name); err != nil {
+				return copied, err
+			} else if exists {
+				continue
+			}
+			logActivity("Syncing %s to %s", pin.archive.getPath(), uploader.describe(pin.name))
+			if err := uploadArchive(uploader, pin, 0); err != nil {
+				return copied, err
+			}
+			copied = append(copied, uploader.describe(pin.name))
+			continue
+		}
+
+		target := filepath.Join(destination, pin.name)
+		if _, err := os.Stat(target); err == nil {
+			continue
+		}
+		stat, err := os.Stat(pin.path)
+		if err != nil {
+			logActivity("Failed to stat %s", pin.archive.getPath())
+			continue
+		}
+
+		// Copy to a temporary name first so an interrupted sync never
+		// leaves a truncated archive behind that we would skip next time.
+		logActivity("Syncing %s to %s", pin.archive.getPath(), target)
+		if err := copyFile(pin.path, target+".part"); err != nil {
+			os.Remove(target + ".part")
+			return copied, err
+		}
+		if err := os.Chtimes(target+".part", stat.ModTime(), stat.ModTime()); err != nil {
+			os.Remove(target + ".part")
+			return copied, err
+		}
+		if err := renameFile(target+".part", target); err != nil {
+			os.Remove(target + ".part")
+			return copied, err
+		}
+		copied = append(copied, target)
+	}
+
+	return copied, nil
+}
+
+func syncArchives(archiveBase string, destination string, uploader archiveUploader, manifest *archiveManifest) ([]string, error) {
+	return mirrorPinnedArchives(pinMirrorArchives(findAllArchives(archiveBase), archiveBase, manifest, false), destination, uploader)
+}
+
+func runSyncCommand(args []string) {
+
+	parser := argparse.NewParser("rotee sync",
+		"Mirror all archives of an output file to another directory or a remote, copying only missing archives")
+	outputFile := parser.String("o", "output-file",
+		&argparse.Options{Required: true, Help: "Output file whose archives should be mirrored."})
+	archiveDir := parser.String("", "archive-dir",
+		&argparse.Options{Required: false, Help: "Directory the archives are kept in, if not next to the output file."})
+	destination := parser.String("d", "destination",
+		&argparse.Options{Required: true, Help: "Directory to mirror the archives to, or a remote like --upload takes, " +
+			"for example s3://bucket/prefix or sftp://user@host/path. Credentials come from the environment and ~/.ssh"})
+	uploadTimeout := parser.Float("", "upload-timeout",
+		&argparse.Options{Required: false, Help: "Give up copying a single archive to a remote after this many seconds", Default: 300.0})
+
+	if err := parser.Parse(args); err != nil {
+		fmt.Print(parser.Usage(err))
+		os.Exit(exitConfigError)
+	}
+
+	if *uploadTimeout <= 0 {
+		exitf(exitConfigError, "Upload timeout must be positive")
+	}
+	uploader, err := newSyncUploader(*destination, uploadConfig{timeout: time.Millisecond * time.Duration(*uploadTimeout*1000)})
+	if err != nil {
+		exitf(exitConfigError, "Can not set up sync to %s: %s", *destination, err)
+	}
+
+	// Archives without a record get one now, so they keep their mirror name on the next run
+	archiveBase := makeArchiveBase(*outputFile, rotateConfig{archiveDir: *archiveDir})
+	manifest := loadManifest(archiveBase, findAllArchives(archiveBase))
+	copied, err := syncArchives(archiveBase, *destination, uploader, manifest)
+	if err := manifest.save(); err != nil {
+		logActivity("Failed to write manifest for %s. Error: %s", archiveBase, err)
+	}
+	for _, target := range copied {
+		fmt.Println(target)
+	}
+	if err != nil {
+		exitf(exitRotationError, "Sync failed: %s", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"time"
+)
+
+// How lines are written to the output file
+const (
+	formatRaw     string = "raw"
+	formatRFC5424 string = "rfc5424"
+)
+
+func parseOutputFormat(format string) (string, error) {
+	switch format {
+	case formatRaw, formatRFC5424:
+		return format, nil
+	}
+	return "", errors.New("Unknown format " + format + ", use raw or rfc5424")
+}
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// Header fields are printable ASCII without spaces, - stands for a missing value
+func syslogHeaderField(value string, maxLength int) string {
+	field := make([]byte, 0, len(value))
+	for i := 0; i < len(value) && len(field) < maxLength; i++ {
+		if value[i] > 32 && value[i] < 127 {
+			field = append(field, value[i])
+		}
+	}
+	if len(field) == 0 {
+		return "-"
+	}
+	return string(field)
+}
+
+// Puts an RFC 5424 header in front of every line, without message id and structured data:
+// <13>1 2024-06-01T12:00:00.000000+02:00 myhost rotee 1234 - - the line
+type syslogFormatter struct {
+	prefix      []byte
+	suffix      []byte
+	atLineStart bool
+}
+
+func newSyslogFormatter(facility string, severity string, appName string) (*syslogFormatter, error) {
+
+	facilityCode, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, errors.New("Unknown syslog facility " + facility)
+	}
+	severityCode, ok := syslogSeverities[severity]
+	if !ok {
+		return nil, errors.New("Unknown syslog severity " + severity + ", use emerg, alert, crit, err, warning, notice, info or debug")
+	}
+
+	hostname, _ := os.Hostname()
+	return &syslogFormatter{
+		prefix:      []byte("<" + strconv.Itoa(facilityCode*8+severityCode) + ">1 "),
+		suffix:      []byte(" " + syslogHeaderField(hostname, 255) + " " + syslogHeaderField(appName, 48) + " " + strconv.Itoa(os.Getpid()) + " - - "),
+		atLineStart: true,
+	}, nil
+}
+
+func (formatter *syslogFormatter) filter(dst []byte, src []byte) []byte {
+
+	// All lines of a chunk arrived at the same time
+	var timestamp []byte
+	for len(src) > 0 {
+		if formatter.atLineStart {
+			if timestamp == nil {
+				timestamp = time.Now().AppendFormat(nil, "2006-01-02T15:04:05.000000Z07:00")
+			}
+			dst = append(dst, formatter.prefix...)
+			dst = append(dst, timestamp...)
+			dst = append(dst, formatter.suffix...)
+			formatter.atLineStart = false
+		}
+
+		// A line split between chunks only gets one header
+		end := 0
+		for end < len(src) && src[end] != '\n' {
+			end++
+		}
+		if end < len(src) {
+			end++
+			formatter.atLineStart = true
+		}
+		dst = append(dst, src[:end]...)
+		src = src[end:]
+	}
+	return dst
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Output files like app-%Y-%m-%d.log are a new file whenever the rendered name changes.
+// The writer moves on with the first line after the change, the file it left is
+// compressed in place and falls under --max-files and --max-days.
+func isOutputTemplate(outputFile string) bool {
+	return strings.Contains(filepath.Base(outputFile), "%")
+}
+
+// Layout and pattern of the digits every strftime verb stands for
+var outputTemplateVerbs = map[byte]struct {
+	layout  string
+	pattern string
+}{
+	'Y': {"2006", "[0-9]{4}"},
+	'y': {"06", "[0-9]{2}"},
+	'm': {"01", "[0-9]{2}"},
+	'd': {"02", "[0-9]{2}"},
+	'j': {"002", "[0-9]{3}"},
+	'H': {"15", "[0-9]{2}"},
+	'M': {"04", "[0-9]{2}"},
+	'S': {"05", "[0-9]{2}"},
+}
+
+func parseOutputTemplate(outputFile string) error {
+
+	if strings.Contains(filepath.Dir(outputFile), "%") {
+		return errors.New("date patterns are only allowed in the name of the output file, not in its directory")
+	}
+	name := filepath.Base(outputFile)
+	for i := 0; i < len(name); i++ {
+		if name[i] != '%' {
+			continue
+		}
+		if i++; i == len(name) {
+			return errors.New("output file " + outputFile + " ends with a single %")
+		}
+		if _, ok := outputTemplateVerbs[name[i]]; !ok && name[i] != '%' {
+			return fmt.Errorf("unknown date pattern %%%c in output file %s, use %%Y, %%y, %%m, %%d, %%j, %%H, %%M, %%S or %%%%", name[i], outputFile)
+		}
+	}
+	return nil
+}
+
+// Replace every verb, the template was checked by parseOutputTemplate
+func expandOutputTemplate(outputFile string, verb func(layout string, pattern string) string, literal func(text string) string) string {
+
+	name := filepath.Base(outputFile)
+	var result strings.Builder
+	start := 0
+	for i := 0; i < len(name); i++ {
+		if name[i] != '%' {
+			continue
+		}
+		result.WriteString(literal(name[start:i]))
+		i++
+		if name[i] == '%' {
+			result.WriteString(literal("%"))
+		} else {
+			result.WriteString(verb(outputTemplateVerbs[name[i]].layout, outputTemplateVerbs[name[i]].pattern))
+		}
+		start = i + 1
+	}
+	result.WriteString(literal(name[start:]))
+	return result.String()
+}
+
+func renderOutputTemplate(outputFile string, now time.Time) string {
+	return filepath.Join(filepath.Dir(outputFile), expandOutputTemplate(outputFile,
+		func(layout string, pattern string) string { return now.Format(layout) },
+		func(text string) string { return text }))
+}
+
+// Files the template rendered to at any time, compressed or not
+func outputTemplatePattern(outputFile string) *regexp.Regexp {
+	return regexp.MustCompile("^" + expandOutputTemplate(outputFile,
+		func(layout string, pattern string) string { return pattern },
+		regexp.QuoteMeta) + archiveExtensionPattern() + "$")
+}
+
+// The file the writer has open, or the one it is going to open
+func currentTemplatedFile(outputFile string, config rotateConfig) string {
+	if current, ok := config.state.templatedOutputFile.Load().(string); ok {
+		return current
+	}
+	return renderOutputTemplate(outputFile, time.Now().In(config.location))
+}
+
+// Compress the files the writer left behind and apply the retention rules. Runs whenever
+// the writer moved on and at start, after a restart on another day the last file is still plain.
+func finishTemplatedFiles(outputFile string, config rotateConfig) {
+
+	// Rotations and retention touch the same files
+	config.state.rotateLock.Lock()
+	defer config.state.rotateLock.Unlock()
+
+	if config.compression != nil {
+		pattern := outputTemplatePattern(outputFile)
+		for _, path := range findTemplatedFiles(outputFile, config) {
+			if match := pattern.FindStringSubmatch(filepath.Base(path)); match == nil || match[len(match)-1] != "" {
+				continue
+			}
+			acquireCompressionSlot("")
+			err := compressTemplatedFile(path, config)
+			releaseCompressionSlot()
+			if err != nil {
+				logActivity("Failed to compress %s. Error: %s", path, err)
+				reportFailure(config, "rotate", outputFile, path, err)
+			}
+		}
+	}
+	pruneTemplatedFiles(outputFile, config)
+}
+
+func compressTemplatedFile(closedFile string, config rotateConfig) error {
+
+	stat, err := os.Stat(closedFile)
+	if err != nil {
+		return err
+	}
+
+	// Same as for archives, a crash mid compression must never leave a truncated file
+	compressedFile := closedFile + config.compression.extension
+	partialPath := compressedFile + partialArchiveSuffix
+	err = withCompressPriority(config, func() error {
+		return compressFile(closedFile, partialPath, makeArchiveBase(closedFile, config), config)
+	})
+	if err != nil {
+		os.Remove(partialPath)
+		return err
+	}
+	if err := os.Chtimes(partialPath, stat.ModTime(), stat.ModTime()); err != nil {
+		logActivity("Failed to set modification time of %s. Error: %s", partialPath, err)
+	}
+	if err := renameFile(partialPath, compressedFile); err != nil {
+		os.Remove(partialPath)
+		return err
+	}
+	if err := removeFile(closedFile); err != nil {
+		return err
+	}
+	audit("", "compact", closedFile, compressedFile)
+	logActivity("Compressed %s to %s", closedFile, compressedFile)
+	return nil
+}
+
+// Files the writer left behind, newest first by the time of their last line
+func findTemplatedFiles(outputFile string, config rotateConfig) []string {
+
+	files := make([]string, 0)
+	entries, err := os.ReadDir(filepath.Dir(outputFile))
+	if err != nil {
+		return files
+	}
+	pattern := outputTemplatePattern(outputFile)
+	current := currentTemplatedFile(outputFile, config)
+	modified := make(map[string]time.Time)
+	for _, entry := range entries {
+		path := filepath.Join(filepath.Dir(outputFile), entry.Name())
+		if !entry.Type().IsRegular() || !pattern.MatchString(entry.Name()) || path == current {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			files = append(files, path)
+			modified[path] = info.ModTime()
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return modified[files[i]].After(modified[files[j]]) })
+	return files
+}
+
+func pruneTemplatedFiles(outputFile string, config rotateConfig) {
+
+	today := time.Now()
+	for i, path := range findTemplatedFiles(outputFile, config) {
+		stat, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		fileAge := int(math.Floor(today.Sub(stat.ModTime()).Hours() / 24))
+		if (config.maxFiles < 0 || i < config.maxFiles) && (config.maxAgeDays < 0 || fileAge < config.maxAgeDays) {
+			continue
+		}
+		logActivity("Removing %s, only %d files or %d days are kept", path, config.maxFiles, config.maxAgeDays)
+		if err := removeFile(path); err != nil {
+			logActivity("Failed to delete %s. Error: %s", path, err)
+			reportFailure(config, "prune", outputFile, path, err)
+			continue
+		}
+		audit("", "delete", path, "")
+	}
+}
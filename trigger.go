@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// How the time and size triggers combine. With any each of them rotates on its own,
+// with all the file has to be large enough and the last rotation long enough ago.
+const (
+	triggerPolicyAny string = "any"
+	triggerPolicyAll string = "all"
+)
+
+func parseTriggerPolicy(policy string) (string, error) {
+	switch policy {
+	case triggerPolicyAny, triggerPolicyAll:
+		return policy, nil
+	}
+	return "", errors.New("Unknown trigger policy " + policy + ", use any or all")
+}
+
+// What rotee writes back after handling a trigger file. digit is the single status digit,
+// json replaces it with a triggerResponse and status-file keeps the digit in the trigger file
+// and writes the triggerResponse next to it, for scripts that only understand the digit.
+const (
+	triggerResponseDigit      string = "digit"
+	triggerResponseJSON       string = "json"
+	triggerResponseStatusFile string = "status-file"
+)
+
+func parseTriggerResponse(response string) (string, error) {
+	switch response {
+	case triggerResponseDigit, triggerResponseJSON, triggerResponseStatusFile:
+		return response, nil
+	}
+	return "", errors.New("Unknown trigger response " + response + ", use digit, json or status-file")
+}
+
+// Everything known about the handling of one trigger, Status is the digit
+type triggerResponse struct {
+	Status     int       `json:"status"`
+	Result     string    `json:"result"`
+	RotationID string    `json:"rotation_id"`
+	Archive    string    `json:"archive,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+var triggerResults = map[int]string{
+	0: "rotated",
+	2: "failed",
+	3: "rate_limited",
+	4: "nothing_to_rotate",
+	5: "coalesced",
+}
+
+func newTriggerResponse(status int, rotationID string, result rotationResult) triggerResponse {
+
+	response := triggerResponse{Status: status, Result: triggerResults[status], RotationID: rotationID,
+		Archive: result.archive, Time: time.Now()}
+	if result.err != nil {
+		response.Error = result.err.Error()
+	}
+	return response
+}
+
+// The status file goes first, whoever waits for the digit finds the details already there.
+// In touch mode the trigger file is deleted instead, only the status file tells what happened.
+func writeTriggerResponse(triggerFile string, triggerMode string, mode string, response triggerResponse) error {
+
+	details, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	digit := []byte{byte('0' + response.Status)}
+	switch mode {
+	case triggerResponseJSON:
+		return os.WriteFile(triggerFile, details, 0644)
+	case triggerResponseStatusFile:
+		if err := os.WriteFile(triggerFile+".status", details, 0644); err != nil {
+			return err
+		}
+	}
+	if triggerMode == triggerModeTouch {
+		if err := os.Remove(triggerFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(triggerFile, digit, 0644)
+}
+
+// With content a 1 in the trigger file requests a rotation and the result replaces it.
+// With touch the file existing is enough and rotee deletes it once it handled the request.
+const (
+	triggerModeContent string = "content"
+	triggerModeTouch   string = "touch"
+)
+
+func parseTriggerMode(mode string) (string, error) {
+	switch mode {
+	case triggerModeContent, triggerModeTouch:
+		return mode, nil
+	}
+	return "", errors.New("Unknown trigger mode " + mode + ", use content or touch")
+}
+
+// Check the rotation condition at the scan frequency, this covers the size trigger as well
+func automaticConditionRotation(wg *sync.WaitGroup, condition *rotationCondition, outputFile string, config rotateConfig) {
+
+	logActivity("Running logrotate once %s, checking every %f seconds", condition.text, config.scanFrequencySeconds)
+	for {
+
+		// Start work, tell wait group that we are busy and cant exit.
+		wg.Add(1)
+
+		resolved, err := resolveOutputFile(outputFile, config)
+		if err != nil {
+			resolved = outputFile
+		}
+		if stat, err := statFile(resolved); err == nil {
+
+			facts := rotationFacts{
+				size:  stat.Size(),
+				age:   config.state.timeSinceRotation(),
+				idle:  config.state.timeSinceWrite(),
+				lines: config.state.linesWritten.Load(),
+				now:   time.Now().In(config.location),
+			}
+
+			// Size and age only grow during a hold, the condition is still true once it is lifted
+			if condition.holds(facts) && !config.hold.held() {
+				config.rotationID = newRotationID()
+				logRotation(config.rotationID, "Log file is now %d bytes with %d lines and was last rotated %s ago, %s holds",
+					facts.size, facts.lines, facts.age.Round(time.Millisecond), condition.text)
+				if err := requestRotation(config); errors.Is(err, errRotationRateLimited) {
+					logRotation(config.rotationID, "Skipping conditional rotation because of the rate limit")
+				} else if errors.Is(err, errNothingToRotate) {
+					logRotation(config.rotationID, "Skipping conditional rotation, nothing was written")
+				} else if err != nil {
+					logRotation(config.rotationID, "Conditional rotation failed!")
+					reportFailure(config, "rotate", outputFile, "", err)
+					if config.errorMode == errorModeFailFast {
+						exitf(exitRotationError, "Conditional rotation failed!")
+					}
+				}
+			}
+		} else {
+			logActivity("Conditional rotation could not stat file %s", outputFile)
+		}
+
+		// Tell the wait group that we could exit here while we are asleep.
+		wg.Done()
+
+		// Wait time before checking again
+		time.Sleep(time.Millisecond * time.Duration(config.scanFrequencySeconds*1000))
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"syscall"
+)
+
+// Set the umask for everything rotee creates from here on, given in octal like 027
+func applyUmask(mask string) error {
+
+	if mask == "" {
+		return nil
+	}
+
+	value, err := strconv.ParseUint(mask, 8, 32)
+	if err != nil || value > 0777 {
+		return fmt.Errorf("invalid umask %s, expected an octal value like 027", mask)
+	}
+	syscall.Umask(int(value))
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+)
+
+func applyUmask(mask string) error {
+
+	if mask == "" {
+		return nil
+	}
+	return errors.New("setting the umask is not supported on windows")
+}
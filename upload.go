@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type archiveUploader interface {
+
+	// Upload the local file at path to the remote under the given name.
+	// The name is relative to whatever prefix the user configured.
+	upload(path string, name string) error
+
+	// Human readable location of an uploaded file, used for logging.
+	describe(name string) string
+
+	// Whether a file of that name is on the remote already, mirrors only copy what is missing.
+	exists(name string) (bool, error)
+}
+
+type uploadConfig struct {
+	target  string
+	timeout time.Duration
+	s3      s3Options
+	azure   azureOptions
+	sftp    sftpOptions
+}
+
+func newArchiveUploader(config uploadConfig) (archiveUploader, error) {
+
+	target, err := url.Parse(config.target)
+	if err != nil {
+		return nil, err
+	}
+
+	// Prefix never starts or ends with a slash, we join it with the archive name later
+	prefix := strings.Trim(target.Path, "/")
+
+	switch target.Scheme {
+	case "s3":
+		return newS3Uploader(target.Host, prefix, config.s3, config.timeout)
+	case "gs":
+		return newGCSUploader(target.Host, prefix, config.timeout)
+	case "azblob":
+		return newAzureUploader(target.Host, prefix, config.azure, config.timeout)
+	case "sftp":
+		return newSFTPUploader(target.Host, target.User.Username(), target.Path, config.sftp)
+	default:
+		return nil, errors.New("Unsupported upload target " + config.target)
+	}
+}
+
+func makeRemoteArchiveName(archive archiveFile, rotatedAt time.Time) string {
+
+	// Archives are renamed locally on every rotation so their index is useless
+	// as a remote name, use the time of rotation instead.
+	return filepath.Base(archive.name) + "." + rotatedAt.UTC().Format("20060102T150405.000") + "Z" + archive.extension
+}
+
+func joinRemotePath(prefix string, name string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + "/" + name
+}
+
+// Answer of a HEAD or metadata request for a single object
+func objectExists(service string, response *http.Response) (bool, error) {
+
+	switch {
+	case response.StatusCode == http.StatusNotFound:
+		return false, nil
+	case response.StatusCode < 200 || response.StatusCode > 299:
+		return false, fmt.Errorf("%s lookup failed with status %s", service, response.Status)
+	}
+	return true, nil
+}
+
+// An archive taken out of the archive directory under the rotate lock. Rotations can move or delete
+// the archive while it is shipped, so it is read from a hard link with a name no rule touches.
+type pinnedArchive struct {
+	archive    archiveFile
+	path       string
+	name       string
+	rotationID string
+}
+
+// Every pin gets its own name, a rotation can pin an archive again while the last pin is still read
+func makeArchivePinPath(archiveBase string, name string, purpose string) string {
+	return filepath.Join(filepath.Dir(archiveBase), "."+name+"."+purpose+"."+strconv.FormatInt(time.Now().UnixNano(), 10))
+}
+
+func pinArchive(archive archiveFile, archiveBase string, name string, purpose string) (string, error) {
+
+	pin := makeArchivePinPath(archiveBase, name, purpose)
+	if err := os.Link(archive.getPath(), pin); err == nil {
+		return pin, nil
+	}
+
+	// Not every file system has hard links, a copy does the same at some cost
+	stat, err := os.Stat(archive.getPath())
+	if err != nil {
+		return "", err
+	}
+	if err := copyFile(archive.getPath(), pin); err != nil {
+		os.Remove(pin)
+		return "", err
+	}
+	return pin, os.Chtimes(pin, stat.ModTime(), stat.ModTime())
+}
+
+// Pins rotee did not get to remove before, like when it was killed during an upload
+func removeStalePins(archiveBase string) {
+
+	entries, err := os.ReadDir(filepath.Dir(archiveBase))
+	if err != nil {
+		return
+	}
+	pattern := regexp.MustCompile(`^\.` + regexp.QuoteMeta(filepath.Base(archiveBase)) +
+		`\.[0-9]{8}T[0-9]{6}\.[0-9]{3}Z.*\.(upload|sync)\.[0-9]+$`)
+	for _, entry := range entries {
+		if pattern.MatchString(entry.Name()) {
+			os.Remove(filepath.Join(filepath.Dir(archiveBase), entry.Name()))
+		}
+	}
+}
+
+func releasePins(pins []pinnedArchive) {
+	for _, pin := range pins {
+		os.Remove(pin.path)
+	}
+}
+
+func uploadArchive(uploader archiveUploader, pin pinnedArchive, retries int) error {
+
+	// Retry with exponential backoff, the remote might be unavailable for a moment
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			backoff := time.Second * time.Duration(1<<(attempt-1))
+			logActivity("Upload of %s failed, retrying in %s. Error: %s", pin.archive.getPath(), backoff, err)
+			time.Sleep(backoff)
+		}
+
+		if err = uploader.upload(pin.path, pin.name); err == nil {
+			logActivity("Uploaded %s to %s", pin.archive.getPath(), uploader.describe(pin.name))
+			return nil
+		}
+	}
+
+	logActivity("Giving up uploading %s. Error: %s", pin.archive.getPath(), err)
+	return err
+}
+
+func removeArchive(archives []archiveFile, index int, manifest *archiveManifest, rotationID string) ([]archiveFile, error) {
+
+	if err := removeArchiveFile(archives[index].name, archives[index].getPath()); err != nil {
+		return archives, err
+	}
+	audit(rotationID, "delete", archives[index].getPath(), "")
+	manifest.forget(archives[index])
+
+	// Move all older archives down by one so there is no hole,
+	// archive discovery stops at the first missing index.
+	// Dated archives are found no matter what, they never move.
+	for i := index + 1; i < len(archives); i++ {
+		if archives[index].date != "" || archives[i].date != "" {
+			continue
+		}
+		target := makeArchivePath(archives[i].name, archives[i].index-1, archives[i].extension)
+		if err := renameFile(archives[i].getPath(), target); err != nil {
+			return append(archives[:index], archives[index+1:]...), err
+		}
+		audit(rotationID, "rename", archives[i].getPath(), target)
+		manifest.move(archives[i].index, archives[i].index-1)
+		archives[i].index -= 1
+	}
+
+	return append(archives[:index], archives[index+1:]...), nil
+}
+
+// Everything that could not be uploaded stays in the manifest as pending,
+// this way we pick it up again later, even after a restart.
+func pinQueuedUploads(archives []archiveFile, archiveBase string, manifest *archiveManifest) []pinnedArchive {
+
+	pins := make([]pinnedArchive, 0)
+	for _, archive := range archives {
+		record := manifest.get(archive)
+		if record == nil || !record.uploadPending() {
+			continue
+		}
+		path, err := pinArchive(archive, archiveBase, record.UploadName, "upload")
+		if err != nil {
+			logActivity("Failed to pin %s for upload. Error: %s", archive.getPath(), err)
+			continue
+		}
+		pins = append(pins, pinnedArchive{archive: archive, path: path, name: record.UploadName, rotationID: record.RotationID})
+	}
+	return pins
+}
+
+// Keep a short local tail, older archives may only go once they are safe on the remote
+func applyLocalMaxFiles(archives []archiveFile, manifest *archiveManifest, outputFile string, config rotateConfig) ([]archiveFile, []string) {
+
+	pruned := make([]string, 0)
+	logRotation(config.rotationID, "Limit max number of local archives to %d", config.localMaxFiles)
+	for i := len(archives) - 1; i >= config.localMaxFiles; i-- {
+		if record := manifest.get(archives[i]); record == nil || record.Remote == "" {
+			logRotation(config.rotationID, "Keeping %s, it was not uploaded yet", archives[i].getPath())
+			continue
+		}
+
+		// Its okay if removing fails here
+		path := archives[i].getPath()
+		logRotation(config.rotationID, "Removing uploaded archive %s", path)
+		var err error
+		if archives, err = removeArchive(archives, i, manifest, config.rotationID); err != nil {
+			logRotation(config.rotationID, "Failed to delete %s. Error: %s", path, err)
+			reportFailure(config, "prune", outputFile, path, err)
+		} else {
+			pruned = append(pruned, path)
+		}
+	}
+	return archives, pruned
+}
+
+// Record what made it to the remote. The archives might have moved while we uploaded,
+// their remote name finds them again.
+func finishUploads(archiveBase string, outputFile string, uploaded map[string]bool, config rotateConfig) {
+
+	config.state.rotateLock.Lock()
+	defer config.state.rotateLock.Unlock()
+
+	archives := orderArchives(findAllArchives(archiveBase), config.archiveNaming)
+	manifest := loadManifest(archiveBase, archives)
+	for i := 0; i < len(archives); i++ {
+		record := manifest.get(archives[i])
+		if record == nil || !record.uploadPending() || !uploaded[record.UploadName] {
+			continue
+		}
+		config.rotationID = record.RotationID
+		record.Remote = config.uploader.describe(record.UploadName)
+		audit(config.rotationID, "upload", archives[i].getPath(), record.Remote)
+
+		// Its okay if removing fails here, the retention rules will clean up later
+		if config.uploadDeleteAfter {
+			path := archives[i].getPath()
+			logRotation(config.rotationID, "Removing uploaded archive %s", path)
+			var err error
+			if archives, err = removeArchive(archives, i, manifest, config.rotationID); err != nil {
+				logRotation(config.rotationID, "Failed to delete %s. Error: %s", path, err)
+			} else {
+				i--
+			}
+		}
+	}
+
+	if config.localMaxFiles >= 0 {
+		config.rotationID = ""
+		applyLocalMaxFiles(archives, manifest, outputFile, config)
+	}
+	if err := manifest.save(); err != nil {
+		logActivity("Failed to write manifest for %s. Error: %s", archiveBase, err)
+	}
+}
+
+// Upload what is queued and mirror what rotations pinned for it. Only looking at the archives
+// needs the rotate lock, the network is slow and must not hold up rotations.
+func shipArchives(outputFile string, config rotateConfig) {
+
+	config.state.shipLock.Lock()
+	defer config.state.shipLock.Unlock()
+
+	config.state.rotateLock.Lock()
+	resolvedOutputFile, err := resolveOutputFile(outputFile, config)
+	if err != nil {
+		config.state.rotateLock.Unlock()
+		return
+	}
+	archiveBase := makeArchiveBase(resolvedOutputFile, config)
+	uploads := make([]pinnedArchive, 0)
+	if config.uploader != nil {
+		archives := findAllArchives(archiveBase)
+		uploads = pinQueuedUploads(archives, archiveBase, loadManifest(archiveBase, archives))
+	}
+	mirrors := slices.Collect(maps.Values(config.state.mirrorPins))
+	clear(config.state.mirrorPins)
+	config.state.rotateLock.Unlock()
+	defer releasePins(uploads)
+	defer releasePins(mirrors)
+
+	uploaded := make(map[string]bool)
+	for _, pin := range uploads {
+
+		// Queued archives report under the rotation that created them
+		config.rotationID = pin.rotationID
+		if err := uploadArchive(config.uploader, pin, config.uploadRetries); err != nil {
+			logRotation(config.rotationID, "Keeping %s queued for upload", pin.archive.getPath())
+			reportFailure(config, "upload", resolvedOutputFile, pin.archive.getPath(), err)
+			continue
+		}
+		uploaded[pin.name] = true
+	}
+
+	// A mirror that is not reachable gets the archives that are still there with the next rotation
+	if len(mirrors) > 0 {
+		config.rotationID = ""
+		if _, err := mirrorPinnedArchives(mirrors, config.syncDestination, config.syncUploader); err != nil {
+			logActivity("Error while syncing archives to %s: %s", config.syncDestination, err)
+			reportFailure(config, "sync", resolvedOutputFile, "", err)
+		}
+	}
+
+	if len(uploaded) > 0 {
+		finishUploads(archiveBase, resolvedOutputFile, uploaded, config)
+	}
+}
+
+func shipArchivesPeriodically(wg *sync.WaitGroup, outputFile string, retryIntervalSeconds float64, config rotateConfig) {
+
+	// Nothing else is shipping yet, whatever pins are there are left over
+	config.state.rotateLock.Lock()
+	if resolvedOutputFile, err := resolveOutputFile(outputFile, config); err == nil {
+		removeStalePins(makeArchiveBase(resolvedOutputFile, config))
+	}
+	config.state.rotateLock.Unlock()
+
+	if config.uploader != nil {
+		logActivity("Retrying queued uploads every %f seconds", retryIntervalSeconds)
+	}
+	for {
+
+		// Start work, tell wait group that we are busy and cant exit.
+		wg.Add(1)
+		shipArchives(outputFile, config)
+
+		// Tell the wait group that we could exit here while we are asleep.
+		wg.Done()
+
+		// Rotations wake us up early, otherwise look at the queue again after a while
+		select {
+		case <-config.state.shipWake:
+		case <-time.After(time.Millisecond * time.Duration(retryIntervalSeconds*1000)):
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const azureStorageVersion string = "2021-08-06"
+
+type azureOptions struct {
+	connectionString string
+	account          string
+}
+
+type azureUploader struct {
+	container string
+	prefix    string
+	account   string
+	endpoint  string
+	key       []byte
+	sas       string
+	client    *http.Client
+
+	// Managed identity tokens are cached until shortly before they expire
+	tokenLock    sync.Mutex
+	token        string
+	tokenExpires time.Time
+}
+
+func parseAzureConnectionString(connectionString string) map[string]string {
+
+	// Connection strings look like AccountName=foo;AccountKey=bar;...
+	// Values might contain '=' themselves (base64 keys), only split on the first one.
+	result := make(map[string]string)
+	for _, part := range strings.Split(connectionString, ";") {
+		if key, value, found := strings.Cut(part, "="); found {
+			result[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return result
+}
+
+func newAzureUploader(container string, prefix string, options azureOptions, timeout time.Duration) (*azureUploader, error) {
+
+	if container == "" {
+		return nil, errors.New("Azure upload target is missing a container name")
+	}
+
+	uploader := &azureUploader{container: container, prefix: prefix, client: &http.Client{Timeout: timeout}}
+
+	if options.connectionString == "" {
+		options.connectionString = os.Getenv("AZURE_STORAGE_CONNECTION_STRING")
+	}
+
+	// Prefer the connection string, it carries everything we need
+	if options.connectionString != "" {
+		settings := parseAzureConnectionString(options.connectionString)
+		uploader.account = settings["AccountName"]
+		uploader.sas = strings.TrimPrefix(settings["SharedAccessSignature"], "?")
+		if settings["AccountKey"] != "" {
+			key, err := base64.StdEncoding.DecodeString(settings["AccountKey"])
+			if err != nil {
+				return nil, errors.New("Azure connection string contains an invalid account key")
+			}
+			uploader.key = key
+		}
+
+		uploader.endpoint = settings["BlobEndpoint"]
+		if uploader.endpoint == "" {
+			protocol := settings["DefaultEndpointsProtocol"]
+			if protocol == "" {
+				protocol = "https"
+			}
+			suffix := settings["EndpointSuffix"]
+			if suffix == "" {
+				suffix = "core.windows.net"
+			}
+			uploader.endpoint = protocol + "://" + uploader.account + ".blob." + suffix
+		}
+
+		if uploader.account == "" || (uploader.key == nil && uploader.sas == "") {
+			return nil, errors.New("Azure connection string needs an account name and either an account key or a SAS")
+		}
+		return uploader, nil
+	}
+
+	// Without a connection string we authenticate with the managed identity of the machine
+	if options.account == "" {
+		options.account = os.Getenv("AZURE_STORAGE_ACCOUNT")
+	}
+	if options.account == "" {
+		return nil, errors.New("Azure upload needs either a connection string or a storage account name")
+	}
+	uploader.account = options.account
+	uploader.endpoint = "https://" + options.account + ".blob.core.windows.net"
+
+	return uploader, nil
+}
+
+func (uploader *azureUploader) describe(name string) string {
+	return "azblob://" + uploader.container + "/" + joinRemotePath(uploader.prefix, name)
+}
+
+func (uploader *azureUploader) managedIdentityToken() (string, error) {
+
+	uploader.tokenLock.Lock()
+	defer uploader.tokenLock.Unlock()
+
+	if uploader.token != "" && time.Now().Before(uploader.tokenExpires) {
+		return uploader.token, nil
+	}
+
+	// Ask the instance metadata service, see
+	// https://learn.microsoft.com/en-us/entra/identity/managed-identities-azure-resources/how-to-use-vm-token
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", "https://storage.azure.com/")
+	if clientID := os.Getenv("AZURE_CLIENT_ID"); clientID != "" {
+		query.Set("client_id", clientID)
+	}
+	request, err := http.NewRequest(http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Metadata", "true")
+
+	response, err := uploader.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", errors.New("Managed identity token request failed with status " + response.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresOn   string `json:"expires_on"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	// Refresh a few minutes early so a token never expires mid upload
+	expiresOn, err := strconv.ParseInt(token.ExpiresOn, 10, 64)
+	if err != nil {
+		return "", err
+	}
+	uploader.token = token.AccessToken
+	uploader.tokenExpires = time.Unix(expiresOn, 0).Add(-5 * time.Minute)
+	return uploader.token, nil
+}
+
+func (uploader *azureUploader) signSharedKey(request *http.Request) {
+
+	// Shared key authorization, see
+	// https://learn.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+	contentLength := ""
+	if request.ContentLength > 0 {
+		contentLength = strconv.FormatInt(request.ContentLength, 10)
+	}
+
+	msHeaders := make([]string, 0)
+	for name := range request.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower+":"+strings.TrimSpace(request.Header.Get(name)))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	canonicalizedResource := "/" + uploader.account + request.URL.EscapedPath()
+	query := request.URL.Query()
+	queryKeys := make([]string, 0, len(query))
+	for key := range query {
+		queryKeys = append(queryKeys, key)
+	}
+	sort.Strings(queryKeys)
+	for _, key := range queryKeys {
+		canonicalizedResource += "\n" + strings.ToLower(key) + ":" + strings.Join(query[key], ",")
+	}
+
+	stringToSign := strings.Join([]string{
+		request.Method,
+		request.Header.Get("Content-Encoding"),
+		request.Header.Get("Content-Language"),
+		contentLength,
+		request.Header.Get("Content-MD5"),
+		request.Header.Get("Content-Type"),
+		"", // Date, we use x-ms-date instead
+		request.Header.Get("If-Modified-Since"),
+		request.Header.Get("If-Match"),
+		request.Header.Get("If-None-Match"),
+		request.Header.Get("If-Unmodified-Since"),
+		request.Header.Get("Range"),
+		strings.Join(msHeaders, "\n"),
+		canonicalizedResource,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, uploader.key)
+	mac.Write([]byte(stringToSign))
+	request.Header.Set("Authorization", "SharedKey "+uploader.account+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+func (uploader *azureUploader) blobURL(name string) string {
+
+	target := strings.TrimSuffix(uploader.endpoint, "/") + "/" + url.PathEscape(uploader.container) + "/" +
+		strings.ReplaceAll(url.PathEscape(joinRemotePath(uploader.prefix, name)), "%2F", "/")
+	if uploader.key == nil && uploader.sas != "" {
+		target += "?" + uploader.sas
+	}
+	return target
+}
+
+// Sign with the account key, use the managed identity or nothing if the SAS in the URL does it
+func (uploader *azureUploader) authorize(request *http.Request) error {
+
+	request.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	request.Header.Set("x-ms-version", azureStorageVersion)
+
+	if uploader.key != nil {
+		uploader.signSharedKey(request)
+	} else if uploader.sas == "" {
+		token, err := uploader.managedIdentityToken()
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return nil
+}
+
+func (uploader *azureUploader) upload(path string, name string) error {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Single put blob request, this is fine for anything below 5000 MiB
+	request, err := http.NewRequest(http.MethodPut, uploader.blobURL(name), file)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = stat.Size()
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("x-ms-blob-type", "BlockBlob")
+	if err := uploader.authorize(request); err != nil {
+		return err
+	}
+
+	response, err := uploader.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("Azure upload failed with status %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+func (uploader *azureUploader) exists(name string) (bool, error) {
+
+	request, err := http.NewRequest(http.MethodHead, uploader.blobURL(name), nil)
+	if err != nil {
+		return false, err
+	}
+	if err := uploader.authorize(request); err != nil {
+		return false, err
+	}
+
+	response, err := uploader.client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	response.Body.Close()
+	return objectExists("Azure", response)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+type gcsUploader struct {
+	bucket   string
+	prefix   string
+	endpoint string
+	client   *http.Client
+}
+
+func newGCSUploader(bucket string, prefix string, timeout time.Duration) (*gcsUploader, error) {
+
+	if bucket == "" {
+		return nil, errors.New("GCS upload target is missing a bucket name")
+	}
+
+	// Talk to a local emulator without credentials if the user asks for it,
+	// this uses the same variable as the official client libraries.
+	if emulator := os.Getenv("STORAGE_EMULATOR_HOST"); emulator != "" {
+		if !strings.Contains(emulator, "://") {
+			emulator = "http://" + emulator
+		}
+		return &gcsUploader{bucket: bucket, prefix: prefix, endpoint: emulator, client: &http.Client{Timeout: timeout}}, nil
+	}
+
+	// Application default credentials: GOOGLE_APPLICATION_CREDENTIALS,
+	// gcloud user credentials or the metadata server when running on GCP.
+	client, err := google.DefaultClient(context.Background(), "https://www.googleapis.com/auth/devstorage.read_write")
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = timeout
+
+	return &gcsUploader{bucket: bucket, prefix: prefix, endpoint: "https://storage.googleapis.com", client: client}, nil
+}
+
+func (uploader *gcsUploader) describe(name string) string {
+	return "gs://" + uploader.bucket + "/" + joinRemotePath(uploader.prefix, name)
+}
+
+func (uploader *gcsUploader) upload(path string, name string) error {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Simple media upload, see
+	// https://cloud.google.com/storage/docs/uploading-objects#uploading-an-object
+	target := uploader.endpoint + "/upload/storage/v1/b/" + url.PathEscape(uploader.bucket) +
+		"/o?uploadType=media&name=" + url.QueryEscape(joinRemotePath(uploader.prefix, name))
+	request, err := http.NewRequest(http.MethodPost, target, file)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = stat.Size()
+	request.Header.Set("Content-Type", "application/octet-stream")
+
+	response, err := uploader.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("GCS upload failed with status %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+func (uploader *gcsUploader) exists(name string) (bool, error) {
+
+	// Object metadata, the slashes of the name are part of it and escaped as well
+	target := uploader.endpoint + "/storage/v1/b/" + url.PathEscape(uploader.bucket) +
+		"/o/" + url.PathEscape(joinRemotePath(uploader.prefix, name))
+	response, err := uploader.client.Get(target)
+	if err != nil {
+		return false, err
+	}
+	response.Body.Close()
+	return objectExists("GCS", response)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+type s3Options struct {
+	endpoint     string
+	region       string
+	pathStyle    bool
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+type s3Uploader struct {
+	bucket  string
+	prefix  string
+	options s3Options
+	client  *http.Client
+}
+
+func newS3Uploader(bucket string, prefix string, options s3Options, timeout time.Duration) (*s3Uploader, error) {
+
+	if bucket == "" {
+		return nil, errors.New("S3 upload target is missing a bucket name")
+	}
+
+	// Static credentials win, otherwise use what the usual AWS variables provide
+	if options.accessKey == "" {
+		options.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if options.secretKey == "" {
+		options.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if options.sessionToken == "" {
+		options.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if options.accessKey == "" || options.secretKey == "" {
+		return nil, errors.New("S3 upload requires an access key and a secret key")
+	}
+
+	if options.region == "" {
+		options.region = os.Getenv("AWS_REGION")
+	}
+	if options.region == "" {
+		options.region = "us-east-1"
+	}
+
+	// A stalled connection must not hold up the queue forever
+	return &s3Uploader{bucket: bucket, prefix: prefix, options: options, client: &http.Client{Timeout: timeout}}, nil
+}
+
+func (uploader *s3Uploader) describe(name string) string {
+	return "s3://" + uploader.bucket + "/" + joinRemotePath(uploader.prefix, name)
+}
+
+func (uploader *s3Uploader) objectURL(key string) (*url.URL, error) {
+
+	endpoint := uploader.options.endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + uploader.options.region + ".amazonaws.com"
+	}
+
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme == "" || base.Host == "" {
+		return nil, errors.New("Invalid S3 endpoint " + endpoint)
+	}
+
+	// Most self hosted S3 implementations (MinIO, Ceph RGW, ...) do not
+	// have wildcard DNS set up, so they need the bucket in the path.
+	if uploader.options.pathStyle {
+		base.Path = "/" + uploader.bucket + "/" + key
+	} else {
+		base.Host = uploader.bucket + "." + base.Host
+		base.Path = "/" + key
+	}
+	return base, nil
+}
+
+func (uploader *s3Uploader) upload(path string, name string) error {
+
+	target, err := uploader.objectURL(joinRemotePath(uploader.prefix, name))
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The payload hash is part of the signature, so we need to read the file twice
+	payloadHash := sha256.New()
+	size, err := io.Copy(payloadHash, file)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPut, target.String(), file)
+	if err != nil {
+		return err
+	}
+	request.ContentLength = size
+	uploader.sign(request, hex.EncodeToString(payloadHash.Sum(nil)), time.Now().UTC())
+
+	response, err := uploader.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("S3 upload failed with status %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+func (uploader *s3Uploader) exists(name string) (bool, error) {
+
+	target, err := uploader.objectURL(joinRemotePath(uploader.prefix, name))
+	if err != nil {
+		return false, err
+	}
+	request, err := http.NewRequest(http.MethodHead, target.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	emptyPayloadHash := sha256.Sum256(nil)
+	uploader.sign(request, hex.EncodeToString(emptyPayloadHash[:]), time.Now().UTC())
+
+	response, err := uploader.client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	response.Body.Close()
+	return objectExists("S3", response)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (uploader *s3Uploader) sign(request *http.Request, payloadHash string, now time.Time) {
+
+	// AWS signature version 4, see
+	// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+
+	request.Header.Set("x-amz-date", amzDate)
+	request.Header.Set("x-amz-content-sha256", payloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + request.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	if uploader.options.sessionToken != "" {
+		request.Header.Set("x-amz-security-token", uploader.options.sessionToken)
+		signedHeaders += ";x-amz-security-token"
+		canonicalHeaders += "x-amz-security-token:" + uploader.options.sessionToken + "\n"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := shortDate + "/" + uploader.options.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+uploader.options.secretKey), shortDate)
+	signingKey = hmacSHA256(signingKey, uploader.options.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+uploader.options.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type sftpOptions struct {
+	keyFile        string
+	knownHostsFile string
+}
+
+type sftpUploader struct {
+	address   string
+	directory string
+	config    *ssh.ClientConfig
+}
+
+func defaultSSHFile(names ...string) string {
+
+	// Pick the first file that exists in ~/.ssh
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	for _, name := range names {
+		candidate := filepath.Join(home, ".ssh", name)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return ""
+}
+
+func newSFTPUploader(target string, user string, directory string, options sftpOptions) (*sftpUploader, error) {
+
+	if target == "" {
+		return nil, errors.New("SFTP upload target is missing a host name")
+	}
+	if user == "" {
+		return nil, errors.New("SFTP upload target is missing a user name")
+	}
+
+	if options.keyFile == "" {
+		options.keyFile = defaultSSHFile("id_ed25519", "id_ecdsa", "id_rsa")
+	}
+	if options.knownHostsFile == "" {
+		options.knownHostsFile = defaultSSHFile("known_hosts")
+	}
+	if options.keyFile == "" {
+		return nil, errors.New("SFTP upload needs a private key")
+	}
+	if options.knownHostsFile == "" {
+		return nil, errors.New("SFTP upload needs a known hosts file to verify the server")
+	}
+
+	key, err := os.ReadFile(options.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := knownhosts.New(options.knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Paths are absolute unless they start with ~, same as curl does it
+	if strings.HasPrefix(directory, "/~/") || directory == "/~" {
+		directory = strings.TrimPrefix(strings.TrimPrefix(directory, "/~"), "/")
+	}
+	if directory == "" {
+		directory = "."
+	}
+
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "22")
+	}
+
+	return &sftpUploader{
+		address:   target,
+		directory: directory,
+		config: &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+		},
+	}, nil
+}
+
+func (uploader *sftpUploader) describe(name string) string {
+	return "sftp://" + uploader.config.User + "@" + uploader.address + "/" + strings.TrimPrefix(path.Join(uploader.directory, name), "/")
+}
+
+// Rotations are rare enough that we just connect every time,
+// this way we never have to deal with stale connections.
+func (uploader *sftpUploader) connect() (*ssh.Client, *sftp.Client, error) {
+
+	connection, err := ssh.Dial("tcp", uploader.address, uploader.config)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := sftp.NewClient(connection)
+	if err != nil {
+		connection.Close()
+		return nil, nil, err
+	}
+	return connection, client, nil
+}
+
+func (uploader *sftpUploader) exists(name string) (bool, error) {
+
+	connection, client, err := uploader.connect()
+	if err != nil {
+		return false, err
+	}
+	defer connection.Close()
+	defer client.Close()
+
+	if _, err := client.Stat(path.Join(uploader.directory, name)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (uploader *sftpUploader) upload(localPath string, name string) error {
+
+	connection, client, err := uploader.connect()
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+	defer client.Close()
+
+	if err := client.MkdirAll(uploader.directory); err != nil {
+		return err
+	}
+
+	input, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	// Upload to a temporary name first so nobody picks up a half written archive
+	remotePath := path.Join(uploader.directory, name)
+	output, err := client.Create(remotePath + ".part")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(output, input); err != nil {
+		output.Close()
+		client.Remove(remotePath + ".part")
+		return err
+	}
+	if err := output.Close(); err != nil {
+		client.Remove(remotePath + ".part")
+		return err
+	}
+
+	// An earlier attempt might have gotten as far as the rename, a plain rename
+	// fails on an existing target. Servers without posix-rename need it gone first.
+	if err := client.PosixRename(remotePath+".part", remotePath); err == nil {
+		return nil
+	}
+	if err := client.Remove(remotePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return client.Rename(remotePath+".part", remotePath)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The watchdog gave up on the output file, the data goes to the fallback instead
+var errWriterStalled = errors.New("writer stalled")
+
+// Watch the writer for writes that make no progress, like on a hung NFS mount.
+// Only reports once per stuck write, and once more when it got through after all.
+func watchWriter(outputFile string, inputData chan *lineChunk, config rotateConfig) {
+
+	ticker := time.NewTicker(min(config.stallTimeout/4, time.Second))
+	defer ticker.Stop()
+
+	var reported int64
+	fallbackUsed := false
+	for range ticker.C {
+		started := config.state.writeStartedAt.Load()
+		if reported != 0 && started != reported {
+			logActivity("Writer made progress on %s again", outputFile)
+			reported = 0
+		}
+		if started == 0 || started == reported || time.Since(time.Unix(0, started)) < config.stallTimeout {
+			continue
+		}
+
+		reported = started
+		stalled := time.Since(time.Unix(0, started)).Round(time.Millisecond)
+		logActivity("Critical: writer made no progress on %s for %s, %d reads are waiting", outputFile, stalled, len(inputData))
+		reportFailure(config, "stall", outputFile, "", fmt.Errorf("writer made no progress for %s", stalled))
+
+		// The stuck write is abandoned, a second stall on the fallback has nowhere left to go
+		if config.stallFallback != "" && !fallbackUsed {
+			fallbackUsed = true
+			close(config.state.writerStalled)
+		}
+	}
+}
+
+// Write in the background so the writer can walk away from a write that never returns
+func writeUnlessStalled(output *os.File, data []byte, stalled chan struct{}) error {
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := output.Write(data)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-stalled:
+		return errWriterStalled
+	}
+}
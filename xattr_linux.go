@@ -0,0 +1,87 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const selinuxContextAttribute string = "security.selinux"
+const posixACLAttribute string = "system.posix_acl_access"
+
+func getExtendedAttribute(path string, name string) ([]byte, error) {
+
+	// Ask for the size first, attributes can be large
+	size, err := unix.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = unix.Getxattr(path, name, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
+
+func listExtendedAttributes(path string) ([]string, error) {
+
+	size, err := unix.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	names := make([]byte, size)
+	size, err = unix.Listxattr(path, names)
+	if err != nil {
+		return nil, err
+	}
+
+	// Names are separated by null bytes
+	return strings.FieldsFunc(string(names[:size]), func(r rune) bool { return r == 0 }), nil
+}
+
+// Everything that decides who may read the file and what tools think of it.
+// Other namespaces belong to the system (e.g. capabilities) and stay where they are.
+func shouldCopyExtendedAttribute(name string) bool {
+	return name == selinuxContextAttribute || name == posixACLAttribute || strings.HasPrefix(name, "user.")
+}
+
+// Give a file the SELinux context, ACLs and user attributes of another one. Files created by rotee
+// get the defaults of the directory, so without this a relabeled log directory or ACL based access
+// would not survive rotation. Filesystems without extended attributes have nothing to copy.
+func copyExtendedAttributes(from string, to string) error {
+
+	names, err := listExtendedAttributes(from)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var copyErrors []error
+	for _, name := range names {
+		if !shouldCopyExtendedAttribute(name) {
+			continue
+		}
+
+		value, err := getExtendedAttribute(from, name)
+		if errors.Is(err, unix.ENODATA) {
+			continue
+		} else if err != nil {
+			copyErrors = append(copyErrors, err)
+			continue
+		}
+
+		// Setting the same SELinux context again needs permissions we might not have
+		if current, err := getExtendedAttribute(to, name); err == nil && string(current) == string(value) {
+			continue
+		}
+		if err := unix.Setxattr(to, name, value, 0); err != nil {
+			copyErrors = append(copyErrors, errors.New(name+": "+err.Error()))
+		}
+	}
+	return errors.Join(copyErrors...)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// Only linux has SELinux and the attributes we care about
+func copyExtendedAttributes(from string, to string) error {
+	return nil
+}